@@ -11,13 +11,27 @@ import (
 // This test triggers a mongo stepdown during execution. We expect that every
 // insert that was confirmed by mongo was picked up by oplogtoredis.
 func TestMongoStepdown(t *testing.T) {
+	testMongoStepdown(t, []string{})
+}
+
+// The same, but with a server selection timeout (and query timeout) long
+// enough that the tailer's queries wait out the election for a new primary,
+// rather than failing and being retried.
+func TestMongoStepdownServerSelectionTimeout(t *testing.T) {
+	testMongoStepdown(t, []string{
+		"OTR_MONGO_SERVER_SELECTION_TIMEOUT=30s",
+		"OTR_MONGO_FIND_TIMEOUT=30s",
+	})
+}
+
+func testMongoStepdown(t *testing.T, otrEnv []string) {
 	mongo := harness.StartMongoServer()
 	defer mongo.Stop()
 
 	redis := harness.StartRedisServer()
 	defer redis.Stop()
 
-	otr := harness.StartOTRProcess(mongo.Addr, redis.Addr, 9000)
+	otr := harness.StartOTRProcessWithEnv(mongo.Addr, redis.Addr, 9000, otrEnv)
 	defer otr.Stop()
 
 	mongoClient := mongo.Client()
@@ -4,13 +4,18 @@
 package config
 
 import (
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
 	"time"
 
 	"github.com/kelseyhightower/envconfig"
+	"github.com/pkg/errors"
 )
 
 type oplogtoredisConfiguration struct {
-	RedisURL                      string        `required:"true" split_words:"true"`
+	RedisURL                      []string      `required:"true" split_words:"true"`
 	MongoURL                      string        `required:"true" split_words:"true"`
 	HTTPServerAddr                string        `default:"0.0.0.0:9000" envconfig:"HTTP_SERVER_ADDR"`
 	BufferSize                    int           `default:"10000" split_words:"true"`
@@ -21,6 +26,232 @@ type oplogtoredisConfiguration struct {
 	MongoConnectTimeout           time.Duration `default:"10s" split_words:"true"`
 	MongoQueryTimeout             time.Duration `default:"5s" split_words:"true"`
 	OplogV2ExtractSubfieldChanges bool          `default:"false" envconfig:"OPLOG_V2_EXTRACT_SUBFIELD_CHANGES"`
+	Allowlist                     []string      `split_words:"true"`
+	Denylist                      []string      `split_words:"true"`
+	FullDocumentCollections       []string      `split_words:"true"`
+	RedisSentinelAddrs            []string      `split_words:"true"`
+	RedisSentinelMaster           string        `split_words:"true"`
+	RedisWriteMode                string        `default:"all" split_words:"true"`
+	ChannelTemplate               string        `split_words:"true"`
+	OutputMode                    string        `default:"pubsub" split_words:"true"`
+	StreamMaxlen                  int64         `default:"0" split_words:"true"`
+	RetryInitialDelay             time.Duration `default:"1s" split_words:"true"`
+	RetryMaxDelay                 time.Duration `default:"30s" split_words:"true"`
+	SourceMode                    string        `default:"oplog" split_words:"true"`
+	ChangeStreamFullDocument      string        `default:"default" split_words:"true"`
+	SlowPublishThreshold          time.Duration `default:"1s" split_words:"true"`
+	PublishBatchSize              int           `default:"1" split_words:"true"`
+	PublishBatchWindow            time.Duration `default:"0" split_words:"true"`
+	ProcessorConcurrency          int           `default:"1" split_words:"true"`
+	OplogDatabase                 string        `default:"local" split_words:"true"`
+	OplogCollection               string        `default:"oplog.rs" split_words:"true"`
+	ShutdownTimeout               time.Duration `default:"10s" split_words:"true"`
+	MaxIdle                       time.Duration `default:"1m" split_words:"true"`
+	DedupTTL                      time.Duration `default:"0" split_words:"true"`
+	RedisTLS                      bool          `default:"false" envconfig:"REDIS_TLS"`
+	RedisTLSCAFile                string        `envconfig:"REDIS_TLS_CA_FILE"`
+	RedisTLSCertFile              string        `envconfig:"REDIS_TLS_CERT_FILE"`
+	RedisTLSKeyFile               string        `envconfig:"REDIS_TLS_KEY_FILE"`
+	RedisTLSInsecureSkipVerify    bool          `default:"false" envconfig:"REDIS_TLS_INSECURE_SKIP_VERIFY"`
+	MongoReadPreference           string        `split_words:"true"`
+	MaxCatchUpOverrides           durationMap   `split_words:"true"`
+	PayloadFormat                 string        `default:"json" split_words:"true"`
+	PublishDocumentChannels       bool          `default:"true" split_words:"true"`
+	OtelEndpoint                  string        `envconfig:"OTEL_ENDPOINT"`
+	Backpressure                  string        `default:"block"`
+	ResumeLogInterval             time.Duration `default:"1m" split_words:"true"`
+	OplogBatchSize                int32         `split_words:"true"`
+	OplogMaxAwaitMS               int           `envconfig:"OPLOG_MAX_AWAIT_MS"`
+	DeadLetterKey                 string        `envconfig:"DEADLETTER_KEY"`
+	MaxPayloadBytes               int           `split_words:"true"`
+	NamespaceMap                  []string      `split_words:"true"`
+	MongoAuthMechanism            string        `split_words:"true"`
+	MongoTLSCAFile                string        `envconfig:"MONGO_TLS_CA_FILE"`
+	MongoTLSCertFile              string        `envconfig:"MONGO_TLS_CERT_FILE"`
+	MongoTLSKeyFile               string        `envconfig:"MONGO_TLS_KEY_FILE"`
+	MongoAppName                  string        `default:"oplogtoredis" split_words:"true"`
+	TransactionAtomic             bool          `split_words:"true"`
+	MetricCollectionLabel         bool          `split_words:"true"`
+	MetricMaxCollections          int           `default:"1000" split_words:"true"`
+	AdminSeekEnabled              bool          `split_words:"true"`
+	OperationFilter               operationMap  `split_words:"true"`
+	FieldFilter                   fieldMap      `split_words:"true"`
+	IncludeTimestamp              bool          `split_words:"true"`
+	DryRun                        bool          `split_words:"true"`
+	DistributionWindow            time.Duration `default:"1m" split_words:"true"`
+	MaxSizeReportInterval         time.Duration `default:"1m" split_words:"true"`
+	LeaderKey                     string        `split_words:"true"`
+	LeaderTTL                     time.Duration `default:"10s" envconfig:"LEADER_TTL"`
+	PositionLostWarnCount         int           `default:"5" split_words:"true"`
+	PositionLostWarnWindow        time.Duration `default:"1m" split_words:"true"`
+	StartPosition                 string        `default:"resume" split_words:"true"`
+	StartupPingChannel            string        `split_words:"true"`
+	SelfTestCollection            string        `split_words:"true"`
+	SelfTestTimeout               time.Duration `default:"30s" split_words:"true"`
+	MongoFindTimeout              time.Duration `split_words:"true"`
+	MongoNextTimeout              time.Duration `split_words:"true"`
+	MongoCloseTimeout             time.Duration `split_words:"true"`
+	PayloadCompression            string        `default:"none" split_words:"true"`
+	PayloadCompressionThreshold   int           `default:"1024" split_words:"true"`
+	PrefixOverrides               stringMap     `split_words:"true"`
+	RedisUsername                 string        `split_words:"true"`
+	RedisPassword                 string        `split_words:"true"`
+	MongoServerSelectionTimeout   time.Duration `split_words:"true"`
+	IncludeSystemNamespaces       bool          `split_words:"true"`
+	OutputBufferSize              int           `split_words:"true"`
+	Databases                     []string      `split_words:"true"`
+	MaxPublishRate                int           `split_words:"true"`
+	PayloadKeys                   stringMap     `split_words:"true"`
+	OplogNsFilter                 string        `split_words:"true"`
+	MongoMaxPoolSize              int           `split_words:"true"`
+	RedisPoolSize                 int           `split_words:"true"`
+	RunMode                       string        `default:"continuous" split_words:"true"`
+	ResumeKeyPersist              bool          `split_words:"true"`
+	StartupJitter                 time.Duration `split_words:"true"`
+	RedisStartupRetry             time.Duration `split_words:"true"`
+	MongoStartupRetry             time.Duration `split_words:"true"`
+	IncludeOperation              bool          `split_words:"true"`
+	HeartbeatInterval             time.Duration `split_words:"true"`
+	HeartbeatChannel              string        `default:"oplogtoredis.heartbeat" split_words:"true"`
+	ShutdownFlushTimeout          time.Duration `default:"5s" split_words:"true"`
+	CatchUpMaxRate                int           `default:"0" envconfig:"CATCHUP_MAX_RATE"`
+	CatchUpLagThreshold           time.Duration `default:"30s" envconfig:"CATCHUP_LAG_THRESHOLD"`
+	DisableDeprecatedMetrics      bool          `split_words:"true"`
+	StreamDocumentStreams         bool          `split_words:"true"`
+	KafkaBrokers                  []string      `split_words:"true"`
+	KafkaTopicTemplate            string        `default:"{{.Database}}.{{.Collection}}" split_words:"true"`
+	KafkaTimeout                  time.Duration `default:"10s" split_words:"true"`
+}
+
+// durationMap is a map of names to durations, parsed from a comma-separated
+// list of name=duration pairs (e.g. "db1=1h,db2=30s")
+type durationMap map[string]time.Duration
+
+func (m *durationMap) Decode(value string) error {
+	result := durationMap{}
+
+	for _, pair := range strings.Split(value, ",") {
+		if pair == "" {
+			continue
+		}
+
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return errors.Errorf("expected name=duration, got %q", pair)
+		}
+
+		duration, err := time.ParseDuration(parts[1])
+		if err != nil {
+			return errors.Wrapf(err, "parsing duration for %q", parts[0])
+		}
+
+		result[parts[0]] = duration
+	}
+
+	*m = result
+	return nil
+}
+
+// stringMap is a map of names to strings, parsed from a comma-separated list
+// of name=value pairs (e.g. "db1=app1:,db2=app2:"). Values may be empty.
+type stringMap map[string]string
+
+func (m *stringMap) Decode(value string) error {
+	result := stringMap{}
+
+	for _, pair := range strings.Split(value, ",") {
+		if pair == "" {
+			continue
+		}
+
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return errors.Errorf("expected name=value, got %q", pair)
+		}
+
+		result[parts[0]] = parts[1]
+	}
+
+	*m = result
+	return nil
+}
+
+// Parses a semicolon-separated list of pattern=values pairs, where pattern
+// is a namespace pattern (as for Allowlist) and values is a comma-separated
+// list (e.g. "db.coll=a,b;logs.*=c"), into a map of patterns to values
+func parsePatternLists(value string) (map[string][]string, error) {
+	result := map[string][]string{}
+
+	for _, rule := range strings.Split(value, ";") {
+		if rule == "" {
+			continue
+		}
+
+		parts := strings.SplitN(rule, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, errors.Errorf("expected pattern=values, got %q", rule)
+		}
+
+		if _, err := path.Match(parts[0], ""); err != nil {
+			return nil, errors.Wrapf(err, "invalid namespace pattern %q", parts[0])
+		}
+
+		result[parts[0]] = append(result[parts[0]], strings.Split(parts[1], ",")...)
+	}
+
+	return result, nil
+}
+
+// operationMap maps namespace patterns to lists of operations, parsed with
+// parsePatternLists (e.g. "db.coll=insert,update;logs.*=insert")
+type operationMap map[string][]string
+
+// The operations an operationMap may list
+var operationNames = map[string]bool{
+	"insert":  true,
+	"update":  true,
+	"remove":  true,
+	"command": true,
+}
+
+func (m *operationMap) Decode(value string) error {
+	result, err := parsePatternLists(value)
+	if err != nil {
+		return err
+	}
+
+	for pattern, operations := range result {
+		for _, operation := range operations {
+			if !operationNames[operation] {
+				return errors.Errorf("invalid operation %q for %q; expected insert, update, remove, or command", operation, pattern)
+			}
+		}
+	}
+
+	*m = result
+	return nil
+}
+
+// fieldMap maps namespace patterns to lists of field names, parsed with
+// parsePatternLists (e.g. "db.users=name,email;logs.*=level")
+type fieldMap map[string][]string
+
+func (m *fieldMap) Decode(value string) error {
+	result, err := parsePatternLists(value)
+	if err != nil {
+		return err
+	}
+
+	for pattern, fields := range result {
+		for _, field := range fields {
+			if field == "" {
+				return errors.Errorf("empty field name for %q", pattern)
+			}
+		}
+	}
+
+	*m = result
+	return nil
 }
 
 var globalConfig *oplogtoredisConfiguration
@@ -29,7 +260,13 @@ var globalConfig *oplogtoredisConfiguration
 // environment variable `OTR_REDIS_URL`.
 // To connect to a instance over TLS be sure to specify the url with protocol
 // `rediss://`, otherwise use `redis://`
-func RedisURL() string {
+//
+// This may be a comma-separated list of URLs, in which case every message is
+// published to all of the Redis servers (see RedisWriteMode), and the
+// last-processed timestamp is written to all of them. This is useful when
+// migrating between Redis servers. The last-processed timestamp is read
+// from the first server at startup.
+func RedisURL() []string {
 	return globalConfig.RedisURL
 }
 
@@ -56,9 +293,11 @@ func BufferSize() int {
 
 // TimestampFlushInterval is how frequently to flush the timestamp of the last
 // processed message to Redis. When we start up, we start tailing the oplog from
-// where we left off (as indicated by this timestamp). It is set via the
-// environment variable `OTR_TIMESTAMP_FLUSH_INTERVAL and defaults to
-// 1s.
+// where we left off (as indicated by this timestamp). Only the latest
+// timestamp in each interval is written, and the final one is always written
+// on shutdown, so a longer interval trades less Redis write load for more
+// re-publishing after a crash. It is set via the environment variable
+// `OTR_TIMESTAMP_FLUSH_INTERVAL` and defaults to 1s.
 func TimestampFlushInterval() time.Duration {
 	return globalConfig.TimestampFlushInterval
 }
@@ -74,6 +313,18 @@ func MaxCatchUp() time.Duration {
 	return globalConfig.MaxCatchUp
 }
 
+// MaxCatchUpOverrides overrides MaxCatchUp for individual databases, so that
+// a database whose clients can handle replaying a large backlog can catch up
+// further than the others (or vice versa). When starting up, we resume from
+// the last processed timestamp if it's within the longest of these windows,
+// and drop the backlog of entries for any database whose own window it's
+// outside of. It is set via the environment variable
+// `OTR_MAX_CATCH_UP_OVERRIDES` as a comma-separated list of database=duration
+// pairs, such as `db1=1h,db2=30s`.
+func MaxCatchUpOverrides() map[string]time.Duration {
+	return globalConfig.MaxCatchUpOverrides
+}
+
 // RedisDedupeExpiration controls the expiration of the Redis keys that are used
 // to ensure we process oplog entries at most once. Every time we publish an
 // oplog entry to Redis, we write its unique timestamp as a Redis expiring key,
@@ -121,6 +372,43 @@ func MongoQueryTimeout() time.Duration {
 	return globalConfig.MongoQueryTimeout
 }
 
+// MongoFindTimeout is how long we'll wait for Mongo to respond to a query that
+// should return promptly: issuing the oplog tail query (or opening a change
+// stream), and looking up individual entries or documents. It is set via the
+// environment variable `OTR_MONGO_FIND_TIMEOUT` and defaults to
+// MongoQueryTimeout.
+func MongoFindTimeout() time.Duration {
+	if globalConfig.MongoFindTimeout == 0 {
+		return globalConfig.MongoQueryTimeout
+	}
+
+	return globalConfig.MongoFindTimeout
+}
+
+// MongoNextTimeout is how long we'll wait for the next oplog entry (or change
+// event) before timing out and re-issuing the query. On rarely-active
+// clusters, set it longer than OplogMaxAwait to avoid spurious timeouts. It
+// is set via the environment variable `OTR_MONGO_NEXT_TIMEOUT` and defaults
+// to MongoQueryTimeout.
+func MongoNextTimeout() time.Duration {
+	if globalConfig.MongoNextTimeout == 0 {
+		return globalConfig.MongoQueryTimeout
+	}
+
+	return globalConfig.MongoNextTimeout
+}
+
+// MongoCloseTimeout is how long we'll wait for Mongo to close an oplog cursor
+// (or change stream). It is set via the environment variable
+// `OTR_MONGO_CLOSE_TIMEOUT` and defaults to MongoQueryTimeout.
+func MongoCloseTimeout() time.Duration {
+	if globalConfig.MongoCloseTimeout == 0 {
+		return globalConfig.MongoQueryTimeout
+	}
+
+	return globalConfig.MongoCloseTimeout
+}
+
 // OplogV2ExtractSubfieldChanges controls whether we perform an in-depth
 // analysis of v2 oplog entries (from Mongo 5.x+) to extract not just
 // which top-levels fields of documents have changed, but also which sub-fields
@@ -132,6 +420,911 @@ func OplogV2ExtractSubfieldChanges() bool {
 	return globalConfig.OplogV2ExtractSubfieldChanges
 }
 
+// Allowlist is a list of `<db-name>.<collection-name>` patterns. When it's
+// non-empty, only oplog entries whose namespace matches at least one of the
+// patterns are published. Patterns use the syntax of path.Match, so
+// `mydb.*` matches every collection in `mydb`. It is set via the environment
+// variable `OTR_ALLOWLIST` as a comma-separated list, and defaults to empty
+// (every namespace is published).
+func Allowlist() []string {
+	return globalConfig.Allowlist
+}
+
+// Denylist is a list of `<db-name>.<collection-name>` patterns, in the same
+// format as Allowlist. Oplog entries whose namespace matches any of these
+// patterns are never published, even if they match the Allowlist. Filtered
+// entries still advance the position we resume tailing from. It is set via
+// the environment variable `OTR_DENYLIST` as a comma-separated list, and
+// defaults to empty.
+func Denylist() []string {
+	return globalConfig.Denylist
+}
+
+// FullDocumentCollections is a list of `<db-name>.<collection-name>`
+// namespaces for which we publish the entire post-update document with each
+// update, rather than just the document ID. Oplog entries for updates don't
+// contain the full document, so each update to one of these collections
+// requires an additional query against Mongo (bounded by MongoQueryTimeout).
+// If that query fails, we fall back to publishing just the document ID. It is
+// set via the environment variable `OTR_FULL_DOCUMENT_COLLECTIONS` as a
+// comma-separated list, and defaults to empty.
+func FullDocumentCollections() []string {
+	return globalConfig.FullDocumentCollections
+}
+
+// RedisSentinelAddrs is a list of `host:port` addresses of Redis Sentinels.
+// When it's set, we ask these Sentinels for the address of the current
+// master (named by RedisSentinelMaster) instead of connecting to the host in
+// RedisURL directly, and automatically follow the master across failovers.
+// The password and database number are still taken from RedisURL. It is set
+// via the environment variable `OTR_REDIS_SENTINEL_ADDRS` as a
+// comma-separated list, and defaults to empty (Sentinel is not used).
+func RedisSentinelAddrs() []string {
+	return globalConfig.RedisSentinelAddrs
+}
+
+// RedisSentinelMaster is the name of the master set monitored by the
+// Sentinels in RedisSentinelAddrs. It is required if RedisSentinelAddrs is
+// set, and is set via the environment variable `OTR_REDIS_SENTINEL_MASTER`.
+func RedisSentinelMaster() string {
+	return globalConfig.RedisSentinelMaster
+}
+
+// RedisWriteMode controls when a message is considered successfully published
+// when RedisURL lists more than one Redis server. In "all" mode, publishing
+// must succeed on every server (failures are retried); in "any" mode,
+// succeeding on at least one server is enough. It is set via the environment
+// variable `OTR_REDIS_WRITE_MODE` and defaults to "all".
+func RedisWriteMode() string {
+	return globalConfig.RedisWriteMode
+}
+
+// ChannelTemplate is a Go text/template that controls the names of the Redis
+// channels we publish to, for consumers that don't follow the redis-oplog
+// channel naming convention. The template can reference {{.Database}},
+// {{.Collection}}, {{.DocID}}, and {{.Operation}} (one of "insert", "update",
+// or "remove").
+//
+// The template is rendered twice for each message: once with an empty DocID
+// to produce the collection channel, and once with the document's ID to
+// produce the document channel. If both produce the same name (e.g.
+// `changes:{{.Database}}:{{.Collection}}`), the message is only published
+// once. The default (when unset) is equivalent to
+// `{{.Database}}.{{.Collection}}{{if .DocID}}::{{.DocID}}{{end}}`, which
+// matches redis-oplog. It is set via the environment variable
+// `OTR_CHANNEL_TEMPLATE`.
+func ChannelTemplate() string {
+	return globalConfig.ChannelTemplate
+}
+
+// OutputMode controls how messages are delivered to Redis. In "pubsub" mode,
+// they're sent with PUBLISH to the channels described in ChannelTemplate. In
+// "stream" mode, they're instead appended (with XADD) to Redis Streams with
+// the same names (only the collection's, unless StreamDocumentStreams is
+// set), with the message in the field "msg". Streams retain
+// messages when no consumer is connected, at the cost of Redis memory (see
+// StreamMaxLen). In "kafka" mode, they're produced to the Kafka cluster at
+// KafkaBrokers instead, one message per change, to the topics described in
+// KafkaTopicTemplate; Redis is still used for the last-processed timestamp,
+// heartbeats, and everything else. It is set via the environment variable
+// `OTR_OUTPUT_MODE` and defaults to "pubsub".
+func OutputMode() string {
+	return globalConfig.OutputMode
+}
+
+// StreamMaxLen caps the number of entries in each stream when OutputMode is
+// "stream". Streams are trimmed approximately (`MAXLEN ~`), so they may
+// briefly exceed this length. It is set via the environment variable
+// `OTR_STREAM_MAXLEN` and defaults to 0 (streams are never trimmed).
+func StreamMaxLen() int64 {
+	return globalConfig.StreamMaxlen
+}
+
+// StreamDocumentStreams makes "stream" OutputMode append each message to the
+// document's stream, as well as the collection's. Unlike pubsub channels,
+// streams stay in Redis, so this keeps a stream for every document that has
+// ever changed, which grows without bound. It is set via the environment
+// variable `OTR_STREAM_DOCUMENT_STREAMS` and defaults to false.
+func StreamDocumentStreams() bool {
+	return globalConfig.StreamDocumentStreams
+}
+
+// KafkaBrokers is the list of Kafka brokers ("host:port") to connect to when
+// OutputMode is "kafka". Only one needs to be reachable; the rest of the
+// cluster is discovered from it. TLS and SASL aren't supported. It is set
+// via the environment variable `OTR_KAFKA_BROKERS` as a comma-separated
+// list, and is required in "kafka" mode.
+func KafkaBrokers() []string {
+	return globalConfig.KafkaBrokers
+}
+
+// KafkaTopicTemplate is a Go text/template that controls the names of the
+// Kafka topics we produce to when OutputMode is "kafka". It can reference
+// {{.Database}}, {{.Collection}}, and {{.Operation}}. Messages are keyed by
+// the document's ID, so each document's changes stay in order within its
+// partition. It is set via the environment variable
+// `OTR_KAFKA_TOPIC_TEMPLATE` and defaults to `{{.Database}}.{{.Collection}}`.
+func KafkaTopicTemplate() string {
+	return globalConfig.KafkaTopicTemplate
+}
+
+// KafkaTimeout is how long we wait for each request to Kafka, including for
+// the in-sync replicas to acknowledge the messages we produce. It is set via
+// the environment variable `OTR_KAFKA_TIMEOUT` and defaults to 10 seconds.
+func KafkaTimeout() time.Duration {
+	return globalConfig.KafkaTimeout
+}
+
+// RetryInitialDelay is how long we wait before re-querying the oplog after
+// tailing fails (e.g. because Mongo is restarting). Each consecutive failure
+// doubles the delay, up to RetryMaxDelay, and a random jitter of up to half
+// the delay is subtracted so that multiple instances don't retry in
+// lockstep. It is set via the environment variable
+// `OTR_RETRY_INITIAL_DELAY` and defaults to 1s.
+func RetryInitialDelay() time.Duration {
+	return globalConfig.RetryInitialDelay
+}
+
+// RetryMaxDelay is the maximum delay between attempts to re-query the oplog
+// (see RetryInitialDelay). Once tailing has run successfully for longer than
+// this, the delay is reset to RetryInitialDelay. It is set via the
+// environment variable `OTR_RETRY_MAX_DELAY` and defaults to 30s.
+func RetryMaxDelay() time.Duration {
+	return globalConfig.RetryMaxDelay
+}
+
+// SourceMode controls how we read changes from Mongo. In "oplog" mode, we tail
+// the oplog directly (or each shard's oplog, for a sharded cluster). In
+// "changestream" mode, we instead open a change stream on the whole cluster,
+// which only requires the changeStream privilege and survives failovers, and
+// we persist the change stream's resume token in Redis alongside the
+// last-processed timestamp. It is set via the environment variable
+// `OTR_SOURCE_MODE` and defaults to "oplog".
+func SourceMode() string {
+	return globalConfig.SourceMode
+}
+
+// ChangeStreamFullDocument is the fullDocument option passed to the change
+// stream when SourceMode is "changestream". It may be "default", in which
+// case updates are published with their changed fields as usual, or
+// "updateLookup", in which case Mongo looks up the current version of each
+// updated document and we publish it in full (as with
+// FullDocumentCollections, but for every collection). It is set via the
+// environment variable `OTR_CHANGE_STREAM_FULL_DOCUMENT` and defaults to
+// "default".
+func ChangeStreamFullDocument() string {
+	return globalConfig.ChangeStreamFullDocument
+}
+
+// SlowPublishThreshold is how long a single publish to Redis can take before
+// we log a warning about it. Every publish is also recorded in the
+// otr_redis_publish_duration_seconds histogram. It is set via the environment
+// variable `OTR_SLOW_PUBLISH_THRESHOLD` and defaults to 1s; set it to 0 to
+// disable the warning.
+func SlowPublishThreshold() time.Duration {
+	return globalConfig.SlowPublishThreshold
+}
+
+// PublishBatchSize is the maximum number of messages we send to Redis in a
+// single pipeline. Batching messages reduces the number of round-trips to
+// Redis under heavy write load; messages within a batch are still sent in
+// order, and the last-processed timestamp only advances once the whole batch
+// has been sent. It is set via the environment variable
+// `OTR_PUBLISH_BATCH_SIZE` and defaults to 1 (no batching).
+func PublishBatchSize() int {
+	return globalConfig.PublishBatchSize
+}
+
+// PublishBatchWindow is how long we wait for more messages to arrive to fill
+// a batch (see PublishBatchSize), after the first message of the batch
+// arrives. A small window (e.g. 5ms) increases batch sizes at the expense of
+// latency. If it is zero, we only batch messages that are already waiting to
+// be sent. It is set via the environment variable `OTR_PUBLISH_BATCH_WINDOW`
+// and defaults to 0.
+func PublishBatchWindow() time.Duration {
+	return globalConfig.PublishBatchWindow
+}
+
+// ProcessorConcurrency is the number of goroutines used to unmarshal and
+// process oplog entries. Processing is normally done on the goroutine that
+// reads the oplog, which can become a bottleneck during bulk loads or large
+// transactions. With a higher concurrency, entries are processed in parallel
+// and then re-ordered, so publications are still sent (and the last-processed
+// timestamp recorded) in oplog order. It only applies when SourceMode is
+// "oplog". It is set via the environment variable
+// `OTR_PROCESSOR_CONCURRENCY` and defaults to 1.
+func ProcessorConcurrency() int {
+	return globalConfig.ProcessorConcurrency
+}
+
+// OplogDatabase is the database containing the oplog collection we tail
+// (see OplogCollection). It is set via the environment variable
+// `OTR_OPLOG_DATABASE` and defaults to "local".
+func OplogDatabase() string {
+	return globalConfig.OplogDatabase
+}
+
+// OplogCollection is the name of the oplog collection we tail. Together with
+// OplogDatabase, this can point oplogtoredis at a non-standard oplog location,
+// or at a copy of an oplog for replaying or testing. It is set via the
+// environment variable `OTR_OPLOG_COLLECTION` and defaults to "oplog.rs".
+func OplogCollection() string {
+	return globalConfig.OplogCollection
+}
+
+// ShutdownTimeout bounds how long we spend shutting down cleanly after
+// receiving SIGINT or SIGTERM. During shutdown, we stop reading the oplog,
+// publish the messages that are already buffered, and write the final
+// last-processed timestamp to Redis. If that takes longer than this, we stop
+// publishing the remaining buffered messages (they're published again on the
+// next start, which resumes from the last-processed timestamp), and allow
+// ShutdownFlushTimeout more to write the timestamp. It is set via the
+// environment variable `OTR_SHUTDOWN_TIMEOUT` and defaults to 10s.
+func ShutdownTimeout() time.Duration {
+	return globalConfig.ShutdownTimeout
+}
+
+// MaxIdle is how long the oplog tailer can go without making progress before
+// the /healthz/live endpoint reports it as unhealthy. The tailer makes
+// progress when it reads an oplog entry, or when Mongo tells it there are no
+// new entries, so an idle database doesn't cause failures but a wedged cursor
+// does. This should be comfortably longer than OTR_MONGO_QUERY_TIMEOUT. It is
+// set via the environment variable `OTR_MAX_IDLE` and defaults to 1m.
+func MaxIdle() time.Duration {
+	return globalConfig.MaxIdle
+}
+
+// DedupTTL controls an optional in-memory deduplication cache in front of
+// the Redis publisher. Each publication is remembered for this long, keyed by
+// its namespace, document ID, timestamp, and index within a transaction, and
+// duplicates seen within that window (such as entries re-read after the
+// tailer reconnects) are dropped without being sent to Redis. This doesn't
+// replace the Redis-side deduplication controlled by
+// OTR_REDIS_DEDUPE_EXPIRATION, which also covers multiple oplogtoredis
+// instances and restarts. It is set via the environment variable
+// `OTR_DEDUP_TTL` and defaults to 0, which disables the cache.
+func DedupTTL() time.Duration {
+	return globalConfig.DedupTTL
+}
+
+// RedisTLS controls whether we connect to Redis over TLS. Using a `rediss://`
+// URL in OTR_REDIS_URL also enables TLS. It is set via the environment
+// variable `OTR_REDIS_TLS` and defaults to false.
+func RedisTLS() bool {
+	return globalConfig.RedisTLS
+}
+
+// RedisTLSCAFile is the path to a PEM file of CA certificates used to verify
+// the Redis server's certificate. If it's not set, we use the system's CAs.
+// It is set via the environment variable `OTR_REDIS_TLS_CA_FILE`.
+func RedisTLSCAFile() string {
+	return globalConfig.RedisTLSCAFile
+}
+
+// RedisTLSCertFile is the path to a PEM client certificate to present to
+// Redis, for servers that require mutual TLS. It must be set along with
+// RedisTLSKeyFile. It is set via the environment variable
+// `OTR_REDIS_TLS_CERT_FILE`.
+func RedisTLSCertFile() string {
+	return globalConfig.RedisTLSCertFile
+}
+
+// RedisTLSKeyFile is the path to the PEM private key for RedisTLSCertFile. It
+// is set via the environment variable `OTR_REDIS_TLS_KEY_FILE`.
+func RedisTLSKeyFile() string {
+	return globalConfig.RedisTLSKeyFile
+}
+
+// RedisTLSInsecureSkipVerify disables verification of the Redis server's
+// certificate. This should only be used for testing. It is set via the
+// environment variable `OTR_REDIS_TLS_INSECURE_SKIP_VERIFY` and defaults to
+// false.
+func RedisTLSInsecureSkipVerify() bool {
+	return globalConfig.RedisTLSInsecureSkipVerify
+}
+
+// MongoReadPreference is the read preference used when tailing the oplog:
+// "primary", "primaryPreferred", "secondary", "secondaryPreferred", or
+// "nearest". Every member of a replica set has a copy of the oplog, so tailing
+// a secondary is a valid way to take load off the primary, but changes are
+// only published once they've replicated to the secondary we're reading from,
+// which adds that secondary's replication lag to the publication latency. It
+// doesn't apply in change stream mode (use the readPreference option in
+// OTR_MONGO_URL instead). It is set via the environment variable
+// `OTR_MONGO_READ_PREFERENCE`; if it's not set, we use the read preference
+// from OTR_MONGO_URL, which defaults to primary.
+func MongoReadPreference() string {
+	return globalConfig.MongoReadPreference
+}
+
+// PayloadFormat controls how the messages we publish are encoded. It may be
+// "json" (the format redis-oplog expects), "ejson" (the same, except that
+// BSON values such as dates and binary data in full documents are encoded
+// using Meteor's EJSON, so Meteor clients can decode them back into the same
+// types), or "msgpack" (MessagePack with the same structure as "json", for
+// non-Meteor consumers that want a more compact encoding). It is set via the
+// environment variable `OTR_PAYLOAD_FORMAT` and defaults to "json".
+func PayloadFormat() string {
+	return globalConfig.PayloadFormat
+}
+
+// PublishDocumentChannels controls whether each change is published to the
+// channel for the specific document (e.g. `mydb.mycollection::someid`) as well
+// as the channel for its collection. redis-oplog uses the document channels
+// for subscriptions that target specific IDs, so only disable this if none of
+// your subscriptions do; doing so halves the number of messages published. It
+// is set via the environment variable `OTR_PUBLISH_DOCUMENT_CHANNELS` and
+// defaults to true.
+func PublishDocumentChannels() bool {
+	return globalConfig.PublishDocumentChannels
+}
+
+// OtelEndpoint is the base URL of an OpenTelemetry collector's OTLP/HTTP
+// receiver (e.g. "http://otel-collector:4318"). If it's set, we export a trace
+// span for each publication, covering the time from reading the oplog entry
+// to publishing it to Redis. It is set via the environment variable
+// `OTR_OTEL_ENDPOINT`; tracing is disabled if it's empty (the default).
+func OtelEndpoint() string {
+	return globalConfig.OtelEndpoint
+}
+
+// Backpressure controls what the oplog tailer does when the buffer of
+// publications waiting to be sent to Redis is full, e.g. because Redis is
+// slow or unreachable. It may be "block" (wait for room, so nothing is lost
+// but the tailer falls behind), "drop_oldest" (drop the oldest buffered
+// publication), or "drop" (drop the new publication). When publications are
+// dropped, the last-processed timestamp stops advancing, so that if
+// oplogtoredis restarts, it republishes them (within OTR_MAX_CATCH_UP). It is
+// set via the environment variable `OTR_BACKPRESSURE` and defaults to "block".
+func Backpressure() string {
+	return globalConfig.Backpressure
+}
+
+// ResumeLogInterval is how often oplogtoredis logs the timestamp of the last
+// oplog entry it read, to help work out why a change wasn't published. Zero
+// disables the log. It is set via the environment variable
+// `OTR_RESUME_LOG_INTERVAL` and defaults to 1 minute.
+func ResumeLogInterval() time.Duration {
+	return globalConfig.ResumeLogInterval
+}
+
+// OplogBatchSize is the number of oplog entries Mongo returns in each batch
+// of the tail query. Larger batches improve throughput over high-latency
+// links, at the cost of memory. It is set via the environment variable
+// `OTR_OPLOG_BATCH_SIZE`; 0 (the default) uses the server's default.
+func OplogBatchSize() int32 {
+	return globalConfig.OplogBatchSize
+}
+
+// OplogMaxAwait is how long Mongo waits for new oplog entries before
+// responding to the tail query with an empty batch. A shorter wait means
+// entries are delivered sooner when they trickle in, at the cost of more
+// round trips when the oplog is idle. It is set in milliseconds via the
+// environment variable `OTR_OPLOG_MAX_AWAIT_MS`; 0 (the default) uses the
+// server's default (1 second). It must be less than MongoQueryTimeout.
+func OplogMaxAwait() time.Duration {
+	return time.Duration(globalConfig.OplogMaxAwaitMS) * time.Millisecond
+}
+
+// DeadLetterKey is the Redis list to which we append publications that we
+// gave up on publishing after retrying, as JSON records with the namespace,
+// document ID, channels, payload (base64-encoded), oplog timestamp, and the
+// error, so they can be inspected or replayed. It's written to every Redis
+// server in RedisURL. It is set via the environment variable
+// `OTR_DEADLETTER_KEY`; if it's empty (the default), failed publications are
+// only logged.
+func DeadLetterKey() string {
+	return globalConfig.DeadLetterKey
+}
+
+// MaxPayloadBytes is the size limit for the messages we publish, after
+// they've been serialized (see PayloadFormat). Messages for updates to
+// collections in FullDocumentCollections that exceed it are sent without the
+// full document (with just its _id, as for other collections), so subscribers
+// stay reactive without receiving huge payloads. It is set via the
+// environment variable `OTR_MAX_PAYLOAD_BYTES`; 0 (the default) means no
+// limit.
+func MaxPayloadBytes() int {
+	return globalConfig.MaxPayloadBytes
+}
+
+// NamespaceMap is a list of `from=to` rules that rewrite the namespaces
+// (`<db-name>.<collection-name>`) of the changes we publish, so the channel
+// names and messages use the rewritten database and collection names. A `*`
+// in `from` matches any sequence of characters, and each `*` in `to` is
+// replaced with what the corresponding `*` matched: for example,
+// `prod_*=*` publishes changes to `prod_acme.users` as `acme.users`. Rules
+// without wildcards take precedence over rules with them; otherwise the first
+// matching rule applies. Allowlist and Denylist match the original
+// namespaces. It is set via the environment variable `OTR_NAMESPACE_MAP` as a
+// comma-separated list, and defaults to empty (namespaces aren't rewritten).
+func NamespaceMap() []string {
+	return globalConfig.NamespaceMap
+}
+
+// MongoAuthMechanism overrides the authentication mechanism in MongoURL, for
+// mechanisms such as MONGODB-X509 and MONGODB-AWS that are awkward to express
+// in a URL. It may be "SCRAM-SHA-1", "SCRAM-SHA-256", "MONGODB-X509",
+// "MONGODB-AWS", "GSSAPI", or "PLAIN". MONGODB-X509 requires a client
+// certificate (see MongoTLSCertFile). It is set via the environment variable
+// `OTR_MONGO_AUTH_MECHANISM`; if it's empty (the default), the mechanism in
+// MongoURL is used.
+func MongoAuthMechanism() string {
+	return globalConfig.MongoAuthMechanism
+}
+
+// MongoTLSCAFile is the path to a PEM file of CA certificates used to verify
+// the Mongo servers, in place of the system roots. Setting it (or
+// MongoTLSCertFile) enables TLS. It is set via the environment variable
+// `OTR_MONGO_TLS_CA_FILE`.
+func MongoTLSCAFile() string {
+	return globalConfig.MongoTLSCAFile
+}
+
+// MongoTLSCertFile is the path to a PEM client certificate to present to the
+// Mongo servers, e.g. for MONGODB-X509 authentication. The file may also
+// contain the private key, as is usual for Mongo; otherwise, set
+// MongoTLSKeyFile. Setting it enables TLS. It is set via the environment
+// variable `OTR_MONGO_TLS_CERT_FILE`.
+func MongoTLSCertFile() string {
+	return globalConfig.MongoTLSCertFile
+}
+
+// MongoTLSKeyFile is the path to the PEM private key for MongoTLSCertFile, if
+// it isn't in the same file. It is set via the environment variable
+// `OTR_MONGO_TLS_KEY_FILE`.
+func MongoTLSKeyFile() string {
+	return globalConfig.MongoTLSKeyFile
+}
+
+// MongoAppName is the application name oplogtoredis reports to Mongo, which
+// appears in the server logs and in db.currentOp(). It overrides the appName
+// in MongoURL, if any, and is also used in the comment attached to the oplog
+// tail query. It is set via the environment variable `OTR_MONGO_APP_NAME` and
+// defaults to "oplogtoredis".
+func MongoAppName() string {
+	return globalConfig.MongoAppName
+}
+
+// TransactionAtomic controls whether the publications for the operations of
+// a transaction (which Mongo writes as a single applyOps oplog entry) are
+// published together, in a single batch, with the last-processed timestamp
+// only advancing once all of them have been published. Otherwise, a large
+// transaction may be split across batches, and if oplogtoredis stops partway
+// through it, the rest of its operations won't be published when it resumes.
+// It has no effect in the changestream source mode, and can't be used with a
+// Backpressure that drops publications. It is set via the environment
+// variable `OTR_TRANSACTION_ATOMIC` and defaults to false.
+func TransactionAtomic() bool {
+	return globalConfig.TransactionAtomic
+}
+
+// MetricCollectionLabel controls whether the otr_oplog_entries_by_size and
+// otr_publications_total metrics are labeled by collection, as well as by
+// database, to find the collections with the most writes. It is set via the
+// environment variable `OTR_METRIC_COLLECTION_LABEL` and defaults to false.
+func MetricCollectionLabel() bool {
+	return globalConfig.MetricCollectionLabel
+}
+
+// MetricMaxCollections is how many collections (across all databases) get
+// their own collection label when MetricCollectionLabel is set. Entries for
+// any further collections are labeled "(other)", to bound the number of
+// metric series. It is set via the environment variable
+// `OTR_METRIC_MAX_COLLECTIONS` and defaults to 1000.
+func MetricMaxCollections() int {
+	return globalConfig.MetricMaxCollections
+}
+
+// AdminSeekEnabled controls whether the HTTP server has the /admin/seek
+// endpoint, which makes oplogtoredis re-tail the oplog from a given timestamp
+// and so re-publish everything since then. It's disabled by default because
+// that can be a lot of messages. It can't be used in the changestream source
+// mode. It is set via the environment variable `OTR_ADMIN_SEEK_ENABLED`.
+func AdminSeekEnabled() bool {
+	return globalConfig.AdminSeekEnabled
+}
+
+// OperationFilter restricts which operations are published for the
+// namespaces matching the given patterns (which are as for Allowlist). For
+// example, "db.coll=insert,update;logs.*=insert" publishes only inserts and
+// updates to db.coll, and only inserts to the collections of logs. The
+// operations are insert, update, remove, and command (for namespace events
+// such as drops and renames). If several patterns match a namespace, the
+// operations listed for any of them are published. Namespaces no pattern
+// matches are unrestricted. The last-processed timestamp still advances past
+// the entries that are filtered out. It is set via the environment variable
+// `OTR_OPERATION_FILTER`.
+func OperationFilter() map[string][]string {
+	return globalConfig.OperationFilter
+}
+
+// FieldFilter lists, for the namespaces matching the given patterns (which
+// are as for Allowlist), the fields whose changes subscribers care about. An
+// update to a matching namespace is only published if it changes one of
+// those fields (or a field within one of them, or a document containing
+// one), and the message only lists the changed fields among them. For
+// example, "db.users=name,email" ignores updates to db.users that only change
+// other fields. If several patterns match a namespace, the fields listed for
+// any of them count. Inserts and removes aren't affected. It is set via the
+// environment variable `OTR_FIELD_FILTER`.
+func FieldFilter() map[string][]string {
+	return globalConfig.FieldFilter
+}
+
+// IncludeTimestamp controls whether each message includes the timestamp of
+// the oplog entry it's for, as "ts": {"t": <seconds>, "i": <ordinal>}, so
+// consumers merging several streams can order messages globally. It's off
+// by default to keep messages small. It is set via the environment variable
+// `OTR_INCLUDE_TIMESTAMP`.
+func IncludeTimestamp() bool {
+	return globalConfig.IncludeTimestamp
+}
+
+// DryRun makes oplogtoredis process the oplog as usual, but instead of
+// publishing anything to Redis, log each message it would have published (at
+// debug level) and count it in otr_redispub_dry_run_messages. The
+// last-processed timestamp isn't written either, so a dry run doesn't affect
+// where a real run resumes from. Useful for trying out new filter or output
+// settings against production traffic. It is set via the environment
+// variable `OTR_DRY_RUN`.
+func DryRun() bool {
+	return globalConfig.DryRun
+}
+
+// DistributionWindow is the period over which the
+// `/metrics/oplog-distribution` endpoint reports the collections with the
+// most oplog entries and bytes. Zero disables the endpoint. It is set via the
+// environment variable `OTR_DISTRIBUTION_WINDOW` and defaults to 1 minute.
+func DistributionWindow() time.Duration {
+	return globalConfig.DistributionWindow
+}
+
+// MaxSizeReportInterval is the interval over which the
+// otr_oplog_entries_max_size metric reports the largest oplog entry received.
+// A shorter interval catches spikes sooner. It is set via the environment
+// variable `OTR_MAX_SIZE_REPORT_INTERVAL` and defaults to 1 minute.
+func MaxSizeReportInterval() time.Duration {
+	return globalConfig.MaxSizeReportInterval
+}
+
+// LeaderKey, if set, enables leader election among several instances of
+// oplogtoredis publishing to the same Redis server, so that only one of them
+// (the leader) publishes at a time. The others stay connected, standing by to
+// take over. The leader holds a lease on this Redis key. It is set via the
+// environment variable `OTR_LEADER_KEY`.
+func LeaderKey() string {
+	return globalConfig.LeaderKey
+}
+
+// LeaderTTL is how long the leader's lease (see LeaderKey) lasts without
+// being renewed; the leader renews it every third of this. It's how long it
+// takes another instance to take over if the leader goes away without
+// releasing it. It is set via the environment variable `OTR_LEADER_TTL` and
+// defaults to 10 seconds.
+func LeaderTTL() time.Duration {
+	return globalConfig.LeaderTTL
+}
+
+// PositionLostWarnCount is how many times the oplog can roll over past our
+// cursor's position (which loses the changes in between) within
+// PositionLostWarnWindow before we log an error saying the oplog is too
+// small. Every occurrence is counted in otr_oplog_position_lost_total. Zero
+// disables the error. It is set via the environment variable
+// `OTR_POSITION_LOST_WARN_COUNT` and defaults to 5.
+func PositionLostWarnCount() int {
+	return globalConfig.PositionLostWarnCount
+}
+
+// PositionLostWarnWindow is the window for PositionLostWarnCount. It is set
+// via the environment variable `OTR_POSITION_LOST_WARN_WINDOW` and defaults
+// to 1 minute.
+func PositionLostWarnWindow() time.Duration {
+	return globalConfig.PositionLostWarnWindow
+}
+
+// StartPosition is where oplogtoredis starts tailing when it starts up:
+// "resume" (the default) to resume from the last processed timestamp, if it's
+// within MaxCatchUp, and otherwise from the end of the oplog; "end" to always
+// start from the end of the oplog; or "beginning" to process the whole oplog,
+// e.g. for an initial backfill, ignoring MaxCatchUp. It only applies when
+// oplogtoredis starts; if tailing is interrupted after that, it resumes as
+// usual. "beginning" isn't supported with SourceMode "changestream". It is set
+// via the environment variable `OTR_START_POSITION`.
+func StartPosition() string {
+	return globalConfig.StartPosition
+}
+
+// StartupPingChannel, if set, is a Redis channel that oplogtoredis publishes
+// a message to when it starts, so a health dashboard can see that it's up and
+// can reach Redis. It is set via the environment variable
+// `OTR_STARTUP_PING_CHANNEL`.
+func StartupPingChannel() string {
+	return globalConfig.StartupPingChannel
+}
+
+// SelfTestCollection, if set, is a collection ("database.collection") that
+// oplogtoredis writes a test document to when it starts (and then removes),
+// checking that the write is published within SelfTestTimeout. The result is
+// logged and reported in the otr_redispub_self_test_ok metric. The collection
+// must be one that's published (see Allowlist and Denylist). It is set via
+// the environment variable `OTR_SELF_TEST_COLLECTION`.
+func SelfTestCollection() string {
+	return globalConfig.SelfTestCollection
+}
+
+// SelfTestTimeout is how long the startup self-test (see SelfTestCollection)
+// waits for its write to be published. It also bounds the startup ping (see
+// StartupPingChannel). It is set via the environment variable
+// `OTR_SELF_TEST_TIMEOUT` and defaults to 30 seconds.
+func SelfTestTimeout() time.Duration {
+	return globalConfig.SelfTestTimeout
+}
+
+// PayloadCompression controls whether we compress the messages we publish:
+// "none" (the default), "gzip", or "zstd". Compressed messages start with
+// "gzip:" or "zstd:", followed by the compressed JSON, so this changes the
+// wire format and requires a consumer that can decompress them. It is set
+// via the environment variable `OTR_PAYLOAD_COMPRESSION`.
+func PayloadCompression() string {
+	return globalConfig.PayloadCompression
+}
+
+// PayloadCompressionThreshold is the size, in bytes, below which messages
+// aren't compressed (see PayloadCompression), since compressing small
+// messages costs more than it saves. It is set via the environment variable
+// `OTR_PAYLOAD_COMPRESSION_THRESHOLD` and defaults to 1024.
+func PayloadCompressionThreshold() int {
+	return globalConfig.PayloadCompressionThreshold
+}
+
+// PrefixOverrides maps database names to prefixes for the channels their
+// changes are published to, so that several applications sharing one
+// oplogtoredis (and one Redis) each get their own keyspace. The prefix is
+// prepended to the channel names (including ones from ChannelTemplate);
+// channels for databases that aren't listed have no prefix, as usual.
+// Databases are matched by their names in Mongo, before NamespaceMap. It is
+// set via the environment variable `OTR_PREFIX_OVERRIDES` as a
+// comma-separated list of database=prefix pairs, such as
+// `db1=app1:,db2=app2:`.
+func PrefixOverrides() map[string]string {
+	return globalConfig.PrefixOverrides
+}
+
+// RedisUsername is the Redis 6 ACL user to authenticate as. It takes
+// precedence over a username in RedisURL, and may be set without
+// RedisPassword (for example, when authenticating with a client certificate).
+// It is set via the environment variable `OTR_REDIS_USERNAME`.
+func RedisUsername() string {
+	return globalConfig.RedisUsername
+}
+
+// RedisPassword is the password to authenticate to Redis with. It takes
+// precedence over a password in RedisURL, so that credentials can be rotated
+// without changing the URL. It is set via the environment variable
+// `OTR_REDIS_PASSWORD`.
+func RedisPassword() string {
+	return globalConfig.RedisPassword
+}
+
+// MongoServerSelectionTimeout is how long the Mongo driver waits for a
+// suitable server (such as the primary) to become available before failing
+// an operation, for example while the replica set elects a new primary. Each
+// query is still bounded by its own timeout (see MongoFindTimeout), so this
+// only helps when that's longer; either way, the tailer retries until a
+// server is available. It is set via the environment variable
+// `OTR_MONGO_SERVER_SELECTION_TIMEOUT`, and takes precedence over
+// serverSelectionTimeoutMS in MongoURL. If neither is set, the driver's
+// default of 30 seconds applies.
+func MongoServerSelectionTimeout() time.Duration {
+	return globalConfig.MongoServerSelectionTimeout
+}
+
+// IncludeSystemNamespaces controls whether we publish changes to documents in
+// namespaces that are internal to Mongo: system collections (such as
+// mydb.system.views), and the config and admin databases. These are skipped
+// by default, before they're decoded, since nothing subscribes to them. It is
+// set via the environment variable `OTR_INCLUDE_SYSTEM_NAMESPACES`.
+func IncludeSystemNamespaces() bool {
+	return globalConfig.IncludeSystemNamespaces
+}
+
+// OutputBufferSize is the number of publications that can wait in the channel
+// between the oplog tailer and the Redis publisher. A larger buffer smooths
+// out bursts of writes, at the cost of memory (up to OutputBufferSize times
+// the largest message, see MaxPayloadBytes) and of hiding a slow Redis for
+// longer. When it's full, Backpressure applies. It is set via the environment
+// variable `OTR_OUTPUT_BUFFER_SIZE` and defaults to BufferSize.
+func OutputBufferSize() int {
+	if globalConfig.OutputBufferSize == 0 {
+		return globalConfig.BufferSize
+	}
+
+	return globalConfig.OutputBufferSize
+}
+
+// Databases is a list of database names. When it's non-empty, only oplog
+// entries for these databases are published. It's a simpler alternative to
+// Allowlist for the common case of publishing whole databases, and applies
+// as well as Allowlist and Denylist. Filtered entries still advance the
+// position we resume tailing from. It is set via the environment variable
+// `OTR_DATABASES` as a comma-separated list, and defaults to empty (every
+// database is published).
+func Databases() []string {
+	return globalConfig.Databases
+}
+
+// MaxPublishRate is the most messages per second oplogtoredis sends for any
+// one collection, to protect subscribers from a flood of updates (e.g. when a
+// job rewrites a whole collection). Beyond that, the collection's messages
+// aren't sent; instead, its collection channel gets a notification with the
+// event "refetch" at most once a second, and once more after the burst, and
+// subscribers should re-run their queries on the collection. Messages that
+// aren't about a single document, such as drops, are never held back. It is
+// set via the environment variable `OTR_MAX_PUBLISH_RATE`; 0 (the default)
+// means no limit.
+func MaxPublishRate() int {
+	return globalConfig.MaxPublishRate
+}
+
+// PayloadKeys renames the top-level keys of the messages we publish, for
+// consumers that expect different names from redis-oplog's. The keys are
+// "e" (the event), "d" (the document, or the details of a namespace event),
+// "f" (the changed fields), "op" (the operation; see IncludeOperation), and
+// "ts" (the timestamp; see IncludeTimestamp).
+// Their order, and everything inside them, stays the same. It is set via the
+// environment variable `OTR_PAYLOAD_KEYS` as a comma-separated list of
+// key=name pairs, such as `f=ef`, and defaults to empty (redis-oplog's
+// names).
+func PayloadKeys() map[string]string {
+	return globalConfig.PayloadKeys
+}
+
+// OplogNsFilter is a regular expression that the namespaces
+// (`<db-name>.<collection-name>`) of oplog entries must match for the oplog
+// query to return them, so that Mongo does the filtering instead of sending
+// us every entry. Transactions (which are logged in `admin.$cmd`) and no-ops
+// are always returned, and a transaction's operations are filtered after we
+// read it. Commands such as drops are logged in `<db-name>.$cmd`, so the
+// expression must match those too for them to be published. It only applies
+// when SourceMode is "oplog". It is set via the environment variable
+// `OTR_OPLOG_NS_FILTER` and defaults to empty (no filter).
+func OplogNsFilter() string {
+	return globalConfig.OplogNsFilter
+}
+
+// MongoMaxPoolSize is the largest number of connections the Mongo driver
+// keeps open to each server. The tailer uses a single connection; the rest
+// are for full-document lookups and health checks. It is set via the
+// environment variable `OTR_MONGO_MAX_POOL_SIZE`; 0 (the default) uses the
+// maxPoolSize from OTR_MONGO_URL, or the driver's default of 100.
+func MongoMaxPoolSize() int {
+	return globalConfig.MongoMaxPoolSize
+}
+
+// RedisPoolSize is the largest number of connections we keep open to each
+// Redis server. It is set via the environment variable `OTR_REDIS_POOL_SIZE`;
+// 0 (the default) uses the driver's default of 10 per CPU.
+func RedisPoolSize() int {
+	return globalConfig.RedisPoolSize
+}
+
+// RunMode is "continuous" (the default) to tail the oplog until we're
+// stopped, or "once" to read from the starting point (see StartPosition) up
+// to the end of the oplog as of startup, publish everything, write the
+// last-processed timestamp, and exit. "once" is for one-shot backfills run as
+// batch jobs. It can't be used with SourceMode "changestream" or with
+// LeaderKey. It is set via the environment variable `OTR_RUN_MODE`.
+func RunMode() string {
+	return globalConfig.RunMode
+}
+
+// ResumeKeyPersist controls whether we PERSIST the last-processed timestamp
+// keys in Redis every time we write them, so that they never have an
+// expiration and can't be evicted under a volatile-* maxmemory policy. It is
+// set via the environment variable `OTR_RESUME_KEY_PERSIST`. Regardless of
+// this setting, we log a warning (and count it in
+// otr_redispub_resume_key_vanished) if one of these keys disappears while
+// we're running.
+func ResumeKeyPersist() bool {
+	return globalConfig.ResumeKeyPersist
+}
+
+// StartupJitter is the longest we wait, for a random duration, before we
+// start tailing the oplog (or, with LeaderKey, before we first try to become
+// the leader). When a deployment restarts many instances at once, this
+// spreads out their startup queries to Mongo and Redis. It is set via the
+// environment variable `OTR_STARTUP_JITTER`, and defaults to 0 (no waiting).
+func StartupJitter() time.Duration {
+	return globalConfig.StartupJitter
+}
+
+// RedisStartupRetry is how long we keep retrying if we can't connect to Redis
+// when we start up, instead of exiting straight away. We retry with the same
+// backoff as RetryInitialDelay and RetryMaxDelay, and don't start tailing the
+// oplog until we're connected. A negative value retries forever. While we're
+// waiting, /healthz and /healthz/ready report what we're waiting for (and
+// /healthz/live reports that we're live). It is set via the environment
+// variable `OTR_REDIS_STARTUP_RETRY`, and defaults to 0 (no retries).
+func RedisStartupRetry() time.Duration {
+	return globalConfig.RedisStartupRetry
+}
+
+// MongoStartupRetry is like RedisStartupRetry, but for Mongo. If it's
+// non-zero, we ping Mongo when we start up, and keep retrying for this long
+// (or forever, if it's negative) until it responds. Otherwise, we don't wait
+// for Mongo to respond before starting. It is set via the environment variable
+// `OTR_MONGO_STARTUP_RETRY`, and defaults to 0.
+func MongoStartupRetry() time.Duration {
+	return globalConfig.MongoStartupRetry
+}
+
+// IncludeOperation controls whether each message about a document includes
+// the operation of the oplog entry it's for, as "op": "i" (insert), "u"
+// (update), or "d" (remove), for consumers that handle each differently.
+// redis-oplog's "e" has the same information, but removes are "r" there. It's
+// off by default, to keep messages as redis-oplog sends them. It is set via
+// the environment variable `OTR_INCLUDE_OPERATION`.
+func IncludeOperation() bool {
+	return globalConfig.IncludeOperation
+}
+
+// HeartbeatInterval, if set, is how often we publish a heartbeat message to
+// HeartbeatChannel, even when nothing is written to Mongo, so consumers can
+// use it as a signal that the whole pipeline is alive. Heartbeats don't
+// affect the last-processed timestamp, and are counted in
+// otr_redispub_heartbeats rather than otr_redispub_processed_messages. It is
+// set via the environment variable `OTR_HEARTBEAT_INTERVAL`, and defaults to
+// 0 (no heartbeats).
+func HeartbeatInterval() time.Duration {
+	return globalConfig.HeartbeatInterval
+}
+
+// HeartbeatChannel is the Redis channel (or stream, with OutputMode
+// "stream") that heartbeats are published to; see HeartbeatInterval. It is
+// set via the environment variable `OTR_HEARTBEAT_CHANNEL`, and defaults to
+// "oplogtoredis.heartbeat".
+func HeartbeatChannel() string {
+	return globalConfig.HeartbeatChannel
+}
+
+// ShutdownFlushTimeout is how long we wait to write the final last-processed
+// timestamp to Redis if stopping the tailer and draining the buffered
+// messages during shutdown takes longer than ShutdownTimeout. If that takes longer than this too, we exit
+// anyway, and the next start resumes from the last timestamp we wrote, so
+// some messages are published again. It is set via the environment variable
+// `OTR_SHUTDOWN_FLUSH_TIMEOUT` and defaults to 5s.
+func ShutdownFlushTimeout() time.Duration {
+	return globalConfig.ShutdownFlushTimeout
+}
+
+// CatchUpMaxRate, if positive, is the most messages per second we publish
+// while we're catching up on a backlog, i.e. while the messages we're
+// publishing are more than CatchUpLagThreshold behind. This smooths out the
+// replay after an outage (within MaxCatchUp), so it doesn't flood Redis and
+// subscribers. Messages over the limit are delayed, not dropped. It is set
+// via the environment variable `OTR_CATCHUP_MAX_RATE`, and defaults to 0 (no
+// limit).
+func CatchUpMaxRate() int {
+	return globalConfig.CatchUpMaxRate
+}
+
+// CatchUpLagThreshold is how far behind the messages we're publishing must
+// be for CatchUpMaxRate to apply. It is set via the environment variable
+// `OTR_CATCHUP_LAG_THRESHOLD`, and defaults to 30s.
+func CatchUpLagThreshold() time.Duration {
+	return globalConfig.CatchUpLagThreshold
+}
+
+// DisableDeprecatedMetrics drops the deprecated metrics
+// otr_oplog_entries_received and otr_oplog_entries_received_size (which
+// otr_oplog_entries_by_size replaces), to reduce the size of each scrape
+// ahead of their removal. It is set via the environment variable
+// `OTR_DISABLE_DEPRECATED_METRICS` and defaults to false.
+func DisableDeprecatedMetrics() bool {
+	return globalConfig.DisableDeprecatedMetrics
+}
+
 // ParseEnv parses the current environment variables and updates the stored
 // configuration. It is *not* threadsafe, and should just be called once
 // at the start of the program.
@@ -143,6 +1336,313 @@ func ParseEnv() error {
 		return err
 	}
 
+	err = validateNamespacePatterns(config.Allowlist)
+	if err != nil {
+		return errors.Wrap(err, "parsing OTR_ALLOWLIST")
+	}
+
+	err = validateNamespacePatterns(config.Denylist)
+	if err != nil {
+		return errors.Wrap(err, "parsing OTR_DENYLIST")
+	}
+
+	if (len(config.RedisSentinelAddrs) > 0) != (config.RedisSentinelMaster != "") {
+		return errors.New("OTR_REDIS_SENTINEL_ADDRS and OTR_REDIS_SENTINEL_MASTER must be set together")
+	}
+
+	if len(config.RedisSentinelAddrs) > 0 && len(config.RedisURL) > 1 {
+		return errors.New("OTR_REDIS_SENTINEL_ADDRS cannot be used with more than one OTR_REDIS_URL")
+	}
+
+	if config.RedisWriteMode != "all" && config.RedisWriteMode != "any" {
+		return errors.Errorf("OTR_REDIS_WRITE_MODE must be \"all\" or \"any\", got %q", config.RedisWriteMode)
+	}
+
+	if config.OutputMode != "pubsub" && config.OutputMode != "stream" && config.OutputMode != "kafka" {
+		return errors.Errorf("OTR_OUTPUT_MODE must be \"pubsub\", \"stream\", or \"kafka\", got %q", config.OutputMode)
+	}
+
+	if config.OutputMode == "kafka" && len(config.KafkaBrokers) == 0 {
+		return errors.New("OTR_KAFKA_BROKERS is required when OTR_OUTPUT_MODE is \"kafka\"")
+	}
+
+	if config.KafkaTimeout <= 0 {
+		return errors.New("OTR_KAFKA_TIMEOUT must be positive")
+	}
+
+	if config.RetryInitialDelay <= 0 || config.RetryMaxDelay < config.RetryInitialDelay {
+		return errors.New("OTR_RETRY_INITIAL_DELAY must be positive and no greater than OTR_RETRY_MAX_DELAY")
+	}
+
+	if config.SourceMode != "oplog" && config.SourceMode != "changestream" {
+		return errors.Errorf("OTR_SOURCE_MODE must be \"oplog\" or \"changestream\", got %q", config.SourceMode)
+	}
+
+	if config.ChangeStreamFullDocument != "default" && config.ChangeStreamFullDocument != "updateLookup" {
+		return errors.Errorf("OTR_CHANGE_STREAM_FULL_DOCUMENT must be \"default\" or \"updateLookup\", got %q", config.ChangeStreamFullDocument)
+	}
+
+	if config.ShutdownTimeout <= 0 {
+		return errors.New("OTR_SHUTDOWN_TIMEOUT must be positive")
+	}
+
+	if config.MaxIdle <= 0 {
+		return errors.New("OTR_MAX_IDLE must be positive")
+	}
+
+	if config.DedupTTL < 0 {
+		return errors.New("OTR_DEDUP_TTL must not be negative")
+	}
+
+	for database, maxCatchUp := range config.MaxCatchUpOverrides {
+		if maxCatchUp < 0 {
+			return errors.Errorf("OTR_MAX_CATCH_UP_OVERRIDES: catch-up window for %q must not be negative", database)
+		}
+	}
+
+	if config.PayloadFormat != "json" && config.PayloadFormat != "ejson" && config.PayloadFormat != "msgpack" {
+		return errors.Errorf("OTR_PAYLOAD_FORMAT must be \"json\", \"ejson\", or \"msgpack\", got %q", config.PayloadFormat)
+	}
+
+	switch config.MongoReadPreference {
+	case "", "primary", "primaryPreferred", "secondary", "secondaryPreferred", "nearest":
+	default:
+		return errors.Errorf("OTR_MONGO_READ_PREFERENCE must be one of primary, primaryPreferred, secondary, secondaryPreferred, or nearest, got %q", config.MongoReadPreference)
+	}
+
+	if (config.RedisTLSCertFile == "") != (config.RedisTLSKeyFile == "") {
+		return errors.New("OTR_REDIS_TLS_CERT_FILE and OTR_REDIS_TLS_KEY_FILE must be set together")
+	}
+
+	if config.OplogDatabase == "" || config.OplogCollection == "" {
+		return errors.New("OTR_OPLOG_DATABASE and OTR_OPLOG_COLLECTION must not be empty")
+	}
+
+	if config.ProcessorConcurrency < 1 {
+		return errors.New("OTR_PROCESSOR_CONCURRENCY must be at least 1")
+	}
+
+	if config.PublishBatchSize < 1 {
+		return errors.New("OTR_PUBLISH_BATCH_SIZE must be at least 1")
+	}
+
+	if config.PublishBatchWindow < 0 {
+		return errors.New("OTR_PUBLISH_BATCH_WINDOW must not be negative")
+	}
+
+	if config.SlowPublishThreshold < 0 {
+		return errors.New("OTR_SLOW_PUBLISH_THRESHOLD must not be negative")
+	}
+
+	if config.StreamMaxlen < 0 {
+		return errors.New("OTR_STREAM_MAXLEN must not be negative")
+	}
+
+	if config.Backpressure != "block" && config.Backpressure != "drop_oldest" && config.Backpressure != "drop" {
+		return errors.Errorf("OTR_BACKPRESSURE must be \"block\", \"drop_oldest\", or \"drop\", got %q", config.Backpressure)
+	}
+
+	// Dropping publications could drop the end of a transaction, which the
+	// publisher would then wait for forever
+	if config.TransactionAtomic && config.Backpressure != "block" {
+		return errors.New("OTR_TRANSACTION_ATOMIC requires OTR_BACKPRESSURE=block")
+	}
+
+	if config.ResumeLogInterval < 0 {
+		return errors.New("OTR_RESUME_LOG_INTERVAL must not be negative")
+	}
+
+	if config.OplogBatchSize < 0 {
+		return errors.New("OTR_OPLOG_BATCH_SIZE must not be negative")
+	}
+
+	if config.OplogMaxAwaitMS < 0 {
+		return errors.New("OTR_OPLOG_MAX_AWAIT_MS must not be negative")
+	}
+
+	if time.Duration(config.OplogMaxAwaitMS)*time.Millisecond >= config.MongoQueryTimeout {
+		return errors.New("OTR_OPLOG_MAX_AWAIT_MS must be less than OTR_MONGO_QUERY_TIMEOUT")
+	}
+
+	if config.MaxPayloadBytes < 0 {
+		return errors.New("OTR_MAX_PAYLOAD_BYTES must not be negative")
+	}
+
+	switch config.MongoAuthMechanism {
+	case "", "SCRAM-SHA-1", "SCRAM-SHA-256", "MONGODB-X509", "MONGODB-AWS", "GSSAPI", "PLAIN":
+	default:
+		return errors.Errorf("OTR_MONGO_AUTH_MECHANISM must be one of SCRAM-SHA-1, SCRAM-SHA-256, MONGODB-X509, MONGODB-AWS, GSSAPI, or PLAIN, got %q", config.MongoAuthMechanism)
+	}
+
+	if config.MongoTLSKeyFile != "" && config.MongoTLSCertFile == "" {
+		return errors.New("OTR_MONGO_TLS_KEY_FILE requires OTR_MONGO_TLS_CERT_FILE")
+	}
+
+	if config.MetricMaxCollections <= 0 {
+		return errors.New("OTR_METRIC_MAX_COLLECTIONS must be positive")
+	}
+
+	if config.DistributionWindow < 0 {
+		return errors.New("OTR_DISTRIBUTION_WINDOW must not be negative")
+	}
+
+	if config.MaxSizeReportInterval <= 0 {
+		return errors.New("OTR_MAX_SIZE_REPORT_INTERVAL must be positive")
+	}
+
+	if config.LeaderKey != "" && config.LeaderTTL <= 0 {
+		return errors.New("OTR_LEADER_TTL must be positive")
+	}
+
+	if config.PositionLostWarnCount < 0 {
+		return errors.New("OTR_POSITION_LOST_WARN_COUNT must not be negative")
+	}
+
+	if config.PositionLostWarnWindow <= 0 {
+		return errors.New("OTR_POSITION_LOST_WARN_WINDOW must be positive")
+	}
+
+	if config.StartPosition != "resume" && config.StartPosition != "end" && config.StartPosition != "beginning" {
+		return errors.Errorf("OTR_START_POSITION must be \"resume\", \"end\", or \"beginning\", got %q", config.StartPosition)
+	}
+
+	if config.StartPosition == "beginning" && config.SourceMode == "changestream" {
+		return errors.New("OTR_START_POSITION=beginning cannot be used with OTR_SOURCE_MODE=changestream")
+	}
+
+	if config.SelfTestCollection != "" && !strings.Contains(config.SelfTestCollection, ".") {
+		return errors.Errorf("OTR_SELF_TEST_COLLECTION must be in the form database.collection, got %q", config.SelfTestCollection)
+	}
+
+	if config.SelfTestTimeout <= 0 {
+		return errors.New("OTR_SELF_TEST_TIMEOUT must be positive")
+	}
+
+	if config.MongoFindTimeout < 0 || config.MongoNextTimeout < 0 || config.MongoCloseTimeout < 0 {
+		return errors.New("OTR_MONGO_FIND_TIMEOUT, OTR_MONGO_NEXT_TIMEOUT, and OTR_MONGO_CLOSE_TIMEOUT must not be negative")
+	}
+
+	if config.MongoNextTimeout > 0 && config.OplogMaxAwaitMS > 0 && config.MongoNextTimeout <= time.Duration(config.OplogMaxAwaitMS)*time.Millisecond {
+		return errors.New("OTR_MONGO_NEXT_TIMEOUT must be longer than OTR_OPLOG_MAX_AWAIT_MS")
+	}
+
+	if config.PayloadCompression != "none" && config.PayloadCompression != "gzip" && config.PayloadCompression != "zstd" {
+		return errors.Errorf("OTR_PAYLOAD_COMPRESSION must be \"none\", \"gzip\", or \"zstd\", got %q", config.PayloadCompression)
+	}
+
+	if config.PayloadCompressionThreshold < 0 {
+		return errors.New("OTR_PAYLOAD_COMPRESSION_THRESHOLD must not be negative")
+	}
+
+	if config.MongoServerSelectionTimeout < 0 {
+		return errors.New("OTR_MONGO_SERVER_SELECTION_TIMEOUT must not be negative")
+	}
+
+	if config.OutputBufferSize < 0 {
+		return errors.New("OTR_OUTPUT_BUFFER_SIZE must not be negative")
+	}
+
+	for _, database := range config.Databases {
+		if database == "" || strings.ContainsAny(database, "./") {
+			return errors.Errorf("OTR_DATABASES must be a comma-separated list of database names, got %q", database)
+		}
+	}
+
+	if config.MaxPublishRate < 0 {
+		return errors.New("OTR_MAX_PUBLISH_RATE must not be negative")
+	}
+
+	payloadKeyNames := map[string]string{"e": "e", "d": "d", "f": "f", "op": "op", "ts": "ts"}
+	for key, name := range config.PayloadKeys {
+		if _, ok := payloadKeyNames[key]; !ok {
+			return errors.Errorf("OTR_PAYLOAD_KEYS can only rename e, d, f, op, and ts, got %q", key)
+		}
+		if name == "" {
+			return errors.Errorf("OTR_PAYLOAD_KEYS must give %s a name", key)
+		}
+		payloadKeyNames[key] = name
+	}
+	seenPayloadKeyNames := map[string]bool{}
+	for _, name := range payloadKeyNames {
+		if seenPayloadKeyNames[name] {
+			return errors.Errorf("OTR_PAYLOAD_KEYS gives two keys the name %q", name)
+		}
+		seenPayloadKeyNames[name] = true
+	}
+
+	if config.OplogNsFilter != "" {
+		if _, err := regexp.Compile(config.OplogNsFilter); err != nil {
+			return errors.Wrap(err, "parsing OTR_OPLOG_NS_FILTER")
+		}
+	}
+
+	if config.MongoMaxPoolSize < 0 {
+		return errors.New("OTR_MONGO_MAX_POOL_SIZE must not be negative")
+	}
+
+	if config.RedisPoolSize < 0 {
+		return errors.New("OTR_REDIS_POOL_SIZE must not be negative")
+	}
+
+	if config.RunMode != "continuous" && config.RunMode != "once" {
+		return errors.Errorf("OTR_RUN_MODE must be \"continuous\" or \"once\", got %q", config.RunMode)
+	}
+
+	if config.RunMode == "once" && config.SourceMode == "changestream" {
+		return errors.New("OTR_RUN_MODE=once cannot be used with OTR_SOURCE_MODE=changestream")
+	}
+
+	if config.RunMode == "once" && config.LeaderKey != "" {
+		return errors.New("OTR_RUN_MODE=once cannot be used with OTR_LEADER_KEY")
+	}
+
+	if config.StartupJitter < 0 {
+		return errors.New("OTR_STARTUP_JITTER must not be negative")
+	}
+
+	if config.HeartbeatInterval < 0 {
+		return errors.New("OTR_HEARTBEAT_INTERVAL must not be negative")
+	}
+
+	if config.HeartbeatInterval > 0 && config.HeartbeatChannel == "" {
+		return errors.New("OTR_HEARTBEAT_CHANNEL must not be empty when OTR_HEARTBEAT_INTERVAL is set")
+	}
+
+	if config.ShutdownFlushTimeout <= 0 {
+		return errors.New("OTR_SHUTDOWN_FLUSH_TIMEOUT must be positive")
+	}
+
+	if config.CatchUpMaxRate < 0 {
+		return errors.New("OTR_CATCHUP_MAX_RATE must not be negative")
+	}
+
+	if config.CatchUpLagThreshold <= 0 {
+		return errors.New("OTR_CATCHUP_LAG_THRESHOLD must be positive")
+	}
+
+	if config.AdminSeekEnabled && config.SourceMode == "changestream" {
+		return errors.New("OTR_ADMIN_SEEK_ENABLED cannot be used with OTR_SOURCE_MODE=changestream")
+	}
+
+	if config.OtelEndpoint != "" {
+		endpoint, err := url.Parse(config.OtelEndpoint)
+		if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+			return errors.Errorf("OTR_OTEL_ENDPOINT must be an http:// or https:// URL, got %q", config.OtelEndpoint)
+		}
+	}
+
 	globalConfig = &config
 	return nil
 }
+
+// Checks that each of the given namespace patterns is a valid path.Match
+// pattern
+func validateNamespacePatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return errors.Wrapf(err, "invalid namespace pattern %q", pattern)
+		}
+	}
+
+	return nil
+}
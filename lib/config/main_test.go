@@ -2,6 +2,7 @@ package config
 
 import (
 	"os"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
@@ -14,7 +15,7 @@ var envTests = map[string]struct {
 }{
 	"Full env": {
 		env: map[string]string{
-			"OTR_REDIS_URL":                         "redis://something",
+			"OTR_REDIS_URL":                         "redis://something,redis://otherthing",
 			"OTR_MONGO_URL":                         "mongodb://something",
 			"OTR_HTTP_SERVER_ADDR":                  "localhost:1234",
 			"OTR_BUFFER_SIZE":                       "10",
@@ -23,9 +24,99 @@ var envTests = map[string]struct {
 			"OTR_REDIS_DEDUPE_EXPIRATION":           "12s",
 			"OTR_REDIS_METADATA_PREFIX":             "someprefix.",
 			"OTR_OPLOG_V2_EXTRACT_SUBFIELD_CHANGES": "true",
+			"OTR_ALLOWLIST":                         "foo.*,bar.baz",
+			"OTR_DENYLIST":                          "foo.secret",
+			"OTR_FULL_DOCUMENT_COLLECTIONS":         "foo.small,bar.tiny",
+			"OTR_REDIS_WRITE_MODE":                  "any",
+			"OTR_CHANNEL_TEMPLATE":                  "changes:{{.Database}}:{{.Collection}}",
+			"OTR_OUTPUT_MODE":                       "stream",
+			"OTR_STREAM_MAXLEN":                     "1000",
+			"OTR_RETRY_INITIAL_DELAY":               "100ms",
+			"OTR_RETRY_MAX_DELAY":                   "1m",
+			"OTR_SOURCE_MODE":                       "changestream",
+			"OTR_CHANGE_STREAM_FULL_DOCUMENT":       "updateLookup",
+			"OTR_SLOW_PUBLISH_THRESHOLD":            "250ms",
+			"OTR_PUBLISH_BATCH_SIZE":                "100",
+			"OTR_PUBLISH_BATCH_WINDOW":              "5ms",
+			"OTR_PROCESSOR_CONCURRENCY":             "4",
+			"OTR_OPLOG_DATABASE":                    "replay",
+			"OTR_OPLOG_COLLECTION":                  "captured_oplog",
+			"OTR_SHUTDOWN_TIMEOUT":                  "45s",
+			"OTR_MAX_IDLE":                          "5m",
+			"OTR_DEDUP_TTL":                         "30s",
+			"OTR_REDIS_TLS":                         "true",
+			"OTR_REDIS_TLS_CA_FILE":                 "/etc/ssl/redis-ca.pem",
+			"OTR_REDIS_TLS_CERT_FILE":               "/etc/ssl/client.pem",
+			"OTR_REDIS_TLS_KEY_FILE":                "/etc/ssl/client-key.pem",
+			"OTR_REDIS_TLS_INSECURE_SKIP_VERIFY":    "true",
+			"OTR_MONGO_READ_PREFERENCE":             "secondaryPreferred",
+			"OTR_MAX_CATCH_UP_OVERRIDES":            "db1=1h,db2=30s",
+			"OTR_PAYLOAD_FORMAT":                    "msgpack",
+			"OTR_PUBLISH_DOCUMENT_CHANNELS":         "false",
+			"OTR_OTEL_ENDPOINT":                     "http://otel-collector:4318",
+			"OTR_BACKPRESSURE":                      "drop_oldest",
+			"OTR_RESUME_LOG_INTERVAL":               "10m",
+			"OTR_OPLOG_BATCH_SIZE":                  "1000",
+			"OTR_OPLOG_MAX_AWAIT_MS":                "250",
+			"OTR_DEADLETTER_KEY":                    "otr.deadletter",
+			"OTR_MAX_PAYLOAD_BYTES":                 "65536",
+			"OTR_NAMESPACE_MAP":                     "prod_*=*,legacy.users=app.users",
+			"OTR_MONGO_AUTH_MECHANISM":              "MONGODB-X509",
+			"OTR_MONGO_TLS_CA_FILE":                 "/etc/ssl/mongo-ca.pem",
+			"OTR_MONGO_TLS_CERT_FILE":               "/etc/ssl/mongo-client.pem",
+			"OTR_MONGO_TLS_KEY_FILE":                "/etc/ssl/mongo-client-key.pem",
+			"OTR_MONGO_APP_NAME":                    "oplogtoredis-prod",
+			"OTR_METRIC_COLLECTION_LABEL":           "true",
+			"OTR_METRIC_MAX_COLLECTIONS":            "50",
+			"OTR_OPERATION_FILTER":                  "foo.events=insert;bar.*=insert,update",
+			"OTR_FIELD_FILTER":                      "foo.users=name,email;bar.*=status",
+			"OTR_INCLUDE_TIMESTAMP":                 "true",
+			"OTR_DRY_RUN":                           "true",
+			"OTR_DISTRIBUTION_WINDOW":               "5m",
+			"OTR_MAX_SIZE_REPORT_INTERVAL":          "10s",
+			"OTR_LEADER_KEY":                        "oplogtoredis::leader",
+			"OTR_LEADER_TTL":                        "30s",
+			"OTR_POSITION_LOST_WARN_COUNT":          "10",
+			"OTR_POSITION_LOST_WARN_WINDOW":         "5m",
+			"OTR_START_POSITION":                    "end",
+			"OTR_STARTUP_PING_CHANNEL":              "oplogtoredis.startup",
+			"OTR_SELF_TEST_COLLECTION":              "test.selfTest",
+			"OTR_SELF_TEST_TIMEOUT":                 "5s",
+			"OTR_MONGO_FIND_TIMEOUT":                "2s",
+			"OTR_MONGO_NEXT_TIMEOUT":                "30s",
+			"OTR_MONGO_CLOSE_TIMEOUT":               "1s",
+			"OTR_PAYLOAD_COMPRESSION":               "zstd",
+			"OTR_PAYLOAD_COMPRESSION_THRESHOLD":     "512",
+			"OTR_PREFIX_OVERRIDES":                  "db1=app1:,db2=app2:",
+			"OTR_REDIS_USERNAME":                    "oplogtoredis",
+			"OTR_REDIS_PASSWORD":                    "secret",
+			"OTR_MONGO_SERVER_SELECTION_TIMEOUT":    "20s",
+			"OTR_INCLUDE_SYSTEM_NAMESPACES":         "true",
+			"OTR_OUTPUT_BUFFER_SIZE":                "50000",
+			"OTR_DATABASES":                         "app,analytics",
+			"OTR_MAX_PUBLISH_RATE":                  "500",
+			"OTR_PAYLOAD_KEYS":                      "f=ef,ts=timestamp",
+			"OTR_OPLOG_NS_FILTER":                   `^app\.`,
+			"OTR_MONGO_MAX_POOL_SIZE":               "20",
+			"OTR_REDIS_POOL_SIZE":                   "30",
+			"OTR_RESUME_KEY_PERSIST":                "true",
+			"OTR_STARTUP_JITTER":                    "5s",
+			"OTR_REDIS_STARTUP_RETRY":               "10m",
+			"OTR_MONGO_STARTUP_RETRY":               "-1s",
+			"OTR_INCLUDE_OPERATION":                 "true",
+			"OTR_HEARTBEAT_INTERVAL":                "30s",
+			"OTR_HEARTBEAT_CHANNEL":                 "app.heartbeat",
+			"OTR_SHUTDOWN_FLUSH_TIMEOUT":            "3s",
+			"OTR_CATCHUP_MAX_RATE":                  "500",
+			"OTR_CATCHUP_LAG_THRESHOLD":             "2m",
+			"OTR_DISABLE_DEPRECATED_METRICS":        "true",
+			"OTR_STREAM_DOCUMENT_STREAMS":           "true",
+			"OTR_KAFKA_BROKERS":                     "kafka1:9092,kafka2:9092",
+			"OTR_KAFKA_TOPIC_TEMPLATE":              "changes.{{.Database}}",
+			"OTR_KAFKA_TIMEOUT":                     "3s",
 		},
 		expectedConfig: &oplogtoredisConfiguration{
-			RedisURL:                      "redis://something",
+			RedisURL:                      []string{"redis://something", "redis://otherthing"},
 			MongoURL:                      "mongodb://something",
 			HTTPServerAddr:                "localhost:1234",
 			BufferSize:                    10,
@@ -34,6 +125,96 @@ var envTests = map[string]struct {
 			RedisDedupeExpiration:         12 * time.Second,
 			RedisMetadataPrefix:           "someprefix.",
 			OplogV2ExtractSubfieldChanges: true,
+			Allowlist:                     []string{"foo.*", "bar.baz"},
+			Denylist:                      []string{"foo.secret"},
+			FullDocumentCollections:       []string{"foo.small", "bar.tiny"},
+			RedisWriteMode:                "any",
+			ChannelTemplate:               "changes:{{.Database}}:{{.Collection}}",
+			OutputMode:                    "stream",
+			StreamMaxlen:                  1000,
+			RetryInitialDelay:             100 * time.Millisecond,
+			RetryMaxDelay:                 time.Minute,
+			SourceMode:                    "changestream",
+			ChangeStreamFullDocument:      "updateLookup",
+			SlowPublishThreshold:          250 * time.Millisecond,
+			PublishBatchSize:              100,
+			PublishBatchWindow:            5 * time.Millisecond,
+			ProcessorConcurrency:          4,
+			OplogDatabase:                 "replay",
+			OplogCollection:               "captured_oplog",
+			ShutdownTimeout:               45 * time.Second,
+			MaxIdle:                       5 * time.Minute,
+			DedupTTL:                      30 * time.Second,
+			RedisTLS:                      true,
+			RedisTLSCAFile:                "/etc/ssl/redis-ca.pem",
+			RedisTLSCertFile:              "/etc/ssl/client.pem",
+			RedisTLSKeyFile:               "/etc/ssl/client-key.pem",
+			RedisTLSInsecureSkipVerify:    true,
+			MongoReadPreference:           "secondaryPreferred",
+			MaxCatchUpOverrides:           durationMap{"db1": time.Hour, "db2": 30 * time.Second},
+			PayloadFormat:                 "msgpack",
+			OtelEndpoint:                  "http://otel-collector:4318",
+			Backpressure:                  "drop_oldest",
+			ResumeLogInterval:             10 * time.Minute,
+			OplogBatchSize:                1000,
+			OplogMaxAwaitMS:               250,
+			DeadLetterKey:                 "otr.deadletter",
+			MaxPayloadBytes:               65536,
+			NamespaceMap:                  []string{"prod_*=*", "legacy.users=app.users"},
+			MongoAuthMechanism:            "MONGODB-X509",
+			MongoTLSCAFile:                "/etc/ssl/mongo-ca.pem",
+			MongoTLSCertFile:              "/etc/ssl/mongo-client.pem",
+			MongoTLSKeyFile:               "/etc/ssl/mongo-client-key.pem",
+			MongoAppName:                  "oplogtoredis-prod",
+			MetricCollectionLabel:         true,
+			MetricMaxCollections:          50,
+			OperationFilter:               operationMap{"foo.events": {"insert"}, "bar.*": {"insert", "update"}},
+			FieldFilter:                   fieldMap{"foo.users": {"name", "email"}, "bar.*": {"status"}},
+			IncludeTimestamp:              true,
+			DryRun:                        true,
+			DistributionWindow:            5 * time.Minute,
+			MaxSizeReportInterval:         10 * time.Second,
+			LeaderKey:                     "oplogtoredis::leader",
+			LeaderTTL:                     30 * time.Second,
+			PositionLostWarnCount:         10,
+			PositionLostWarnWindow:        5 * time.Minute,
+			StartPosition:                 "end",
+			StartupPingChannel:            "oplogtoredis.startup",
+			SelfTestCollection:            "test.selfTest",
+			SelfTestTimeout:               5 * time.Second,
+			MongoFindTimeout:              2 * time.Second,
+			MongoNextTimeout:              30 * time.Second,
+			MongoCloseTimeout:             1 * time.Second,
+			PayloadCompression:            "zstd",
+			PayloadCompressionThreshold:   512,
+			PrefixOverrides:               stringMap{"db1": "app1:", "db2": "app2:"},
+			RedisUsername:                 "oplogtoredis",
+			RedisPassword:                 "secret",
+			MongoServerSelectionTimeout:   20 * time.Second,
+			IncludeSystemNamespaces:       true,
+			OutputBufferSize:              50000,
+			Databases:                     []string{"app", "analytics"},
+			MaxPublishRate:                500,
+			PayloadKeys:                   stringMap{"f": "ef", "ts": "timestamp"},
+			OplogNsFilter:                 `^app\.`,
+			MongoMaxPoolSize:              20,
+			RedisPoolSize:                 30,
+			RunMode:                       "continuous",
+			ResumeKeyPersist:              true,
+			StartupJitter:                 5 * time.Second,
+			RedisStartupRetry:             10 * time.Minute,
+			MongoStartupRetry:             -time.Second,
+			IncludeOperation:              true,
+			HeartbeatInterval:             30 * time.Second,
+			HeartbeatChannel:              "app.heartbeat",
+			ShutdownFlushTimeout:          3 * time.Second,
+			CatchUpMaxRate:                500,
+			CatchUpLagThreshold:           2 * time.Minute,
+			DisableDeprecatedMetrics:      true,
+			StreamDocumentStreams:         true,
+			KafkaBrokers:                  []string{"kafka1:9092", "kafka2:9092"},
+			KafkaTopicTemplate:            "changes.{{.Database}}",
+			KafkaTimeout:                  3 * time.Second,
 		},
 	},
 	"Minimal env": {
@@ -42,7 +223,7 @@ var envTests = map[string]struct {
 			"OTR_MONGO_URL": "mongodb://xxx",
 		},
 		expectedConfig: &oplogtoredisConfiguration{
-			RedisURL:                      "redis://yyy",
+			RedisURL:                      []string{"redis://yyy"},
 			MongoURL:                      "mongodb://xxx",
 			HTTPServerAddr:                "0.0.0.0:9000",
 			BufferSize:                    10000,
@@ -51,6 +232,202 @@ var envTests = map[string]struct {
 			RedisDedupeExpiration:         2 * time.Minute,
 			RedisMetadataPrefix:           "oplogtoredis::",
 			OplogV2ExtractSubfieldChanges: false,
+			RedisWriteMode:                "all",
+			OutputMode:                    "pubsub",
+			RetryInitialDelay:             time.Second,
+			RetryMaxDelay:                 30 * time.Second,
+			SourceMode:                    "oplog",
+			ChangeStreamFullDocument:      "default",
+			SlowPublishThreshold:          time.Second,
+			PublishBatchSize:              1,
+			ProcessorConcurrency:          1,
+			OplogDatabase:                 "local",
+			OplogCollection:               "oplog.rs",
+			ShutdownTimeout:               10 * time.Second,
+			MaxIdle:                       time.Minute,
+			PayloadFormat:                 "json",
+			PublishDocumentChannels:       true,
+			Backpressure:                  "block",
+			ResumeLogInterval:             time.Minute,
+			MongoAppName:                  "oplogtoredis",
+			DistributionWindow:            time.Minute,
+			MaxSizeReportInterval:         time.Minute,
+			LeaderTTL:                     10 * time.Second,
+			PositionLostWarnCount:         5,
+			PositionLostWarnWindow:        time.Minute,
+			StartPosition:                 "resume",
+			SelfTestTimeout:               30 * time.Second,
+			PayloadCompression:            "none",
+			PayloadCompressionThreshold:   1024,
+			MetricMaxCollections:          1000,
+			RunMode:                       "continuous",
+			HeartbeatChannel:              "oplogtoredis.heartbeat",
+			ShutdownFlushTimeout:          5 * time.Second,
+			CatchUpLagThreshold:           30 * time.Second,
+			KafkaTopicTemplate:            "{{.Database}}.{{.Collection}}",
+			KafkaTimeout:                  10 * time.Second,
+		},
+	},
+	"Kafka": {
+		env: map[string]string{
+			"OTR_REDIS_URL":     "redis://yyy",
+			"OTR_MONGO_URL":     "mongodb://xxx",
+			"OTR_OUTPUT_MODE":   "kafka",
+			"OTR_KAFKA_BROKERS": "kafka:9092",
+		},
+		expectedConfig: &oplogtoredisConfiguration{
+			RedisURL:                      []string{"redis://yyy"},
+			MongoURL:                      "mongodb://xxx",
+			HTTPServerAddr:                "0.0.0.0:9000",
+			BufferSize:                    10000,
+			TimestampFlushInterval:        time.Second,
+			MaxCatchUp:                    time.Minute,
+			RedisDedupeExpiration:         2 * time.Minute,
+			RedisMetadataPrefix:           "oplogtoredis::",
+			OplogV2ExtractSubfieldChanges: false,
+			RedisWriteMode:                "all",
+			OutputMode:                    "kafka",
+			RetryInitialDelay:             time.Second,
+			RetryMaxDelay:                 30 * time.Second,
+			SourceMode:                    "oplog",
+			ChangeStreamFullDocument:      "default",
+			SlowPublishThreshold:          time.Second,
+			PublishBatchSize:              1,
+			ProcessorConcurrency:          1,
+			OplogDatabase:                 "local",
+			OplogCollection:               "oplog.rs",
+			ShutdownTimeout:               10 * time.Second,
+			MaxIdle:                       time.Minute,
+			PayloadFormat:                 "json",
+			PublishDocumentChannels:       true,
+			Backpressure:                  "block",
+			ResumeLogInterval:             time.Minute,
+			MongoAppName:                  "oplogtoredis",
+			DistributionWindow:            time.Minute,
+			MaxSizeReportInterval:         time.Minute,
+			LeaderTTL:                     10 * time.Second,
+			PositionLostWarnCount:         5,
+			PositionLostWarnWindow:        time.Minute,
+			StartPosition:                 "resume",
+			SelfTestTimeout:               30 * time.Second,
+			PayloadCompression:            "none",
+			PayloadCompressionThreshold:   1024,
+			MetricMaxCollections:          1000,
+			RunMode:                       "continuous",
+			HeartbeatChannel:              "oplogtoredis.heartbeat",
+			ShutdownFlushTimeout:          5 * time.Second,
+			CatchUpLagThreshold:           30 * time.Second,
+			KafkaBrokers:                  []string{"kafka:9092"},
+			KafkaTopicTemplate:            "{{.Database}}.{{.Collection}}",
+			KafkaTimeout:                  10 * time.Second,
+		},
+	},
+	"Run once": {
+		env: map[string]string{
+			"OTR_REDIS_URL":          "redis://yyy",
+			"OTR_MONGO_URL":          "mongodb://xxx",
+			"OTR_RUN_MODE":           "once",
+			"OTR_TRANSACTION_ATOMIC": "true",
+		},
+		expectedConfig: &oplogtoredisConfiguration{
+			RedisURL:                      []string{"redis://yyy"},
+			MongoURL:                      "mongodb://xxx",
+			HTTPServerAddr:                "0.0.0.0:9000",
+			BufferSize:                    10000,
+			TimestampFlushInterval:        time.Second,
+			MaxCatchUp:                    time.Minute,
+			RedisDedupeExpiration:         2 * time.Minute,
+			RedisMetadataPrefix:           "oplogtoredis::",
+			OplogV2ExtractSubfieldChanges: false,
+			RedisWriteMode:                "all",
+			OutputMode:                    "pubsub",
+			RetryInitialDelay:             time.Second,
+			RetryMaxDelay:                 30 * time.Second,
+			SourceMode:                    "oplog",
+			ChangeStreamFullDocument:      "default",
+			SlowPublishThreshold:          time.Second,
+			PublishBatchSize:              1,
+			ProcessorConcurrency:          1,
+			OplogDatabase:                 "local",
+			OplogCollection:               "oplog.rs",
+			ShutdownTimeout:               10 * time.Second,
+			MaxIdle:                       time.Minute,
+			PayloadFormat:                 "json",
+			PublishDocumentChannels:       true,
+			Backpressure:                  "block",
+			ResumeLogInterval:             time.Minute,
+			MongoAppName:                  "oplogtoredis",
+			DistributionWindow:            time.Minute,
+			MaxSizeReportInterval:         time.Minute,
+			LeaderTTL:                     10 * time.Second,
+			PositionLostWarnCount:         5,
+			PositionLostWarnWindow:        time.Minute,
+			StartPosition:                 "resume",
+			SelfTestTimeout:               30 * time.Second,
+			PayloadCompression:            "none",
+			PayloadCompressionThreshold:   1024,
+			MetricMaxCollections:          1000,
+			RunMode:                       "once",
+			TransactionAtomic:             true,
+			HeartbeatChannel:              "oplogtoredis.heartbeat",
+			ShutdownFlushTimeout:          5 * time.Second,
+			CatchUpLagThreshold:           30 * time.Second,
+			KafkaTopicTemplate:            "{{.Database}}.{{.Collection}}",
+			KafkaTimeout:                  10 * time.Second,
+		},
+	},
+	"Sentinel": {
+		env: map[string]string{
+			"OTR_REDIS_URL":             "redis://yyy",
+			"OTR_MONGO_URL":             "mongodb://xxx",
+			"OTR_REDIS_SENTINEL_ADDRS":  "sentinel1:26379,sentinel2:26379",
+			"OTR_REDIS_SENTINEL_MASTER": "mymaster",
+		},
+		expectedConfig: &oplogtoredisConfiguration{
+			RedisURL:                    []string{"redis://yyy"},
+			MongoURL:                    "mongodb://xxx",
+			HTTPServerAddr:              "0.0.0.0:9000",
+			BufferSize:                  10000,
+			TimestampFlushInterval:      time.Second,
+			MaxCatchUp:                  time.Minute,
+			RedisDedupeExpiration:       2 * time.Minute,
+			RedisMetadataPrefix:         "oplogtoredis::",
+			RedisSentinelAddrs:          []string{"sentinel1:26379", "sentinel2:26379"},
+			RedisSentinelMaster:         "mymaster",
+			RedisWriteMode:              "all",
+			OutputMode:                  "pubsub",
+			RetryInitialDelay:           time.Second,
+			RetryMaxDelay:               30 * time.Second,
+			SourceMode:                  "oplog",
+			ChangeStreamFullDocument:    "default",
+			SlowPublishThreshold:        time.Second,
+			PublishBatchSize:            1,
+			ProcessorConcurrency:        1,
+			OplogDatabase:               "local",
+			OplogCollection:             "oplog.rs",
+			ShutdownTimeout:             10 * time.Second,
+			MaxIdle:                     time.Minute,
+			PayloadFormat:               "json",
+			PublishDocumentChannels:     true,
+			Backpressure:                "block",
+			ResumeLogInterval:           time.Minute,
+			MongoAppName:                "oplogtoredis",
+			DistributionWindow:          time.Minute,
+			MaxSizeReportInterval:       time.Minute,
+			LeaderTTL:                   10 * time.Second,
+			PositionLostWarnCount:       5,
+			PositionLostWarnWindow:      time.Minute,
+			StartPosition:               "resume",
+			SelfTestTimeout:             30 * time.Second,
+			PayloadCompression:          "none",
+			PayloadCompressionThreshold: 1024,
+			MetricMaxCollections:        1000,
+			RunMode:                     "continuous",
+			HeartbeatChannel:            "oplogtoredis.heartbeat",
+			ShutdownFlushTimeout:        5 * time.Second,
+			CatchUpLagThreshold:         30 * time.Second,
+			KafkaTopicTemplate:          "{{.Database}}.{{.Collection}}",
+			KafkaTimeout:                10 * time.Second,
 		},
 	},
 	"Missing redis URL": {
@@ -59,6 +436,546 @@ var envTests = map[string]struct {
 		},
 		expectError: true,
 	},
+	"Invalid allowlist pattern": {
+		env: map[string]string{
+			"OTR_REDIS_URL": "redis://yyy",
+			"OTR_MONGO_URL": "mongodb://xxx",
+			"OTR_ALLOWLIST": "foo.[bar",
+		},
+		expectError: true,
+	},
+	"Sentinel addresses without master name": {
+		env: map[string]string{
+			"OTR_REDIS_URL":            "redis://yyy",
+			"OTR_MONGO_URL":            "mongodb://xxx",
+			"OTR_REDIS_SENTINEL_ADDRS": "sentinel1:26379",
+		},
+		expectError: true,
+	},
+	"Sentinel with multiple Redis URLs": {
+		env: map[string]string{
+			"OTR_REDIS_URL":             "redis://yyy,redis://zzz",
+			"OTR_MONGO_URL":             "mongodb://xxx",
+			"OTR_REDIS_SENTINEL_ADDRS":  "sentinel1:26379",
+			"OTR_REDIS_SENTINEL_MASTER": "mymaster",
+		},
+		expectError: true,
+	},
+	"Invalid write mode": {
+		env: map[string]string{
+			"OTR_REDIS_URL":        "redis://yyy",
+			"OTR_MONGO_URL":        "mongodb://xxx",
+			"OTR_REDIS_WRITE_MODE": "some",
+		},
+		expectError: true,
+	},
+	"Invalid output mode": {
+		env: map[string]string{
+			"OTR_REDIS_URL":   "redis://yyy",
+			"OTR_MONGO_URL":   "mongodb://xxx",
+			"OTR_OUTPUT_MODE": "kinesis",
+		},
+		expectError: true,
+	},
+	"Retry max delay less than initial delay": {
+		env: map[string]string{
+			"OTR_REDIS_URL":           "redis://yyy",
+			"OTR_MONGO_URL":           "mongodb://xxx",
+			"OTR_RETRY_INITIAL_DELAY": "10s",
+			"OTR_RETRY_MAX_DELAY":     "1s",
+		},
+		expectError: true,
+	},
+	"Invalid source mode": {
+		env: map[string]string{
+			"OTR_REDIS_URL":   "redis://yyy",
+			"OTR_MONGO_URL":   "mongodb://xxx",
+			"OTR_SOURCE_MODE": "binlog",
+		},
+		expectError: true,
+	},
+	"Invalid change stream full document option": {
+		env: map[string]string{
+			"OTR_REDIS_URL":                   "redis://yyy",
+			"OTR_MONGO_URL":                   "mongodb://xxx",
+			"OTR_SOURCE_MODE":                 "changestream",
+			"OTR_CHANGE_STREAM_FULL_DOCUMENT": "whenAvailable",
+		},
+		expectError: true,
+	},
+	"Negative slow publish threshold": {
+		env: map[string]string{
+			"OTR_REDIS_URL":              "redis://yyy",
+			"OTR_MONGO_URL":              "mongodb://xxx",
+			"OTR_SLOW_PUBLISH_THRESHOLD": "-1s",
+		},
+		expectError: true,
+	},
+	"Zero batch size": {
+		env: map[string]string{
+			"OTR_REDIS_URL":          "redis://yyy",
+			"OTR_MONGO_URL":          "mongodb://xxx",
+			"OTR_PUBLISH_BATCH_SIZE": "0",
+		},
+		expectError: true,
+	},
+	"Negative batch window": {
+		env: map[string]string{
+			"OTR_REDIS_URL":            "redis://yyy",
+			"OTR_MONGO_URL":            "mongodb://xxx",
+			"OTR_PUBLISH_BATCH_WINDOW": "-5ms",
+		},
+		expectError: true,
+	},
+	"Zero processor concurrency": {
+		env: map[string]string{
+			"OTR_REDIS_URL":             "redis://yyy",
+			"OTR_MONGO_URL":             "mongodb://xxx",
+			"OTR_PROCESSOR_CONCURRENCY": "0",
+		},
+		expectError: true,
+	},
+	"Empty oplog collection": {
+		env: map[string]string{
+			"OTR_REDIS_URL":        "redis://yyy",
+			"OTR_MONGO_URL":        "mongodb://xxx",
+			"OTR_OPLOG_COLLECTION": "",
+		},
+		expectError: true,
+	},
+	"Zero shutdown timeout": {
+		env: map[string]string{
+			"OTR_REDIS_URL":        "redis://yyy",
+			"OTR_MONGO_URL":        "mongodb://xxx",
+			"OTR_SHUTDOWN_TIMEOUT": "0s",
+		},
+		expectError: true,
+	},
+	"Zero max idle": {
+		env: map[string]string{
+			"OTR_REDIS_URL": "redis://yyy",
+			"OTR_MONGO_URL": "mongodb://xxx",
+			"OTR_MAX_IDLE":  "0s",
+		},
+		expectError: true,
+	},
+	"Negative dedup TTL": {
+		env: map[string]string{
+			"OTR_REDIS_URL": "redis://yyy",
+			"OTR_MONGO_URL": "mongodb://xxx",
+			"OTR_DEDUP_TTL": "-1s",
+		},
+		expectError: true,
+	},
+	"Redis TLS cert without key": {
+		env: map[string]string{
+			"OTR_REDIS_URL":           "redis://yyy",
+			"OTR_MONGO_URL":           "mongodb://xxx",
+			"OTR_REDIS_TLS_CERT_FILE": "/etc/ssl/client.pem",
+		},
+		expectError: true,
+	},
+	"Invalid mongo read preference": {
+		env: map[string]string{
+			"OTR_REDIS_URL":             "redis://yyy",
+			"OTR_MONGO_URL":             "mongodb://xxx",
+			"OTR_MONGO_READ_PREFERENCE": "secondaryOnly",
+		},
+		expectError: true,
+	},
+	"Malformed max catch-up override": {
+		env: map[string]string{
+			"OTR_REDIS_URL":              "redis://yyy",
+			"OTR_MONGO_URL":              "mongodb://xxx",
+			"OTR_MAX_CATCH_UP_OVERRIDES": "db1:1h",
+		},
+		expectError: true,
+	},
+	"Negative max catch-up override": {
+		env: map[string]string{
+			"OTR_REDIS_URL":              "redis://yyy",
+			"OTR_MONGO_URL":              "mongodb://xxx",
+			"OTR_MAX_CATCH_UP_OVERRIDES": "db1=-1h",
+		},
+		expectError: true,
+	},
+	"Invalid payload format": {
+		env: map[string]string{
+			"OTR_REDIS_URL":      "redis://yyy",
+			"OTR_MONGO_URL":      "mongodb://xxx",
+			"OTR_PAYLOAD_FORMAT": "xml",
+		},
+		expectError: true,
+	},
+	"Invalid OpenTelemetry endpoint": {
+		env: map[string]string{
+			"OTR_REDIS_URL":     "redis://yyy",
+			"OTR_MONGO_URL":     "mongodb://xxx",
+			"OTR_OTEL_ENDPOINT": "otel-collector:4318",
+		},
+		expectError: true,
+	},
+	"Invalid backpressure policy": {
+		env: map[string]string{
+			"OTR_REDIS_URL":    "redis://yyy",
+			"OTR_MONGO_URL":    "mongodb://xxx",
+			"OTR_BACKPRESSURE": "spill",
+		},
+		expectError: true,
+	},
+	"Negative resume log interval": {
+		env: map[string]string{
+			"OTR_REDIS_URL":           "redis://yyy",
+			"OTR_MONGO_URL":           "mongodb://xxx",
+			"OTR_RESUME_LOG_INTERVAL": "-1m",
+		},
+		expectError: true,
+	},
+	"Negative oplog batch size": {
+		env: map[string]string{
+			"OTR_REDIS_URL":        "redis://yyy",
+			"OTR_MONGO_URL":        "mongodb://xxx",
+			"OTR_OPLOG_BATCH_SIZE": "-1",
+		},
+		expectError: true,
+	},
+	"Negative oplog max await": {
+		env: map[string]string{
+			"OTR_REDIS_URL":          "redis://yyy",
+			"OTR_MONGO_URL":          "mongodb://xxx",
+			"OTR_OPLOG_MAX_AWAIT_MS": "-1",
+		},
+		expectError: true,
+	},
+	"Oplog max await longer than query timeout": {
+		env: map[string]string{
+			"OTR_REDIS_URL":           "redis://yyy",
+			"OTR_MONGO_URL":           "mongodb://xxx",
+			"OTR_MONGO_QUERY_TIMEOUT": "1s",
+			"OTR_OPLOG_MAX_AWAIT_MS":  "1000",
+		},
+		expectError: true,
+	},
+	"Negative max payload bytes": {
+		env: map[string]string{
+			"OTR_REDIS_URL":         "redis://yyy",
+			"OTR_MONGO_URL":         "mongodb://xxx",
+			"OTR_MAX_PAYLOAD_BYTES": "-1",
+		},
+		expectError: true,
+	},
+	"Invalid Mongo auth mechanism": {
+		env: map[string]string{
+			"OTR_REDIS_URL":            "redis://yyy",
+			"OTR_MONGO_URL":            "mongodb://xxx",
+			"OTR_MONGO_AUTH_MECHANISM": "KERBEROS",
+		},
+		expectError: true,
+	},
+	"Mongo TLS key without cert": {
+		env: map[string]string{
+			"OTR_REDIS_URL":          "redis://yyy",
+			"OTR_MONGO_URL":          "mongodb://xxx",
+			"OTR_MONGO_TLS_KEY_FILE": "/etc/ssl/mongo-client-key.pem",
+		},
+		expectError: true,
+	},
+	"Zero metric max collections": {
+		env: map[string]string{
+			"OTR_REDIS_URL":              "redis://yyy",
+			"OTR_MONGO_URL":              "mongodb://xxx",
+			"OTR_METRIC_MAX_COLLECTIONS": "0",
+		},
+		expectError: true,
+	},
+	"Admin seek with change streams": {
+		env: map[string]string{
+			"OTR_REDIS_URL":          "redis://yyy",
+			"OTR_MONGO_URL":          "mongodb://xxx",
+			"OTR_SOURCE_MODE":        "changestream",
+			"OTR_ADMIN_SEEK_ENABLED": "true",
+		},
+		expectError: true,
+	},
+	"Invalid operation filter operation": {
+		env: map[string]string{
+			"OTR_REDIS_URL":        "redis://yyy",
+			"OTR_MONGO_URL":        "mongodb://xxx",
+			"OTR_OPERATION_FILTER": "foo.bar=insert,upsert",
+		},
+		expectError: true,
+	},
+	"Invalid operation filter pattern": {
+		env: map[string]string{
+			"OTR_REDIS_URL":        "redis://yyy",
+			"OTR_MONGO_URL":        "mongodb://xxx",
+			"OTR_OPERATION_FILTER": "foo.[=insert",
+		},
+		expectError: true,
+	},
+	"Empty field filter field": {
+		env: map[string]string{
+			"OTR_REDIS_URL":    "redis://yyy",
+			"OTR_MONGO_URL":    "mongodb://xxx",
+			"OTR_FIELD_FILTER": "foo.users=name,,email",
+		},
+		expectError: true,
+	},
+	"Field filter without fields": {
+		env: map[string]string{
+			"OTR_REDIS_URL":    "redis://yyy",
+			"OTR_MONGO_URL":    "mongodb://xxx",
+			"OTR_FIELD_FILTER": "foo.users",
+		},
+		expectError: true,
+	},
+	"Negative distribution window": {
+		env: map[string]string{
+			"OTR_REDIS_URL":           "redis://yyy",
+			"OTR_MONGO_URL":           "mongodb://xxx",
+			"OTR_DISTRIBUTION_WINDOW": "-1m",
+		},
+		expectError: true,
+	},
+	"Zero max size report interval": {
+		env: map[string]string{
+			"OTR_REDIS_URL":                "redis://yyy",
+			"OTR_MONGO_URL":                "mongodb://xxx",
+			"OTR_MAX_SIZE_REPORT_INTERVAL": "0s",
+		},
+		expectError: true,
+	},
+	"Zero leader TTL": {
+		env: map[string]string{
+			"OTR_REDIS_URL":  "redis://yyy",
+			"OTR_MONGO_URL":  "mongodb://xxx",
+			"OTR_LEADER_KEY": "oplogtoredis::leader",
+			"OTR_LEADER_TTL": "0s",
+		},
+		expectError: true,
+	},
+	"Negative position lost warn count": {
+		env: map[string]string{
+			"OTR_REDIS_URL":                "redis://yyy",
+			"OTR_MONGO_URL":                "mongodb://xxx",
+			"OTR_POSITION_LOST_WARN_COUNT": "-1",
+		},
+		expectError: true,
+	},
+	"Invalid start position": {
+		env: map[string]string{
+			"OTR_REDIS_URL":      "redis://yyy",
+			"OTR_MONGO_URL":      "mongodb://xxx",
+			"OTR_START_POSITION": "middle",
+		},
+		expectError: true,
+	},
+	"Start from the beginning of a change stream": {
+		env: map[string]string{
+			"OTR_REDIS_URL":      "redis://yyy",
+			"OTR_MONGO_URL":      "mongodb://xxx",
+			"OTR_SOURCE_MODE":    "changestream",
+			"OTR_START_POSITION": "beginning",
+		},
+		expectError: true,
+	},
+	"Self-test collection without a database": {
+		env: map[string]string{
+			"OTR_REDIS_URL":            "redis://yyy",
+			"OTR_MONGO_URL":            "mongodb://xxx",
+			"OTR_SELF_TEST_COLLECTION": "selfTest",
+		},
+		expectError: true,
+	},
+	"Next timeout shorter than max await": {
+		env: map[string]string{
+			"OTR_REDIS_URL":          "redis://yyy",
+			"OTR_MONGO_URL":          "mongodb://xxx",
+			"OTR_OPLOG_MAX_AWAIT_MS": "10000",
+			"OTR_MONGO_NEXT_TIMEOUT": "5s",
+		},
+		expectError: true,
+	},
+	"Invalid payload compression": {
+		env: map[string]string{
+			"OTR_REDIS_URL":           "redis://yyy",
+			"OTR_MONGO_URL":           "mongodb://xxx",
+			"OTR_PAYLOAD_COMPRESSION": "brotli",
+		},
+		expectError: true,
+	},
+	"Invalid prefix overrides": {
+		env: map[string]string{
+			"OTR_REDIS_URL":        "redis://yyy",
+			"OTR_MONGO_URL":        "mongodb://xxx",
+			"OTR_PREFIX_OVERRIDES": "db1",
+		},
+		expectError: true,
+	},
+	"Negative server selection timeout": {
+		env: map[string]string{
+			"OTR_REDIS_URL":                      "redis://yyy",
+			"OTR_MONGO_URL":                      "mongodb://xxx",
+			"OTR_MONGO_SERVER_SELECTION_TIMEOUT": "-1s",
+		},
+		expectError: true,
+	},
+	"Negative output buffer size": {
+		env: map[string]string{
+			"OTR_REDIS_URL":          "redis://yyy",
+			"OTR_MONGO_URL":          "mongodb://xxx",
+			"OTR_OUTPUT_BUFFER_SIZE": "-1",
+		},
+		expectError: true,
+	},
+	"Namespace in databases": {
+		env: map[string]string{
+			"OTR_REDIS_URL": "redis://yyy",
+			"OTR_MONGO_URL": "mongodb://xxx",
+			"OTR_DATABASES": "app,analytics.events",
+		},
+		expectError: true,
+	},
+	"Negative max publish rate": {
+		env: map[string]string{
+			"OTR_REDIS_URL":        "redis://yyy",
+			"OTR_MONGO_URL":        "mongodb://xxx",
+			"OTR_MAX_PUBLISH_RATE": "-1",
+		},
+		expectError: true,
+	},
+	"Unknown payload key": {
+		env: map[string]string{
+			"OTR_REDIS_URL":    "redis://yyy",
+			"OTR_MONGO_URL":    "mongodb://xxx",
+			"OTR_PAYLOAD_KEYS": "x=y",
+		},
+		expectError: true,
+	},
+	"Duplicate payload key names": {
+		env: map[string]string{
+			"OTR_REDIS_URL":    "redis://yyy",
+			"OTR_MONGO_URL":    "mongodb://xxx",
+			"OTR_PAYLOAD_KEYS": "f=e",
+		},
+		expectError: true,
+	},
+	"Invalid oplog namespace filter": {
+		env: map[string]string{
+			"OTR_REDIS_URL":       "redis://yyy",
+			"OTR_MONGO_URL":       "mongodb://xxx",
+			"OTR_OPLOG_NS_FILTER": "^app(",
+		},
+		expectError: true,
+	},
+	"Negative Mongo pool size": {
+		env: map[string]string{
+			"OTR_REDIS_URL":           "redis://yyy",
+			"OTR_MONGO_URL":           "mongodb://xxx",
+			"OTR_MONGO_MAX_POOL_SIZE": "-1",
+		},
+		expectError: true,
+	},
+	"Negative Redis pool size": {
+		env: map[string]string{
+			"OTR_REDIS_URL":       "redis://yyy",
+			"OTR_MONGO_URL":       "mongodb://xxx",
+			"OTR_REDIS_POOL_SIZE": "-1",
+		},
+		expectError: true,
+	},
+	"Unknown run mode": {
+		env: map[string]string{
+			"OTR_REDIS_URL": "redis://yyy",
+			"OTR_MONGO_URL": "mongodb://xxx",
+			"OTR_RUN_MODE":  "twice",
+		},
+		expectError: true,
+	},
+	"Run once with change streams": {
+		env: map[string]string{
+			"OTR_REDIS_URL":   "redis://yyy",
+			"OTR_MONGO_URL":   "mongodb://xxx",
+			"OTR_RUN_MODE":    "once",
+			"OTR_SOURCE_MODE": "changestream",
+		},
+		expectError: true,
+	},
+	"Run once with leader election": {
+		env: map[string]string{
+			"OTR_REDIS_URL":  "redis://yyy",
+			"OTR_MONGO_URL":  "mongodb://xxx",
+			"OTR_RUN_MODE":   "once",
+			"OTR_LEADER_KEY": "otr-leader",
+		},
+		expectError: true,
+	},
+	"Negative startup jitter": {
+		env: map[string]string{
+			"OTR_REDIS_URL":      "redis://yyy",
+			"OTR_MONGO_URL":      "mongodb://xxx",
+			"OTR_STARTUP_JITTER": "-1s",
+		},
+		expectError: true,
+	},
+	"Heartbeat without a channel": {
+		env: map[string]string{
+			"OTR_REDIS_URL":          "redis://yyy",
+			"OTR_MONGO_URL":          "mongodb://xxx",
+			"OTR_HEARTBEAT_INTERVAL": "30s",
+			"OTR_HEARTBEAT_CHANNEL":  "",
+		},
+		expectError: true,
+	},
+	"Zero shutdown flush timeout": {
+		env: map[string]string{
+			"OTR_REDIS_URL":              "redis://yyy",
+			"OTR_MONGO_URL":              "mongodb://xxx",
+			"OTR_SHUTDOWN_FLUSH_TIMEOUT": "0s",
+		},
+		expectError: true,
+	},
+	"Negative catch-up rate": {
+		env: map[string]string{
+			"OTR_REDIS_URL":        "redis://yyy",
+			"OTR_MONGO_URL":        "mongodb://xxx",
+			"OTR_CATCHUP_MAX_RATE": "-1",
+		},
+		expectError: true,
+	},
+	"Zero catch-up lag threshold": {
+		env: map[string]string{
+			"OTR_REDIS_URL":             "redis://yyy",
+			"OTR_MONGO_URL":             "mongodb://xxx",
+			"OTR_CATCHUP_LAG_THRESHOLD": "0s",
+		},
+		expectError: true,
+	},
+	"Atomic transactions with dropping backpressure": {
+		env: map[string]string{
+			"OTR_REDIS_URL":          "redis://yyy",
+			"OTR_MONGO_URL":          "mongodb://xxx",
+			"OTR_TRANSACTION_ATOMIC": "true",
+			"OTR_BACKPRESSURE":       "drop",
+		},
+		expectError: true,
+	},
+	"Kafka without brokers": {
+		env: map[string]string{
+			"OTR_REDIS_URL":   "redis://yyy",
+			"OTR_MONGO_URL":   "mongodb://xxx",
+			"OTR_OUTPUT_MODE": "kafka",
+		},
+		expectError: true,
+	},
+	"Zero Kafka timeout": {
+		env: map[string]string{
+			"OTR_REDIS_URL":     "redis://yyy",
+			"OTR_MONGO_URL":     "mongodb://xxx",
+			"OTR_KAFKA_TIMEOUT": "0s",
+		},
+		expectError: true,
+	},
 	"Missing mongo URL": {
 		env: map[string]string{
 			"OTR_REDIS_URL": "redis://yyy",
@@ -116,9 +1033,9 @@ func checkConfigExpectation(t *testing.T, expectedConfig *oplogtoredisConfigurat
 			expectedConfig.MongoURL, MongoURL())
 	}
 
-	if expectedConfig.RedisURL != RedisURL() {
-		t.Errorf("Incorrect Redis URL. Got \"%s\", Expected \"%s\"",
-			expectedConfig.RedisURL, RedisURL())
+	if !reflect.DeepEqual(expectedConfig.RedisURL, RedisURL()) {
+		t.Errorf("Incorrect Redis URL. Got %#v, Expected %#v",
+			RedisURL(), expectedConfig.RedisURL)
 	}
 
 	if expectedConfig.HTTPServerAddr != HTTPServerAddr() {
@@ -155,4 +1072,505 @@ func checkConfigExpectation(t *testing.T, expectedConfig *oplogtoredisConfigurat
 		t.Errorf("Incorrect OplogV2ExtractSubfieldChanges. Got \"%t\", Expected \"%t\"",
 			expectedConfig.OplogV2ExtractSubfieldChanges, OplogV2ExtractSubfieldChanges())
 	}
+
+	if !reflect.DeepEqual(expectedConfig.Allowlist, Allowlist()) {
+		t.Errorf("Incorrect Allowlist. Got %#v, Expected %#v",
+			Allowlist(), expectedConfig.Allowlist)
+	}
+
+	if !reflect.DeepEqual(expectedConfig.Denylist, Denylist()) {
+		t.Errorf("Incorrect Denylist. Got %#v, Expected %#v",
+			Denylist(), expectedConfig.Denylist)
+	}
+
+	if !reflect.DeepEqual(expectedConfig.FullDocumentCollections, FullDocumentCollections()) {
+		t.Errorf("Incorrect FullDocumentCollections. Got %#v, Expected %#v",
+			FullDocumentCollections(), expectedConfig.FullDocumentCollections)
+	}
+
+	if !reflect.DeepEqual(expectedConfig.RedisSentinelAddrs, RedisSentinelAddrs()) {
+		t.Errorf("Incorrect RedisSentinelAddrs. Got %#v, Expected %#v",
+			RedisSentinelAddrs(), expectedConfig.RedisSentinelAddrs)
+	}
+
+	if expectedConfig.RedisSentinelMaster != RedisSentinelMaster() {
+		t.Errorf("Incorrect RedisSentinelMaster. Got \"%s\", Expected \"%s\"",
+			RedisSentinelMaster(), expectedConfig.RedisSentinelMaster)
+	}
+
+	if expectedConfig.RedisWriteMode != RedisWriteMode() {
+		t.Errorf("Incorrect RedisWriteMode. Got \"%s\", Expected \"%s\"",
+			RedisWriteMode(), expectedConfig.RedisWriteMode)
+	}
+
+	if expectedConfig.ChannelTemplate != ChannelTemplate() {
+		t.Errorf("Incorrect ChannelTemplate. Got \"%s\", Expected \"%s\"",
+			ChannelTemplate(), expectedConfig.ChannelTemplate)
+	}
+
+	if expectedConfig.OutputMode != OutputMode() {
+		t.Errorf("Incorrect OutputMode. Got \"%s\", Expected \"%s\"",
+			OutputMode(), expectedConfig.OutputMode)
+	}
+
+	if expectedConfig.StreamMaxlen != StreamMaxLen() {
+		t.Errorf("Incorrect StreamMaxLen. Got %d, Expected %d",
+			StreamMaxLen(), expectedConfig.StreamMaxlen)
+	}
+
+	if expectedConfig.RetryInitialDelay != RetryInitialDelay() {
+		t.Errorf("Incorrect RetryInitialDelay. Got %d, Expected %d",
+			RetryInitialDelay(), expectedConfig.RetryInitialDelay)
+	}
+
+	if expectedConfig.RetryMaxDelay != RetryMaxDelay() {
+		t.Errorf("Incorrect RetryMaxDelay. Got %d, Expected %d",
+			RetryMaxDelay(), expectedConfig.RetryMaxDelay)
+	}
+
+	if expectedConfig.SourceMode != SourceMode() {
+		t.Errorf("Incorrect SourceMode. Got %s, Expected %s",
+			SourceMode(), expectedConfig.SourceMode)
+	}
+
+	if expectedConfig.ChangeStreamFullDocument != ChangeStreamFullDocument() {
+		t.Errorf("Incorrect ChangeStreamFullDocument. Got %s, Expected %s",
+			ChangeStreamFullDocument(), expectedConfig.ChangeStreamFullDocument)
+	}
+
+	if expectedConfig.SlowPublishThreshold != SlowPublishThreshold() {
+		t.Errorf("Incorrect SlowPublishThreshold. Got %d, Expected %d",
+			SlowPublishThreshold(), expectedConfig.SlowPublishThreshold)
+	}
+
+	if expectedConfig.PublishBatchSize != PublishBatchSize() {
+		t.Errorf("Incorrect PublishBatchSize. Got %d, Expected %d",
+			PublishBatchSize(), expectedConfig.PublishBatchSize)
+	}
+
+	if expectedConfig.PublishBatchWindow != PublishBatchWindow() {
+		t.Errorf("Incorrect PublishBatchWindow. Got %d, Expected %d",
+			PublishBatchWindow(), expectedConfig.PublishBatchWindow)
+	}
+
+	if expectedConfig.ProcessorConcurrency != ProcessorConcurrency() {
+		t.Errorf("Incorrect ProcessorConcurrency. Got %d, Expected %d",
+			ProcessorConcurrency(), expectedConfig.ProcessorConcurrency)
+	}
+
+	if expectedConfig.OplogDatabase != OplogDatabase() {
+		t.Errorf("Incorrect OplogDatabase. Got %s, Expected %s",
+			OplogDatabase(), expectedConfig.OplogDatabase)
+	}
+
+	if expectedConfig.OplogCollection != OplogCollection() {
+		t.Errorf("Incorrect OplogCollection. Got %s, Expected %s",
+			OplogCollection(), expectedConfig.OplogCollection)
+	}
+
+	if expectedConfig.ShutdownTimeout != ShutdownTimeout() {
+		t.Errorf("Incorrect ShutdownTimeout. Got %d, Expected %d",
+			ShutdownTimeout(), expectedConfig.ShutdownTimeout)
+	}
+
+	if expectedConfig.MaxIdle != MaxIdle() {
+		t.Errorf("Incorrect MaxIdle. Got %d, Expected %d",
+			MaxIdle(), expectedConfig.MaxIdle)
+	}
+
+	if expectedConfig.DedupTTL != DedupTTL() {
+		t.Errorf("Incorrect DedupTTL. Got %d, Expected %d",
+			DedupTTL(), expectedConfig.DedupTTL)
+	}
+
+	if expectedConfig.RedisTLS != RedisTLS() {
+		t.Errorf("Incorrect RedisTLS. Got %t, Expected %t",
+			RedisTLS(), expectedConfig.RedisTLS)
+	}
+
+	if expectedConfig.RedisTLSCAFile != RedisTLSCAFile() {
+		t.Errorf("Incorrect RedisTLSCAFile. Got %s, Expected %s",
+			RedisTLSCAFile(), expectedConfig.RedisTLSCAFile)
+	}
+
+	if expectedConfig.RedisTLSCertFile != RedisTLSCertFile() {
+		t.Errorf("Incorrect RedisTLSCertFile. Got %s, Expected %s",
+			RedisTLSCertFile(), expectedConfig.RedisTLSCertFile)
+	}
+
+	if expectedConfig.RedisTLSKeyFile != RedisTLSKeyFile() {
+		t.Errorf("Incorrect RedisTLSKeyFile. Got %s, Expected %s",
+			RedisTLSKeyFile(), expectedConfig.RedisTLSKeyFile)
+	}
+
+	if expectedConfig.RedisTLSInsecureSkipVerify != RedisTLSInsecureSkipVerify() {
+		t.Errorf("Incorrect RedisTLSInsecureSkipVerify. Got %t, Expected %t",
+			RedisTLSInsecureSkipVerify(), expectedConfig.RedisTLSInsecureSkipVerify)
+	}
+
+	if expectedConfig.MongoReadPreference != MongoReadPreference() {
+		t.Errorf("Incorrect MongoReadPreference. Got %s, Expected %s",
+			MongoReadPreference(), expectedConfig.MongoReadPreference)
+	}
+
+	if len(expectedConfig.MaxCatchUpOverrides) != 0 || len(MaxCatchUpOverrides()) != 0 {
+		if !reflect.DeepEqual(map[string]time.Duration(expectedConfig.MaxCatchUpOverrides), MaxCatchUpOverrides()) {
+			t.Errorf("Incorrect MaxCatchUpOverrides. Got %#v, Expected %#v",
+				MaxCatchUpOverrides(), expectedConfig.MaxCatchUpOverrides)
+		}
+	}
+
+	if expectedConfig.PayloadFormat != PayloadFormat() {
+		t.Errorf("Incorrect PayloadFormat. Got %s, Expected %s",
+			PayloadFormat(), expectedConfig.PayloadFormat)
+	}
+
+	if expectedConfig.PublishDocumentChannels != PublishDocumentChannels() {
+		t.Errorf("Incorrect PublishDocumentChannels. Got %t, Expected %t",
+			PublishDocumentChannels(), expectedConfig.PublishDocumentChannels)
+	}
+
+	if expectedConfig.OtelEndpoint != OtelEndpoint() {
+		t.Errorf("Incorrect OtelEndpoint. Got %s, Expected %s",
+			OtelEndpoint(), expectedConfig.OtelEndpoint)
+	}
+
+	if expectedConfig.Backpressure != Backpressure() {
+		t.Errorf("Incorrect Backpressure. Got %s, Expected %s",
+			Backpressure(), expectedConfig.Backpressure)
+	}
+
+	if expectedConfig.ResumeLogInterval != ResumeLogInterval() {
+		t.Errorf("Incorrect ResumeLogInterval. Got %s, Expected %s",
+			ResumeLogInterval(), expectedConfig.ResumeLogInterval)
+	}
+
+	if expectedConfig.OplogBatchSize != OplogBatchSize() {
+		t.Errorf("Incorrect OplogBatchSize. Got %d, Expected %d",
+			OplogBatchSize(), expectedConfig.OplogBatchSize)
+	}
+
+	if time.Duration(expectedConfig.OplogMaxAwaitMS)*time.Millisecond != OplogMaxAwait() {
+		t.Errorf("Incorrect OplogMaxAwait. Got %s, Expected %dms",
+			OplogMaxAwait(), expectedConfig.OplogMaxAwaitMS)
+	}
+
+	if expectedConfig.DeadLetterKey != DeadLetterKey() {
+		t.Errorf("Incorrect DeadLetterKey. Got %s, Expected %s",
+			DeadLetterKey(), expectedConfig.DeadLetterKey)
+	}
+
+	if expectedConfig.MaxPayloadBytes != MaxPayloadBytes() {
+		t.Errorf("Incorrect MaxPayloadBytes. Got %d, Expected %d",
+			MaxPayloadBytes(), expectedConfig.MaxPayloadBytes)
+	}
+
+	if !reflect.DeepEqual(expectedConfig.NamespaceMap, NamespaceMap()) {
+		t.Errorf("Incorrect NamespaceMap. Got %#v, Expected %#v",
+			NamespaceMap(), expectedConfig.NamespaceMap)
+	}
+
+	if expectedConfig.MongoAuthMechanism != MongoAuthMechanism() {
+		t.Errorf("Incorrect MongoAuthMechanism. Got %s, Expected %s",
+			MongoAuthMechanism(), expectedConfig.MongoAuthMechanism)
+	}
+
+	if expectedConfig.MongoTLSCAFile != MongoTLSCAFile() {
+		t.Errorf("Incorrect MongoTLSCAFile. Got %s, Expected %s",
+			MongoTLSCAFile(), expectedConfig.MongoTLSCAFile)
+	}
+
+	if expectedConfig.MongoTLSCertFile != MongoTLSCertFile() {
+		t.Errorf("Incorrect MongoTLSCertFile. Got %s, Expected %s",
+			MongoTLSCertFile(), expectedConfig.MongoTLSCertFile)
+	}
+
+	if expectedConfig.MongoTLSKeyFile != MongoTLSKeyFile() {
+		t.Errorf("Incorrect MongoTLSKeyFile. Got %s, Expected %s",
+			MongoTLSKeyFile(), expectedConfig.MongoTLSKeyFile)
+	}
+
+	if expectedConfig.MongoAppName != MongoAppName() {
+		t.Errorf("Incorrect MongoAppName. Got %s, Expected %s",
+			MongoAppName(), expectedConfig.MongoAppName)
+	}
+
+	if expectedConfig.TransactionAtomic != TransactionAtomic() {
+		t.Errorf("Incorrect TransactionAtomic. Got %t, Expected %t",
+			TransactionAtomic(), expectedConfig.TransactionAtomic)
+	}
+
+	if expectedConfig.MetricCollectionLabel != MetricCollectionLabel() {
+		t.Errorf("Incorrect MetricCollectionLabel. Got %t, Expected %t",
+			MetricCollectionLabel(), expectedConfig.MetricCollectionLabel)
+	}
+
+	if expectedConfig.MetricMaxCollections != MetricMaxCollections() {
+		t.Errorf("Incorrect MetricMaxCollections. Got %d, Expected %d",
+			MetricMaxCollections(), expectedConfig.MetricMaxCollections)
+	}
+
+	if expectedConfig.AdminSeekEnabled != AdminSeekEnabled() {
+		t.Errorf("Incorrect AdminSeekEnabled. Got %t, Expected %t",
+			AdminSeekEnabled(), expectedConfig.AdminSeekEnabled)
+	}
+
+	if len(expectedConfig.OperationFilter) != 0 || len(OperationFilter()) != 0 {
+		if !reflect.DeepEqual(map[string][]string(expectedConfig.OperationFilter), OperationFilter()) {
+			t.Errorf("Incorrect OperationFilter. Got %#v, Expected %#v",
+				OperationFilter(), expectedConfig.OperationFilter)
+		}
+	}
+
+	if len(expectedConfig.FieldFilter) != 0 || len(FieldFilter()) != 0 {
+		if !reflect.DeepEqual(map[string][]string(expectedConfig.FieldFilter), FieldFilter()) {
+			t.Errorf("Incorrect FieldFilter. Got %#v, Expected %#v",
+				FieldFilter(), expectedConfig.FieldFilter)
+		}
+	}
+
+	if expectedConfig.IncludeTimestamp != IncludeTimestamp() {
+		t.Errorf("Incorrect IncludeTimestamp. Got %t, Expected %t",
+			IncludeTimestamp(), expectedConfig.IncludeTimestamp)
+	}
+
+	if expectedConfig.DryRun != DryRun() {
+		t.Errorf("Incorrect DryRun. Got %t, Expected %t",
+			DryRun(), expectedConfig.DryRun)
+	}
+
+	if expectedConfig.DistributionWindow != DistributionWindow() {
+		t.Errorf("Incorrect DistributionWindow. Got %s, Expected %s",
+			DistributionWindow(), expectedConfig.DistributionWindow)
+	}
+
+	if expectedConfig.MaxSizeReportInterval != MaxSizeReportInterval() {
+		t.Errorf("Incorrect MaxSizeReportInterval. Got %s, Expected %s",
+			MaxSizeReportInterval(), expectedConfig.MaxSizeReportInterval)
+	}
+
+	if expectedConfig.LeaderKey != LeaderKey() {
+		t.Errorf("Incorrect LeaderKey. Got %s, Expected %s",
+			LeaderKey(), expectedConfig.LeaderKey)
+	}
+
+	if expectedConfig.LeaderTTL != LeaderTTL() {
+		t.Errorf("Incorrect LeaderTTL. Got %s, Expected %s",
+			LeaderTTL(), expectedConfig.LeaderTTL)
+	}
+
+	if expectedConfig.PositionLostWarnCount != PositionLostWarnCount() {
+		t.Errorf("Incorrect PositionLostWarnCount. Got %d, Expected %d",
+			PositionLostWarnCount(), expectedConfig.PositionLostWarnCount)
+	}
+
+	if expectedConfig.PositionLostWarnWindow != PositionLostWarnWindow() {
+		t.Errorf("Incorrect PositionLostWarnWindow. Got %s, Expected %s",
+			PositionLostWarnWindow(), expectedConfig.PositionLostWarnWindow)
+	}
+
+	if expectedConfig.StartPosition != StartPosition() {
+		t.Errorf("Incorrect StartPosition. Got %s, Expected %s",
+			StartPosition(), expectedConfig.StartPosition)
+	}
+
+	if expectedConfig.StartupPingChannel != StartupPingChannel() {
+		t.Errorf("Incorrect StartupPingChannel. Got %s, Expected %s",
+			StartupPingChannel(), expectedConfig.StartupPingChannel)
+	}
+
+	if expectedConfig.SelfTestCollection != SelfTestCollection() {
+		t.Errorf("Incorrect SelfTestCollection. Got %s, Expected %s",
+			SelfTestCollection(), expectedConfig.SelfTestCollection)
+	}
+
+	if expectedConfig.SelfTestTimeout != SelfTestTimeout() {
+		t.Errorf("Incorrect SelfTestTimeout. Got %s, Expected %s",
+			SelfTestTimeout(), expectedConfig.SelfTestTimeout)
+	}
+
+	expectedFindTimeout := expectedConfig.MongoFindTimeout
+	if expectedFindTimeout == 0 {
+		expectedFindTimeout = MongoQueryTimeout()
+	}
+	if expectedFindTimeout != MongoFindTimeout() {
+		t.Errorf("Incorrect MongoFindTimeout. Got %s, Expected %s",
+			MongoFindTimeout(), expectedFindTimeout)
+	}
+
+	expectedNextTimeout := expectedConfig.MongoNextTimeout
+	if expectedNextTimeout == 0 {
+		expectedNextTimeout = MongoQueryTimeout()
+	}
+	if expectedNextTimeout != MongoNextTimeout() {
+		t.Errorf("Incorrect MongoNextTimeout. Got %s, Expected %s",
+			MongoNextTimeout(), expectedNextTimeout)
+	}
+
+	expectedCloseTimeout := expectedConfig.MongoCloseTimeout
+	if expectedCloseTimeout == 0 {
+		expectedCloseTimeout = MongoQueryTimeout()
+	}
+	if expectedCloseTimeout != MongoCloseTimeout() {
+		t.Errorf("Incorrect MongoCloseTimeout. Got %s, Expected %s",
+			MongoCloseTimeout(), expectedCloseTimeout)
+	}
+
+	if expectedConfig.PayloadCompression != PayloadCompression() {
+		t.Errorf("Incorrect PayloadCompression. Got %q, Expected %q",
+			PayloadCompression(), expectedConfig.PayloadCompression)
+	}
+
+	if expectedConfig.PayloadCompressionThreshold != PayloadCompressionThreshold() {
+		t.Errorf("Incorrect PayloadCompressionThreshold. Got %d, Expected %d",
+			PayloadCompressionThreshold(), expectedConfig.PayloadCompressionThreshold)
+	}
+
+	if len(expectedConfig.PrefixOverrides) != 0 || len(PrefixOverrides()) != 0 {
+		if !reflect.DeepEqual(map[string]string(expectedConfig.PrefixOverrides), PrefixOverrides()) {
+			t.Errorf("Incorrect PrefixOverrides. Got %#v, Expected %#v",
+				PrefixOverrides(), expectedConfig.PrefixOverrides)
+		}
+	}
+
+	if expectedConfig.RedisUsername != RedisUsername() {
+		t.Errorf("Incorrect RedisUsername. Got %q, Expected %q",
+			RedisUsername(), expectedConfig.RedisUsername)
+	}
+
+	if expectedConfig.RedisPassword != RedisPassword() {
+		t.Errorf("Incorrect RedisPassword. Got %q, Expected %q",
+			RedisPassword(), expectedConfig.RedisPassword)
+	}
+
+	if expectedConfig.MongoServerSelectionTimeout != MongoServerSelectionTimeout() {
+		t.Errorf("Incorrect MongoServerSelectionTimeout. Got %s, Expected %s",
+			MongoServerSelectionTimeout(), expectedConfig.MongoServerSelectionTimeout)
+	}
+
+	if expectedConfig.IncludeSystemNamespaces != IncludeSystemNamespaces() {
+		t.Errorf("Incorrect IncludeSystemNamespaces. Got %t, Expected %t",
+			IncludeSystemNamespaces(), expectedConfig.IncludeSystemNamespaces)
+	}
+
+	expectedOutputBufferSize := expectedConfig.OutputBufferSize
+	if expectedOutputBufferSize == 0 {
+		expectedOutputBufferSize = BufferSize()
+	}
+	if expectedOutputBufferSize != OutputBufferSize() {
+		t.Errorf("Incorrect OutputBufferSize. Got %d, Expected %d",
+			OutputBufferSize(), expectedOutputBufferSize)
+	}
+
+	if !reflect.DeepEqual(expectedConfig.Databases, Databases()) {
+		t.Errorf("Incorrect Databases. Got %#v, Expected %#v",
+			Databases(), expectedConfig.Databases)
+	}
+
+	if expectedConfig.MaxPublishRate != MaxPublishRate() {
+		t.Errorf("Incorrect MaxPublishRate. Got %d, Expected %d",
+			MaxPublishRate(), expectedConfig.MaxPublishRate)
+	}
+
+	if len(expectedConfig.PayloadKeys) != 0 || len(PayloadKeys()) != 0 {
+		if !reflect.DeepEqual(map[string]string(expectedConfig.PayloadKeys), PayloadKeys()) {
+			t.Errorf("Incorrect PayloadKeys. Got %#v, Expected %#v",
+				PayloadKeys(), expectedConfig.PayloadKeys)
+		}
+	}
+
+	if expectedConfig.OplogNsFilter != OplogNsFilter() {
+		t.Errorf("Incorrect OplogNsFilter. Got %q, Expected %q",
+			OplogNsFilter(), expectedConfig.OplogNsFilter)
+	}
+
+	if expectedConfig.MongoMaxPoolSize != MongoMaxPoolSize() {
+		t.Errorf("Incorrect MongoMaxPoolSize. Got %d, Expected %d",
+			MongoMaxPoolSize(), expectedConfig.MongoMaxPoolSize)
+	}
+
+	if expectedConfig.RedisPoolSize != RedisPoolSize() {
+		t.Errorf("Incorrect RedisPoolSize. Got %d, Expected %d",
+			RedisPoolSize(), expectedConfig.RedisPoolSize)
+	}
+
+	if expectedConfig.RunMode != RunMode() {
+		t.Errorf("Incorrect RunMode. Got %q, Expected %q",
+			RunMode(), expectedConfig.RunMode)
+	}
+
+	if expectedConfig.ResumeKeyPersist != ResumeKeyPersist() {
+		t.Errorf("Incorrect ResumeKeyPersist. Got %t, Expected %t",
+			ResumeKeyPersist(), expectedConfig.ResumeKeyPersist)
+	}
+
+	if expectedConfig.StartupJitter != StartupJitter() {
+		t.Errorf("Incorrect StartupJitter. Got %s, Expected %s",
+			StartupJitter(), expectedConfig.StartupJitter)
+	}
+
+	if expectedConfig.RedisStartupRetry != RedisStartupRetry() {
+		t.Errorf("Incorrect RedisStartupRetry. Got %s, Expected %s",
+			RedisStartupRetry(), expectedConfig.RedisStartupRetry)
+	}
+
+	if expectedConfig.MongoStartupRetry != MongoStartupRetry() {
+		t.Errorf("Incorrect MongoStartupRetry. Got %s, Expected %s",
+			MongoStartupRetry(), expectedConfig.MongoStartupRetry)
+	}
+
+	if expectedConfig.IncludeOperation != IncludeOperation() {
+		t.Errorf("Incorrect IncludeOperation. Got %t, Expected %t",
+			IncludeOperation(), expectedConfig.IncludeOperation)
+	}
+
+	if expectedConfig.HeartbeatInterval != HeartbeatInterval() {
+		t.Errorf("Incorrect HeartbeatInterval. Got %s, Expected %s",
+			HeartbeatInterval(), expectedConfig.HeartbeatInterval)
+	}
+
+	if expectedConfig.HeartbeatChannel != HeartbeatChannel() {
+		t.Errorf("Incorrect HeartbeatChannel. Got %q, Expected %q",
+			HeartbeatChannel(), expectedConfig.HeartbeatChannel)
+	}
+
+	if expectedConfig.ShutdownFlushTimeout != ShutdownFlushTimeout() {
+		t.Errorf("Incorrect ShutdownFlushTimeout. Got %s, Expected %s",
+			ShutdownFlushTimeout(), expectedConfig.ShutdownFlushTimeout)
+	}
+
+	if expectedConfig.CatchUpMaxRate != CatchUpMaxRate() {
+		t.Errorf("Incorrect CatchUpMaxRate. Got %d, Expected %d",
+			CatchUpMaxRate(), expectedConfig.CatchUpMaxRate)
+	}
+
+	if expectedConfig.CatchUpLagThreshold != CatchUpLagThreshold() {
+		t.Errorf("Incorrect CatchUpLagThreshold. Got %s, Expected %s",
+			CatchUpLagThreshold(), expectedConfig.CatchUpLagThreshold)
+	}
+
+	if expectedConfig.DisableDeprecatedMetrics != DisableDeprecatedMetrics() {
+		t.Errorf("Incorrect DisableDeprecatedMetrics. Got %t, Expected %t",
+			DisableDeprecatedMetrics(), expectedConfig.DisableDeprecatedMetrics)
+	}
+
+	if expectedConfig.StreamDocumentStreams != StreamDocumentStreams() {
+		t.Errorf("Incorrect StreamDocumentStreams. Got %t, Expected %t",
+			StreamDocumentStreams(), expectedConfig.StreamDocumentStreams)
+	}
+
+	if !reflect.DeepEqual(expectedConfig.KafkaBrokers, KafkaBrokers()) {
+		t.Errorf("Incorrect KafkaBrokers. Got %#v, Expected %#v",
+			KafkaBrokers(), expectedConfig.KafkaBrokers)
+	}
+
+	if expectedConfig.KafkaTopicTemplate != KafkaTopicTemplate() {
+		t.Errorf("Incorrect KafkaTopicTemplate. Got \"%s\", Expected \"%s\"",
+			KafkaTopicTemplate(), expectedConfig.KafkaTopicTemplate)
+	}
+
+	if expectedConfig.KafkaTimeout != KafkaTimeout() {
+		t.Errorf("Incorrect KafkaTimeout. Got %d, Expected %d",
+			KafkaTimeout(), expectedConfig.KafkaTimeout)
+	}
 }
@@ -0,0 +1,81 @@
+package config
+
+import (
+	"net/url"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// What secrets are replaced with in Redacted
+const redactedValue = "redacted"
+
+// Redacted returns the current configuration, keyed by the name of each
+// option (e.g. "MongoURL" for MongoURL), for showing which configuration a
+// running instance has. Passwords are replaced with "redacted", including
+// ones in the Mongo, Redis, and OpenTelemetry URLs, and durations are
+// formatted as strings (e.g. "1m30s").
+func Redacted() map[string]interface{} {
+	result := map[string]interface{}{}
+
+	value := reflect.ValueOf(*globalConfig)
+	for i := 0; i < value.NumField(); i++ {
+		switch field := value.Field(i).Interface().(type) {
+		case time.Duration:
+			result[value.Type().Field(i).Name] = field.String()
+		case durationMap:
+			durations := make(map[string]string, len(field))
+			for name, duration := range field {
+				durations[name] = duration.String()
+			}
+			result[value.Type().Field(i).Name] = durations
+		default:
+			result[value.Type().Field(i).Name] = field
+		}
+	}
+
+	redisURLs := make([]string, len(globalConfig.RedisURL))
+	for i, redisURL := range globalConfig.RedisURL {
+		redisURLs[i] = redactURL(redisURL)
+	}
+	result["RedisURL"] = redisURLs
+	result["MongoURL"] = redactURL(globalConfig.MongoURL)
+	result["OtelEndpoint"] = redactURL(globalConfig.OtelEndpoint)
+
+	if globalConfig.RedisPassword != "" {
+		result["RedisPassword"] = redactedValue
+	}
+
+	return result
+}
+
+// Replaces the password in a URL, and the values of any query parameters
+// that can hold secrets (such as tlsCertificateKeyFilePassword, or the AWS
+// session token in authMechanismProperties). If the URL can't be parsed,
+// the whole thing is redacted.
+func redactURL(rawURL string) string {
+	if rawURL == "" {
+		return ""
+	}
+
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return redactedValue
+	}
+
+	if _, ok := parsed.User.Password(); ok {
+		parsed.User = url.UserPassword(parsed.User.Username(), redactedValue)
+	}
+
+	query := parsed.Query()
+	for key := range query {
+		lowerKey := strings.ToLower(key)
+		if strings.Contains(lowerKey, "password") || strings.Contains(lowerKey, "secret") ||
+			strings.Contains(lowerKey, "token") || lowerKey == "authmechanismproperties" {
+			query.Set(key, redactedValue)
+		}
+	}
+	parsed.RawQuery = query.Encode()
+
+	return parsed.String()
+}
@@ -0,0 +1,383 @@
+// Package kafka is a minimal Kafka producer. It implements just enough of
+// the Kafka protocol (Metadata and Produce requests, with v2 record batches)
+// to send messages to the leaders of a topic's partitions, so we don't need
+// a Kafka client library. It doesn't support TLS, SASL, compression, or
+// idempotent or transactional producing, and needs Kafka 0.11 or newer.
+package kafka
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The protocol versions we use. Metadata v4 and Produce v3 are the oldest
+// versions that every broker from 0.11 to 4.x supports.
+const (
+	apiKeyProduce  = 0
+	apiKeyMetadata = 3
+
+	produceVersion  = 3
+	metadataVersion = 4
+)
+
+const clientID = "oplogtoredis"
+
+// Message is a single message to produce
+type Message struct {
+	Topic string
+
+	// Key picks the partition, using the same hash as the Java client, so
+	// that messages with the same key are kept in order. A nil key picks the
+	// partitions in turn.
+	Key   []byte
+	Value []byte
+}
+
+// Producer sends messages to a Kafka cluster. It's safe for concurrent use,
+// but sends one request at a time.
+type Producer struct {
+	brokers []string
+	timeout time.Duration
+
+	lock          sync.Mutex
+	conns         map[string]*conn
+	leaders       map[string][]string // Topic => address of each partition's leader
+	correlationID int32
+	nextPartition int
+}
+
+// NewProducer returns a Producer for the cluster with the given bootstrap
+// brokers ("host:port"). timeout limits each request, and is also how long
+// the brokers may wait for the messages to be replicated. No connections
+// are made until the first call to Produce.
+func NewProducer(brokers []string, timeout time.Duration) *Producer {
+	return &Producer{
+		brokers: brokers,
+		timeout: timeout,
+		conns:   map[string]*conn{},
+		leaders: map[string][]string{},
+	}
+}
+
+// Produce sends the messages, and waits for every in-sync replica to
+// acknowledge them (acks=all). Messages with the same topic and partition
+// are written in order.
+//
+// If it returns an error, some of the messages may have been written
+// anyway, so retrying can produce duplicates. The cached metadata is
+// dropped after an error, so a retry finds the current partition leaders.
+func (p *Producer) Produce(messages []Message) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	err := p.produce(messages)
+	if err != nil {
+		p.reset()
+	}
+
+	return err
+}
+
+// Close closes the connections to the brokers
+func (p *Producer) Close() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.reset()
+	return nil
+}
+
+// Drops the cached metadata and connections
+func (p *Producer) reset() {
+	for _, c := range p.conns {
+		c.Close()
+	}
+	p.conns = map[string]*conn{}
+	p.leaders = map[string][]string{}
+}
+
+func (p *Producer) produce(messages []Message) error {
+	var missing []string
+	for _, m := range messages {
+		if _, ok := p.leaders[m.Topic]; !ok {
+			missing = append(missing, m.Topic)
+			p.leaders[m.Topic] = nil
+		}
+	}
+
+	if len(missing) > 0 {
+		if err := p.fetchMetadata(missing); err != nil {
+			return err
+		}
+	}
+
+	// Group the messages by leader, topic, and partition, keeping them in
+	// order within each partition
+	requests := map[string]*produceRequest{}
+	var addrs []string
+	for _, m := range messages {
+		leaders := p.leaders[m.Topic]
+		partition := p.partition(m.Key, len(leaders))
+		addr := leaders[partition]
+
+		req := requests[addr]
+		if req == nil {
+			req = &produceRequest{}
+			requests[addr] = req
+			addrs = append(addrs, addr)
+		}
+		req.add(m, int32(partition))
+	}
+
+	for _, addr := range addrs {
+		if err := p.sendProduce(addr, requests[addr]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Picks the partition for a message with the given key
+func (p *Producer) partition(key []byte, partitions int) int {
+	if key == nil {
+		p.nextPartition++
+		return p.nextPartition % partitions
+	}
+
+	return int(murmur2(key)&0x7fffffff) % partitions
+}
+
+// Fetches the partition leaders of the given topics from the first
+// bootstrap broker that responds
+func (p *Producer) fetchMetadata(topics []string) error {
+	var req encoder
+	req.int32(int32(len(topics)))
+	for _, topic := range topics {
+		req.string(topic)
+	}
+	req.int8(1) // allow_auto_topic_creation
+
+	var lastErr error
+	for _, addr := range p.brokers {
+		resp, err := p.roundTrip(addr, apiKeyMetadata, metadataVersion, req.bytes())
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		leaders, err := decodeMetadata(resp)
+		if err != nil {
+			return errors.Wrapf(err, "reading metadata from Kafka broker %s", addr)
+		}
+
+		for _, topic := range topics {
+			if len(leaders[topic]) == 0 {
+				return errors.Errorf("Kafka broker %s returned no partitions for topic %q", addr, topic)
+			}
+			p.leaders[topic] = leaders[topic]
+		}
+
+		return nil
+	}
+
+	return errors.Wrap(lastErr, "fetching metadata from Kafka")
+}
+
+// Parses a Metadata response into the address of the leader of each
+// partition of each topic. Returns an error if any topic or partition has
+// an error, or no leader (e.g. while it's being created or during an
+// election).
+func decodeMetadata(resp []byte) (map[string][]string, error) {
+	d := decoder{buf: resp}
+	d.int32() // throttle_time_ms
+
+	addrs := map[int32]string{}
+	for i := d.arrayLen(); i > 0 && d.err == nil; i-- {
+		nodeID := d.int32()
+		host := d.string()
+		port := d.int32()
+		d.nullableString() // rack
+		addrs[nodeID] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+
+	d.nullableString() // cluster_id
+	d.int32()          // controller_id
+
+	leaders := map[string][]string{}
+	for i := d.arrayLen(); i > 0 && d.err == nil; i-- {
+		topicErr := d.int16()
+		topic := d.string()
+		d.int8() // is_internal
+		if topicErr != 0 {
+			return nil, errors.Wrapf(kafkaError(topicErr), "topic %q", topic)
+		}
+
+		for j := d.arrayLen(); j > 0 && d.err == nil; j-- {
+			partitionErr := d.int16()
+			partition := d.int32()
+			leader := d.int32()
+			d.int32Array() // replica_nodes
+			d.int32Array() // isr_nodes
+
+			addr, ok := addrs[leader]
+			if partitionErr != 0 && partitionErr != errReplicaNotAvailable {
+				return nil, errors.Wrapf(kafkaError(partitionErr), "topic %q partition %d", topic, partition)
+			} else if !ok {
+				return nil, errors.Errorf("topic %q partition %d has no leader", topic, partition)
+			}
+
+			for int(partition) >= len(leaders[topic]) {
+				leaders[topic] = append(leaders[topic], "")
+			}
+			leaders[topic][partition] = addr
+		}
+	}
+
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	for topic, topicLeaders := range leaders {
+		for partition, addr := range topicLeaders {
+			if addr == "" {
+				return nil, errors.Errorf("topic %q partition %d is missing from the metadata", topic, partition)
+			}
+		}
+	}
+
+	return leaders, nil
+}
+
+// produceRequest collects the messages for a single broker, by topic and
+// partition
+type produceRequest struct {
+	topics     []string
+	partitions map[string][]int32
+	messages   map[string]map[int32][]Message
+}
+
+func (req *produceRequest) add(m Message, partition int32) {
+	if req.messages == nil {
+		req.partitions = map[string][]int32{}
+		req.messages = map[string]map[int32][]Message{}
+	}
+
+	if req.messages[m.Topic] == nil {
+		req.topics = append(req.topics, m.Topic)
+		req.messages[m.Topic] = map[int32][]Message{}
+	}
+
+	if req.messages[m.Topic][partition] == nil {
+		req.partitions[m.Topic] = append(req.partitions[m.Topic], partition)
+	}
+
+	req.messages[m.Topic][partition] = append(req.messages[m.Topic][partition], m)
+}
+
+func (p *Producer) sendProduce(addr string, req *produceRequest) error {
+	now := time.Now()
+
+	var e encoder
+	e.int16(-1) // transactional_id
+	e.int16(-1) // acks=all
+	e.int32(int32(p.timeout / time.Millisecond))
+	e.int32(int32(len(req.topics)))
+	for _, topic := range req.topics {
+		e.string(topic)
+		e.int32(int32(len(req.partitions[topic])))
+		for _, partition := range req.partitions[topic] {
+			e.int32(partition)
+			e.bytesWithLength(encodeRecordBatch(req.messages[topic][partition], now))
+		}
+	}
+
+	resp, err := p.roundTrip(addr, apiKeyProduce, produceVersion, e.bytes())
+	if err != nil {
+		return err
+	}
+
+	d := decoder{buf: resp}
+	for i := d.arrayLen(); i > 0 && d.err == nil; i-- {
+		topic := d.string()
+		for j := d.arrayLen(); j > 0 && d.err == nil; j-- {
+			partition := d.int32()
+			code := d.int16()
+			d.int64() // base_offset
+			d.int64() // log_append_time_ms
+			if code != 0 && d.err == nil {
+				return errors.Wrapf(kafkaError(code), "producing to topic %q partition %d on Kafka broker %s", topic, partition, addr)
+			}
+		}
+	}
+
+	return errors.Wrapf(d.err, "reading produce response from Kafka broker %s", addr)
+}
+
+// Sends a request to the broker at addr (connecting if necessary), and
+// returns the body of the response. Any error closes the connection.
+func (p *Producer) roundTrip(addr string, apiKey int16, apiVersion int16, body []byte) ([]byte, error) {
+	c := p.conns[addr]
+	if c == nil {
+		netConn, err := net.DialTimeout("tcp", addr, p.timeout)
+		if err != nil {
+			return nil, errors.Wrapf(err, "connecting to Kafka broker %s", addr)
+		}
+
+		c = &conn{Conn: netConn}
+		p.conns[addr] = c
+	}
+
+	p.correlationID++
+	resp, err := c.roundTrip(apiKey, apiVersion, p.correlationID, body, p.timeout)
+	if err != nil {
+		c.Close()
+		delete(p.conns, addr)
+		return nil, errors.Wrapf(err, "sending request to Kafka broker %s", addr)
+	}
+
+	return resp, nil
+}
+
+// Error codes from the Kafka protocol that we refer to, or describe in
+// errors
+const (
+	errUnknownTopicOrPartition = 3
+	errLeaderNotAvailable      = 5
+	errNotLeaderForPartition   = 6
+	errRequestTimedOut         = 7
+	errReplicaNotAvailable     = 9
+	errMessageTooLarge         = 10
+	errInvalidTopic            = 17
+	errRecordListTooLarge      = 18
+	errNotEnoughReplicas       = 19
+	errTopicAuthorization      = 29
+)
+
+var errorNames = map[int16]string{
+	errUnknownTopicOrPartition: "UNKNOWN_TOPIC_OR_PARTITION",
+	errLeaderNotAvailable:      "LEADER_NOT_AVAILABLE",
+	errNotLeaderForPartition:   "NOT_LEADER_OR_FOLLOWER",
+	errRequestTimedOut:         "REQUEST_TIMED_OUT",
+	errReplicaNotAvailable:     "REPLICA_NOT_AVAILABLE",
+	errMessageTooLarge:         "MESSAGE_TOO_LARGE",
+	errInvalidTopic:            "INVALID_TOPIC_EXCEPTION",
+	errRecordListTooLarge:      "RECORD_LIST_TOO_LARGE",
+	errNotEnoughReplicas:       "NOT_ENOUGH_REPLICAS",
+	errTopicAuthorization:      "TOPIC_AUTHORIZATION_FAILED",
+}
+
+// kafkaError is an error code returned by a broker
+type kafkaError int16
+
+func (code kafkaError) Error() string {
+	if name, ok := errorNames[int16(code)]; ok {
+		return fmt.Sprintf("Kafka error %s (%d)", name, int16(code))
+	}
+	return fmt.Sprintf("Kafka error %d", int16(code))
+}
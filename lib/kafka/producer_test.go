@@ -0,0 +1,421 @@
+package kafka
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeBroker is a single-node Kafka cluster that answers Metadata and
+// Produce requests, and records the messages produced to it
+type fakeBroker struct {
+	t        *testing.T
+	listener net.Listener
+
+	lock sync.Mutex
+
+	// Configuration: the number of partitions of every topic, the error
+	// code to return for the topics in the metadata, and the error codes to
+	// return for the next produce requests
+	partitions    int
+	topicErrors   map[string]int16
+	produceErrors []int16
+
+	// Results: the number of metadata requests, and the messages produced
+	// to each topic and partition
+	metadataRequests int
+	produced         map[string]map[int32][]Message
+}
+
+func newFakeBroker(t *testing.T, partitions int) *fakeBroker {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %s", err)
+	}
+
+	broker := &fakeBroker{
+		t:           t,
+		listener:    listener,
+		partitions:  partitions,
+		topicErrors: map[string]int16{},
+		produced:    map[string]map[int32][]Message{},
+	}
+
+	go func() {
+		for {
+			c, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go broker.serve(c)
+		}
+	}()
+
+	t.Cleanup(func() { listener.Close() })
+	return broker
+}
+
+func (broker *fakeBroker) addr() string {
+	return broker.listener.Addr().String()
+}
+
+func (broker *fakeBroker) serve(c net.Conn) {
+	defer c.Close()
+
+	for {
+		var size [4]byte
+		if _, err := io.ReadFull(c, size[:]); err != nil {
+			return
+		}
+
+		req := make([]byte, binary.BigEndian.Uint32(size[:]))
+		if _, err := io.ReadFull(c, req); err != nil {
+			return
+		}
+
+		d := decoder{buf: req}
+		apiKey := d.int16()
+		apiVersion := d.int16()
+		correlationID := d.int32()
+		if client := d.string(); client != clientID {
+			broker.t.Errorf("Expected client ID %q, got %q", clientID, client)
+		}
+
+		var resp encoder
+		resp.int32(0) // Size, filled in below
+		resp.int32(correlationID)
+
+		switch {
+		case apiKey == apiKeyMetadata && apiVersion == metadataVersion:
+			broker.metadata(&d, &resp)
+		case apiKey == apiKeyProduce && apiVersion == produceVersion:
+			broker.produce(&d, &resp)
+		default:
+			broker.t.Errorf("Unexpected request: API key %d version %d", apiKey, apiVersion)
+			return
+		}
+
+		if d.err != nil {
+			broker.t.Errorf("Error decoding request: %s", d.err)
+		}
+
+		raw := resp.bytes()
+		binary.BigEndian.PutUint32(raw, uint32(len(raw)-4))
+		if _, err := c.Write(raw); err != nil {
+			return
+		}
+	}
+}
+
+func (broker *fakeBroker) metadata(d *decoder, resp *encoder) {
+	broker.lock.Lock()
+	defer broker.lock.Unlock()
+	broker.metadataRequests++
+
+	var topics []string
+	for i := d.arrayLen(); i > 0; i-- {
+		topics = append(topics, d.string())
+	}
+	d.int8() // allow_auto_topic_creation
+
+	host, port, _ := net.SplitHostPort(broker.addr())
+	portNumber, _ := strconv.Atoi(port)
+
+	resp.int32(0) // throttle_time_ms
+	resp.int32(1)
+	resp.int32(7) // node_id
+	resp.string(host)
+	resp.int32(int32(portNumber))
+	resp.int16(-1) // rack
+	resp.int16(-1) // cluster_id
+	resp.int32(7)  // controller_id
+
+	resp.int32(int32(len(topics)))
+	for _, topic := range topics {
+		resp.int16(broker.topicErrors[topic])
+		resp.string(topic)
+		resp.int8(0) // is_internal
+
+		resp.int32(int32(broker.partitions))
+		for partition := 0; partition < broker.partitions; partition++ {
+			resp.int16(0)
+			resp.int32(int32(partition))
+			resp.int32(7) // leader_id
+			resp.int32(1) // replica_nodes
+			resp.int32(7)
+			resp.int32(1) // isr_nodes
+			resp.int32(7)
+		}
+	}
+}
+
+func (broker *fakeBroker) produce(d *decoder, resp *encoder) {
+	broker.lock.Lock()
+	defer broker.lock.Unlock()
+
+	var errorCode int16
+	if len(broker.produceErrors) > 0 {
+		errorCode = broker.produceErrors[0]
+		broker.produceErrors = broker.produceErrors[1:]
+	}
+
+	if transactionalID := d.int16(); transactionalID != -1 {
+		broker.t.Errorf("Expected a null transactional ID, got length %d", transactionalID)
+	}
+	if acks := d.int16(); acks != -1 {
+		broker.t.Errorf("Expected acks=all, got %d", acks)
+	}
+	d.int32() // timeout_ms
+
+	topicCount := d.arrayLen()
+	resp.int32(int32(topicCount))
+	for i := 0; i < topicCount; i++ {
+		topic := d.string()
+		resp.string(topic)
+
+		partitionCount := d.arrayLen()
+		resp.int32(int32(partitionCount))
+		for j := 0; j < partitionCount; j++ {
+			partition := d.int32()
+			messages := broker.decodeRecordBatch(topic, d.bytesWithLength())
+
+			if errorCode == 0 {
+				if broker.produced[topic] == nil {
+					broker.produced[topic] = map[int32][]Message{}
+				}
+				broker.produced[topic][partition] = append(broker.produced[topic][partition], messages...)
+			}
+
+			resp.int32(partition)
+			resp.int16(errorCode)
+			resp.int64(0)  // base_offset
+			resp.int64(-1) // log_append_time_ms
+		}
+	}
+
+	resp.int32(0) // throttle_time_ms
+}
+
+func (broker *fakeBroker) decodeRecordBatch(topic string, batch []byte) []Message {
+	d := decoder{buf: batch}
+	if baseOffset := d.int64(); baseOffset != 0 {
+		broker.t.Errorf("Expected base offset 0, got %d", baseOffset)
+	}
+	if length := d.int32(); int(length) != len(d.buf) {
+		broker.t.Errorf("Batch length is %d, but %d bytes follow", length, len(d.buf))
+	}
+	d.int32() // partition_leader_epoch
+	if magic := d.int8(); magic != 2 {
+		broker.t.Errorf("Expected magic 2, got %d", magic)
+	}
+	if crc := uint32(d.int32()); crc != crc32.Checksum(d.buf, crc32.MakeTable(crc32.Castagnoli)) {
+		broker.t.Error("Incorrect CRC")
+	}
+	d.int16() // attributes
+	lastOffsetDelta := d.int32()
+	d.int64() // first_timestamp
+	d.int64() // max_timestamp
+	d.int64() // producer_id
+	d.int16() // producer_epoch
+	d.int32() // base_sequence
+
+	count := d.int32()
+	if lastOffsetDelta != count-1 {
+		broker.t.Errorf("Last offset delta is %d, but there are %d records", lastOffsetDelta, count)
+	}
+
+	var messages []Message
+	for i := int32(0); i < count; i++ {
+		length := d.varint()
+		record := decoder{buf: d.take(int(length))}
+
+		record.int8()   // attributes
+		record.varint() // timestamp_delta
+		if offsetDelta := record.varint(); offsetDelta != int64(i) {
+			broker.t.Errorf("Expected offset delta %d, got %d", i, offsetDelta)
+		}
+
+		m := Message{Topic: topic}
+		if keyLength := record.varint(); keyLength >= 0 {
+			m.Key = record.take(int(keyLength))
+		}
+		m.Value = record.take(int(record.varint()))
+		if headers := record.varint(); headers != 0 {
+			broker.t.Errorf("Expected no headers, got %d", headers)
+		}
+
+		if record.err != nil || len(record.buf) != 0 {
+			broker.t.Errorf("Error decoding record %d: %v", i, record.err)
+		}
+		messages = append(messages, m)
+	}
+
+	if d.err != nil || len(d.buf) != 0 {
+		broker.t.Errorf("Error decoding record batch: %v", d.err)
+	}
+
+	return messages
+}
+
+func TestMurmur2(t *testing.T) {
+	// From the Java client's tests
+	tests := map[string]int32{
+		"21":                         -973932308,
+		"foobar":                     -790332482,
+		"a-little-bit-long-string":   -985981536,
+		"a-little-bit-longer-string": -1486304829,
+		"lkjh234lh9fiuh90y23oiuhsafujhadof229phr9h19h89h8": -58897971,
+		"abc": 479470107,
+	}
+
+	for input, expected := range tests {
+		if got := murmur2([]byte(input)); got != expected {
+			t.Errorf("murmur2(%q): got %d, expected %d", input, got, expected)
+		}
+	}
+}
+
+func TestProduce(t *testing.T) {
+	broker := newFakeBroker(t, 3)
+	producer := NewProducer([]string{broker.addr()}, time.Second)
+	defer producer.Close()
+
+	var messages []Message
+	for i := 0; i < 20; i++ {
+		messages = append(messages, Message{
+			Topic: "db.coll",
+			Key:   []byte("id" + strconv.Itoa(i%5)),
+			Value: []byte("message " + strconv.Itoa(i)),
+		})
+	}
+	messages = append(messages, Message{Topic: "db.other", Value: []byte("no key")})
+
+	if err := producer.Produce(messages[:10]); err != nil {
+		t.Fatalf("Error producing: %s", err)
+	}
+	if err := producer.Produce(messages[10:]); err != nil {
+		t.Fatalf("Error producing: %s", err)
+	}
+
+	// Each key's messages are in one partition, in order
+	expected := map[string]map[int32][]Message{}
+	for _, m := range messages {
+		var partition int32
+		if m.Key != nil {
+			partition = (murmur2(m.Key) & 0x7fffffff) % 3
+		} else {
+			// The first message without a key
+			partition = 1
+		}
+
+		if expected[m.Topic] == nil {
+			expected[m.Topic] = map[int32][]Message{}
+		}
+		expected[m.Topic][partition] = append(expected[m.Topic][partition], m)
+	}
+
+	if !reflect.DeepEqual(broker.produced, expected) {
+		t.Errorf("Incorrect messages produced. Got %v, expected %v", broker.produced, expected)
+	}
+
+	// The metadata is only fetched when there's a new topic
+	if broker.metadataRequests != 2 {
+		t.Errorf("Expected 2 metadata requests, got %d", broker.metadataRequests)
+	}
+}
+
+func TestProduceError(t *testing.T) {
+	broker := newFakeBroker(t, 1)
+	broker.produceErrors = []int16{errNotLeaderForPartition}
+
+	producer := NewProducer([]string{broker.addr()}, time.Second)
+	defer producer.Close()
+
+	messages := []Message{{Topic: "db.coll", Key: []byte("id"), Value: []byte("message")}}
+
+	err := producer.Produce(messages)
+	if err == nil || !strings.Contains(err.Error(), "NOT_LEADER_OR_FOLLOWER") {
+		t.Fatalf("Expected a NOT_LEADER_OR_FOLLOWER error, got %v", err)
+	}
+
+	// After an error, we look up the leaders again
+	if err := producer.Produce(messages); err != nil {
+		t.Fatalf("Error producing: %s", err)
+	}
+
+	if broker.metadataRequests != 2 {
+		t.Errorf("Expected 2 metadata requests, got %d", broker.metadataRequests)
+	}
+	if !reflect.DeepEqual(broker.produced["db.coll"][0], messages) {
+		t.Errorf("Incorrect messages produced: %v", broker.produced)
+	}
+}
+
+func TestProduceTopicError(t *testing.T) {
+	broker := newFakeBroker(t, 1)
+	broker.topicErrors["db.coll"] = errUnknownTopicOrPartition
+
+	producer := NewProducer([]string{broker.addr()}, time.Second)
+	defer producer.Close()
+
+	err := producer.Produce([]Message{{Topic: "db.coll", Value: []byte("message")}})
+	if err == nil || !strings.Contains(err.Error(), "UNKNOWN_TOPIC_OR_PARTITION") {
+		t.Errorf("Expected an UNKNOWN_TOPIC_OR_PARTITION error, got %v", err)
+	}
+	if len(broker.produced) != 0 {
+		t.Errorf("Expected nothing to be produced, got %v", broker.produced)
+	}
+}
+
+func TestProduceTriesEachBroker(t *testing.T) {
+	broker := newFakeBroker(t, 1)
+
+	// Nothing is listening on the first address
+	unused, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %s", err)
+	}
+	unused.Close()
+
+	producer := NewProducer([]string{unused.Addr().String(), broker.addr()}, time.Second)
+	defer producer.Close()
+
+	if err := producer.Produce([]Message{{Topic: "db.coll", Value: []byte("message")}}); err != nil {
+		t.Errorf("Error producing: %s", err)
+	}
+
+	producer = NewProducer([]string{unused.Addr().String()}, time.Second)
+	defer producer.Close()
+
+	if err := producer.Produce([]Message{{Topic: "db.coll", Value: []byte("message")}}); err == nil {
+		t.Error("Expected an error when no broker is reachable")
+	}
+}
+
+func TestEncodeRecordBatch(t *testing.T) {
+	batch := encodeRecordBatch([]Message{{Key: []byte("k"), Value: []byte("v")}}, time.Unix(1, 0))
+
+	expected := []byte{
+		0, 0, 0, 0, 0, 0, 0, 0, // base_offset
+		0, 0, 0, 58, // batch_length
+		0xff, 0xff, 0xff, 0xff, // partition_leader_epoch
+		2, // magic
+	}
+	if !bytes.HasPrefix(batch, expected) {
+		t.Errorf("Incorrect batch header: %v", batch[:len(expected)])
+	}
+
+	// attributes, timestamp_delta, offset_delta, key, value, headers
+	record := []byte{16, 0, 0, 0, 2, 'k', 2, 'v', 0}
+	if !bytes.HasSuffix(batch, record) {
+		t.Errorf("Incorrect record: %v", batch[len(batch)-len(record):])
+	}
+}
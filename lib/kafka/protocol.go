@@ -0,0 +1,298 @@
+package kafka
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The largest response we'll read, to guard against reading garbage as a
+// length
+const maxResponseSize = 64 * 1024 * 1024
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// conn is a connection to a single broker
+type conn struct {
+	net.Conn
+}
+
+// Sends a request, and reads the response with the same correlation ID.
+// Requests use header v1 and responses header v0, as every non-flexible
+// request version does.
+func (c *conn) roundTrip(apiKey int16, apiVersion int16, correlationID int32, body []byte, timeout time.Duration) ([]byte, error) {
+	if err := c.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+
+	var req encoder
+	req.int32(0) // Size, filled in below
+	req.int16(apiKey)
+	req.int16(apiVersion)
+	req.int32(correlationID)
+	req.string(clientID)
+	req.buf.Write(body)
+
+	raw := req.bytes()
+	binary.BigEndian.PutUint32(raw, uint32(len(raw)-4))
+	if _, err := c.Write(raw); err != nil {
+		return nil, err
+	}
+
+	var header [8]byte
+	if _, err := io.ReadFull(c, header[:]); err != nil {
+		return nil, err
+	}
+
+	size := int32(binary.BigEndian.Uint32(header[:4]))
+	if size < 4 || size > maxResponseSize {
+		return nil, errors.Errorf("invalid response size %d", size)
+	}
+	if got := int32(binary.BigEndian.Uint32(header[4:])); got != correlationID {
+		return nil, errors.Errorf("got the response to request %d, expected %d", got, correlationID)
+	}
+
+	resp := make([]byte, size-4)
+	if _, err := io.ReadFull(c, resp); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// Encodes messages as a v2 record batch (the format used since Kafka 0.11),
+// uncompressed and without headers, all with the timestamp now
+func encodeRecordBatch(messages []Message, now time.Time) []byte {
+	var records encoder
+	for i, m := range messages {
+		var record encoder
+		record.int8(0)          // attributes
+		record.varint(0)        // timestamp_delta
+		record.varint(int64(i)) // offset_delta
+		if m.Key == nil {
+			record.varint(-1)
+		} else {
+			record.varint(int64(len(m.Key)))
+			record.buf.Write(m.Key)
+		}
+		record.varint(int64(len(m.Value)))
+		record.buf.Write(m.Value)
+		record.varint(0) // headers
+
+		records.varint(int64(record.buf.Len()))
+		records.buf.Write(record.bytes())
+	}
+
+	timestamp := now.UnixNano() / int64(time.Millisecond)
+
+	// The part of the batch covered by the CRC
+	var body encoder
+	body.int16(0) // attributes
+	body.int32(int32(len(messages) - 1))
+	body.int64(timestamp) // first_timestamp
+	body.int64(timestamp) // max_timestamp
+	body.int64(-1)        // producer_id
+	body.int16(-1)        // producer_epoch
+	body.int32(-1)        // base_sequence
+	body.int32(int32(len(messages)))
+	body.buf.Write(records.bytes())
+
+	var batch encoder
+	batch.int64(0) // base_offset
+	batch.int32(int32(4 + 1 + 4 + body.buf.Len()))
+	batch.int32(-1) // partition_leader_epoch
+	batch.int8(2)   // magic
+	batch.int32(int32(crc32.Checksum(body.bytes(), crc32c)))
+	batch.buf.Write(body.bytes())
+
+	return batch.bytes()
+}
+
+// murmur2 is the hash the Java client's default partitioner uses for keys
+func murmur2(data []byte) int32 {
+	const (
+		seed = 0x9747b28c
+		m    = 0x5bd1e995
+		r    = 24
+	)
+
+	length := len(data)
+	h := uint32(seed) ^ uint32(length)
+
+	for i := 0; i+4 <= length; i += 4 {
+		k := binary.LittleEndian.Uint32(data[i:])
+		k *= m
+		k ^= k >> r
+		k *= m
+		h *= m
+		h ^= k
+	}
+
+	tail := data[length&^3:]
+	switch len(tail) {
+	case 3:
+		h ^= uint32(tail[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(tail[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(tail[0])
+		h *= m
+	}
+
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+
+	return int32(h)
+}
+
+// encoder writes the big-endian primitive types of the Kafka protocol
+type encoder struct {
+	buf bytes.Buffer
+}
+
+func (e *encoder) bytes() []byte {
+	return e.buf.Bytes()
+}
+
+func (e *encoder) int8(v int8) {
+	e.buf.WriteByte(byte(v))
+}
+
+func (e *encoder) int16(v int16) {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], uint16(v))
+	e.buf.Write(b[:])
+}
+
+func (e *encoder) int32(v int32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(v))
+	e.buf.Write(b[:])
+}
+
+func (e *encoder) int64(v int64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(v))
+	e.buf.Write(b[:])
+}
+
+// Writes a zigzag-encoded varint, as used in record batches
+func (e *encoder) varint(v int64) {
+	var b [binary.MaxVarintLen64]byte
+	e.buf.Write(b[:binary.PutVarint(b[:], v)])
+}
+
+func (e *encoder) string(s string) {
+	e.int16(int16(len(s)))
+	e.buf.WriteString(s)
+}
+
+func (e *encoder) bytesWithLength(b []byte) {
+	e.int32(int32(len(b)))
+	e.buf.Write(b)
+}
+
+// decoder reads the big-endian primitive types of the Kafka protocol. Once
+// it runs out of data, err is set and every read returns zero.
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) take(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(d.buf) {
+		d.err = errors.New("truncated Kafka response")
+		return nil
+	}
+
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) int8() int8 {
+	if b := d.take(1); b != nil {
+		return int8(b[0])
+	}
+	return 0
+}
+
+func (d *decoder) int16() int16 {
+	if b := d.take(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (d *decoder) int32() int32 {
+	if b := d.take(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (d *decoder) int64() int64 {
+	if b := d.take(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+func (d *decoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+
+	v, n := binary.Varint(d.buf)
+	if n <= 0 {
+		d.err = errors.New("invalid varint in Kafka response")
+		return 0
+	}
+
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *decoder) string() string {
+	return string(d.take(int(d.int16())))
+}
+
+func (d *decoder) nullableString() string {
+	length := d.int16()
+	if length < 0 {
+		return ""
+	}
+	return string(d.take(int(length)))
+}
+
+func (d *decoder) bytesWithLength() []byte {
+	return d.take(int(d.int32()))
+}
+
+// Reads the length of an array, treating a null array as empty
+func (d *decoder) arrayLen() int {
+	length := d.int32()
+	if length < 0 {
+		return 0
+	}
+	return int(length)
+}
+
+func (d *decoder) int32Array() []int32 {
+	var values []int32
+	for i := d.arrayLen(); i > 0 && d.err == nil; i-- {
+		values = append(values, d.int32())
+	}
+	return values
+}
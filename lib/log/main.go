@@ -5,7 +5,9 @@ package log
 import (
 	golog "log"
 	"os"
+	"strconv"
 
+	"github.com/pkg/errors"
 	"go.uber.org/zap"
 )
 
@@ -17,8 +19,31 @@ var Log *zap.SugaredLogger
 // safe, but has a clunkier API). See: https://godoc.org/go.uber.org/zap#hdr-Choosing_a_Logger
 var RawLog *zap.Logger
 
+// Level is the minimum level of the logs we print. It can be changed while
+// oplogtoredis is running; it's also an http.Handler that reports the level
+// on GET and changes it on PUT (see zap.AtomicLevel.ServeHTTP).
+var Level zap.AtomicLevel
+
 // Initialize Log and RawLog
 func init() {
+	logConfig, err := buildConfig(os.Getenv)
+	if err != nil {
+		golog.Print(err)
+		panic("Unable to create a logger")
+	}
+
+	RawLog, err = logConfig.Build()
+	if err != nil {
+		golog.Print(err)
+		panic("Unable to create a logger")
+	}
+
+	Level = logConfig.Level
+	Log = RawLog.Sugar()
+}
+
+// Builds the zap config from the environment variables
+func buildConfig(getenv func(string) string) (zap.Config, error) {
 	var logConfig zap.Config
 
 	// The OPLOGTOREDIS_LOG_DEBUG flag controls development vs production config.
@@ -37,24 +62,69 @@ func init() {
 	// within a second, it will stop printing that particular log message
 	// until the next second (e.g. each log message is capped at 100/second) to
 	// give an upper bound to the overhead of logging.
-	if os.Getenv("OTR_LOG_DEBUG") != "" {
+	if getenv("OTR_LOG_DEBUG") != "" {
 		logConfig = zap.NewDevelopmentConfig()
 	} else {
 		logConfig = zap.NewProductionConfig()
 	}
 
-	if os.Getenv("OTR_LOG_QUIET") != "" {
-		logConfig.Level.SetLevel(zap.PanicLevel)
+	// OTR_LOG_FORMAT overrides the encoder chosen above, so you can (for
+	// example) get debug logs as JSON
+	switch format := getenv("OTR_LOG_FORMAT"); format {
+	case "":
+	case "json":
+		logConfig.Encoding = "json"
+		logConfig.EncoderConfig = zap.NewProductionEncoderConfig()
+	case "console":
+		logConfig.Encoding = "console"
+		logConfig.EncoderConfig = zap.NewDevelopmentEncoderConfig()
+	default:
+		return logConfig, errors.Errorf("OTR_LOG_FORMAT must be \"json\" or \"console\", got %q", format)
 	}
 
-	var err error
-	RawLog, err = logConfig.Build()
-	if err != nil {
-		golog.Print(err)
-		panic("Unable to create a logger")
+	// OTR_LOG_LEVEL overrides the level chosen above (debug, info, warn,
+	// error, etc.)
+	if level := getenv("OTR_LOG_LEVEL"); level != "" {
+		if err := logConfig.Level.UnmarshalText([]byte(level)); err != nil {
+			return logConfig, errors.Wrap(err, "parsing OTR_LOG_LEVEL")
+		}
 	}
 
-	Log = RawLog.Sugar()
+	// OTR_LOG_SAMPLING_INITIAL and OTR_LOG_SAMPLING_THEREAFTER enable
+	// sampling (which is otherwise only on in the production config) or
+	// change its parameters: each second, we print the first `initial` logs
+	// with a given level and message, and then every `thereafter`th one
+	// after that. This keeps chatty debug logs, like the one for every oplog
+	// entry, from overwhelming the output (or slowing us down) under load.
+	initial := getenv("OTR_LOG_SAMPLING_INITIAL")
+	thereafter := getenv("OTR_LOG_SAMPLING_THEREAFTER")
+	if initial != "" || thereafter != "" {
+		sampling := zap.SamplingConfig{Initial: 100, Thereafter: 100}
+
+		if initial != "" {
+			n, err := strconv.Atoi(initial)
+			if err != nil || n < 1 {
+				return logConfig, errors.Errorf("OTR_LOG_SAMPLING_INITIAL must be a positive integer, got %q", initial)
+			}
+			sampling.Initial = n
+		}
+
+		if thereafter != "" {
+			n, err := strconv.Atoi(thereafter)
+			if err != nil || n < 0 {
+				return logConfig, errors.Errorf("OTR_LOG_SAMPLING_THEREAFTER must be a non-negative integer, got %q", thereafter)
+			}
+			sampling.Thereafter = n
+		}
+
+		logConfig.Sampling = &sampling
+	}
+
+	if getenv("OTR_LOG_QUIET") != "" {
+		logConfig.Level.SetLevel(zap.PanicLevel)
+	}
+
+	return logConfig, nil
 }
 
 // Sync writes the log to its output stream (typically stdout/stderr). This should
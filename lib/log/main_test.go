@@ -0,0 +1,95 @@
+package log
+
+import (
+	"reflect"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestBuildConfig(t *testing.T) {
+	tests := map[string]struct {
+		env              map[string]string
+		expectedEncoding string
+		expectedLevel    zapcore.Level
+		expectedSampling *zap.SamplingConfig
+		expectError      bool
+	}{
+		"Defaults": {
+			expectedEncoding: "json",
+			expectedLevel:    zapcore.InfoLevel,
+			expectedSampling: &zap.SamplingConfig{Initial: 100, Thereafter: 100},
+		},
+		"Debug": {
+			env:              map[string]string{"OTR_LOG_DEBUG": "true"},
+			expectedEncoding: "console",
+			expectedLevel:    zapcore.DebugLevel,
+		},
+		"Debug with sampling": {
+			env: map[string]string{
+				"OTR_LOG_DEBUG":               "true",
+				"OTR_LOG_SAMPLING_INITIAL":    "10",
+				"OTR_LOG_SAMPLING_THEREAFTER": "1000",
+			},
+			expectedEncoding: "console",
+			expectedLevel:    zapcore.DebugLevel,
+			expectedSampling: &zap.SamplingConfig{Initial: 10, Thereafter: 1000},
+		},
+		"Sampling with only one parameter set": {
+			env:              map[string]string{"OTR_LOG_SAMPLING_THEREAFTER": "0"},
+			expectedEncoding: "json",
+			expectedLevel:    zapcore.InfoLevel,
+			expectedSampling: &zap.SamplingConfig{Initial: 100, Thereafter: 0},
+		},
+		"Invalid sampling": {
+			env:         map[string]string{"OTR_LOG_SAMPLING_INITIAL": "0"},
+			expectError: true,
+		},
+		"Debug as JSON": {
+			env:              map[string]string{"OTR_LOG_DEBUG": "true", "OTR_LOG_FORMAT": "json"},
+			expectedEncoding: "json",
+			expectedLevel:    zapcore.DebugLevel,
+		},
+		"Console at warn level": {
+			env:              map[string]string{"OTR_LOG_FORMAT": "console", "OTR_LOG_LEVEL": "warn"},
+			expectedEncoding: "console",
+			expectedLevel:    zapcore.WarnLevel,
+			expectedSampling: &zap.SamplingConfig{Initial: 100, Thereafter: 100},
+		},
+		"Invalid format": {
+			env:         map[string]string{"OTR_LOG_FORMAT": "xml"},
+			expectError: true,
+		},
+		"Invalid level": {
+			env:         map[string]string{"OTR_LOG_LEVEL": "loud"},
+			expectError: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			config, err := buildConfig(func(key string) string { return test.env[key] })
+
+			if test.expectError {
+				if err == nil {
+					t.Error("Expected an error, got none")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			if config.Encoding != test.expectedEncoding {
+				t.Errorf("Expected encoding %s, got %s", test.expectedEncoding, config.Encoding)
+			}
+			if config.Level.Level() != test.expectedLevel {
+				t.Errorf("Expected level %s, got %s", test.expectedLevel, config.Level.Level())
+			}
+			if !reflect.DeepEqual(config.Sampling, test.expectedSampling) {
+				t.Errorf("Expected sampling %#v, got %#v", test.expectedSampling, config.Sampling)
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package oplog
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ActivityTracker records when the Tailer last made progress: when it
+// received an oplog entry, or when the Mongo server told it there were no new
+// entries. It's used to detect a tailer that has stalled, as opposed to one
+// that's idle because nothing is being written.
+//
+// When tailing a sharded cluster, activity is tracked separately for each
+// shard, and the tracker reports the activity of the least recently active
+// shard.
+//
+// It also records how far the tailer has read through each shard's oplog;
+// see Positions.
+type ActivityTracker struct {
+	lock      sync.Mutex
+	createdAt time.Time
+	times     map[string]time.Time
+	positions map[string]primitive.Timestamp
+}
+
+// Position is how far the tailer has read through the oplog of a shard
+type Position struct {
+	// Shard is the name of the shard, or "" for a replica set
+	Shard string
+
+	// Timestamp is the timestamp of the last oplog entry read
+	Timestamp primitive.Timestamp
+
+	// LagSeconds is how long ago that entry was written
+	LagSeconds float64
+}
+
+// NewActivityTracker creates an ActivityTracker. Until the tailer records any
+// activity, it reports the time it was created as the last activity.
+func NewActivityTracker() *ActivityTracker {
+	return &ActivityTracker{
+		createdAt: time.Now(),
+		times:     map[string]time.Time{},
+		positions: map[string]primitive.Timestamp{},
+	}
+}
+
+// Records activity for the given shard (or "" for a replica set). It's safe
+// to call on a nil tracker.
+func (tracker *ActivityTracker) record(shardName string) {
+	if tracker == nil {
+		return
+	}
+
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	tracker.times[shardName] = time.Now()
+}
+
+// LastActivity returns the time of the most recent activity of the least
+// recently active shard
+func (tracker *ActivityTracker) LastActivity() time.Time {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	if len(tracker.times) == 0 {
+		return tracker.createdAt
+	}
+
+	var oldest time.Time
+	for _, t := range tracker.times {
+		if oldest.IsZero() || t.Before(oldest) {
+			oldest = t
+		}
+	}
+
+	return oldest
+}
+
+// Records the timestamp of the last entry read from the given shard's oplog.
+// It's safe to call on a nil tracker.
+func (tracker *ActivityTracker) recordPosition(shardName string, ts primitive.Timestamp) {
+	if tracker == nil {
+		return
+	}
+
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	tracker.positions[shardName] = ts
+}
+
+// Positions returns how far the tailer has read through each shard's oplog,
+// ordered by shard name, as of now
+func (tracker *ActivityTracker) Positions(now time.Time) []Position {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	positions := make([]Position, 0, len(tracker.positions))
+	for shardName, ts := range tracker.positions {
+		positions = append(positions, Position{
+			Shard:      shardName,
+			Timestamp:  ts,
+			LagSeconds: oplogLag(ts, now),
+		})
+	}
+
+	sort.Slice(positions, func(i, j int) bool {
+		return positions[i].Shard < positions[j].Shard
+	})
+
+	return positions
+}
@@ -0,0 +1,63 @@
+package oplog
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestActivityTracker(t *testing.T) {
+	tracker := NewActivityTracker()
+	createdAt := tracker.LastActivity()
+
+	if time.Since(createdAt) > time.Second {
+		t.Errorf("Expected a new tracker to report its creation time, got %s", createdAt)
+	}
+
+	tracker.record("shard01")
+	time.Sleep(10 * time.Millisecond)
+	tracker.record("shard02")
+
+	shard01 := tracker.times["shard01"]
+	if got := tracker.LastActivity(); !got.Equal(shard01) {
+		t.Errorf("Expected least recently active shard's time %s, got %s", shard01, got)
+	}
+
+	tracker.record("shard01")
+	if got := tracker.LastActivity(); !got.Equal(tracker.times["shard02"]) {
+		t.Errorf("Expected shard02's time %s, got %s", tracker.times["shard02"], got)
+	}
+
+	// Recording on a nil tracker does nothing
+	var nilTracker *ActivityTracker
+	nilTracker.record("")
+}
+
+func TestActivityTrackerPositions(t *testing.T) {
+	tracker := NewActivityTracker()
+	if got := tracker.Positions(time.Now()); len(got) != 0 {
+		t.Errorf("Expected no positions before any were recorded, got %v", got)
+	}
+
+	tracker.recordPosition("shard02", primitive.Timestamp{T: 1500000000, I: 2})
+	tracker.recordPosition("shard01", primitive.Timestamp{T: 1500000050, I: 1})
+
+	got := tracker.Positions(time.Unix(1500000100, 0))
+	want := []Position{
+		{Shard: "shard01", Timestamp: primitive.Timestamp{T: 1500000050, I: 1}, LagSeconds: 50},
+		{Shard: "shard02", Timestamp: primitive.Timestamp{T: 1500000000, I: 2}, LagSeconds: 100},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("Expected %d positions, got %v", len(want), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Expected position %d to be %+v, got %+v", i, want[i], got[i])
+		}
+	}
+
+	// Recording on a nil tracker does nothing
+	var nilTracker *ActivityTracker
+	nilTracker.recordPosition("", primitive.Timestamp{})
+}
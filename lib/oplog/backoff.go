@@ -0,0 +1,49 @@
+package oplog
+
+import (
+	"math/rand"
+	"time"
+)
+
+// backoff computes exponentially-increasing delays with jitter, for retrying
+// failed operations
+type backoff struct {
+	initial time.Duration
+	max     time.Duration
+
+	// current is the un-jittered delay that next() will use
+	current time.Duration
+}
+
+func newBackoff(initial, max time.Duration) *backoff {
+	if initial <= 0 {
+		initial = requeryDuration
+	}
+
+	if max < initial {
+		max = initial
+	}
+
+	return &backoff{initial: initial, max: max, current: initial}
+}
+
+// next returns the delay to wait before the next retry, and increases the
+// delay for subsequent retries. The returned delay is randomly chosen between
+// half and all of the current delay, so that many clients retrying at once
+// spread out their retries.
+func (b *backoff) next() time.Duration {
+	delay := b.current
+
+	b.current *= 2
+	if b.current > b.max {
+		b.current = b.max
+	}
+
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(delay-half)+1))
+}
+
+// reset returns the delay to its initial value
+func (b *backoff) reset() {
+	b.current = b.initial
+}
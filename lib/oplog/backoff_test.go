@@ -0,0 +1,33 @@
+package oplog
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	b := newBackoff(time.Second, 5*time.Second)
+
+	// Each delay should be jittered between half and all of 1s, 2s, 4s, 5s, 5s
+	for i, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		got := b.next()
+
+		if got < want/2 || got > want {
+			t.Errorf("Delay %d was %s; want between %s and %s", i, got, want/2, want)
+		}
+	}
+
+	b.reset()
+
+	if got := b.next(); got > time.Second {
+		t.Errorf("Delay after reset was %s; want at most 1s", got)
+	}
+}
+
+func TestBackoffDefaults(t *testing.T) {
+	b := newBackoff(0, 0)
+
+	if b.initial != requeryDuration || b.max != requeryDuration {
+		t.Errorf("Expected zero-valued backoff to use requeryDuration, got initial %s and max %s", b.initial, b.max)
+	}
+}
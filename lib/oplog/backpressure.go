@@ -0,0 +1,91 @@
+package oplog
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/vlasky/oplogtoredis/lib/redispub"
+)
+
+// Values for Tailer.Backpressure (see config.Backpressure)
+const (
+	// Wait for the publisher to make room
+	BackpressureBlock = "block"
+
+	// Drop the oldest publication waiting in the output channel to make room
+	BackpressureDropOldest = "drop_oldest"
+
+	// Drop the new publication
+	BackpressureDrop = "drop"
+)
+
+var (
+	metricOutputChannelDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "otr",
+		Name:      "output_channel_depth",
+		Help:      "Number of publications waiting in the channel between the oplog tailer and the Redis publisher.",
+	})
+
+	metricOutputChannelCapacity = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "otr",
+		Name:      "output_channel_capacity",
+		Help:      "Number of publications the channel between the oplog tailer and the Redis publisher can hold (see OTR_OUTPUT_BUFFER_SIZE).",
+	})
+
+	metricOutputChannelDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "otr",
+		Name:      "output_channel_dropped",
+		Help:      "Number of publications dropped because the channel between the oplog tailer and the Redis publisher was full (see OTR_BACKPRESSURE).",
+	})
+)
+
+// Sends a publication to out, applying the tailer's backpressure policy if
+// out is full
+func (tailer *Tailer) send(out chan *redispub.Publication, pub *redispub.Publication) {
+	tailer.Pauser.wait()
+	pub.EnqueuedAt = tailer.now()
+
+	defer func() {
+		metricOutputChannelDepth.Set(float64(len(out)))
+	}()
+
+	switch tailer.Backpressure {
+	case BackpressureDrop:
+		select {
+		case out <- pub:
+		default:
+			tailer.drop(pub)
+		}
+
+	case BackpressureDropOldest:
+		for {
+			select {
+			case out <- pub:
+				return
+			default:
+			}
+
+			// The publisher may empty the channel in the meantime, so we
+			// don't block here either
+			select {
+			case oldest := <-out:
+				tailer.drop(oldest)
+			default:
+			}
+		}
+
+	default:
+		out <- pub
+	}
+}
+
+func (tailer *Tailer) drop(pub *redispub.Publication) {
+	metricOutputChannelDropped.Inc()
+
+	// A dropped timestamp-only publication just means the last-processed
+	// timestamp advances a bit later, so it doesn't need to hold it back
+	if tailer.DropBarrier != nil && !pub.TimestampOnly {
+		tailer.DropBarrier.Dropped(pub)
+	}
+	pub.Span.SetAttribute("oplogtoredis.dropped", true)
+	pub.Span.End()
+}
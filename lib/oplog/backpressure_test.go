@@ -0,0 +1,89 @@
+package oplog
+
+import (
+	"testing"
+	"time"
+
+	"github.com/vlasky/oplogtoredis/lib/redispub"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestSendBackpressure(t *testing.T) {
+	pub := func(i uint32) *redispub.Publication {
+		return &redispub.Publication{OplogTimestamp: primitive.Timestamp{T: 1, I: i}}
+	}
+
+	tests := map[string]struct {
+		policy       string
+		expectedSent []uint32
+		expectedHeld uint32
+	}{
+		"drop": {
+			policy:       BackpressureDrop,
+			expectedSent: []uint32{1, 2},
+			expectedHeld: 3,
+		},
+		"drop_oldest": {
+			policy:       BackpressureDropOldest,
+			expectedSent: []uint32{2, 3},
+			expectedHeld: 1,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			barrier := redispub.NewDropBarrier()
+			tailer := Tailer{Backpressure: test.policy, DropBarrier: barrier}
+
+			out := make(chan *redispub.Publication, 2)
+			for i := uint32(1); i <= 3; i++ {
+				tailer.send(out, pub(i))
+			}
+			close(out)
+
+			var sent []uint32
+			for p := range out {
+				sent = append(sent, p.OplogTimestamp.I)
+			}
+
+			if len(sent) != len(test.expectedSent) || sent[0] != test.expectedSent[0] || sent[1] != test.expectedSent[1] {
+				t.Errorf("Expected %v to be sent, got %v", test.expectedSent, sent)
+			}
+
+			// The publications sent after the dropped one must not advance
+			// the last-processed timestamp
+			dropped := pub(test.expectedHeld)
+			if !barrier.Holds(dropped) {
+				t.Errorf("Expected the drop barrier to hold back timestamp %d", test.expectedHeld)
+			}
+		})
+	}
+}
+
+func TestSendBlock(t *testing.T) {
+	tailer := Tailer{}
+	out := make(chan *redispub.Publication, 1)
+
+	done := make(chan struct{})
+	go func() {
+		tailer.send(out, &redispub.Publication{})
+		tailer.send(out, &redispub.Publication{})
+		close(done)
+	}()
+
+	<-out
+	<-out
+	<-done
+}
+
+func TestSendSetsEnqueuedAt(t *testing.T) {
+	now := time.Unix(1000, 0)
+	tailer := Tailer{NowFunc: func() time.Time { return now }}
+	out := make(chan *redispub.Publication, 1)
+
+	tailer.send(out, &redispub.Publication{})
+
+	if pub := <-out; !pub.EnqueuedAt.Equal(now) {
+		t.Errorf("Expected EnqueuedAt to be %s, got %s", now, pub.EnqueuedAt)
+	}
+}
@@ -0,0 +1,121 @@
+package oplog
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// catchUpLimit records where we resumed tailing from, so that we can drop the
+// backlog of entries for databases whose catch-up window (see
+// Tailer.MaxCatchUpOverrides) doesn't reach back that far, and skip the
+// entries of each database that we've already processed
+type catchUpLimit struct {
+	// The time of the last entry we processed before starting up
+	lastProcessed time.Time
+
+	// When we started up. Entries from before this are the backlog.
+	startedAt time.Time
+
+	// The last entry we processed for each database with its own
+	// last-processed timestamp (see redispub.LastProcessedDatabaseTimestamps),
+	// and for every other database
+	databaseResumeFrom map[string]primitive.Timestamp
+	resumeFrom         primitive.Timestamp
+}
+
+// Returns the maximum catch-up window for the given database
+func (tailer *Tailer) maxCatchUpFor(database string) time.Duration {
+	if maxCatchUp, ok := tailer.MaxCatchUpOverrides[database]; ok {
+		return maxCatchUp
+	}
+
+	return tailer.MaxCatchUp
+}
+
+// Returns the longest catch-up window of any database
+func (tailer *Tailer) longestCatchUp() time.Duration {
+	longest := tailer.MaxCatchUp
+	for _, maxCatchUp := range tailer.MaxCatchUpOverrides {
+		if maxCatchUp > longest {
+			longest = maxCatchUp
+		}
+	}
+
+	return longest
+}
+
+// startCatchUp decides whether we should resume from lastProcessed, which
+// we do if it's within the catch-up window of any database. If we do, it
+// records the limit so that dropBacklog can drop the entries of the
+// databases whose window it isn't within.
+func (tailer *Tailer) startCatchUp(lastProcessed time.Time, now time.Time) bool {
+	tailer.catchUp = nil
+
+	if !lastProcessed.After(now.Add(-1 * tailer.longestCatchUp())) {
+		return false
+	}
+
+	tailer.catchUp = &catchUpLimit{lastProcessed: lastProcessed, startedAt: now}
+	return true
+}
+
+// resumeFromDatabases moves the start of the catch-up back to the earliest
+// of the given per-database last-processed timestamps, ignoring those outside
+// their database's catch-up window. It returns the timestamp to start tailing
+// from; dropBacklog then skips each database's entries up to its own
+// timestamp. It must be called after startCatchUp returns true.
+func (tailer *Tailer) resumeFromDatabases(ts primitive.Timestamp, databaseTimestamps map[string]primitive.Timestamp) primitive.Timestamp {
+	tailer.catchUp.resumeFrom = ts
+	tailer.catchUp.databaseResumeFrom = map[string]primitive.Timestamp{}
+
+	start := ts
+	for database, databaseTS := range databaseTimestamps {
+		cutoff := tailer.catchUp.startedAt.Add(-1 * tailer.maxCatchUpFor(database))
+		if !time.Unix(int64(databaseTS.T), 0).After(cutoff) {
+			continue
+		}
+
+		tailer.catchUp.databaseResumeFrom[database] = databaseTS
+		if timestampAfter(start, databaseTS) {
+			start = databaseTS
+		}
+	}
+
+	return start
+}
+
+// Returns whether a is after b
+func timestampAfter(a, b primitive.Timestamp) bool {
+	return a.T > b.T || (a.T == b.T && a.I > b.I)
+}
+
+// Returns the subset of entries that aren't part of a backlog we've decided
+// not to catch up on, or that we've already processed
+func (tailer *Tailer) dropBacklog(entries []oplogEntry) []oplogEntry {
+	if tailer.catchUp == nil || (len(tailer.MaxCatchUpOverrides) == 0 && len(tailer.catchUp.databaseResumeFrom) == 0) {
+		return entries
+	}
+
+	startedAt := uint32(tailer.catchUp.startedAt.Unix())
+
+	filtered := entries[:0]
+	for _, entry := range entries {
+		tooOld := !tailer.catchUp.lastProcessed.After(tailer.catchUp.startedAt.Add(-1 * tailer.maxCatchUpFor(entry.Database)))
+		if entry.Timestamp.T <= startedAt && tooOld {
+			continue
+		}
+
+		resumeFrom, ok := tailer.catchUp.databaseResumeFrom[entry.Database]
+		if !ok {
+			resumeFrom = tailer.catchUp.resumeFrom
+		}
+		if !timestampAfter(entry.Timestamp, resumeFrom) {
+			continue
+		}
+
+		filtered = append(filtered, entry)
+	}
+
+	return filtered
+}
@@ -0,0 +1,139 @@
+package oplog
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestStartCatchUp(t *testing.T) {
+	now := time.Now()
+
+	tests := map[string]struct {
+		lastProcessed  time.Time
+		overrides      map[string]time.Duration
+		expectedResume bool
+	}{
+		"Within the default window": {
+			lastProcessed:  now.Add(-30 * time.Second),
+			expectedResume: true,
+		},
+		"Outside the default window": {
+			lastProcessed:  now.Add(-2 * time.Minute),
+			expectedResume: false,
+		},
+		"Outside the default window, but within an override": {
+			lastProcessed:  now.Add(-2 * time.Minute),
+			overrides:      map[string]time.Duration{"replayable": time.Hour},
+			expectedResume: true,
+		},
+		"Outside every window": {
+			lastProcessed:  now.Add(-2 * time.Hour),
+			overrides:      map[string]time.Duration{"replayable": time.Hour},
+			expectedResume: false,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			tailer := Tailer{
+				MaxCatchUp:          time.Minute,
+				MaxCatchUpOverrides: test.overrides,
+			}
+
+			resume := tailer.startCatchUp(test.lastProcessed, now)
+			if resume != test.expectedResume {
+				t.Errorf("Got resume %v, expected %v", resume, test.expectedResume)
+			}
+			if (tailer.catchUp != nil) != resume {
+				t.Errorf("Expected catchUp to be set only when resuming, got %#v", tailer.catchUp)
+			}
+		})
+	}
+}
+
+func TestDropBacklog(t *testing.T) {
+	now := time.Unix(100000, 0)
+	backlogTS := primitive.Timestamp{T: uint32(now.Add(-10 * time.Minute).Unix())}
+	newTS := primitive.Timestamp{T: uint32(now.Add(time.Second).Unix())}
+
+	tailer := Tailer{
+		MaxCatchUp: time.Minute,
+		MaxCatchUpOverrides: map[string]time.Duration{
+			"replayable": time.Hour,
+			"strict":     10 * time.Second,
+		},
+	}
+	if !tailer.startCatchUp(now.Add(-30*time.Minute), now) {
+		t.Fatal("Expected to resume")
+	}
+
+	entries := []oplogEntry{
+		{Database: "replayable", Timestamp: backlogTS},
+		{Database: "strict", Timestamp: backlogTS},
+		{Database: "other", Timestamp: backlogTS},
+		{Database: "strict", Timestamp: newTS},
+		{Database: "other", Timestamp: newTS},
+	}
+
+	got := tailer.dropBacklog(entries)
+	want := []oplogEntry{
+		{Database: "replayable", Timestamp: backlogTS},
+		{Database: "strict", Timestamp: newTS},
+		{Database: "other", Timestamp: newTS},
+	}
+
+	if diff := pretty.Compare(got, want); diff != "" {
+		t.Errorf("Got incorrect entries (-got +want)\n%s", diff)
+	}
+}
+
+func TestResumeFromDatabases(t *testing.T) {
+	now := time.Unix(100000, 0)
+	ts := func(ago time.Duration) primitive.Timestamp {
+		return primitive.Timestamp{T: uint32(now.Add(-ago).Unix())}
+	}
+
+	globalTS := ts(10 * time.Second)
+
+	tailer := Tailer{MaxCatchUp: time.Minute}
+	if !tailer.startCatchUp(now.Add(-10*time.Second), now) {
+		t.Fatal("Expected to resume")
+	}
+
+	start := tailer.resumeFromDatabases(globalTS, map[string]primitive.Timestamp{
+		// Was excluded for a while, so it's behind the global timestamp
+		"readded": ts(40 * time.Second),
+		"current": globalTS,
+		// Outside the catch-up window, so it resumes from the global
+		// timestamp
+		"stale": ts(time.Hour),
+	})
+
+	if start != ts(40*time.Second) {
+		t.Errorf("Expected to start from the earliest database timestamp, got %v", start)
+	}
+
+	entries := []oplogEntry{
+		{Database: "readded", Timestamp: ts(30 * time.Second)},
+		{Database: "current", Timestamp: ts(30 * time.Second)},
+		{Database: "stale", Timestamp: ts(30 * time.Second)},
+		{Database: "untracked", Timestamp: ts(30 * time.Second)},
+		{Database: "current", Timestamp: ts(5 * time.Second)},
+		{Database: "untracked", Timestamp: ts(5 * time.Second)},
+	}
+
+	got := tailer.dropBacklog(entries)
+	want := []oplogEntry{
+		{Database: "readded", Timestamp: ts(30 * time.Second)},
+		{Database: "current", Timestamp: ts(5 * time.Second)},
+		{Database: "untracked", Timestamp: ts(5 * time.Second)},
+	}
+
+	if diff := pretty.Compare(got, want); diff != "" {
+		t.Errorf("Got incorrect entries (-got +want)\n%s", diff)
+	}
+}
@@ -0,0 +1,324 @@
+package oplog
+
+import (
+	"context"
+	"errors"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/vlasky/oplogtoredis/lib/config"
+	"github.com/vlasky/oplogtoredis/lib/log"
+	"github.com/vlasky/oplogtoredis/lib/redispub"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Values for Tailer.SourceMode
+const (
+	SourceModeOplog        = "oplog"
+	SourceModeChangeStream = "changestream"
+)
+
+// Change event from a Mongo change stream. See
+// https://docs.mongodb.com/manual/reference/change-events/
+type changeEvent struct {
+	ID            bson.Raw             `bson:"_id"`
+	OperationType string               `bson:"operationType"`
+	ClusterTime   primitive.Timestamp  `bson:"clusterTime"`
+	Namespace     changeEventNamespace `bson:"ns"`
+	To            changeEventNamespace `bson:"to"`
+	DocumentKey   rawOplogEntryID      `bson:"documentKey"`
+	FullDocument  bson.Raw             `bson:"fullDocument"`
+
+	UpdateDescription struct {
+		UpdatedFields bson.Raw `bson:"updatedFields"`
+		RemovedFields []string `bson:"removedFields"`
+	} `bson:"updateDescription"`
+}
+
+type changeEventNamespace struct {
+	Database   string `bson:"db"`
+	Collection string `bson:"coll"`
+}
+
+func (ns changeEventNamespace) String() string {
+	return ns.Database + "." + ns.Collection
+}
+
+func (tailer *Tailer) tailChangeStreamOnce(out chan *redispub.Publication, stop <-chan bool) {
+	stream, err := tailer.openChangeStream(tailer.getResumeToken())
+	if err != nil {
+		countMongoError(err)
+		log.Log.Errorw("Error opening change stream", "error", err)
+		return
+	}
+	defer closeChangeStream(stream)
+
+	for {
+		select {
+		case <-stop:
+			log.Log.Infof("Received stop; aborting change stream tailing")
+			return
+		default:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), config.MongoNextTimeout())
+		gotResult := stream.TryNext(ctx)
+		cancel()
+
+		if gotResult || stream.Err() == nil {
+			// Either we got an event, or Mongo told us there were none
+			tailer.Activity.record(tailer.shardName)
+		}
+
+		if gotResult {
+			for _, pub := range tailer.unmarshalChangeEvent(stream.Current) {
+				tailer.send(out, pub)
+			}
+		} else if err := stream.Err(); err != nil {
+			// The driver has already tried to resume the stream if the error
+			// was resumable, so we give up on it and start a new one
+			countMongoError(err)
+			log.Log.Errorw("Error from change stream", "error", err)
+			return
+		}
+	}
+}
+
+// Opens a change stream on the whole cluster, resuming after the given token
+// if it's non-nil
+func (tailer *Tailer) openChangeStream(resumeToken bson.Raw) (*mongo.ChangeStream, error) {
+	opts := options.ChangeStream()
+	if tailer.ChangeStreamFullDocument != "" {
+		opts.SetFullDocument(tailer.ChangeStreamFullDocument)
+	}
+
+	if resumeToken != nil {
+		opts.SetResumeAfter(resumeToken)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.MongoFindTimeout())
+	defer cancel()
+
+	stream, err := tailer.MongoClient.Watch(ctx, mongo.Pipeline{}, opts)
+
+	if resumeToken != nil && isChangeStreamHistoryLost(err) {
+		log.Log.Warnw("Resume token is no longer in the oplog. Will start change stream from now",
+			"error", err)
+		return tailer.openChangeStream(nil)
+	}
+
+	return stream, err
+}
+
+// Returns whether err indicates that we can't resume a change stream because
+// the resume point has fallen off the end of the oplog
+func isChangeStreamHistoryLost(err error) bool {
+	var serverErr mongo.ServerError
+	if !errors.As(err, &serverErr) {
+		return false
+	}
+
+	// 286: ChangeStreamHistoryLost
+	// 280: ChangeStreamFatalError
+	return serverErr.HasErrorCode(286) || serverErr.HasErrorCode(280)
+}
+
+func closeChangeStream(stream *mongo.ChangeStream) {
+	ctx, cancel := context.WithTimeout(context.Background(), config.MongoCloseTimeout())
+	defer cancel()
+
+	closeErr := stream.Close(ctx)
+	if closeErr != nil {
+		log.Log.Errorw("Error from closing change stream",
+			"error", closeErr)
+	}
+}
+
+// Gets the resume token we should open the change stream with, or nil if we
+// should start from the current time. This parallels getStartTime: we don't
+// resume if the last processed event is older than MaxCatchUp (or the longest
+// of MaxCatchUpOverrides).
+func (tailer *Tailer) getResumeToken() bson.Raw {
+	tailer.catchUp = nil
+
+	startPosition := tailer.StartPosition
+	if tailer.started {
+		startPosition = StartPositionResume
+	}
+	tailer.started = true
+
+	if startPosition == StartPositionEnd {
+		log.Log.Warn("Ignoring the resume token (OTR_START_POSITION=end). Will start change stream from now")
+		return nil
+	}
+
+	token, err := redispub.LastProcessedResumeToken(tailer.RedisClient, tailer.RedisPrefix, tailer.shardName)
+	if err == redis.Nil {
+		log.Log.Info("No resume token found. Will start change stream from now")
+		return nil
+	} else if err != nil {
+		log.Log.Errorw("Error querying Redis for resume token. Will start change stream from now.",
+			"error", err)
+		return nil
+	}
+
+	_, tsTime, err := redispub.LastProcessedTimestamp(tailer.RedisClient, tailer.RedisPrefix, tailer.shardName)
+	if err != nil {
+		log.Log.Errorw("Error querying Redis for last processed timestamp. Will start change stream from now.",
+			"error", err)
+		return nil
+	}
+
+	if !tailer.startCatchUp(tsTime, tailer.now()) {
+		log.Log.Warnf("Found resume token, but it was too far in the past (%d). Will start change stream from now", tsTime.Unix())
+		return nil
+	}
+
+	log.Log.Infof("Found resume token, resuming change stream from %d", tsTime.Unix())
+	return token
+}
+
+// unmarshalChangeEvent is the equivalent of unmarshalEntry for change stream
+// events. Each returned publication carries the event's resume token.
+func (tailer *Tailer) unmarshalChangeEvent(rawData bson.Raw) []*redispub.Publication {
+	var event changeEvent
+
+	err := bson.Unmarshal(rawData, &event)
+	if err != nil {
+		metricDecodeErrors.Inc()
+		log.Log.Errorw("Error unmarshalling change event", "error", err)
+		return nil
+	}
+
+	log.Log.Debugw("Received change event",
+		"event", event)
+
+	pubs := tailer.processEntries(parseChangeEvent(event), float64(len(rawData)), changeEventOperationLabel(event.OperationType))
+
+	for _, pub := range pubs {
+		pub.ResumeToken = event.ID
+	}
+
+	return pubs
+}
+
+// Returns the operation label for the metrics of a change event with the
+// given operation type, matching the label of the equivalent oplog entry
+func changeEventOperationLabel(operationType string) string {
+	switch operationType {
+	case "insert":
+		return operationLabel(operationInsert)
+	case "update", "replace":
+		return operationLabel(operationUpdate)
+	case "delete":
+		return operationLabel(operationRemove)
+	default:
+		return operationLabel(operationCommand)
+	}
+}
+
+// converts a change event into oplogEntries, in the same form as
+// parseRawOplogEntry produces for the equivalent oplog entries
+func parseChangeEvent(event changeEvent) []oplogEntry {
+	txIdx := uint(0)
+
+	out := oplogEntry{
+		Timestamp: event.ClusterTime,
+		Namespace: event.Namespace.String(),
+		DocID:     event.DocumentKey.ID,
+	}
+	out.Database, out.Collection = parseNamespace(out.Namespace)
+
+	switch event.OperationType {
+	case "insert":
+		data, ok := unmarshalChangeEventDocument(event.FullDocument)
+		if !ok {
+			return nil
+		}
+
+		out.Operation = operationInsert
+		out.Data = data
+
+	case "update":
+		updatedFields, ok := unmarshalChangeEventDocument(event.UpdateDescription.UpdatedFields)
+		if !ok {
+			return nil
+		}
+
+		// Build a v1-style update, so ChangedFields can extract the fields
+		// as usual
+		out.Operation = operationUpdate
+		out.Data = map[string]interface{}{"$set": updatedFields}
+
+		if len(event.UpdateDescription.RemovedFields) > 0 {
+			removedFields := map[string]interface{}{}
+			for _, field := range event.UpdateDescription.RemovedFields {
+				removedFields[field] = true
+			}
+			out.Data["$unset"] = removedFields
+		}
+
+		// With fullDocument: updateLookup, the change stream gives us the
+		// current version of the document
+		if event.FullDocument != nil {
+			out.FullDocument, _ = unmarshalChangeEventDocument(event.FullDocument)
+		}
+
+	case "replace":
+		data, ok := unmarshalChangeEventDocument(event.FullDocument)
+		if !ok {
+			return nil
+		}
+
+		out.Operation = operationUpdate
+		out.Data = data
+
+	case "delete":
+		out.Operation = operationRemove
+		out.Data = map[string]interface{}{"_id": event.DocumentKey.ID}
+
+	case "rename":
+		entry := rawOplogEntry{Timestamp: event.ClusterTime}
+		data := map[string]interface{}{"from": event.Namespace.String(), "to": event.To.String()}
+
+		return []oplogEntry{
+			newNamespaceEvent(entry, operationRename, event.Namespace.String(), data, &txIdx),
+			newNamespaceEvent(entry, operationRename, event.To.String(), data, &txIdx),
+		}
+
+	case "drop":
+		entry := rawOplogEntry{Timestamp: event.ClusterTime}
+		data := map[string]interface{}{"ns": event.Namespace.String()}
+
+		return []oplogEntry{newNamespaceEvent(entry, operationDrop, event.Namespace.String(), data, &txIdx)}
+
+	case "dropDatabase":
+		entry := rawOplogEntry{Timestamp: event.ClusterTime}
+		data := map[string]interface{}{"db": event.Namespace.Database}
+
+		return []oplogEntry{newNamespaceEvent(entry, operationDropDatabase, event.Namespace.Database, data, &txIdx)}
+
+	default:
+		// invalidate, and DDL events like createIndexes
+		return nil
+	}
+
+	return []oplogEntry{out}
+}
+
+// Unmarshals a document from a change event, logging any error
+func unmarshalChangeEventDocument(raw bson.Raw) (map[string]interface{}, bool) {
+	data := map[string]interface{}{}
+	if raw == nil {
+		return data, true
+	}
+
+	if err := bson.Unmarshal(raw, &data); err != nil {
+		log.Log.Errorf("unmarshalling change event data: %v", err)
+		return nil, false
+	}
+
+	return data, true
+}
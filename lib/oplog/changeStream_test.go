@@ -0,0 +1,237 @@
+package oplog
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/go-redis/redis/v8"
+	"github.com/kylelemons/godebug/pretty"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestParseChangeEvent(t *testing.T) {
+	ns := changeEventNamespace{Database: "foo", Collection: "Bar"}
+	ts := primitive.Timestamp{T: 1234}
+
+	tests := map[string]struct {
+		in   changeEvent
+		want []oplogEntry
+	}{
+		"Insert": {
+			in: changeEvent{
+				OperationType: "insert",
+				ClusterTime:   ts,
+				Namespace:     ns,
+				DocumentKey:   rawOplogEntryID{ID: "someid"},
+				FullDocument:  mustRaw(t, map[string]interface{}{"_id": "someid", "foo": "bar"}),
+			},
+			want: []oplogEntry{{
+				Timestamp:  ts,
+				Operation:  "i",
+				Namespace:  "foo.Bar",
+				Data:       map[string]interface{}{"_id": "someid", "foo": "bar"},
+				DocID:      interface{}("someid"),
+				Database:   "foo",
+				Collection: "Bar",
+			}},
+		},
+		"Update": {
+			in: func() changeEvent {
+				event := changeEvent{
+					OperationType: "update",
+					ClusterTime:   ts,
+					Namespace:     ns,
+					DocumentKey:   rawOplogEntryID{ID: "someid"},
+				}
+				event.UpdateDescription.UpdatedFields = mustRaw(t, map[string]interface{}{"a": "new"})
+				event.UpdateDescription.RemovedFields = []string{"b"}
+				return event
+			}(),
+			want: []oplogEntry{{
+				Timestamp: ts,
+				Operation: "u",
+				Namespace: "foo.Bar",
+				Data: map[string]interface{}{
+					"$set":   map[string]interface{}{"a": "new"},
+					"$unset": map[string]interface{}{"b": true},
+				},
+				DocID:      interface{}("someid"),
+				Database:   "foo",
+				Collection: "Bar",
+			}},
+		},
+		"Update with full document": {
+			in: func() changeEvent {
+				event := changeEvent{
+					OperationType: "update",
+					ClusterTime:   ts,
+					Namespace:     ns,
+					DocumentKey:   rawOplogEntryID{ID: "someid"},
+					FullDocument:  mustRaw(t, map[string]interface{}{"_id": "someid", "a": "new"}),
+				}
+				event.UpdateDescription.UpdatedFields = mustRaw(t, map[string]interface{}{"a": "new"})
+				return event
+			}(),
+			want: []oplogEntry{{
+				Timestamp:    ts,
+				Operation:    "u",
+				Namespace:    "foo.Bar",
+				Data:         map[string]interface{}{"$set": map[string]interface{}{"a": "new"}},
+				FullDocument: map[string]interface{}{"_id": "someid", "a": "new"},
+				DocID:        interface{}("someid"),
+				Database:     "foo",
+				Collection:   "Bar",
+			}},
+		},
+		"Replace": {
+			in: changeEvent{
+				OperationType: "replace",
+				ClusterTime:   ts,
+				Namespace:     ns,
+				DocumentKey:   rawOplogEntryID{ID: "someid"},
+				FullDocument:  mustRaw(t, map[string]interface{}{"_id": "someid", "foo": "baz"}),
+			},
+			want: []oplogEntry{{
+				Timestamp:  ts,
+				Operation:  "u",
+				Namespace:  "foo.Bar",
+				Data:       map[string]interface{}{"_id": "someid", "foo": "baz"},
+				DocID:      interface{}("someid"),
+				Database:   "foo",
+				Collection: "Bar",
+			}},
+		},
+		"Delete": {
+			in: changeEvent{
+				OperationType: "delete",
+				ClusterTime:   ts,
+				Namespace:     ns,
+				DocumentKey:   rawOplogEntryID{ID: "someid"},
+			},
+			want: []oplogEntry{{
+				Timestamp:  ts,
+				Operation:  "d",
+				Namespace:  "foo.Bar",
+				Data:       map[string]interface{}{"_id": "someid"},
+				DocID:      interface{}("someid"),
+				Database:   "foo",
+				Collection: "Bar",
+			}},
+		},
+		"Rename": {
+			in: changeEvent{
+				OperationType: "rename",
+				ClusterTime:   ts,
+				Namespace:     ns,
+				To:            changeEventNamespace{Database: "foo", Collection: "Baz"},
+			},
+			want: []oplogEntry{
+				{
+					Timestamp:  ts,
+					Operation:  "rename",
+					Namespace:  "foo.Bar",
+					Data:       map[string]interface{}{"from": "foo.Bar", "to": "foo.Baz"},
+					Database:   "foo",
+					Collection: "Bar",
+					TxIdx:      0,
+				},
+				{
+					Timestamp:  ts,
+					Operation:  "rename",
+					Namespace:  "foo.Baz",
+					Data:       map[string]interface{}{"from": "foo.Bar", "to": "foo.Baz"},
+					Database:   "foo",
+					Collection: "Baz",
+					TxIdx:      1,
+				},
+			},
+		},
+		"Drop database": {
+			in: changeEvent{
+				OperationType: "dropDatabase",
+				ClusterTime:   ts,
+				Namespace:     changeEventNamespace{Database: "foo"},
+			},
+			want: []oplogEntry{{
+				Timestamp: ts,
+				Operation: "dropDatabase",
+				Namespace: "foo",
+				Data:      map[string]interface{}{"db": "foo"},
+				Database:  "foo",
+			}},
+		},
+		"Invalidate": {
+			in: changeEvent{
+				OperationType: "invalidate",
+				ClusterTime:   ts,
+			},
+			want: nil,
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			got := parseChangeEvent(test.in)
+
+			if diff := pretty.Compare(got, test.want); diff != "" {
+				t.Errorf("Got incorrect result (-got +want)\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestGetResumeToken(t *testing.T) {
+	token := mustRaw(t, map[string]interface{}{"_data": "8263A1B2C3"})
+	encodeTime := func(d time.Time) string {
+		return strconv.FormatUint(uint64(d.Unix())<<32, 10)
+	}
+
+	tests := map[string]struct {
+		redisToken     string
+		redisTimestamp string
+		want           bson.Raw
+	}{
+		"Recent token": {
+			redisToken:     string(token),
+			redisTimestamp: encodeTime(time.Now().Add(-30 * time.Second)),
+			want:           token,
+		},
+		"Token too old": {
+			redisToken:     string(token),
+			redisTimestamp: encodeTime(time.Now().Add(-2 * time.Minute)),
+			want:           nil,
+		},
+		"No token": {
+			redisTimestamp: encodeTime(time.Now()),
+			want:           nil,
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			redisServer, err := miniredis.Run()
+			require.NoError(t, err)
+			defer redisServer.Close()
+
+			if test.redisToken != "" {
+				require.NoError(t, redisServer.Set("someprefix.lastProcessedResumeToken", test.redisToken))
+			}
+			require.NoError(t, redisServer.Set("someprefix.lastProcessedEntry", test.redisTimestamp))
+
+			tailer := Tailer{
+				RedisClient: redis.NewUniversalClient(&redis.UniversalOptions{
+					Addrs: []string{redisServer.Addr()},
+				}),
+				RedisPrefix: "someprefix.",
+				MaxCatchUp:  time.Minute,
+			}
+
+			assert.Equal(t, test.want, tailer.getResumeToken())
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package oplog
+
+import (
+	"io/ioutil"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+)
+
+// channelTemplateData is the data available to a channel template
+type channelTemplateData struct {
+	Database   string
+	Collection string
+	DocID      string
+	Operation  string
+}
+
+// NewChannelTemplate parses a text/template used to name the channels we
+// publish to (see config.ChannelTemplate). The template may reference
+// {{.Database}}, {{.Collection}}, {{.DocID}}, and {{.Operation}}. It's
+// validated by rendering it against sample data, so templates that reference
+// unknown fields are rejected here rather than when publishing.
+func NewChannelTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("channel").Parse(text)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing channel template")
+	}
+
+	err = tmpl.Execute(ioutil.Discard, channelTemplateData{
+		Database:   "db",
+		Collection: "collection",
+		DocID:      "id",
+		Operation:  "update",
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "validating channel template")
+	}
+
+	return tmpl, nil
+}
+
+// Renders the collection and document channels for the given entry. The
+// template is rendered with an empty DocID for the collection channel, and
+// with the document's ID for the document channel. If the two are the same
+// (because the template doesn't reference DocID), the returned document
+// channel is empty so we only publish once.
+func renderChannels(tmpl *template.Template, op *oplogEntry, idForChannel string) (string, string, error) {
+	data := channelTemplateData{
+		Database:   op.Database,
+		Collection: op.Collection,
+		Operation:  operationName(op),
+	}
+
+	var collectionChannel strings.Builder
+	if err := tmpl.Execute(&collectionChannel, data); err != nil {
+		return "", "", errors.Wrap(err, "rendering collection channel")
+	}
+
+	data.DocID = idForChannel
+
+	var specificChannel strings.Builder
+	if err := tmpl.Execute(&specificChannel, data); err != nil {
+		return "", "", errors.Wrap(err, "rendering document channel")
+	}
+
+	if specificChannel.String() == collectionChannel.String() {
+		return collectionChannel.String(), "", nil
+	}
+
+	return collectionChannel.String(), specificChannel.String(), nil
+}
+
+// Returns a human-readable name for the entry's operation
+func operationName(op *oplogEntry) string {
+	switch op.Operation {
+	case operationInsert:
+		return "insert"
+	case operationUpdate:
+		return "update"
+	case operationRemove:
+		return "remove"
+	default:
+		return op.Operation
+	}
+}
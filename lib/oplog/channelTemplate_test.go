@@ -0,0 +1,90 @@
+package oplog
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestNewChannelTemplate(t *testing.T) {
+	tests := map[string]struct {
+		in          string
+		expectError bool
+	}{
+		"Valid": {
+			in: "changes:{{.Database}}:{{.Collection}}",
+		},
+		"Syntax error": {
+			in:          "changes:{{.Database",
+			expectError: true,
+		},
+		"Unknown field": {
+			in:          "changes:{{.Namespace}}",
+			expectError: true,
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			_, err := NewChannelTemplate(test.in)
+
+			if test.expectError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestProcessOplogEntryChannelTemplate(t *testing.T) {
+	testObjectID, err := primitive.ObjectIDFromHex("deadbeefdeadbeefdeadbeef")
+	require.NoError(t, err)
+
+	entry := &oplogEntry{
+		DocID:      testObjectID,
+		Operation:  "u",
+		Namespace:  "foo.bar",
+		Database:   "foo",
+		Collection: "bar",
+		Data:       map[string]interface{}{"some": "field"},
+		Timestamp:  primitive.Timestamp{T: 1234},
+	}
+
+	tests := map[string]struct {
+		template              string
+		wantCollectionChannel string
+		wantSpecificChannel   string
+	}{
+		"Equivalent to default": {
+			template:              "{{.Database}}.{{.Collection}}{{if .DocID}}::{{.DocID}}{{end}}",
+			wantCollectionChannel: "foo.bar",
+			wantSpecificChannel:   "foo.bar::deadbeefdeadbeefdeadbeef",
+		},
+		"Collection only": {
+			template:              "changes:{{.Database}}:{{.Collection}}",
+			wantCollectionChannel: "changes:foo:bar",
+			wantSpecificChannel:   "",
+		},
+		"With operation": {
+			template:              "{{.Operation}}/{{.Database}}/{{.Collection}}{{with .DocID}}/{{.}}{{end}}",
+			wantCollectionChannel: "update/foo/bar",
+			wantSpecificChannel:   "update/foo/bar/deadbeefdeadbeefdeadbeef",
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			tmpl, err := NewChannelTemplate(test.template)
+			require.NoError(t, err)
+
+			pub, err := (&Tailer{ChannelTemplate: tmpl}).processOplogEntry(entry)
+			require.NoError(t, err)
+
+			assert.Equal(t, test.wantCollectionChannel, pub.CollectionChannel)
+			assert.Equal(t, test.wantSpecificChannel, pub.SpecificChannel)
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package oplog
+
+import (
+	"sync"
+)
+
+// otherCollectionsLabel is the collection label of the entries of the
+// collections past CollectionLabels' limit
+const otherCollectionsLabel = "(other)"
+
+// CollectionLabels provides the collection label for the oplog metrics,
+// while limiting how many distinct collections get one, so that a database
+// with thousands of collections can't blow up the metrics' cardinality. Once
+// the limit is reached, further collections are labeled "(other)".
+type CollectionLabels struct {
+	lock sync.Mutex
+	max  int
+	seen map[string]bool
+}
+
+// NewCollectionLabels creates a CollectionLabels that gives at most max
+// collections (across all databases) their own label. See
+// config.MetricMaxCollections.
+func NewCollectionLabels(max int) *CollectionLabels {
+	return &CollectionLabels{
+		max:  max,
+		seen: map[string]bool{},
+	}
+}
+
+// Returns the collection label for an entry in the given namespace. It's
+// safe to call on a nil CollectionLabels, which returns an empty label (which
+// Prometheus treats as no label at all).
+func (labels *CollectionLabels) label(database, collection string) string {
+	if labels == nil || collection == "" {
+		return ""
+	}
+
+	labels.lock.Lock()
+	defer labels.lock.Unlock()
+
+	namespace := database + "." + collection
+	if !labels.seen[namespace] {
+		if len(labels.seen) >= labels.max {
+			return otherCollectionsLabel
+		}
+
+		labels.seen[namespace] = true
+	}
+
+	return collection
+}
@@ -0,0 +1,37 @@
+package oplog
+
+import (
+	"testing"
+)
+
+func TestCollectionLabels(t *testing.T) {
+	labels := NewCollectionLabels(2)
+
+	steps := []struct {
+		database   string
+		collection string
+		want       string
+	}{
+		{"db1", "users", "users"},
+		{"db1", "posts", "posts"},
+		{"db1", "users", "users"},
+		{"db1", "comments", "(other)"},
+		{"db2", "users", "(other)"},
+		{"db1", "posts", "posts"},
+		{"db1", "", ""},
+	}
+
+	for _, step := range steps {
+		if got := labels.label(step.database, step.collection); got != step.want {
+			t.Errorf("label(%s, %s) = %s; want %s", step.database, step.collection, got, step.want)
+		}
+	}
+}
+
+func TestCollectionLabelsDisabled(t *testing.T) {
+	var labels *CollectionLabels
+
+	if got := labels.label("db1", "users"); got != "" {
+		t.Errorf("Expected an empty label from a nil CollectionLabels, got %s", got)
+	}
+}
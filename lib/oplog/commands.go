@@ -0,0 +1,101 @@
+package oplog
+
+import (
+	"github.com/vlasky/oplogtoredis/lib/log"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// converts a rawOplogEntry for a command into oplogEntries. Transactions
+// (applyOps) are expanded into the operations they contain, and commands that
+// affect an entire collection are converted into namespace events. Other
+// commands are ignored.
+func (tailer *Tailer) parseCommandOplogEntry(entry rawOplogEntry, txIdx *uint) []oplogEntry {
+	if _, err := entry.Doc.LookupErr("applyOps"); err == nil {
+		return tailer.parseTransactionOplogEntry(entry, txIdx)
+	}
+
+	if from, ok := entry.Doc.Lookup("renameCollection").StringValueOK(); ok {
+		// { renameCollection: "db.from", to: "db.to", stayTemp: false }
+		//
+		// We notify subscribers of both the old and new collections
+		to, _ := entry.Doc.Lookup("to").StringValueOK()
+		data := map[string]interface{}{"from": from, "to": to}
+
+		return []oplogEntry{
+			newNamespaceEvent(entry, operationRename, from, data, txIdx),
+			newNamespaceEvent(entry, operationRename, to, data, txIdx),
+		}
+	}
+
+	database, _ := parseNamespace(entry.Namespace)
+
+	if collection, ok := entry.Doc.Lookup("drop").StringValueOK(); ok {
+		// { drop: "collection" }
+		namespace := database + "." + collection
+		data := map[string]interface{}{"ns": namespace}
+
+		return []oplogEntry{newNamespaceEvent(entry, operationDrop, namespace, data, txIdx)}
+	}
+
+	if _, err := entry.Doc.LookupErr("dropDatabase"); err == nil {
+		// { dropDatabase: 1 }
+		//
+		// This is published on a channel named after just the database, and
+		// means that every collection in the database is gone. Mongo also
+		// writes a drop entry for each collection before this entry.
+		data := map[string]interface{}{"db": database}
+
+		return []oplogEntry{newNamespaceEvent(entry, operationDropDatabase, database, data, txIdx)}
+	}
+
+	return nil
+}
+
+// converts an applyOps command (which is how transactions appear in the
+// oplog) into the operations it contains. Mongo logs transactions in
+// admin.$cmd, but applyOps commands run by tools (e.g. mongorestore
+// --oplogReplay) can be logged in the command namespace of another database,
+// so we accept any of them.
+func (tailer *Tailer) parseTransactionOplogEntry(entry rawOplogEntry, txIdx *uint) []oplogEntry {
+	if !isCommandNamespace(entry.Namespace) {
+		return nil
+	}
+
+	var txData struct {
+		ApplyOps []rawOplogEntry `bson:"applyOps"`
+	}
+
+	if err := bson.Unmarshal(entry.Doc, &txData); err != nil {
+		log.Log.Errorf("unmarshaling transaction data: %v", err)
+		return nil
+	}
+
+	var ret []oplogEntry
+
+	for _, v := range txData.ApplyOps {
+		v.Timestamp = entry.Timestamp
+		v.Wall = entry.Wall
+		ret = append(ret, tailer.parseRawOplogEntry(v, txIdx)...)
+	}
+
+	return ret
+}
+
+// Constructs an oplogEntry for a namespace event affecting the given namespace
+func newNamespaceEvent(entry rawOplogEntry, operation string, namespace string, data map[string]interface{}, txIdx *uint) oplogEntry {
+	out := oplogEntry{
+		Operation: operation,
+		Timestamp: entry.Timestamp,
+		Wall:      entry.Wall,
+		Namespace: namespace,
+		Data:      data,
+
+		TxIdx: *txIdx,
+	}
+
+	*txIdx++
+
+	out.Database, out.Collection = parseNamespace(out.Namespace)
+
+	return out
+}
@@ -0,0 +1,172 @@
+package oplog
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// distributionBuckets is how many buckets a Distribution's window is split
+// into. The window rolls forward a bucket at a time.
+const distributionBuckets = 6
+
+// Distribution keeps a rolling count of the oplog entries (and their total
+// size) received for each collection, so we can see which collections are
+// generating the most oplog volume right now. It's fed the same data as
+// otr_oplog_entries_by_size, but isn't limited by the metrics' label
+// cardinality.
+//
+// Like IntervalMaxMetric, it buckets time into fixed-length intervals
+// reckoned from when it was created; it reports on the buckets within the
+// window, so the reported period is between (distributionBuckets-1)/
+// distributionBuckets of the window and the whole window.
+type Distribution struct {
+	opts *DistributionOpts
+
+	// The start of bucket 0. Only used as a source of monotonic time.
+	startBucket time.Time
+
+	lock    sync.Mutex
+	buckets [distributionBuckets]distributionBucket
+}
+
+// DistributionOpts are options for Distribution
+type DistributionOpts struct {
+	// Window is the period the Distribution reports on. Default 1m.
+	Window time.Duration
+
+	NowFunc func() time.Time
+}
+
+type distributionBucket struct {
+	index      uint
+	namespaces map[string]*CollectionVolume
+}
+
+// CollectionVolume is the oplog volume of a single collection within a
+// Distribution's window
+type CollectionVolume struct {
+	Database   string `json:"database"`
+	Collection string `json:"collection"`
+	Entries    int64  `json:"entries"`
+	Bytes      int64  `json:"bytes"`
+}
+
+// NewDistribution creates a Distribution
+func NewDistribution(opts *DistributionOpts) *Distribution {
+	if opts == nil {
+		opts = &DistributionOpts{}
+	}
+
+	if opts.Window == 0 {
+		opts.Window = DefaultInterval
+	}
+
+	if opts.NowFunc == nil {
+		opts.NowFunc = time.Now
+	}
+
+	return &Distribution{
+		opts:        opts,
+		startBucket: opts.NowFunc(),
+	}
+}
+
+// Window returns the period the Distribution reports on
+func (dist *Distribution) Window() time.Duration {
+	return dist.opts.Window
+}
+
+// Returns the index of the bucket we're currently in
+func (dist *Distribution) thisBucket() uint {
+	bucketLength := dist.opts.Window / distributionBuckets
+	return uint(dist.opts.NowFunc().Sub(dist.startBucket) / bucketLength)
+}
+
+// Records an oplog entry of the given size. It's safe to call on a nil
+// Distribution, which records nothing.
+func (dist *Distribution) record(database, collection string, size float64) {
+	if dist == nil || collection == "" {
+		return
+	}
+
+	dist.lock.Lock()
+	defer dist.lock.Unlock()
+
+	index := dist.thisBucket()
+	bucket := &dist.buckets[index%distributionBuckets]
+	if bucket.namespaces == nil || bucket.index != index {
+		bucket.index = index
+		bucket.namespaces = map[string]*CollectionVolume{}
+	}
+
+	namespace := database + "." + collection
+	volume, ok := bucket.namespaces[namespace]
+	if !ok {
+		volume = &CollectionVolume{Database: database, Collection: collection}
+		bucket.namespaces[namespace] = volume
+	}
+
+	volume.Entries++
+	volume.Bytes += int64(size)
+}
+
+// Top returns the (at most) n collections with the most oplog entries within
+// the window, and the n collections with the largest total size of oplog
+// entries, in descending order.
+func (dist *Distribution) Top(n int) (byEntries []CollectionVolume, byBytes []CollectionVolume) {
+	dist.lock.Lock()
+
+	current := dist.thisBucket()
+	totals := map[string]*CollectionVolume{}
+	for _, bucket := range dist.buckets {
+		if bucket.namespaces == nil || bucket.index > current || current-bucket.index >= distributionBuckets {
+			continue
+		}
+
+		for namespace, volume := range bucket.namespaces {
+			total, ok := totals[namespace]
+			if !ok {
+				total = &CollectionVolume{Database: volume.Database, Collection: volume.Collection}
+				totals[namespace] = total
+			}
+
+			total.Entries += volume.Entries
+			total.Bytes += volume.Bytes
+		}
+	}
+
+	dist.lock.Unlock()
+
+	volumes := make([]CollectionVolume, 0, len(totals))
+	for _, total := range totals {
+		volumes = append(volumes, *total)
+	}
+
+	byEntries = topVolumes(volumes, n, func(a, b CollectionVolume) bool { return a.Entries > b.Entries })
+	byBytes = topVolumes(volumes, n, func(a, b CollectionVolume) bool { return a.Bytes > b.Bytes })
+	return
+}
+
+// Returns the first n of a copy of volumes, sorted with the given function
+// (and then by namespace, so that ties are in a stable order)
+func topVolumes(volumes []CollectionVolume, n int, greater func(a, b CollectionVolume) bool) []CollectionVolume {
+	sorted := make([]CollectionVolume, len(volumes))
+	copy(sorted, volumes)
+	sort.Slice(sorted, func(i, j int) bool {
+		if greater(sorted[i], sorted[j]) {
+			return true
+		}
+		if greater(sorted[j], sorted[i]) {
+			return false
+		}
+
+		return sorted[i].Database+"."+sorted[i].Collection < sorted[j].Database+"."+sorted[j].Collection
+	})
+
+	if len(sorted) > n {
+		sorted = sorted[:n]
+	}
+
+	return sorted
+}
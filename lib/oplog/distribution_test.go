@@ -0,0 +1,63 @@
+package oplog
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDistribution(t *testing.T) {
+	now := time.Now()
+	dist := NewDistribution(&DistributionOpts{
+		Window:  time.Minute,
+		NowFunc: func() time.Time { return now },
+	})
+
+	dist.record("db1", "users", 100)
+	dist.record("db1", "users", 100)
+	dist.record("db1", "users", 100)
+	dist.record("db1", "posts", 5000)
+	dist.record("db2", "users", 10)
+	dist.record("db2", "", 10)
+
+	byEntries, byBytes := dist.Top(2)
+	assert.Equal(t, []CollectionVolume{
+		{Database: "db1", Collection: "users", Entries: 3, Bytes: 300},
+		{Database: "db1", Collection: "posts", Entries: 1, Bytes: 5000},
+	}, byEntries)
+	assert.Equal(t, []CollectionVolume{
+		{Database: "db1", Collection: "posts", Entries: 1, Bytes: 5000},
+		{Database: "db1", Collection: "users", Entries: 3, Bytes: 300},
+	}, byBytes)
+
+	// Later entries are added to the ones still in the window
+	now = now.Add(30 * time.Second)
+	dist.record("db2", "users", 10)
+	dist.record("db2", "users", 10)
+	dist.record("db2", "users", 10)
+
+	byEntries, _ = dist.Top(1)
+	assert.Equal(t, []CollectionVolume{
+		{Database: "db2", Collection: "users", Entries: 4, Bytes: 40},
+	}, byEntries)
+
+	// Once the window has passed, the earlier entries are dropped
+	now = now.Add(45 * time.Second)
+	byEntries, byBytes = dist.Top(10)
+	assert.Equal(t, []CollectionVolume{
+		{Database: "db2", Collection: "users", Entries: 3, Bytes: 30},
+	}, byEntries)
+	assert.Equal(t, byEntries, byBytes)
+
+	now = now.Add(time.Minute)
+	byEntries, _ = dist.Top(10)
+	assert.Empty(t, byEntries)
+}
+
+func TestDistributionDisabled(t *testing.T) {
+	var dist *Distribution
+
+	// Doesn't panic
+	dist.record("db1", "users", 100)
+}
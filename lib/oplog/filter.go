@@ -0,0 +1,146 @@
+package oplog
+
+import (
+	"path"
+	"strings"
+)
+
+// Returns whether the given namespace matches any of the given path.Match
+// patterns. Malformed patterns never match; they're rejected when the config
+// is parsed.
+func namespaceMatchesAny(namespace string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, namespace); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns whether entries for the given namespace should be published,
+// according to the tailer's Allowlist and Denylist
+func (tailer *Tailer) namespaceAllowed(namespace string) bool {
+	if len(tailer.Allowlist) > 0 && !namespaceMatchesAny(namespace, tailer.Allowlist) {
+		return false
+	}
+
+	return !namespaceMatchesAny(namespace, tailer.Denylist)
+}
+
+// Returns whether entries for the given database should be published,
+// according to the tailer's Databases
+func (tailer *Tailer) databaseAllowed(database string) bool {
+	if len(tailer.Databases) == 0 {
+		return true
+	}
+
+	for _, allowed := range tailer.Databases {
+		if allowed == database {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns the subset of entries that should be published
+func (tailer *Tailer) filterEntries(entries []oplogEntry) []oplogEntry {
+	if len(tailer.Allowlist) == 0 && len(tailer.Denylist) == 0 && len(tailer.Databases) == 0 {
+		return entries
+	}
+
+	filtered := entries[:0]
+	for _, entry := range entries {
+		if tailer.databaseAllowed(entry.Database) && tailer.namespaceAllowed(entry.Namespace) {
+			filtered = append(filtered, entry)
+		}
+	}
+
+	return filtered
+}
+
+// Returns the name an entry's operation has in the tailer's OperationFilter
+func filterOperationName(entry *oplogEntry) string {
+	if entry.IsNamespaceEvent() {
+		return "command"
+	}
+
+	return operationLabel(entry.Operation)
+}
+
+// Returns whether the given entry's operation should be published, according
+// to the tailer's OperationFilter
+func (tailer *Tailer) operationAllowed(entry *oplogEntry) bool {
+	operation := filterOperationName(entry)
+	matched := false
+
+	for pattern, operations := range tailer.OperationFilter {
+		if ok, _ := path.Match(pattern, entry.Namespace); !ok {
+			continue
+		}
+
+		matched = true
+		for _, allowed := range operations {
+			if allowed == operation {
+				return true
+			}
+		}
+	}
+
+	return !matched
+}
+
+// Returns the subset of entries whose operations should be published
+func (tailer *Tailer) filterOperations(entries []oplogEntry) []oplogEntry {
+	if len(tailer.OperationFilter) == 0 {
+		return entries
+	}
+
+	filtered := entries[:0]
+	for i := range entries {
+		if tailer.operationAllowed(&entries[i]) {
+			filtered = append(filtered, entries[i])
+		}
+	}
+
+	return filtered
+}
+
+// Returns the fields the tailer's FieldFilter lists for the given namespace,
+// and whether any of its patterns matched the namespace
+func (tailer *Tailer) fieldsOfInterest(namespace string) ([]string, bool) {
+	var fields []string
+	matched := false
+
+	for pattern, patternFields := range tailer.FieldFilter {
+		if ok, _ := path.Match(pattern, namespace); ok {
+			matched = true
+			fields = append(fields, patternFields...)
+		}
+	}
+
+	return fields, matched
+}
+
+// Returns the changed fields that overlap any of the fields of interest
+func intersectFields(changed []string, interesting []string) []string {
+	var result []string
+
+	for _, field := range changed {
+		for _, interestingField := range interesting {
+			if fieldsOverlap(field, interestingField) {
+				result = append(result, field)
+				break
+			}
+		}
+	}
+
+	return result
+}
+
+// Returns whether a change to one of the given (possibly dotted) field paths
+// affects the other: they're the same, or one is within the other
+func fieldsOverlap(a string, b string) bool {
+	return a == b || strings.HasPrefix(a, b+".") || strings.HasPrefix(b, a+".")
+}
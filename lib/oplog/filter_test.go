@@ -0,0 +1,208 @@
+package oplog
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestNamespaceAllowed(t *testing.T) {
+	tests := map[string]struct {
+		allowlist []string
+		denylist  []string
+		namespace string
+		want      bool
+	}{
+		"No lists": {
+			namespace: "foo.bar",
+			want:      true,
+		},
+		"Exact allowlist match": {
+			allowlist: []string{"foo.bar"},
+			namespace: "foo.bar",
+			want:      true,
+		},
+		"Wildcard allowlist match": {
+			allowlist: []string{"baz.qux", "foo.*"},
+			namespace: "foo.bar",
+			want:      true,
+		},
+		"Not in allowlist": {
+			allowlist: []string{"foo.*"},
+			namespace: "other.bar",
+			want:      false,
+		},
+		"Denylisted": {
+			denylist:  []string{"foo.bar"},
+			namespace: "foo.bar",
+			want:      false,
+		},
+		"Not denylisted": {
+			denylist:  []string{"foo.bar"},
+			namespace: "foo.baz",
+			want:      true,
+		},
+		"Denylist overrides allowlist": {
+			allowlist: []string{"foo.*"},
+			denylist:  []string{"foo.secret"},
+			namespace: "foo.secret",
+			want:      false,
+		},
+		"Wildcard database": {
+			denylist:  []string{"*.sessions"},
+			namespace: "foo.sessions",
+			want:      false,
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			tailer := &Tailer{Allowlist: test.allowlist, Denylist: test.denylist}
+
+			got := tailer.namespaceAllowed(test.namespace)
+			if got != test.want {
+				t.Errorf("namespaceAllowed(%s) = %t; want %t", test.namespace, got, test.want)
+			}
+		})
+	}
+}
+
+func TestFilterEntries(t *testing.T) {
+	tailer := &Tailer{Denylist: []string{"foo.secret"}}
+
+	got := tailer.filterEntries([]oplogEntry{
+		{Namespace: "foo.bar", TxIdx: 0},
+		{Namespace: "foo.secret", TxIdx: 1},
+		{Namespace: "foo.baz", TxIdx: 2},
+	})
+
+	if len(got) != 2 || got[0].TxIdx != 0 || got[1].TxIdx != 2 {
+		t.Errorf("filterEntries returned incorrect entries: %#v", got)
+	}
+}
+
+func TestFilterEntriesDatabases(t *testing.T) {
+	tailer := &Tailer{
+		Databases: []string{"app", "analytics"},
+		Denylist:  []string{"app.secret"},
+	}
+
+	got := tailer.filterEntries([]oplogEntry{
+		{Namespace: "app.users", Database: "app", TxIdx: 0},
+		{Namespace: "other.users", Database: "other", TxIdx: 1},
+		{Namespace: "analytics.events", Database: "analytics", TxIdx: 2},
+		{Namespace: "app.secret", Database: "app", TxIdx: 3},
+		{Namespace: "apps.users", Database: "apps", TxIdx: 4},
+	})
+
+	if len(got) != 2 || got[0].TxIdx != 0 || got[1].TxIdx != 2 {
+		t.Errorf("filterEntries returned incorrect entries: %#v", got)
+	}
+}
+
+func TestOperationAllowed(t *testing.T) {
+	filter := map[string][]string{
+		"foo.events": {"insert"},
+		"bar.*":      {"insert", "update"},
+		"bar.logs":   {"remove"},
+	}
+
+	tests := map[string]struct {
+		entry oplogEntry
+		want  bool
+	}{
+		"Restricted namespace, allowed operation": {
+			entry: oplogEntry{Namespace: "foo.events", Operation: "i"},
+			want:  true,
+		},
+		"Restricted namespace, disallowed update": {
+			entry: oplogEntry{Namespace: "foo.events", Operation: "u"},
+			want:  false,
+		},
+		"Restricted namespace, disallowed remove": {
+			entry: oplogEntry{Namespace: "foo.events", Operation: "d"},
+			want:  false,
+		},
+		"Restricted namespace, disallowed command": {
+			entry: oplogEntry{Namespace: "foo.events", Operation: operationDrop},
+			want:  false,
+		},
+		"Unrestricted namespace": {
+			entry: oplogEntry{Namespace: "foo.other", Operation: "d"},
+			want:  true,
+		},
+		"Wildcard pattern": {
+			entry: oplogEntry{Namespace: "bar.users", Operation: "u"},
+			want:  true,
+		},
+		"Operations from several matching patterns": {
+			entry: oplogEntry{Namespace: "bar.logs", Operation: "d"},
+			want:  true,
+		},
+	}
+
+	tailer := &Tailer{OperationFilter: filter}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			got := tailer.operationAllowed(&test.entry)
+			if got != test.want {
+				t.Errorf("operationAllowed(%s %s) = %t; want %t", test.entry.Namespace, test.entry.Operation, got, test.want)
+			}
+		})
+	}
+}
+
+func TestProcessEntriesOperationFilter(t *testing.T) {
+	ts := primitive.Timestamp{T: 1500000000, I: 1}
+	entries := func() []oplogEntry {
+		return []oplogEntry{{
+			Namespace:  "foo.events",
+			Database:   "foo",
+			Collection: "events",
+			Operation:  "u",
+			Timestamp:  ts,
+			DocID:      "someid",
+			Data:       map[string]interface{}{"$set": map[string]interface{}{"a": 1}},
+		}}
+	}
+
+	t.Run("Allow all by default", func(t *testing.T) {
+		tailer := &Tailer{}
+		pubs := tailer.processEntries(entries(), 100, "update")
+
+		if len(pubs) != 1 || pubs[0].TimestampOnly {
+			t.Errorf("Expected a publication, got %#v", pubs)
+		}
+	})
+
+	t.Run("Restricted operations", func(t *testing.T) {
+		tailer := &Tailer{OperationFilter: map[string][]string{"foo.events": {"insert"}}}
+		pubs := tailer.processEntries(entries(), 100, "update")
+
+		if len(pubs) != 1 || !pubs[0].TimestampOnly || pubs[0].OplogTimestamp != ts {
+			t.Errorf("Expected only a timestamp publication, got %#v", pubs)
+		}
+	})
+}
+
+func TestProcessEntriesFilteredNamespace(t *testing.T) {
+	// Entries the allowlist, denylist, or OTR_DATABASES filter out still
+	// advance the last-processed timestamp
+	ts := primitive.Timestamp{T: 1500000000, I: 1}
+	entries := []oplogEntry{{
+		Namespace:  "foo.secrets",
+		Database:   "foo",
+		Collection: "secrets",
+		Operation:  "i",
+		Timestamp:  ts,
+		DocID:      "someid",
+	}}
+
+	tailer := &Tailer{Denylist: []string{"foo.secrets"}}
+	pubs := tailer.processEntries(entries, 100, "insert")
+
+	if len(pubs) != 1 || !pubs[0].TimestampOnly || pubs[0].OplogTimestamp != ts {
+		t.Errorf("Expected only a timestamp publication, got %#v", pubs)
+	}
+}
@@ -0,0 +1,66 @@
+package oplog
+
+import (
+	"context"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/vlasky/oplogtoredis/lib/config"
+	"github.com/vlasky/oplogtoredis/lib/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var metricFullDocumentLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "otr",
+	Subsystem: "oplog",
+	Name:      "full_document_lookups",
+	Help:      "Queries against Mongo to fetch the full document for an update, partitioned by database and status (found, not_found, or error)",
+}, []string{"database", "status"})
+
+// Returns whether we should publish the full document for updates to the
+// given namespace
+func (tailer *Tailer) wantsFullDocument(namespace string) bool {
+	for _, ns := range tailer.FullDocumentCollections {
+		if ns == namespace {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Populates op.FullDocument for updates to collections listed in
+// FullDocumentCollections. If the lookup fails, op.FullDocument is left nil
+// and we just publish the document ID as usual. Entries from a change stream
+// opened with fullDocument: updateLookup already have op.FullDocument set.
+func (tailer *Tailer) lookupFullDocument(op *oplogEntry) {
+	if !op.IsUpdate() || op.FullDocument != nil || !hasDocID(op) || tailer.MongoClient == nil || !tailer.wantsFullDocument(op.Namespace) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.MongoFindTimeout())
+	defer cancel()
+
+	var doc map[string]interface{}
+	err := tailer.MongoClient.Database(op.Database).Collection(op.Collection).
+		FindOne(ctx, bson.M{"_id": op.DocID}).
+		Decode(&doc)
+
+	switch {
+	case err == mongo.ErrNoDocuments:
+		// The document was removed after this update; the remove will be
+		// published separately
+		metricFullDocumentLookups.WithLabelValues(op.Database, "not_found").Inc()
+	case err != nil:
+		metricFullDocumentLookups.WithLabelValues(op.Database, "error").Inc()
+		countMongoError(err)
+		log.Log.Errorw("Error looking up full document for update; publishing ID only",
+			"error", err,
+			"database", op.Database,
+			"collection", op.Collection)
+	default:
+		metricFullDocumentLookups.WithLabelValues(op.Database, "found").Inc()
+		op.FullDocument = doc
+	}
+}
@@ -0,0 +1,78 @@
+package oplog
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// The top-level keys of the messages we publish, as redis-oplog expects them.
+// Tailer.PayloadKeys can rename them.
+const (
+	payloadKeyEvent     = "e"
+	payloadKeyData      = "d"
+	payloadKeyFields    = "f"
+	payloadKeyTimestamp = "ts"
+	payloadKeyOperation = "op"
+)
+
+// message is the top-level object of a message we publish. It marshals to a
+// JSON object with its fields in order, so that the messages have the same
+// layout as redis-oplog's, whatever their keys are called.
+type message []messageField
+
+type messageField struct {
+	key   string
+	value interface{}
+}
+
+func (msg message) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+
+	for i, field := range msg {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+
+		key, err := json.Marshal(field.key)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+
+		value, err := json.Marshal(field.value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(value)
+	}
+
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// Returns the field of a message with the given key (one of the payloadKey
+// constants), renamed according to the tailer's PayloadKeys
+func (tailer *Tailer) messageField(key string, value interface{}) messageField {
+	if renamed, ok := tailer.PayloadKeys[key]; ok {
+		key = renamed
+	}
+
+	return messageField{key: key, value: value}
+}
+
+// Builds a message for op from the given fields, followed by op's operation
+// and timestamp if the tailer includes them
+func (tailer *Tailer) newMessage(op *oplogEntry, fields ...messageField) message {
+	msg := message(fields)
+	if operation := tailer.messageOperation(op); operation != "" {
+		msg = append(msg, tailer.messageField(payloadKeyOperation, operation))
+	}
+
+	if ts := tailer.messageTimestamp(op); ts != nil {
+		msg = append(msg, tailer.messageField(payloadKeyTimestamp, ts))
+	}
+
+	return msg
+}
@@ -0,0 +1,104 @@
+package oplog
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/vlasky/oplogtoredis/lib/config"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MongoClientOptions returns the options for connecting to Mongo: the
+// options in config.MongoURL, with the authentication, TLS, app name, and
+// pool size settings from the other config options applied on top. It's used both for
+// the main client and for the clients we connect directly to each shard.
+func MongoClientOptions() (*options.ClientOptions, error) {
+	clientOptions := options.Client().ApplyURI(config.MongoURL())
+	if err := clientOptions.Validate(); err != nil {
+		return nil, errors.Wrap(err, "parsing Mongo URL")
+	}
+
+	if mechanism := config.MongoAuthMechanism(); mechanism != "" {
+		if clientOptions.Auth == nil {
+			clientOptions.Auth = &options.Credential{}
+		}
+		clientOptions.Auth.AuthMechanism = mechanism
+
+		// These mechanisms authenticate against the virtual $external
+		// database, whatever database the URL names
+		switch mechanism {
+		case "MONGODB-X509", "MONGODB-AWS", "GSSAPI", "PLAIN":
+			clientOptions.Auth.AuthSource = "$external"
+		}
+	}
+
+	if config.MongoTLSCAFile() != "" || config.MongoTLSCertFile() != "" {
+		tlsConfig, err := mongoTLSConfig(clientOptions.TLSConfig)
+		if err != nil {
+			return nil, err
+		}
+		clientOptions.SetTLSConfig(tlsConfig)
+	}
+
+	clientOptions.SetAppName(config.MongoAppName())
+
+	if timeout := config.MongoServerSelectionTimeout(); timeout > 0 {
+		clientOptions.SetServerSelectionTimeout(timeout)
+	}
+
+	// The driver treats a max pool size of 0 as unlimited, so we only set it
+	// if it's configured
+	if size := config.MongoMaxPoolSize(); size > 0 {
+		clientOptions.SetMaxPoolSize(uint64(size))
+	}
+	clientOptions.SetPoolMonitor(mongoPoolMonitor)
+
+	if clientOptions.Auth != nil && clientOptions.Auth.AuthMechanism == "MONGODB-X509" &&
+		(clientOptions.TLSConfig == nil || len(clientOptions.TLSConfig.Certificates) == 0) {
+		return nil, errors.New("MONGODB-X509 authentication requires a client certificate (OTR_MONGO_TLS_CERT_FILE, or tlsCertificateKeyFile in the Mongo URL)")
+	}
+
+	return clientOptions, nil
+}
+
+// Returns the TLS config for Mongo, starting from the one from the Mongo URL
+// (if any) and applying config.MongoTLSCAFile and config.MongoTLSCertFile
+func mongoTLSConfig(fromURL *tls.Config) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+	if fromURL != nil {
+		tlsConfig = fromURL.Clone()
+	}
+
+	if caFile := config.MongoTLSCAFile(); caFile != "" {
+		caPEM, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "reading OTR_MONGO_TLS_CA_FILE")
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caPEM) {
+			return nil, errors.Errorf("no certificates found in OTR_MONGO_TLS_CA_FILE (%s)", caFile)
+		}
+	}
+
+	if certFile := config.MongoTLSCertFile(); certFile != "" {
+		// Mongo usually keeps the certificate and key in the same file
+		keyFile := config.MongoTLSKeyFile()
+		if keyFile == "" {
+			keyFile = certFile
+		}
+
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "loading OTR_MONGO_TLS_CERT_FILE and OTR_MONGO_TLS_KEY_FILE")
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
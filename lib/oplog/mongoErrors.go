@@ -0,0 +1,113 @@
+package oplog
+
+import (
+	"errors"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/auth"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
+)
+
+// Kinds of Mongo errors, for the kind label of otr_mongo_errors_total
+const (
+	// A query or read took longer than its timeout
+	mongoErrorTimeout = "timeout"
+
+	// Our position in the oplog (or change stream) is no longer available
+	mongoErrorPositionLost = "position_lost"
+
+	// We couldn't authenticate, or aren't authorized to run the query
+	mongoErrorAuth = "auth"
+
+	// We couldn't connect to a server, or lost our connection to it
+	mongoErrorNetwork = "network"
+
+	// No server matched the read preference in time, e.g. during an election
+	mongoErrorServerSelection = "server_selection"
+
+	// The server we were reading from stopped being the primary, or is
+	// shutting down
+	mongoErrorPrimaryChange = "primary_change"
+
+	// Anything else
+	mongoErrorOther = "other"
+)
+
+var metricMongoErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "otr",
+	Name:      "mongo_errors_total",
+	Help:      "Errors from Mongo while tailing, partitioned by kind (timeout, position_lost, auth, network, server_selection, primary_change, or other)",
+}, []string{"kind"})
+
+// Server error codes for each kind of error. See
+// https://github.com/mongodb/mongo/blob/master/src/mongo/base/error_codes.yml
+var mongoErrorCodes = []struct {
+	kind  string
+	codes []int
+}{
+	{mongoErrorPositionLost, []int{
+		136, // CappedPositionLost
+		286, // ChangeStreamHistoryLost
+		280, // ChangeStreamFatalError
+	}},
+	{mongoErrorAuth, []int{
+		11, // UserNotFound
+		13, // Unauthorized
+		18, // AuthenticationFailed
+	}},
+	{mongoErrorPrimaryChange, []int{
+		91,    // ShutdownInProgress
+		189,   // PrimarySteppedDown
+		10107, // NotWritablePrimary
+		11600, // InterruptedAtShutdown
+		11602, // InterruptedDueToReplStateChange
+		13435, // NotPrimaryNoSecondaryOk
+		13436, // NotPrimaryOrSecondary
+	}},
+}
+
+// Returns the kind of a (non-nil) error from Mongo
+func classifyMongoError(err error) string {
+	// Checked before timeouts, since a server selection error may wrap the
+	// context's deadline
+	var selectionErr topology.ServerSelectionError
+	if errors.As(err, &selectionErr) || errors.Is(err, topology.ErrServerSelectionTimeout) {
+		return mongoErrorServerSelection
+	}
+
+	var authErr *auth.Error
+	if errors.As(err, &authErr) {
+		return mongoErrorAuth
+	}
+
+	var serverErr mongo.ServerError
+	if errors.As(err, &serverErr) {
+		for _, kind := range mongoErrorCodes {
+			for _, code := range kind.codes {
+				if serverErr.HasErrorCode(code) {
+					return kind.kind
+				}
+			}
+		}
+	}
+
+	if mongo.IsTimeout(err) {
+		return mongoErrorTimeout
+	}
+
+	if mongo.IsNetworkError(err) {
+		return mongoErrorNetwork
+	}
+
+	return mongoErrorOther
+}
+
+// Counts a (non-nil) error from Mongo in otr_mongo_errors_total, and returns
+// its kind
+func countMongoError(err error) string {
+	kind := classifyMongoError(err)
+	metricMongoErrors.WithLabelValues(kind).Inc()
+	return kind
+}
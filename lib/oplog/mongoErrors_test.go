@@ -0,0 +1,100 @@
+package oplog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/auth"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
+)
+
+func TestClassifyMongoError(t *testing.T) {
+	tests := map[string]struct {
+		err  error
+		want string
+	}{
+		"Deadline exceeded": {
+			err:  context.DeadlineExceeded,
+			want: mongoErrorTimeout,
+		},
+		"Network timeout": {
+			err:  mongo.CommandError{Labels: []string{"NetworkError", "NetworkTimeoutError"}},
+			want: mongoErrorTimeout,
+		},
+		"Position lost": {
+			err:  mongo.CommandError{Code: 136, Name: "CappedPositionLost"},
+			want: mongoErrorPositionLost,
+		},
+		"Change stream history lost": {
+			err:  mongo.CommandError{Code: 286, Name: "ChangeStreamHistoryLost"},
+			want: mongoErrorPositionLost,
+		},
+		"Authentication failed": {
+			err:  mongo.CommandError{Code: 18, Name: "AuthenticationFailed"},
+			want: mongoErrorAuth,
+		},
+		"Unauthorized": {
+			err:  mongo.CommandError{Code: 13, Name: "Unauthorized"},
+			want: mongoErrorAuth,
+		},
+		"Authentication failed while connecting": {
+			err:  topology.ConnectionError{Wrapped: &auth.Error{}},
+			want: mongoErrorAuth,
+		},
+		"Network error": {
+			err:  mongo.CommandError{Labels: []string{"NetworkError"}},
+			want: mongoErrorNetwork,
+		},
+		"Server selection": {
+			err:  topology.ServerSelectionError{Wrapped: context.DeadlineExceeded},
+			want: mongoErrorServerSelection,
+		},
+		"Server selection timeout": {
+			err:  topology.ErrServerSelectionTimeout,
+			want: mongoErrorServerSelection,
+		},
+		"Primary stepped down": {
+			err:  mongo.CommandError{Code: 189, Name: "PrimarySteppedDown"},
+			want: mongoErrorPrimaryChange,
+		},
+		"Interrupted by a state change": {
+			err:  mongo.CommandError{Code: 11602, Name: "InterruptedDueToReplStateChange"},
+			want: mongoErrorPrimaryChange,
+		},
+		"Not primary": {
+			err:  mongo.CommandError{Code: 10107, Name: "NotWritablePrimary"},
+			want: mongoErrorPrimaryChange,
+		},
+		"Wrapped": {
+			err:  fmt.Errorf("tailing: %w", mongo.CommandError{Code: 189}),
+			want: mongoErrorPrimaryChange,
+		},
+		"Other server error": {
+			err:  mongo.CommandError{Code: 2, Name: "BadValue"},
+			want: mongoErrorOther,
+		},
+		"Other error": {
+			err:  errors.New("some error"),
+			want: mongoErrorOther,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			require.Equal(t, test.want, classifyMongoError(test.err))
+		})
+	}
+}
+
+func TestCountMongoError(t *testing.T) {
+	counter := metricMongoErrors.WithLabelValues(mongoErrorAuth)
+	before := testutil.ToFloat64(counter)
+
+	require.Equal(t, mongoErrorAuth, countMongoError(mongo.CommandError{Code: 18}))
+	require.Equal(t, 1.0, testutil.ToFloat64(counter)-before)
+}
@@ -0,0 +1,34 @@
+package oplog
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+var metricMongoPoolConnections = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "otr",
+	Subsystem: "mongo",
+	Name:      "pool_connections",
+	Help:      "Connections in the Mongo driver's connection pools (across all servers), partitioned by state: open connections, and those of them that are in use. If in_use stays at OTR_MONGO_MAX_POOL_SIZE, queries are waiting for connections.",
+}, []string{"state"})
+
+// mongoPoolMonitor tracks the connections in the Mongo driver's connection
+// pools in otr_mongo_pool_connections. It's shared by every client we create,
+// so the metric covers the connections to every server.
+var mongoPoolMonitor = &event.PoolMonitor{
+	Event: recordMongoPoolEvent,
+}
+
+func recordMongoPoolEvent(evt *event.PoolEvent) {
+	switch evt.Type {
+	case event.ConnectionCreated:
+		metricMongoPoolConnections.WithLabelValues("open").Inc()
+	case event.ConnectionClosed:
+		metricMongoPoolConnections.WithLabelValues("open").Dec()
+	case event.GetSucceeded:
+		metricMongoPoolConnections.WithLabelValues("in_use").Inc()
+	case event.ConnectionReturned:
+		metricMongoPoolConnections.WithLabelValues("in_use").Dec()
+	}
+}
@@ -0,0 +1,31 @@
+package oplog
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+func TestRecordMongoPoolEvent(t *testing.T) {
+	open := metricMongoPoolConnections.WithLabelValues("open")
+	inUse := metricMongoPoolConnections.WithLabelValues("in_use")
+	openBefore := testutil.ToFloat64(open)
+	inUseBefore := testutil.ToFloat64(inUse)
+
+	for _, eventType := range []string{
+		event.ConnectionCreated,
+		event.ConnectionCreated,
+		event.GetSucceeded,
+		event.GetSucceeded,
+		event.ConnectionReturned,
+		event.ConnectionClosed,
+		event.GetFailed,
+	} {
+		recordMongoPoolEvent(&event.PoolEvent{Type: eventType})
+	}
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(open)-openBefore)
+	assert.Equal(t, 1.0, testutil.ToFloat64(inUse)-inUseBefore)
+}
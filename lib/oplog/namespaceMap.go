@@ -0,0 +1,121 @@
+package oplog
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// NamespaceMap rewrites the namespaces (`<db-name>.<collection-name>`) of
+// oplog entries before we publish them, so the channels and messages use the
+// rewritten database and collection names. See config.NamespaceMap.
+type NamespaceMap struct {
+	exact     map[string]string
+	wildcards []namespaceMapRule
+}
+
+type namespaceMapRule struct {
+	from *regexp.Regexp
+	to   string
+}
+
+// NewNamespaceMap parses a list of `from=to` rules. `from` is a namespace,
+// in which each `*` matches any (possibly empty) sequence of characters, and
+// each `*` in `to` is replaced by the text matched by the corresponding `*`
+// in `from` (so `to` can't have more of them than `from`). For example,
+// `prod_*=*` rewrites `prod_acme.users` to `acme.users`.
+//
+// Rules without wildcards take precedence; otherwise, the first matching
+// rule applies.
+func NewNamespaceMap(rules []string) (*NamespaceMap, error) {
+	namespaceMap := &NamespaceMap{exact: map[string]string{}}
+
+	for _, rule := range rules {
+		parts := strings.Split(rule, "=")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, errors.Errorf("invalid namespace map rule %q: must be of the form from=to", rule)
+		}
+		from, to := parts[0], parts[1]
+
+		wildcards := strings.Count(from, "*")
+		if strings.Count(to, "*") > wildcards {
+			return nil, errors.Errorf("invalid namespace map rule %q: %q has more wildcards than %q", rule, to, from)
+		}
+
+		if wildcards == 0 {
+			if _, ok := namespaceMap.exact[from]; !ok {
+				namespaceMap.exact[from] = to
+			}
+			continue
+		}
+
+		// Wildcards match as little as possible, so in `*.*`, the first one
+		// matches the database name (which can't contain dots) and the
+		// second the collection name (which can)
+		quoted := strings.Split(from, "*")
+		for i := range quoted {
+			quoted[i] = regexp.QuoteMeta(quoted[i])
+		}
+		pattern := regexp.MustCompile("^" + strings.Join(quoted, "(.*?)") + "$")
+
+		namespaceMap.wildcards = append(namespaceMap.wildcards, namespaceMapRule{from: pattern, to: to})
+	}
+
+	return namespaceMap, nil
+}
+
+// Rewrite returns the rewritten namespace, or the namespace unchanged if no
+// rule matches it
+func (namespaceMap *NamespaceMap) Rewrite(namespace string) string {
+	if to, ok := namespaceMap.exact[namespace]; ok {
+		return to
+	}
+
+	for _, rule := range namespaceMap.wildcards {
+		match := rule.from.FindStringSubmatch(namespace)
+		if match == nil {
+			continue
+		}
+
+		captures := match[1:]
+		return replaceWildcards(rule.to, captures)
+	}
+
+	return namespace
+}
+
+// Replaces each `*` in template with the next of the given values
+func replaceWildcards(template string, values []string) string {
+	var result strings.Builder
+	for _, c := range template {
+		if c == '*' {
+			result.WriteString(values[0])
+			values = values[1:]
+		} else {
+			result.WriteRune(c)
+		}
+	}
+
+	return result.String()
+}
+
+// Returns the entry with its namespace rewritten according to the tailer's
+// NamespaceMap. If the namespace changes, the entry is copied, so the
+// original keeps its source namespace.
+func (tailer *Tailer) remapNamespace(op *oplogEntry) *oplogEntry {
+	if tailer.NamespaceMap == nil {
+		return op
+	}
+
+	namespace := tailer.NamespaceMap.Rewrite(op.Namespace)
+	if namespace == op.Namespace {
+		return op
+	}
+
+	remapped := *op
+	remapped.Namespace = namespace
+	remapped.Database, remapped.Collection = parseNamespace(namespace)
+
+	return &remapped
+}
@@ -0,0 +1,125 @@
+package oplog
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNamespaceMapRewrite(t *testing.T) {
+	tests := map[string]struct {
+		rules    []string
+		in       string
+		expected string
+	}{
+		"No rules": {
+			rules:    nil,
+			in:       "foo.bar",
+			expected: "foo.bar",
+		},
+		"Exact match": {
+			rules:    []string{"legacy.users=app.people"},
+			in:       "legacy.users",
+			expected: "app.people",
+		},
+		"Exact rule doesn't match other namespaces": {
+			rules:    []string{"legacy.users=app.people"},
+			in:       "legacy.users2",
+			expected: "legacy.users2",
+		},
+		"Database prefix": {
+			rules:    []string{"prod_*=*"},
+			in:       "prod_acme.users",
+			expected: "acme.users",
+		},
+		"Database and collection wildcards": {
+			rules:    []string{"prod_*.*=*.tenant_*"},
+			in:       "prod_acme.users.archive",
+			expected: "acme.tenant_users.archive",
+		},
+		"Wildcard dropped from the target": {
+			rules:    []string{"shard_*.events=all.events"},
+			in:       "shard_3.events",
+			expected: "all.events",
+		},
+		"Exact rule takes precedence over an earlier wildcard rule": {
+			rules:    []string{"prod_*=*", "prod_acme.users=special.users"},
+			in:       "prod_acme.users",
+			expected: "special.users",
+		},
+		"First matching wildcard rule applies": {
+			rules:    []string{"prod_acme*=acme*", "prod_*=*"},
+			in:       "prod_acme.users",
+			expected: "acme.users",
+		},
+		"Later wildcard rule applies when earlier ones don't match": {
+			rules:    []string{"prod_acme*=acme*", "prod_*=*"},
+			in:       "prod_globex.users",
+			expected: "globex.users",
+		},
+		"First of duplicate exact rules applies": {
+			rules:    []string{"a.b=c.d", "a.b=e.f"},
+			in:       "a.b",
+			expected: "c.d",
+		},
+		"Special characters are matched literally": {
+			rules:    []string{"a+b.*=c.*"},
+			in:       "aab.x",
+			expected: "aab.x",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			namespaceMap, err := NewNamespaceMap(test.rules)
+			require.NoError(t, err)
+
+			assert.Equal(t, test.expected, namespaceMap.Rewrite(test.in))
+		})
+	}
+}
+
+func TestNewNamespaceMapInvalid(t *testing.T) {
+	tests := map[string][]string{
+		"Missing separator":   {"foo.bar"},
+		"Extra separator":     {"a=b=c"},
+		"Empty source":        {"=foo.bar"},
+		"Empty target":        {"foo.bar="},
+		"Too many wildcards":  {"prod_*=*.*"},
+		"Wildcard in target":  {"foo.bar=*"},
+		"One bad rule of two": {"prod_*=*", "bad"},
+	}
+
+	for name, rules := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := NewNamespaceMap(rules)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestProcessOplogEntryNamespaceMap(t *testing.T) {
+	namespaceMap, err := NewNamespaceMap([]string{"prod_*=*"})
+	require.NoError(t, err)
+
+	tailer := &Tailer{NamespaceMap: namespaceMap}
+	op := &oplogEntry{
+		DocID:      "someid",
+		Operation:  "i",
+		Namespace:  "prod_acme.users",
+		Database:   "prod_acme",
+		Collection: "users",
+	}
+
+	pub, err := tailer.processOplogEntry(op)
+	require.NoError(t, err)
+
+	assert.Equal(t, "acme.users", pub.CollectionChannel)
+	assert.Equal(t, "acme.users::someid", pub.SpecificChannel)
+
+	// We still resume and deduplicate by the source namespace, and the
+	// entry itself isn't modified
+	assert.Equal(t, "prod_acme.users", pub.Namespace)
+	assert.Equal(t, "prod_acme", op.Database)
+}
@@ -1,9 +1,12 @@
 package oplog
 
 import (
+	"time"
+
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/vlasky/oplogtoredis/lib/log"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
@@ -12,6 +15,16 @@ const (
 	operationUpdate  = "u"
 	operationRemove  = "d"
 	operationCommand = "c"
+	operationNoop    = "n"
+)
+
+// Operations for namespace events: commands that affect an entire collection
+// rather than a single document. These don't appear in the oplog as-is; they're
+// derived from operationCommand entries.
+const (
+	operationRename       = "rename"
+	operationDrop         = "drop"
+	operationDropDatabase = "dropDatabase"
 )
 
 var metricUnprocessableChangedFields = promauto.NewCounter(prometheus.CounterOpts{
@@ -32,6 +45,20 @@ type oplogEntry struct {
 	Database   string
 	Collection string
 
+	// RawData is the undecoded document for inserts, removes, and
+	// replacement updates read from the oplog, in which case Data is nil.
+	// We only need the _id (which is in DocID) and top-level field names of
+	// these documents, so we don't pay to decode them.
+	RawData bson.Raw
+
+	// FullDocument is the current version of the document, for updates to
+	// collections that we publish full documents for. It's nil otherwise.
+	FullDocument map[string]interface{}
+
+	// Wall is the wall-clock time the entry was written, if the oplog
+	// recorded it (see rawOplogEntry.Wall). It's zero otherwise.
+	Wall time.Time
+
 	TxIdx uint
 }
 
@@ -50,6 +77,17 @@ func (op *oplogEntry) IsRemove() bool {
 	return op.Operation == operationRemove
 }
 
+// Returns whether this oplogEntry is for a namespace event (e.g. a collection
+// being renamed) rather than a change to a single document
+func (op *oplogEntry) IsNamespaceEvent() bool {
+	switch op.Operation {
+	case operationRename, operationDrop, operationDropDatabase:
+		return true
+	default:
+		return false
+	}
+}
+
 // Returns whether this is an oplog update format v2 update (new in MongoDB 5.0)
 func (op *oplogEntry) UpdateIsV2Formatted() bool {
 	dataVersion, ok := op.Data["$v"]
@@ -115,7 +153,7 @@ func (op *oplogEntry) UpdateIsReplace() bool {
 // Given an operation, returned the fields affected by that operation
 func (op *oplogEntry) ChangedFields() []string {
 	if op.IsInsert() || (op.IsUpdate() && op.UpdateIsReplace()) {
-		return mapKeys(op.Data)
+		return op.documentFields()
 	} else if op.IsUpdate() && op.UpdateIsV2Formatted() {
 		// New-style update. Looks like:
 		// { $v: 2, diff: { sa: "10", sb: "20", d: { c: true  } }
@@ -148,6 +186,29 @@ func (op *oplogEntry) ChangedFields() []string {
 	return []string{}
 }
 
+// Returns the top-level field names of the entry's document
+func (op *oplogEntry) documentFields() []string {
+	if op.RawData == nil {
+		return mapKeys(op.Data)
+	}
+
+	elements, err := op.RawData.Elements()
+	if err != nil {
+		metricUnprocessableChangedFields.Inc()
+		log.Log.Errorw("Could not read fields of oplog document",
+			"op", op,
+			"error", err)
+		return []string{}
+	}
+
+	fields := make([]string, len(elements))
+	for i, element := range elements {
+		fields[i] = element.Key()
+	}
+
+	return fields
+}
+
 // Given a map, returns the keys of that map
 func mapKeys(m map[string]interface{}) []string {
 	fields := make([]string, len(m))
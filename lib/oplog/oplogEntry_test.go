@@ -128,6 +128,22 @@ func TestChangedFields(t *testing.T) {
 			want: []string{"foo", "bar"},
 		},
 
+		"Insert with raw document": {
+			input: &oplogEntry{
+				Operation: "i",
+				RawData:   mustRaw(t, map[string]interface{}{"foo": "a", "bar": map[string]interface{}{"baz": 10}}),
+			},
+			want: []string{"foo", "bar"},
+		},
+
+		"Replacement update with raw document": {
+			input: &oplogEntry{
+				Operation: "u",
+				RawData:   mustRaw(t, map[string]interface{}{"foo": "a", "bar": 10}),
+			},
+			want: []string{"foo", "bar"},
+		},
+
 		"Replacement update": {
 			input: &oplogEntry{
 				Operation: "u",
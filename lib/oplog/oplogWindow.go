@@ -0,0 +1,120 @@
+package oplog
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/vlasky/oplogtoredis/lib/config"
+	"github.com/vlasky/oplogtoredis/lib/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// How often we re-check the oplog window, which changes as the write volume
+// does
+const oplogWindowCheckInterval = 10 * time.Minute
+
+var (
+	metricOplogWindow = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "otr",
+		Subsystem: "oplog",
+		Name:      "window_seconds",
+		Help:      "Seconds between the oldest and newest entries in the oplog, partitioned by shard (empty if not sharded). If this is less than OTR_MAX_CATCH_UP, an outage can lose entries.",
+	}, []string{"shard"})
+
+	metricOplogWindowTooSmall = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "otr",
+		Subsystem: "oplog",
+		Name:      "window_too_small",
+		Help:      "1 if the oplog window (see otr_oplog_window_seconds) is shorter than the longest catch-up window (OTR_MAX_CATCH_UP and OTR_MAX_CATCH_UP_OVERRIDES), 0 otherwise, partitioned by shard.",
+	}, []string{"shard"})
+)
+
+// Checks the oplog window (the time between its oldest and newest entries)
+// against the catch-up window when called, and then every
+// oplogWindowCheckInterval until done is closed. If the oplog doesn't go back
+// as far as we'd catch up, entries written during an outage can fall off the
+// oplog before we get to them.
+func (tailer *Tailer) monitorOplogWindow(client *mongo.Client, done <-chan struct{}) {
+	for {
+		tailer.checkOplogWindow(client)
+
+		select {
+		case <-done:
+			return
+		case <-time.After(oplogWindowCheckInterval):
+		}
+	}
+}
+
+func (tailer *Tailer) checkOplogWindow(client *mongo.Client) {
+	database, collectionName := tailer.oplogNamespace()
+	collectionOpts := options.Collection()
+	if tailer.ReadPreference != nil {
+		collectionOpts.SetReadPreference(tailer.ReadPreference)
+	}
+	collection := client.Database(database).Collection(collectionName, collectionOpts)
+
+	first, err := oplogEndTimestamp(collection, 1)
+	if err != nil {
+		countMongoError(err)
+		log.Log.Errorw("Error getting the first oplog entry to check the oplog window",
+			"error", err,
+			"shard", tailer.shardName)
+		return
+	}
+
+	last, err := oplogEndTimestamp(collection, -1)
+	if err != nil {
+		countMongoError(err)
+		log.Log.Errorw("Error getting the last oplog entry to check the oplog window",
+			"error", err,
+			"shard", tailer.shardName)
+		return
+	}
+
+	window, tooSmall := tailer.oplogWindow(first, last)
+	metricOplogWindow.WithLabelValues(tailer.shardName).Set(window.Seconds())
+
+	if !tooSmall {
+		metricOplogWindowTooSmall.WithLabelValues(tailer.shardName).Set(0)
+		return
+	}
+
+	metricOplogWindowTooSmall.WithLabelValues(tailer.shardName).Set(1)
+	log.Log.Warnw("The oplog window is shorter than the catch-up window, so entries written during an outage may be lost before we can publish them. Consider resizing the oplog.",
+		"shard", tailer.shardName,
+		"oplogWindow", window.String(),
+		"maxCatchUp", tailer.longestCatchUp().String())
+}
+
+// Returns the time between the given first and last oplog timestamps, and
+// whether it's shorter than the longest catch-up window
+func (tailer *Tailer) oplogWindow(first, last primitive.Timestamp) (time.Duration, bool) {
+	window := time.Duration(int64(last.T)-int64(first.T)) * time.Second
+	if window < 0 {
+		window = 0
+	}
+
+	return window, window < tailer.longestCatchUp()
+}
+
+// Returns the timestamp of the first (with direction 1) or last (with
+// direction -1) entry in the oplog
+func oplogEndTimestamp(collection *mongo.Collection, direction int) (primitive.Timestamp, error) {
+	var entry rawOplogEntry
+	findOneOpts := &options.FindOneOptions{}
+	findOneOpts.SetSort(bson.M{"$natural": direction})
+	findOneOpts.SetProjection(bson.M{"ts": 1})
+	findOneOpts.SetComment(oplogQueryComment())
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.MongoFindTimeout())
+	defer cancel()
+
+	err := collection.FindOne(ctx, bson.M{}, findOneOpts).Decode(&entry)
+	return entry.Timestamp, err
+}
@@ -0,0 +1,62 @@
+package oplog
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestOplogWindow(t *testing.T) {
+	tests := map[string]struct {
+		tailer       Tailer
+		first        primitive.Timestamp
+		last         primitive.Timestamp
+		wantWindow   time.Duration
+		wantTooSmall bool
+	}{
+		"Larger than MaxCatchUp": {
+			tailer:       Tailer{MaxCatchUp: time.Minute},
+			first:        primitive.Timestamp{T: 1000, I: 3},
+			last:         primitive.Timestamp{T: 4600, I: 1},
+			wantWindow:   time.Hour,
+			wantTooSmall: false,
+		},
+		"Smaller than MaxCatchUp": {
+			tailer:       Tailer{MaxCatchUp: time.Hour},
+			first:        primitive.Timestamp{T: 1000, I: 1},
+			last:         primitive.Timestamp{T: 1060, I: 1},
+			wantWindow:   time.Minute,
+			wantTooSmall: true,
+		},
+		"Smaller than an override": {
+			tailer: Tailer{
+				MaxCatchUp:          time.Minute,
+				MaxCatchUpOverrides: map[string]time.Duration{"db1": 2 * time.Hour},
+			},
+			first:        primitive.Timestamp{T: 1000, I: 1},
+			last:         primitive.Timestamp{T: 4600, I: 1},
+			wantWindow:   time.Hour,
+			wantTooSmall: true,
+		},
+		"Out of order": {
+			tailer:       Tailer{MaxCatchUp: time.Minute},
+			first:        primitive.Timestamp{T: 1060, I: 1},
+			last:         primitive.Timestamp{T: 1000, I: 1},
+			wantWindow:   0,
+			wantTooSmall: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			window, tooSmall := test.tailer.oplogWindow(test.first, test.last)
+			if window != test.wantWindow {
+				t.Errorf("Got window %s, expected %s", window, test.wantWindow)
+			}
+			if tooSmall != test.wantTooSmall {
+				t.Errorf("Got tooSmall %t, expected %t", tooSmall, test.wantTooSmall)
+			}
+		})
+	}
+}
@@ -1,10 +1,17 @@
 package oplog
 
 import (
+	"os"
 	"sort"
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vlasky/oplogtoredis/lib/config"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 // Copied from https://github.com/meteor/meteor/blob/devel/packages/mongo/oplog_v2_converter_tests.js
@@ -169,3 +176,118 @@ func TestOplogV2DeepConverter(t *testing.T) {
 		})
 	}
 }
+
+// These oplog entries are built by hand in the shape MongoDB 5.0 writes for
+// the commented update, and are run through the same decoding path as
+// entries read from the oplog (rather than being constructed as Go maps) so
+// we exercise the types the BSON decoder actually produces.
+func TestOplogV2RealEntries(t *testing.T) {
+	docID, err := primitive.ObjectIDFromHex("61a5b3ac6d7b1f0a3c2e4d5f")
+	require.NoError(t, err)
+
+	// db.Foo.updateOne({ _id }, { $set: { "one.two.three": 123, four: 4 }, $unset: { five: 1 } })
+	setNestedAndUnset := bson.D{
+		{Key: "op", Value: "u"},
+		{Key: "ns", Value: "dev.Foo"},
+		{Key: "ui", Value: primitive.Binary{Subtype: 4, Data: []byte("0123456789abcdef")}},
+		{Key: "o", Value: bson.D{
+			{Key: "$v", Value: int32(2)},
+			{Key: "diff", Value: bson.D{
+				{Key: "d", Value: bson.D{{Key: "five", Value: false}}},
+				{Key: "u", Value: bson.D{{Key: "four", Value: int32(4)}}},
+				{Key: "sone", Value: bson.D{
+					{Key: "stwo", Value: bson.D{
+						{Key: "u", Value: bson.D{{Key: "three", Value: int32(123)}}},
+					}},
+				}},
+			}},
+		}},
+		{Key: "o2", Value: bson.D{{Key: "_id", Value: docID}}},
+		{Key: "ts", Value: primitive.Timestamp{T: 1638249388, I: 1}},
+		{Key: "t", Value: int64(1)},
+		{Key: "v", Value: int64(2)},
+		{Key: "wall", Value: primitive.NewDateTimeFromTime(time.Unix(1638249388, 0))},
+	}
+
+	// db.Foo.updateOne({ _id }, { $push: { tags: "new" }, $set: { "items.1.name": "x" } })
+	arrayUpdate := bson.D{
+		{Key: "op", Value: "u"},
+		{Key: "ns", Value: "dev.Foo"},
+		{Key: "o", Value: bson.D{
+			{Key: "$v", Value: int32(2)},
+			{Key: "diff", Value: bson.D{
+				{Key: "sitems", Value: bson.D{
+					{Key: "a", Value: true},
+					{Key: "s1", Value: bson.D{
+						{Key: "u", Value: bson.D{{Key: "name", Value: "x"}}},
+					}},
+				}},
+				{Key: "stags", Value: bson.D{
+					{Key: "a", Value: true},
+					{Key: "u2", Value: "new"},
+				}},
+			}},
+		}},
+		{Key: "o2", Value: bson.D{{Key: "_id", Value: docID}}},
+		{Key: "ts", Value: primitive.Timestamp{T: 1638249390, I: 1}},
+		{Key: "v", Value: int64(2)},
+	}
+
+	tests := map[string]struct {
+		in                              bson.D
+		enableV2ExtractDeepFieldChanges bool
+		want                            []string
+	}{
+		"Nested set and unset, shallow": {
+			in:   setNestedAndUnset,
+			want: []string{"five", "four", "one"},
+		},
+		"Nested set and unset, deep": {
+			in:                              setNestedAndUnset,
+			enableV2ExtractDeepFieldChanges: true,
+			want:                            []string{"five", "four", "one.two.three"},
+		},
+		"Array update, shallow": {
+			in:   arrayUpdate,
+			want: []string{"items", "tags"},
+		},
+		"Array update, deep": {
+			in:                              arrayUpdate,
+			enableV2ExtractDeepFieldChanges: true,
+			want:                            []string{"items.1.name", "tags.2"},
+		},
+	}
+
+	// Restore the environment and config we change below once we're done
+	// (deferred calls run last first, so the environment is restored before
+	// we re-parse it)
+	defer config.ParseEnv()
+	for _, key := range []string{"OTR_OPLOG_V2_EXTRACT_SUBFIELD_CHANGES", "OTR_REDIS_URL", "OTR_MONGO_URL"} {
+		if value, ok := os.LookupEnv(key); ok {
+			defer os.Setenv(key, value)
+		} else {
+			defer os.Unsetenv(key)
+		}
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			os.Setenv("OTR_OPLOG_V2_EXTRACT_SUBFIELD_CHANGES", strconv.FormatBool(test.enableV2ExtractDeepFieldChanges))
+			os.Setenv("OTR_REDIS_URL", "redis://yyy")
+			os.Setenv("OTR_MONGO_URL", "mongodb://xxx")
+			require.NoError(t, config.ParseEnv())
+
+			var raw rawOplogEntry
+			require.NoError(t, bson.Unmarshal(mustRaw(t, test.in), &raw))
+
+			entries := (&Tailer{}).parseRawOplogEntry(raw, nil)
+			require.Len(t, entries, 1)
+			require.Equal(t, docID, entries[0].DocID)
+			require.True(t, entries[0].UpdateIsV2Formatted())
+
+			got := entries[0].ChangedFields()
+			sort.Strings(got)
+			assert.Equal(t, test.want, got)
+		})
+	}
+}
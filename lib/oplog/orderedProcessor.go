@@ -0,0 +1,76 @@
+package oplog
+
+import (
+	"github.com/vlasky/oplogtoredis/lib/redispub"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// orderedProcessor runs unmarshalEntry for raw oplog entries on a pool of
+// worker goroutines, but sends the resulting publications to the output
+// channel in the same order the entries were submitted. This keeps the
+// publications for each document in order, and ensures the last-processed
+// timestamp that redispub records only ever moves forward.
+type orderedProcessor struct {
+	jobs chan orderedProcessorJob
+
+	// pending holds the result channels of submitted jobs, in the order they
+	// were submitted. Its capacity bounds the number of jobs in flight.
+	pending chan chan []*redispub.Publication
+
+	done chan struct{}
+}
+
+type orderedProcessorJob struct {
+	rawData  bson.Raw
+	entryIdx uint
+	result   chan<- []*redispub.Publication
+}
+
+// Starts an orderedProcessor with the given number of workers, sending
+// publications to out. Call close() to wait for all submitted entries to be
+// sent and shut down the workers.
+func (tailer *Tailer) newOrderedProcessor(concurrency int, out chan *redispub.Publication) *orderedProcessor {
+	processor := &orderedProcessor{
+		jobs:    make(chan orderedProcessorJob),
+		pending: make(chan chan []*redispub.Publication, concurrency*2),
+		done:    make(chan struct{}),
+	}
+
+	for i := 0; i < concurrency; i++ {
+		go func() {
+			for job := range processor.jobs {
+				_, pubs := tailer.unmarshalEntry(job.rawData)
+				setEntryIdx(pubs, job.entryIdx)
+				job.result <- pubs
+			}
+		}()
+	}
+
+	go func() {
+		for result := range processor.pending {
+			tailer.sendPublications(out, <-result)
+		}
+
+		close(processor.done)
+	}()
+
+	return processor
+}
+
+// Submits a raw oplog entry, with its index among the entries that share its
+// timestamp, for processing. Blocks if too many entries are already in
+// flight. rawData must not be modified afterwards.
+func (processor *orderedProcessor) submit(rawData bson.Raw, entryIdx uint) {
+	result := make(chan []*redispub.Publication, 1)
+
+	processor.pending <- result
+	processor.jobs <- orderedProcessorJob{rawData: rawData, entryIdx: entryIdx, result: result}
+}
+
+// Waits for all submitted entries to be processed and their publications
+// sent, then stops the workers. The processor can't be used afterwards.
+func (processor *orderedProcessor) close() {
+	close(processor.jobs)
+	close(processor.pending)
+	<-processor.done
+}
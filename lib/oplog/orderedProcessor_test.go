@@ -0,0 +1,41 @@
+package oplog
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vlasky/oplogtoredis/lib/redispub"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestOrderedProcessor(t *testing.T) {
+	const entryCount = 500
+
+	out := make(chan *redispub.Publication, entryCount)
+	tailer := &Tailer{shardName: "shard01"}
+	processor := tailer.newOrderedProcessor(8, out)
+
+	for i := 0; i < entryCount; i++ {
+		processor.submit(mustRaw(t, bson.M{
+			"ts": primitive.Timestamp{T: 1234, I: uint32(i)},
+			"op": "i",
+			"ns": "foo.bar",
+			"o":  bson.M{"_id": fmt.Sprintf("id%d", i)},
+		}), 0)
+	}
+
+	processor.close()
+	close(out)
+
+	i := 0
+	for pub := range out {
+		require.Equal(t, primitive.Timestamp{T: 1234, I: uint32(i)}, pub.OplogTimestamp, "publication %d out of order", i)
+		require.Equal(t, fmt.Sprintf("foo.bar::id%d", i), pub.SpecificChannel)
+		require.Equal(t, "shard01", pub.ResumeKey)
+		i++
+	}
+
+	require.Equal(t, entryCount, i)
+}
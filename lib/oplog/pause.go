@@ -0,0 +1,84 @@
+package oplog
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var metricPaused = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: "otr",
+	Subsystem: "oplog",
+	Name:      "paused",
+	Help:      "1 if publishing has been paused (with POST /admin/pause), 0 otherwise.",
+})
+
+// Pauser pauses and resumes the Tailer, e.g. for planned Redis maintenance.
+// While it's paused, the tailer waits before sending each publication, so it
+// stops reading the oplog; nothing is dropped, and because nothing more is
+// published, the last-processed timestamp doesn't advance. When it's
+// resumed, the tailer carries on from where it stopped (or, if its cursor
+// timed out in the meantime, from the last-processed timestamp).
+type Pauser struct {
+	lock sync.Mutex
+
+	// Closed when we're resumed. It's nil when we're not paused.
+	resumed chan struct{}
+}
+
+// NewPauser creates a Pauser, which starts out not paused
+func NewPauser() *Pauser {
+	return &Pauser{}
+}
+
+// Pause pauses the tailer. It has no effect if it's already paused.
+func (pauser *Pauser) Pause() {
+	pauser.lock.Lock()
+	defer pauser.lock.Unlock()
+
+	if pauser.resumed == nil {
+		pauser.resumed = make(chan struct{})
+		metricPaused.Set(1)
+	}
+}
+
+// Resume resumes the tailer. It has no effect if it's not paused.
+func (pauser *Pauser) Resume() {
+	pauser.lock.Lock()
+	defer pauser.lock.Unlock()
+
+	if pauser.resumed != nil {
+		close(pauser.resumed)
+		pauser.resumed = nil
+		metricPaused.Set(0)
+	}
+}
+
+// Paused returns whether the tailer is paused. It's safe to call on a nil
+// Pauser, which is never paused.
+func (pauser *Pauser) Paused() bool {
+	if pauser == nil {
+		return false
+	}
+
+	pauser.lock.Lock()
+	defer pauser.lock.Unlock()
+
+	return pauser.resumed != nil
+}
+
+// Blocks while the tailer is paused. It's safe to call on a nil Pauser.
+func (pauser *Pauser) wait() {
+	if pauser == nil {
+		return
+	}
+
+	pauser.lock.Lock()
+	resumed := pauser.resumed
+	pauser.lock.Unlock()
+
+	if resumed != nil {
+		<-resumed
+	}
+}
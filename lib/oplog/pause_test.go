@@ -0,0 +1,54 @@
+package oplog
+
+import (
+	"testing"
+	"time"
+
+	"github.com/vlasky/oplogtoredis/lib/redispub"
+)
+
+func TestPauser(t *testing.T) {
+	pauser := NewPauser()
+	tailer := Tailer{Pauser: pauser}
+	out := make(chan *redispub.Publication, 10)
+
+	tailer.send(out, &redispub.Publication{})
+	if len(out) != 1 {
+		t.Fatalf("Expected the publication to be sent while not paused, got %d", len(out))
+	}
+
+	pauser.Pause()
+	sent := make(chan struct{})
+	go func() {
+		tailer.send(out, &redispub.Publication{})
+		close(sent)
+	}()
+
+	select {
+	case <-sent:
+		t.Fatal("Expected send to wait while paused")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	pauser.Resume()
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatal("Expected send to finish after resuming")
+	}
+
+	if len(out) != 2 {
+		t.Errorf("Expected 2 publications, got %d", len(out))
+	}
+}
+
+func TestNilPauser(t *testing.T) {
+	var pauser *Pauser
+
+	if pauser.Paused() {
+		t.Error("Expected a nil Pauser not to be paused")
+	}
+
+	// Must not block
+	pauser.wait()
+}
@@ -0,0 +1,291 @@
+package oplog
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Values for config.PayloadFormat
+const (
+	PayloadFormatJSON    = "json"
+	PayloadFormatEJSON   = "ejson"
+	PayloadFormatMsgpack = "msgpack"
+)
+
+// PayloadSerializer builds the message bytes of the publications we send to
+// Redis
+type PayloadSerializer interface {
+	// ConvertValue converts a value from a Mongo document into the form it
+	// should take in the message, before the message is marshalled
+	ConvertValue(value interface{}) interface{}
+
+	// Marshal encodes a message
+	Marshal(msg interface{}) ([]byte, error)
+}
+
+// NewPayloadSerializer returns the PayloadSerializer for the given format
+// (see config.PayloadFormat)
+func NewPayloadSerializer(format string) (PayloadSerializer, error) {
+	switch format {
+	case PayloadFormatJSON, "":
+		return jsonSerializer{}, nil
+	case PayloadFormatEJSON:
+		return ejsonSerializer{}, nil
+	case PayloadFormatMsgpack:
+		return msgpackSerializer{}, nil
+	default:
+		return nil, errors.Errorf("unknown payload format %q", format)
+	}
+}
+
+// Returns the tailer's PayloadSerializer, defaulting to JSON
+func (tailer *Tailer) payloadSerializer() PayloadSerializer {
+	if tailer.PayloadSerializer == nil {
+		return jsonSerializer{}
+	}
+
+	return tailer.PayloadSerializer
+}
+
+// jsonSerializer produces the JSON messages that redis-oplog expects. BSON
+// values in documents are marshalled however encoding/json marshals them.
+type jsonSerializer struct{}
+
+func (jsonSerializer) ConvertValue(value interface{}) interface{} {
+	return value
+}
+
+func (jsonSerializer) Marshal(msg interface{}) ([]byte, error) {
+	return json.Marshal(msg)
+}
+
+// ejsonSerializer produces JSON messages in which BSON values in documents
+// are represented using Meteor's EJSON, so that they can be decoded back into
+// the same types by Meteor clients
+type ejsonSerializer struct{}
+
+func (ejsonSerializer) ConvertValue(value interface{}) interface{} {
+	return toEJSON(value)
+}
+
+func (ejsonSerializer) Marshal(msg interface{}) ([]byte, error) {
+	return json.Marshal(msg)
+}
+
+// Converts a value decoded from BSON into its EJSON representation
+func toEJSON(value interface{}) interface{} {
+	switch v := value.(type) {
+	case primitive.ObjectID:
+		return map[string]interface{}{"$type": "oid", "$value": v.Hex()}
+	case primitive.DateTime:
+		return map[string]interface{}{"$date": int64(v)}
+	case time.Time:
+		return map[string]interface{}{"$date": v.UnixNano() / int64(time.Millisecond)}
+	case primitive.Binary:
+		return map[string]interface{}{"$binary": base64.StdEncoding.EncodeToString(v.Data)}
+	case []byte:
+		return map[string]interface{}{"$binary": base64.StdEncoding.EncodeToString(v)}
+	case primitive.Decimal128:
+		return map[string]interface{}{"$type": "Decimal", "$value": v.String()}
+	case primitive.Regex:
+		return map[string]interface{}{"$regexp": v.Pattern, "$flags": v.Options}
+	case float64:
+		switch {
+		case math.IsNaN(v):
+			return map[string]interface{}{"$InfNaN": 0}
+		case math.IsInf(v, 1):
+			return map[string]interface{}{"$InfNaN": 1}
+		case math.IsInf(v, -1):
+			return map[string]interface{}{"$InfNaN": -1}
+		}
+		return v
+	case map[string]interface{}:
+		return ejsonObject(v)
+	case primitive.M:
+		return ejsonObject(v)
+	case primitive.D:
+		return ejsonObject(v.Map())
+	case primitive.A:
+		return ejsonArray(v)
+	case []interface{}:
+		return ejsonArray(v)
+	default:
+		return value
+	}
+}
+
+func ejsonObject(m map[string]interface{}) interface{} {
+	converted := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		converted[k] = toEJSON(v)
+	}
+
+	// Objects that look like EJSON-encoded values are escaped, so they're
+	// not decoded as such
+	if looksLikeEJSON(m) {
+		return map[string]interface{}{"$escape": converted}
+	}
+
+	return converted
+}
+
+func ejsonArray(a []interface{}) []interface{} {
+	converted := make([]interface{}, len(a))
+	for i, v := range a {
+		converted[i] = toEJSON(v)
+	}
+
+	return converted
+}
+
+func looksLikeEJSON(m map[string]interface{}) bool {
+	switch len(m) {
+	case 1:
+		for k := range m {
+			return strings.HasPrefix(k, "$")
+		}
+	case 2:
+		_, hasType := m["$type"]
+		_, hasValue := m["$value"]
+		return hasType && hasValue
+	}
+
+	return false
+}
+
+// msgpackSerializer produces MessagePack messages with the same structure as
+// the JSON ones, for consumers that want a more compact encoding
+type msgpackSerializer struct{}
+
+func (msgpackSerializer) ConvertValue(value interface{}) interface{} {
+	return value
+}
+
+// Marshal encodes the message as JSON and then transcodes it, so BSON values
+// end up in the same form as in the JSON format
+func (msgpackSerializer) Marshal(msg interface{}) ([]byte, error) {
+	jsonBytes, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(jsonBytes))
+	decoder.UseNumber()
+
+	var generic interface{}
+	if err := decoder.Decode(&generic); err != nil {
+		return nil, errors.Wrap(err, "decoding intermediate JSON")
+	}
+
+	var buf bytes.Buffer
+	if err := writeMsgpack(&buf, generic); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Writes a value decoded from JSON (with json.Decoder.UseNumber) as
+// MessagePack. Map keys are written in sorted order.
+func writeMsgpack(buf *bytes.Buffer, value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if v {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			writeMsgpackInt(buf, i)
+		} else {
+			f, err := v.Float64()
+			if err != nil {
+				return errors.Wrapf(err, "encoding number %s", v)
+			}
+			buf.WriteByte(0xcb)
+			writeBigEndian(buf, math.Float64bits(f), 8)
+		}
+	case string:
+		writeMsgpackHeader(buf, len(v), 0xa0, 31, 0xd9, 0xda, 0xdb)
+		buf.WriteString(v)
+	case []interface{}:
+		writeMsgpackHeader(buf, len(v), 0x90, 15, 0, 0xdc, 0xdd)
+		for _, elem := range v {
+			if err := writeMsgpack(buf, elem); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		writeMsgpackHeader(buf, len(v), 0x80, 15, 0, 0xde, 0xdf)
+		for _, k := range keys {
+			if err := writeMsgpack(buf, k); err != nil {
+				return err
+			}
+			if err := writeMsgpack(buf, v[k]); err != nil {
+				return err
+			}
+		}
+	default:
+		return errors.Errorf("cannot encode %T as MessagePack", value)
+	}
+
+	return nil
+}
+
+// Writes the header of a string, array, or map of the given length, using
+// the fix format if length is at most fixMax, and otherwise the 8-, 16-, or
+// 32-bit format (an 8-bit format of 0 means there isn't one)
+func writeMsgpackHeader(buf *bytes.Buffer, length int, fix byte, fixMax int, format8, format16, format32 byte) {
+	switch {
+	case length <= fixMax:
+		buf.WriteByte(fix | byte(length))
+	case format8 != 0 && length <= math.MaxUint8:
+		buf.WriteByte(format8)
+		buf.WriteByte(byte(length))
+	case length <= math.MaxUint16:
+		buf.WriteByte(format16)
+		writeBigEndian(buf, uint64(length), 2)
+	default:
+		buf.WriteByte(format32)
+		writeBigEndian(buf, uint64(length), 4)
+	}
+}
+
+func writeMsgpackInt(buf *bytes.Buffer, i int64) {
+	switch {
+	case i >= 0 && i <= 127:
+		buf.WriteByte(byte(i))
+	case i < 0 && i >= -32:
+		buf.WriteByte(byte(i))
+	case i >= math.MinInt32 && i <= math.MaxInt32:
+		buf.WriteByte(0xd2)
+		writeBigEndian(buf, uint64(uint32(int32(i))), 4)
+	default:
+		buf.WriteByte(0xd3)
+		writeBigEndian(buf, uint64(i), 8)
+	}
+}
+
+func writeBigEndian(buf *bytes.Buffer, v uint64, size int) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	buf.Write(b[8-size:])
+}
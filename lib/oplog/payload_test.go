@@ -0,0 +1,139 @@
+package oplog
+
+import (
+	"encoding/hex"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/kylelemons/godebug/pretty"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestNewPayloadSerializer(t *testing.T) {
+	for _, format := range []string{PayloadFormatJSON, PayloadFormatEJSON, PayloadFormatMsgpack} {
+		if _, err := NewPayloadSerializer(format); err != nil {
+			t.Errorf("Unexpected error for format %s: %s", format, err)
+		}
+	}
+
+	if _, err := NewPayloadSerializer("xml"); err == nil {
+		t.Error("Expected an error for an unknown format")
+	}
+}
+
+func TestToEJSON(t *testing.T) {
+	oid, err := primitive.ObjectIDFromHex("deadbeefdeadbeefdeadbeef")
+	if err != nil {
+		panic(err)
+	}
+
+	tests := map[string]struct {
+		input interface{}
+		want  interface{}
+	}{
+		"ObjectID": {
+			input: oid,
+			want:  map[string]interface{}{"$type": "oid", "$value": "deadbeefdeadbeefdeadbeef"},
+		},
+		"Date": {
+			input: primitive.NewDateTimeFromTime(time.Unix(1500000000, 0)),
+			want:  map[string]interface{}{"$date": int64(1500000000000)},
+		},
+		"Binary": {
+			input: primitive.Binary{Data: []byte("hi")},
+			want:  map[string]interface{}{"$binary": "aGk="},
+		},
+		"NaN": {
+			input: math.NaN(),
+			want:  map[string]interface{}{"$InfNaN": 0},
+		},
+		"Plain values": {
+			input: primitive.A{"a", int32(1), 2.5, true, nil},
+			want:  []interface{}{"a", int32(1), 2.5, true, nil},
+		},
+		"Nested document": {
+			input: primitive.D{{Key: "when", Value: primitive.DateTime(1000)}},
+			want: map[string]interface{}{
+				"when": map[string]interface{}{"$date": int64(1000)},
+			},
+		},
+		"Document that looks like EJSON": {
+			input: map[string]interface{}{"$date": "not a date"},
+			want: map[string]interface{}{
+				"$escape": map[string]interface{}{"$date": "not a date"},
+			},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if diff := pretty.Compare(toEJSON(test.input), test.want); diff != "" {
+				t.Errorf("Got incorrect EJSON (-got +want)\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestMsgpackSerializer(t *testing.T) {
+	tests := map[string]struct {
+		input interface{}
+		want  string
+	}{
+		"Message": {
+			input: map[string]interface{}{
+				"e": "u",
+				"d": map[string]interface{}{"_id": "abc"},
+				"f": []string{"x"},
+			},
+			// {"d": {"_id": "abc"}, "e": "u", "f": ["x"]}
+			want: "83" + "a164" + "81" + "a35f6964" + "a3616263" + "a165" + "a175" + "a166" + "91" + "a178",
+		},
+		"Numbers": {
+			input: []interface{}{1, -1, 300, 1.5, nil, true},
+			want:  "96" + "01" + "ff" + "d200000" + "12c" + "cb3ff8000000000000" + "c0" + "c3",
+		},
+		"Long string": {
+			input: string(make([]byte, 40)),
+			want:  "d928" + hex.EncodeToString(make([]byte, 40)),
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := msgpackSerializer{}.Marshal(test.input)
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+
+			if hex.EncodeToString(got) != test.want {
+				t.Errorf("Got %x, expected %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestProcessOplogEntryEJSON(t *testing.T) {
+	tailer := Tailer{PayloadSerializer: ejsonSerializer{}}
+
+	pub, err := tailer.processOplogEntry(&oplogEntry{
+		DocID:      "someid",
+		Database:   "foo",
+		Collection: "bar",
+		Namespace:  "foo.bar",
+		Operation:  "u",
+		Data:       map[string]interface{}{"$set": map[string]interface{}{"when": primitive.DateTime(1000)}},
+		FullDocument: map[string]interface{}{
+			"_id":  "someid",
+			"when": primitive.DateTime(1000),
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	want := `{"e":"u","d":{"_id":"someid","when":{"$date":1000}},"f":["when"]}`
+	if string(pub.Msg) != want {
+		t.Errorf("Got message %s, expected %s", pub.Msg, want)
+	}
+}
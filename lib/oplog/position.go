@@ -0,0 +1,134 @@
+package oplog
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/vlasky/oplogtoredis/lib/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var metricResumeTimestamp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "otr",
+	Name:      "resume_timestamp_seconds",
+	Help:      "Timestamp (in seconds since the epoch) of the last oplog entry read, partitioned by shard (empty when tailing a replica set). Compare with otr_oplog_lag_seconds to tell whether oplogtoredis is behind or stalled.",
+}, []string{"shard"})
+
+// oplogPosition tracks how far we've read through the oplog, so we can
+// resume from the right place when we re-issue the tail query.
+//
+// Several oplog entries can share a timestamp, so the timestamp alone isn't
+// enough: querying for entries after it would skip any we hadn't read yet,
+// and querying for entries at or after it would re-read the ones we had. So
+// we also count how many entries we've read at the timestamp, query with
+// $gte, and skip that many entries at the start of the new cursor. The new
+// cursor returns the entries in the same (natural) order, so each entry is
+// read exactly once, in order, and the updates to any one document are
+// published in the order they were made.
+type oplogPosition struct {
+	// The timestamp of the last entry we read
+	timestamp primitive.Timestamp
+
+	// How many entries with that timestamp we've read. It's zero when we
+	// start from a timestamp we don't have a count for (such as the
+	// last-processed timestamp stored in Redis); in that case we treat every
+	// entry with the timestamp as read.
+	count int
+
+	// How many more entries at the start of the current cursor we've already
+	// read
+	toSkip int
+}
+
+func newOplogPosition(start primitive.Timestamp) *oplogPosition {
+	return &oplogPosition{timestamp: start}
+}
+
+// startQuery returns the filter for a query that resumes tailing from this
+// position, and arranges for observe to skip the entries that query returns
+// that we've already read.
+func (position *oplogPosition) startQuery() bson.M {
+	position.toSkip = position.count
+
+	if position.count == 0 {
+		return bson.M{"ts": bson.M{"$gt": position.timestamp}}
+	}
+
+	return bson.M{"ts": bson.M{"$gte": position.timestamp}}
+}
+
+// observe records that the cursor returned an entry with the given
+// timestamp, and returns whether it's one we haven't read before.
+func (position *oplogPosition) observe(ts primitive.Timestamp) bool {
+	if position.toSkip > 0 {
+		if ts.Equal(position.timestamp) {
+			position.toSkip--
+			return false
+		}
+
+		// The oplog had fewer entries at the timestamp than we'd counted
+		// (which shouldn't happen), so there's nothing left to skip
+		position.toSkip = 0
+	}
+
+	if ts.Equal(position.timestamp) {
+		position.count++
+	} else {
+		position.timestamp = ts
+		position.count = 1
+	}
+
+	return true
+}
+
+// index returns the index of the last entry observe returned true for among
+// the entries with its timestamp. It's the same however many times we
+// re-issue the query, so it tells apart entries that share a timestamp
+// (see redispub.Publication.EntryIdx).
+func (position *oplogPosition) index() uint {
+	if position.count == 0 {
+		return 0
+	}
+
+	return uint(position.count - 1)
+}
+
+// positionReporter reports how far through the oplog we've read, in the
+// otr_resume_timestamp_seconds metric, to the Tailer's ActivityTracker, and
+// (every interval) in the log
+type positionReporter struct {
+	shardName  string
+	interval   time.Duration
+	gauge      prometheus.Gauge
+	activity   *ActivityTracker
+	lastLogged time.Time
+}
+
+func (tailer *Tailer) newPositionReporter() *positionReporter {
+	return &positionReporter{
+		shardName: tailer.shardName,
+		interval:  tailer.ResumeLogInterval,
+		gauge:     metricResumeTimestamp.WithLabelValues(tailer.shardName),
+		activity:  tailer.Activity,
+	}
+}
+
+// report records the position, logging it if it's been at least interval
+// since we last did. An interval of zero disables the log.
+func (reporter *positionReporter) report(position *oplogPosition, now time.Time) {
+	reporter.gauge.Set(float64(position.timestamp.T))
+	reporter.activity.recordPosition(reporter.shardName, position.timestamp)
+
+	if reporter.interval <= 0 || now.Sub(reporter.lastLogged) < reporter.interval {
+		return
+	}
+
+	reporter.lastLogged = now
+	log.Log.Infow("Current oplog position",
+		"shard", reporter.shardName,
+		"timestamp", position.timestamp,
+		"time", time.Unix(int64(position.timestamp.T), 0).UTC().Format(time.RFC3339),
+		"behindSeconds", oplogLag(position.timestamp, now))
+}
@@ -0,0 +1,78 @@
+package oplog
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/vlasky/oplogtoredis/lib/log"
+)
+
+// Bounds of the backoff before re-issuing the tail query after losing our
+// position
+const (
+	positionLostInitialDelay = 100 * time.Millisecond
+	positionLostMaxDelay     = 5 * time.Second
+)
+
+var metricPositionLost = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "otr",
+	Subsystem: "oplog",
+	Name:      "position_lost_total",
+	Help:      "Number of times the oplog rolled over past our cursor's position, so we had to re-issue the tail query, partitioned by shard (empty if not sharded). If this keeps increasing, the oplog is too small for the write volume.",
+}, []string{"shard"})
+
+// positionLossTracker keeps track of how often our cursor loses its position
+// in the oplog (because the oplog rolled over past it), which happens when
+// we're reading the oplog more slowly than it's being written and it's too
+// small to hold the difference. It backs off between re-issuing the tail
+// query, so that we don't spin when it keeps happening, and warns when it
+// happens more than Tailer.PositionLostWarnCount times within
+// Tailer.PositionLostWarnWindow.
+type positionLossTracker struct {
+	shardName string
+	warnCount int
+	window    time.Duration
+	backoff   *backoff
+
+	// When we lost our position within the window
+	losses []time.Time
+}
+
+func (tailer *Tailer) newPositionLossTracker() *positionLossTracker {
+	return &positionLossTracker{
+		shardName: tailer.shardName,
+		warnCount: tailer.PositionLostWarnCount,
+		window:    tailer.PositionLostWarnWindow,
+		backoff:   newBackoff(positionLostInitialDelay, positionLostMaxDelay),
+	}
+}
+
+// Records that we lost our position at the given time. Returns how long to
+// wait before re-issuing the tail query.
+func (tracker *positionLossTracker) lost(now time.Time) time.Duration {
+	metricPositionLost.WithLabelValues(tracker.shardName).Inc()
+
+	recent := tracker.losses[:0]
+	for _, t := range tracker.losses {
+		if now.Sub(t) < tracker.window {
+			recent = append(recent, t)
+		}
+	}
+	tracker.losses = append(recent, now)
+
+	// A loss on its own isn't a problem, so the backoff starts over unless
+	// they're recurring
+	if len(tracker.losses) == 1 {
+		tracker.backoff.reset()
+	}
+
+	if tracker.warnCount > 0 && len(tracker.losses) == tracker.warnCount+1 {
+		log.Log.Errorw("The oplog keeps rolling over past our position, so changes are being lost. The oplog is too small for the write volume, or we can't read it fast enough; consider resizing the oplog.",
+			"shard", tracker.shardName,
+			"losses", len(tracker.losses),
+			"window", tracker.window.String())
+	}
+
+	return tracker.backoff.next()
+}
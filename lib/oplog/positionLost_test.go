@@ -0,0 +1,50 @@
+package oplog
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestPositionLossTracker(t *testing.T) {
+	tailer := Tailer{
+		shardName:              "positionLostTest",
+		PositionLostWarnCount:  2,
+		PositionLostWarnWindow: time.Minute,
+	}
+	tracker := tailer.newPositionLossTracker()
+	metric := metricPositionLost.WithLabelValues("positionLostTest")
+
+	now := time.Now()
+
+	// Recurring losses back off further each time, up to the maximum
+	var lastDelay time.Duration
+	for i := 0; i < 10; i++ {
+		delay := tracker.lost(now)
+		if delay > positionLostMaxDelay {
+			t.Errorf("Delay %s exceeded the maximum", delay)
+		}
+		lastDelay = delay
+		now = now.Add(time.Second)
+	}
+
+	if lastDelay < positionLostMaxDelay/2 {
+		t.Errorf("Expected the delay to back off towards the maximum, got %s", lastDelay)
+	}
+	if len(tracker.losses) != 10 {
+		t.Errorf("Expected 10 losses within the window, got %d", len(tracker.losses))
+	}
+	if got := testutil.ToFloat64(metric); got != 10 {
+		t.Errorf("Expected the metric to count 10 losses, got %f", got)
+	}
+
+	// Once the losses have dropped out of the window, the backoff starts over
+	now = now.Add(2 * time.Minute)
+	if delay := tracker.lost(now); delay > positionLostInitialDelay {
+		t.Errorf("Expected the backoff to start over, got %s", delay)
+	}
+	if len(tracker.losses) != 1 {
+		t.Errorf("Expected only the latest loss within the window, got %d", len(tracker.losses))
+	}
+}
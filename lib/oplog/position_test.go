@@ -0,0 +1,226 @@
+package oplog
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"github.com/vlasky/oplogtoredis/lib/redispub"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+// Returns the indexes of the entries of an oplog (given by their timestamps,
+// in natural order) matched by the filter from oplogPosition.startQuery
+func runOplogQuery(oplog []primitive.Timestamp, filter bson.M) []int {
+	less := func(a, b primitive.Timestamp) bool {
+		return a.T < b.T || (a.T == b.T && a.I < b.I)
+	}
+
+	cond := filter["ts"].(bson.M)
+	var matched []int
+	for i, ts := range oplog {
+		if gt, ok := cond["$gt"]; ok && less(gt.(primitive.Timestamp), ts) {
+			matched = append(matched, i)
+		}
+		if gte, ok := cond["$gte"]; ok && !less(ts, gte.(primitive.Timestamp)) {
+			matched = append(matched, i)
+		}
+	}
+	return matched
+}
+
+// Simulates tailing an oplog in which two entries share a timestamp, with the
+// cursor timing out in between them. The requery must pick up the second
+// entry without re-reading the first.
+func TestOplogPositionSharedTimestampReconnect(t *testing.T) {
+	ts1 := primitive.Timestamp{T: 1000, I: 1}
+	ts2 := primitive.Timestamp{T: 1001, I: 1}
+	oplog := []primitive.Timestamp{ts1, ts1, ts2}
+
+	position := newOplogPosition(primitive.Timestamp{T: 999})
+	var processed []int
+
+	// The first cursor reads the first entry, then times out
+	cursor := runOplogQuery(oplog, position.startQuery())
+	if position.observe(oplog[cursor[0]]) {
+		processed = append(processed, cursor[0])
+	}
+
+	// The requery should return the remaining entries
+	for _, i := range runOplogQuery(oplog, position.startQuery()) {
+		if position.observe(oplog[i]) {
+			processed = append(processed, i)
+		}
+	}
+
+	if diff := pretty.Compare(processed, []int{0, 1, 2}); diff != "" {
+		t.Errorf("Got incorrect entries processed (-got +want)\n%s", diff)
+	}
+}
+
+// Simulates two updates to the same document that share a timestamp, with the
+// cursor timing out in between them, followed by an update at a later
+// timestamp. Their publications must be in oplog order, and have distinct
+// deduplication keys, so that redispub doesn't drop the second update as a
+// duplicate of the first.
+func TestOplogPositionSameDocumentReconnect(t *testing.T) {
+	ts1 := primitive.Timestamp{T: 1000, I: 1}
+	ts2 := primitive.Timestamp{T: 1001, I: 1}
+	update := func(ts primitive.Timestamp, field string) bson.Raw {
+		return mustRaw(t, bson.M{
+			"ts": ts,
+			"op": "u",
+			"ns": "foo.bar",
+			"o":  bson.M{"$v": 1, "$set": bson.M{field: 1}},
+			"o2": bson.M{"_id": "doc"},
+		})
+	}
+	entries := []bson.Raw{update(ts1, "a"), update(ts1, "b"), update(ts2, "c")}
+	oplog := []primitive.Timestamp{ts1, ts1, ts2}
+
+	tailer := &Tailer{}
+	position := newOplogPosition(primitive.Timestamp{T: 999})
+	var pubs []*redispub.Publication
+
+	read := func(i int) {
+		if !position.observe(oplog[i]) {
+			return
+		}
+
+		_, entryPubs := tailer.unmarshalEntry(entries[i])
+		setEntryIdx(entryPubs, position.index())
+		pubs = append(pubs, entryPubs...)
+	}
+
+	// The first cursor reads the first update, then times out
+	read(runOplogQuery(oplog, position.startQuery())[0])
+
+	// The requery returns the first update again, which is skipped, and
+	// then the rest
+	for _, i := range runOplogQuery(oplog, position.startQuery()) {
+		read(i)
+	}
+
+	require.Len(t, pubs, 3)
+
+	type dedupKey struct {
+		timestamp primitive.Timestamp
+		entryIdx  uint
+		txIdx     uint
+	}
+	keys := map[dedupKey]bool{}
+
+	for i, field := range []string{"a", "b", "c"} {
+		require.Equal(t, "foo.bar::doc", pubs[i].SpecificChannel)
+		require.Contains(t, string(pubs[i].Msg), `"f":["`+field+`"]`, "publication %d out of order", i)
+
+		key := dedupKey{pubs[i].OplogTimestamp, pubs[i].EntryIdx, pubs[i].TxIdx}
+		require.False(t, keys[key], "publication %d has the same deduplication key as an earlier one", i)
+		keys[key] = true
+	}
+
+	require.Equal(t, []uint{0, 1, 0}, []uint{pubs[0].EntryIdx, pubs[1].EntryIdx, pubs[2].EntryIdx})
+}
+
+func TestOplogPositionStartQuery(t *testing.T) {
+	ts := primitive.Timestamp{T: 1000, I: 1}
+
+	tests := map[string]struct {
+		observed       []primitive.Timestamp
+		expectedFilter bson.M
+		expectedSkip   int
+	}{
+		"Fresh start": {
+			expectedFilter: bson.M{"ts": bson.M{"$gt": ts}},
+		},
+		"Read one entry": {
+			observed:       []primitive.Timestamp{ts},
+			expectedFilter: bson.M{"ts": bson.M{"$gte": ts}},
+			expectedSkip:   1,
+		},
+		"Read several entries at the same timestamp": {
+			observed:       []primitive.Timestamp{ts, ts, ts},
+			expectedFilter: bson.M{"ts": bson.M{"$gte": ts}},
+			expectedSkip:   3,
+		},
+		"Read entries at an earlier timestamp": {
+			observed:       []primitive.Timestamp{{T: 999}, {T: 999}, ts},
+			expectedFilter: bson.M{"ts": bson.M{"$gte": ts}},
+			expectedSkip:   1,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			position := newOplogPosition(ts)
+			if len(test.observed) > 0 {
+				position = newOplogPosition(primitive.Timestamp{})
+			}
+			for _, observed := range test.observed {
+				position.observe(observed)
+			}
+
+			filter := position.startQuery()
+
+			if diff := pretty.Compare(filter, test.expectedFilter); diff != "" {
+				t.Errorf("Got incorrect filter (-got +want)\n%s", diff)
+			}
+			if position.toSkip != test.expectedSkip {
+				t.Errorf("Expected to skip %d entries, got %d", test.expectedSkip, position.toSkip)
+			}
+		})
+	}
+}
+
+func TestOplogPositionStopsSkippingAtNewTimestamp(t *testing.T) {
+	ts1 := primitive.Timestamp{T: 1000, I: 1}
+	ts2 := primitive.Timestamp{T: 1001, I: 1}
+
+	position := newOplogPosition(primitive.Timestamp{})
+	position.observe(ts1)
+	position.observe(ts1)
+	position.startQuery()
+
+	// The oplog only has one entry at ts1 now (e.g. it rolled over), so
+	// after skipping it we should process the next entry even though we
+	// expected to skip two
+	if position.observe(ts1) {
+		t.Error("Expected the already-read entry to be skipped")
+	}
+	if !position.observe(ts2) {
+		t.Error("Expected the entry at the new timestamp to be processed")
+	}
+}
+
+func TestPositionReporter(t *testing.T) {
+	tailer := Tailer{ResumeLogInterval: time.Minute, shardName: "reporterTest"}
+	reporter := tailer.newPositionReporter()
+	position := newOplogPosition(primitive.Timestamp{T: 1500000000, I: 1})
+	start := time.Unix(1500000100, 0)
+
+	reporter.report(position, start)
+	if got := testutil.ToFloat64(metricResumeTimestamp.WithLabelValues("reporterTest")); got != 1500000000 {
+		t.Errorf("Expected the resume timestamp metric to be 1500000000, got %f", got)
+	}
+	if !reporter.lastLogged.Equal(start) {
+		t.Errorf("Expected the first report to be logged")
+	}
+
+	position.observe(primitive.Timestamp{T: 1500000030, I: 1})
+	reporter.report(position, start.Add(30*time.Second))
+	if got := testutil.ToFloat64(metricResumeTimestamp.WithLabelValues("reporterTest")); got != 1500000030 {
+		t.Errorf("Expected the resume timestamp metric to be 1500000030, got %f", got)
+	}
+	if !reporter.lastLogged.Equal(start) {
+		t.Errorf("Expected a report within the interval not to be logged")
+	}
+
+	reporter.report(position, start.Add(time.Minute))
+	if !reporter.lastLogged.Equal(start.Add(time.Minute)) {
+		t.Errorf("Expected a report after the interval to be logged")
+	}
+}
@@ -2,9 +2,10 @@ package oplog
 
 import (
 	"encoding/json"
-	"strings"
 
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/vlasky/oplogtoredis/lib/log"
 	"github.com/vlasky/oplogtoredis/lib/redispub"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -12,93 +13,319 @@ import (
 
 var ErrUnsupportedDocIDType = errors.New("unsupported document _id type")
 
+var metricFieldFilteredUpdates = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "otr",
+	Subsystem: "oplog",
+	Name:      "field_filtered_updates",
+	Help:      "Updates that weren't published because they didn't change any of the fields in OTR_FIELD_FILTER, partitioned by database",
+}, []string{"database"})
+
+var metricOversizedPayloads = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "otr",
+	Subsystem: "oplog",
+	Name:      "oversized_payloads",
+	Help:      "Messages larger than OTR_MAX_PAYLOAD_BYTES, which were sent with only the document ID instead of the full document, partitioned by database",
+}, []string{"database"})
+
+var metricNoIDEntries = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "otr",
+	Subsystem: "oplog",
+	Name:      "no_id_entries",
+	Help:      "Inserts, updates, and removes that weren't published because they didn't identify a document by _id, partitioned by database",
+}, []string{"database"})
+
 // Process a signal oplog entry. Returns the redispub.Publication that should
 // be published for this oplog entry, or nil if nothing should be published.
-//
-// TODO PERF: Add options for filtering to specific collections or
-// databases (https://github.com/vlasky/oplogtoredis/issues/8)
-func processOplogEntry(op *oplogEntry) (*redispub.Publication, error) {
-	// Struct that matches the message format redis-oplog expects
-	type outgoingMessageDocument struct {
-		ID interface{} `json:"_id"`
-	}
-	type outgoingMessage struct {
-		Event  string                  `json:"e"`
-		Doc    outgoingMessageDocument `json:"d"`
-		Fields []string                `json:"f"`
-	}
-
-	if strings.HasPrefix(op.Collection, "system.") {
-		// We don't publish index creation events
+func (tailer *Tailer) processOplogEntry(op *oplogEntry) (*redispub.Publication, error) {
+	// The publication keeps the source namespace, which is what we resume
+	// and deduplicate by
+	sourceNamespace := op.Namespace
+	op = tailer.remapNamespace(op)
+
+	if !tailer.IncludeSystemNamespaces && isSystemNamespace(sourceNamespace) {
+		// We don't publish index creation events, or changes to the config
+		// database, which holds internal MongoDB structures such as metadata
+		// about transactions and locks. Entries from the oplog have already
+		// been skipped by parseRawOplogEntry, but change events haven't.
 		return nil, nil
 	}
 
-	if op.Database == "config" {
-		// The Config database holds internal MongoDB structures, such as metadata
-		// about transactions and locks
+	if op.IsNamespaceEvent() {
+		return tailer.processNamespaceEvent(op, sourceNamespace)
+	}
+
+	if !hasDocID(op) {
+		// Without an _id there's no document channel to publish to, and
+		// subscribers couldn't tell which document changed anyway
+		metricNoIDEntries.WithLabelValues(op.Database).Inc()
+		log.Log.Warnw("Skipping oplog entry without a document _id",
+			"database", op.Database,
+			"collection", op.Collection,
+			"operation", op.Operation,
+			"timestamp", op.Timestamp)
 		return nil, nil
 	}
 
-	var idForChannel string
-	var idForMessage interface{}
+	idForChannel, idForMessage, err := formatDocID(op.DocID)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := op.ChangedFields()
+	if op.IsUpdate() && len(fields) > 0 {
+		if interesting, ok := tailer.fieldsOfInterest(sourceNamespace); ok {
+			fields = intersectFields(fields, interesting)
+			if len(fields) == 0 {
+				// None of the fields subscribers care about changed
+				metricFieldFilteredUpdates.WithLabelValues(op.Database).Inc()
+				return nil, nil
+			}
+		}
+	}
+
+	msgBytes, err := tailer.buildPayload(op, idForMessage, fields)
+	if err != nil {
+		return nil, err
+	}
+
+	collectionChannel, specificChannel, err := tailer.buildChannels(op, sourceNamespace, idForChannel)
+	if err != nil {
+		return nil, err
+	}
+
+	return &redispub.Publication{
+		CollectionChannel: collectionChannel,
+		SpecificChannel:   specificChannel,
+
+		Msg:            msgBytes,
+		OplogTimestamp: op.Timestamp,
 
-	switch id := op.DocID.(type) {
+		Namespace: sourceNamespace,
+		DocID:     idForChannel,
+		TxIdx:     op.TxIdx,
+
+		Operation:       operationLabel(op.Operation),
+		CollectionLabel: tailer.CollectionLabels.label(parseNamespace(sourceNamespace)),
+	}, nil
+}
+
+// Struct that matches the document format redis-oplog expects
+type outgoingMessageDocument struct {
+	ID interface{} `json:"_id"`
+}
+
+// Returns the two forms of a document's _id that we publish: the one in the
+// name of the document's channel, and the one in the message
+func formatDocID(docID interface{}) (idForChannel string, idForMessage interface{}, err error) {
+	switch id := docID.(type) {
 	case string:
-		idForChannel = id
-		idForMessage = id
+		return id, id, nil
 
 	case primitive.ObjectID:
 		idHex := id.Hex()
-		idForChannel = idHex
-		idForMessage = map[string]string{
+		return idHex, map[string]string{
 			"$type":  "oid",
 			"$value": idHex,
-		}
+		}, nil
 
 	default:
-		// We don't know how to handle IDs that aren't strings or ObjectIDs,
-		// because we don't what what the specific channel (the channel for
-		// this specific document) should be.
-		return nil, errors.Wrapf(ErrUnsupportedDocIDType, "expected string or ObjectID, got %T instead", op.DocID)
+		// Other IDs (numbers, binary data such as UUIDs, documents, and so
+		// on) are sent as EJSON, and the specific channel is named after the
+		// JSON encoding of that, so a given ID always maps to the same
+		// channel. Strings and ObjectIDs are handled above, in the form
+		// redis-oplog expects.
+		idForMessage = toEJSON(id)
+
+		idJSON, err := json.Marshal(idForMessage)
+		if err != nil {
+			return "", nil, errors.Wrapf(ErrUnsupportedDocIDType, "encoding %T: %s", docID, err)
+		}
+
+		return string(idJSON), idForMessage, nil
 	}
+}
 
+// Returns the message to publish for a change to a document (op, after
+// remapNamespace), given the document's _id as formatted by formatDocID and
+// the changed fields to list. It doesn't touch Mongo or Redis, so the same
+// entry and config always give the same bytes.
+func (tailer *Tailer) buildPayload(op *oplogEntry, idForMessage interface{}, fields []string) ([]byte, error) {
 	// Construct the JSON we're going to send to Redis
 	//
 	// TODO PERF: consider a specialized JSON encoder
 	// https://github.com/vlasky/oplogtoredis/issues/13
-	msg := outgoingMessage{
-		Event:  eventNameForOperation(op),
-		Doc:    outgoingMessageDocument{idForMessage},
-		Fields: op.ChangedFields(),
+	var doc interface{} = outgoingMessageDocument{idForMessage}
+
+	if op.FullDocument != nil {
+		// Send the whole document, with the ID in the same format we'd
+		// otherwise use
+		fullDoc := make(map[string]interface{}, len(op.FullDocument))
+		for k, v := range op.FullDocument {
+			fullDoc[k] = tailer.payloadSerializer().ConvertValue(v)
+		}
+		fullDoc["_id"] = idForMessage
+
+		doc = fullDoc
+	}
+
+	newMessage := func(doc interface{}) message {
+		return tailer.newMessage(op,
+			tailer.messageField(payloadKeyEvent, eventNameForOperation(op)),
+			tailer.messageField(payloadKeyData, doc),
+			tailer.messageField(payloadKeyFields, fields))
 	}
+
+	msg := newMessage(doc)
 	log.Log.Debugw("Sending outgoing message", "message", msg)
-	msgJSON, err := json.Marshal(&msg)
+	msgBytes, err := tailer.payloadSerializer().Marshal(msg)
 
 	if err != nil {
 		return nil, errors.Wrap(err, "marshalling outgoing message")
 	}
 
+	if op.FullDocument != nil && tailer.MaxPayloadBytes > 0 && len(msgBytes) > tailer.MaxPayloadBytes {
+		// Fall back to sending just the ID, as we do for collections we
+		// don't publish full documents for; subscribers can still fetch the
+		// document from Mongo if they need it
+		metricOversizedPayloads.WithLabelValues(op.Database).Inc()
+		log.Log.Warnw("Message exceeds OTR_MAX_PAYLOAD_BYTES; sending only the document ID",
+			"database", op.Database,
+			"collection", op.Collection,
+			"id", op.DocID,
+			"size", len(msgBytes))
+
+		msgBytes, err = tailer.payloadSerializer().Marshal(newMessage(outgoingMessageDocument{idForMessage}))
+		if err != nil {
+			return nil, errors.Wrap(err, "marshalling outgoing message")
+		}
+	}
+
+	return msgBytes, nil
+}
+
+// Returns the collection and document channels to publish a change to a
+// document (op, after remapNamespace) on, given the document's _id as
+// formatted by formatDocID. sourceNamespace is op's namespace before
+// remapNamespace, which picks the channel prefix.
+func (tailer *Tailer) buildChannels(op *oplogEntry, sourceNamespace string, idForChannel string) (collectionChannel string, specificChannel string, err error) {
 	// We need to publish on both the full-collection channel and the
-	// single-document channel
-	return &redispub.Publication{
-		// The "collection" channel is used by redis-oplog for subscriptions
-		// that target arbitrary selectors
-		CollectionChannel: op.Namespace,
+	// single-document channel.
+	//
+	// The "collection" channel is used by redis-oplog for subscriptions
+	// that target arbitrary selectors
+	//
+	// The "specific" channel is used by redis-oplog as a performance
+	// optimization for subscriptions that target a specific ID
+	collectionChannel = op.Namespace
+	specificChannel = op.Namespace + "::" + idForChannel
 
-		// The "specific" channel is used by redis-oplog as a performance
-		// optimization for subscriptions that target a specific ID
-		SpecificChannel: op.Namespace + "::" + idForChannel,
+	if tailer.ChannelTemplate != nil {
+		collectionChannel, specificChannel, err = renderChannels(tailer.ChannelTemplate, op, idForChannel)
+		if err != nil {
+			return "", "", err
+		}
+	}
+
+	collectionChannel = tailer.prefixChannel(sourceNamespace, collectionChannel)
+	specificChannel = tailer.prefixChannel(sourceNamespace, specificChannel)
+
+	return collectionChannel, specificChannel, nil
+}
 
-		Msg:            msgJSON,
+// Process a namespace event (such as a collection being renamed). These are
+// only published on the collection channel, and the message carries the
+// details of the event in place of a document. op has already been through
+// remapNamespace; sourceNamespace is its namespace before that.
+func (tailer *Tailer) processNamespaceEvent(op *oplogEntry, sourceNamespace string) (*redispub.Publication, error) {
+	msg := tailer.newMessage(op,
+		tailer.messageField(payloadKeyEvent, eventNameForOperation(op)),
+		tailer.messageField(payloadKeyData, tailer.payloadSerializer().ConvertValue(op.Data)))
+	log.Log.Debugw("Sending outgoing message", "message", msg)
+	msgBytes, err := tailer.payloadSerializer().Marshal(msg)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "marshalling outgoing message")
+	}
+
+	channel := op.Namespace
+	if tailer.ChannelTemplate != nil {
+		channel, _, err = renderChannels(tailer.ChannelTemplate, op, "")
+		if err != nil {
+			return nil, err
+		}
+	}
+	channel = tailer.prefixChannel(sourceNamespace, channel)
+
+	return &redispub.Publication{
+		CollectionChannel: channel,
+
+		Msg:            msgBytes,
 		OplogTimestamp: op.Timestamp,
 
-		TxIdx: op.TxIdx,
+		Namespace: sourceNamespace,
+		TxIdx:     op.TxIdx,
+
+		Operation:       operationLabel(op.Operation),
+		CollectionLabel: tailer.CollectionLabels.label(parseNamespace(sourceNamespace)),
 	}, nil
 }
 
+// Returns whether op identifies the document it's about. Some entries (such
+// as ones written by internal or malformed operations) have no _id, or a null
+// one.
+func hasDocID(op *oplogEntry) bool {
+	switch op.DocID.(type) {
+	case nil, primitive.Null, primitive.Undefined:
+		return false
+	default:
+		return true
+	}
+}
+
+// Prepends the ChannelPrefixes entry for the database of sourceNamespace (the
+// namespace before NamespaceMap) to channel. Channels of databases without an
+// entry are left as they are.
+func (tailer *Tailer) prefixChannel(sourceNamespace string, channel string) string {
+	database, _ := parseNamespace(sourceNamespace)
+	return tailer.ChannelPrefixes[database] + channel
+}
+
 func eventNameForOperation(op *oplogEntry) string {
 	if op.Operation == "d" {
 		return "r"
 	}
 	return op.Operation
 }
+
+// Returns the operation to include in the message for op: "i", "u", or "d"
+// for an insert, update, or remove. It's empty if the tailer doesn't include
+// operations, and for namespace events, whose "e" already says what they are.
+func (tailer *Tailer) messageOperation(op *oplogEntry) string {
+	if !tailer.IncludeOperation {
+		return ""
+	}
+
+	switch op.Operation {
+	case operationInsert, operationUpdate, operationRemove:
+		return op.Operation
+	default:
+		return ""
+	}
+}
+
+// The oplog timestamp of an entry, as included in messages when
+// Tailer.IncludeTimestamp is set. Consumers can order messages by (t, i).
+type messageTimestamp struct {
+	T uint32 `json:"t"`
+	I uint32 `json:"i"`
+}
+
+// Returns the timestamp to include in the message for op, or nil if the
+// tailer doesn't include timestamps
+func (tailer *Tailer) messageTimestamp(op *oplogEntry) *messageTimestamp {
+	if !tailer.IncludeTimestamp {
+		return nil
+	}
+
+	return &messageTimestamp{T: op.Timestamp.T, I: op.Timestamp.I}
+}
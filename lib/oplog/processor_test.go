@@ -1,15 +1,20 @@
 package oplog
 
 import (
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"os"
 	"sort"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 
 	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"github.com/vlasky/oplogtoredis/lib/config"
 	"github.com/vlasky/oplogtoredis/lib/redispub"
 	"go.mongodb.org/mongo-driver/bson"
 )
@@ -129,6 +134,43 @@ func TestProcessOplogEntry(t *testing.T) {
 				OplogTimestamp: primitive.Timestamp{T: 1234},
 			},
 		},
+		"Update with full document": {
+			in: &oplogEntry{
+				DocID:      testObjectId,
+				Operation:  "u",
+				Namespace:  "foo.bar",
+				Database:   "foo",
+				Collection: "bar",
+				Data: bson.M{
+					"$set": map[string]interface{}{
+						"a": "foo",
+					},
+				},
+				FullDocument: map[string]interface{}{
+					"_id": testObjectId,
+					"a":   "foo",
+					"b":   "unchanged",
+				},
+				Timestamp: primitive.Timestamp{T: 1234},
+			},
+			want: &decodedPublication{
+				CollectionChannel: "foo.bar",
+				SpecificChannel:   "foo.bar::deadbeefdeadbeefdeadbeef",
+				Msg: decodedPublicationMessage{
+					Event: "u",
+					Doc: map[string]interface{}{
+						"_id": map[string]interface{}{
+							"$type":  "oid",
+							"$value": "deadbeefdeadbeefdeadbeef",
+						},
+						"a": "foo",
+						"b": "unchanged",
+					},
+					Fields: []string{"a"},
+				},
+				OplogTimestamp: primitive.Timestamp{T: 1234},
+			},
+		},
 		"Delete": {
 			in: &oplogEntry{
 				DocID:      "someid",
@@ -180,9 +222,95 @@ func TestProcessOplogEntry(t *testing.T) {
 				OplogTimestamp: primitive.Timestamp{T: 1234},
 			},
 		},
+		"Int64 id": {
+			in: &oplogEntry{
+				DocID:      int64(1234),
+				Operation:  "i",
+				Namespace:  "foo.bar",
+				Database:   "foo",
+				Collection: "bar",
+				Data: bson.M{
+					"some": "field",
+				},
+				Timestamp: primitive.Timestamp{T: 1234},
+			},
+			want: &decodedPublication{
+				CollectionChannel: "foo.bar",
+				SpecificChannel:   "foo.bar::1234",
+				Msg: decodedPublicationMessage{
+					Event: "i",
+					Doc: map[string]interface{}{
+						"_id": float64(1234),
+					},
+					Fields: []string{"some"},
+				},
+				OplogTimestamp: primitive.Timestamp{T: 1234},
+			},
+		},
+		"Binary UUID id": {
+			in: &oplogEntry{
+				DocID: primitive.Binary{
+					Subtype: 4,
+					Data:    []byte{0xde, 0xad, 0xbe, 0xef, 0xde, 0xad, 0xbe, 0xef, 0xde, 0xad, 0xbe, 0xef, 0xde, 0xad, 0xbe, 0xef},
+				},
+				Operation:  "d",
+				Namespace:  "foo.bar",
+				Database:   "foo",
+				Collection: "bar",
+				Timestamp:  primitive.Timestamp{T: 1234},
+			},
+			want: &decodedPublication{
+				CollectionChannel: "foo.bar",
+				SpecificChannel:   `foo.bar::{"$binary":"3q2+796tvu/erb7v3q2+7w=="}`,
+				Msg: decodedPublicationMessage{
+					Event: "r",
+					Doc: map[string]interface{}{
+						"_id": map[string]interface{}{
+							"$binary": "3q2+796tvu/erb7v3q2+7w==",
+						},
+					},
+					Fields: []string{},
+				},
+				OplogTimestamp: primitive.Timestamp{T: 1234},
+			},
+		},
+		"Compound document id": {
+			in: &oplogEntry{
+				DocID: primitive.D{
+					{Key: "user", Value: testObjectId},
+					{Key: "seq", Value: int32(7)},
+				},
+				Operation:  "u",
+				Namespace:  "foo.bar",
+				Database:   "foo",
+				Collection: "bar",
+				Data: bson.M{
+					"$set": map[string]interface{}{"a": 1},
+				},
+				Timestamp: primitive.Timestamp{T: 1234},
+			},
+			want: &decodedPublication{
+				CollectionChannel: "foo.bar",
+				SpecificChannel:   `foo.bar::{"seq":7,"user":{"$type":"oid","$value":"deadbeefdeadbeefdeadbeef"}}`,
+				Msg: decodedPublicationMessage{
+					Event: "u",
+					Doc: map[string]interface{}{
+						"_id": map[string]interface{}{
+							"seq": float64(7),
+							"user": map[string]interface{}{
+								"$type":  "oid",
+								"$value": "deadbeefdeadbeefdeadbeef",
+							},
+						},
+					},
+					Fields: []string{"a"},
+				},
+				OplogTimestamp: primitive.Timestamp{T: 1234},
+			},
+		},
 		"Unsupported id type": {
 			in: &oplogEntry{
-				DocID:      1234,
+				DocID:      make(chan int),
 				Operation:  "i",
 				Namespace:  "foo.bar",
 				Database:   "foo",
@@ -195,6 +323,33 @@ func TestProcessOplogEntry(t *testing.T) {
 			wantError: ErrUnsupportedDocIDType,
 			want:      nil,
 		},
+		"Insert without id": {
+			in: &oplogEntry{
+				Operation:  "i",
+				Namespace:  "foo.bar",
+				Database:   "foo",
+				Collection: "bar",
+				Data: bson.M{
+					"some": "field",
+				},
+				Timestamp: primitive.Timestamp{T: 1234},
+			},
+			want: nil,
+		},
+		"Update with null id": {
+			in: &oplogEntry{
+				DocID:      primitive.Null{},
+				Operation:  "u",
+				Namespace:  "foo.bar",
+				Database:   "foo",
+				Collection: "bar",
+				Data: bson.M{
+					"$set": bson.M{"some": "field"},
+				},
+				Timestamp: primitive.Timestamp{T: 1234},
+			},
+			want: nil,
+		},
 		"Index update": {
 			in: &oplogEntry{
 				DocID:      "someid",
@@ -264,7 +419,7 @@ func TestProcessOplogEntry(t *testing.T) {
 			// Create an output channel. We create a buffered channel so that
 			// we can run Tail
 
-			got, err := processOplogEntry(test.in)
+			got, err := (&Tailer{}).processOplogEntry(test.in)
 
 			if test.wantError != nil {
 				assert.EqualError(t, errors.Cause(err), test.wantError.Error())
@@ -276,3 +431,632 @@ func TestProcessOplogEntry(t *testing.T) {
 		})
 	}
 }
+
+// The changed-field extraction for v2 updates depends on config, so we test
+// it separately from the table above.
+func TestProcessOplogEntryV2Update(t *testing.T) {
+	os.Setenv("OTR_OPLOG_V2_EXTRACT_SUBFIELD_CHANGES", "false")
+	os.Setenv("OTR_REDIS_URL", "redis://yyy")
+	os.Setenv("OTR_MONGO_URL", "mongodb://xxx")
+	require.NoError(t, config.ParseEnv())
+
+	pub, err := (&Tailer{}).processOplogEntry(&oplogEntry{
+		DocID:      "someid",
+		Operation:  "u",
+		Namespace:  "foo.bar",
+		Database:   "foo",
+		Collection: "bar",
+		Data: bson.M{
+			"$v": 2,
+			"diff": map[string]interface{}{
+				"u":    map[string]interface{}{"a": 1},
+				"d":    map[string]interface{}{"b": false},
+				"sfoo": map[string]interface{}{"u": map[string]interface{}{"x": 1}},
+			},
+		},
+		Timestamp: primitive.Timestamp{T: 1234},
+	})
+	require.NoError(t, err)
+
+	var msg struct {
+		Event  string   `json:"e"`
+		Fields []string `json:"f"`
+	}
+	require.NoError(t, json.Unmarshal(pub.Msg, &msg))
+	sort.Strings(msg.Fields)
+
+	assert.Equal(t, "u", msg.Event)
+	assert.Equal(t, []string{"a", "b", "foo"}, msg.Fields)
+}
+
+func TestProcessOplogEntryMaxPayloadBytes(t *testing.T) {
+	entry := func() *oplogEntry {
+		return &oplogEntry{
+			DocID:      "someid",
+			Operation:  "u",
+			Namespace:  "foo.bar",
+			Database:   "foo",
+			Collection: "bar",
+			Data: bson.M{
+				"$set": map[string]interface{}{"a": "foo"},
+			},
+			FullDocument: map[string]interface{}{
+				"_id": "someid",
+				"a":   "foo",
+				"big": strings.Repeat("x", 1000),
+			},
+			Timestamp: primitive.Timestamp{T: 1234},
+		}
+	}
+
+	type message struct {
+		Event  string                 `json:"e"`
+		Doc    map[string]interface{} `json:"d"`
+		Fields []string               `json:"f"`
+	}
+
+	tests := map[string]struct {
+		maxPayloadBytes int
+		wantDoc         map[string]interface{}
+	}{
+		"No limit": {
+			maxPayloadBytes: 0,
+			wantDoc:         map[string]interface{}{"_id": "someid", "a": "foo", "big": strings.Repeat("x", 1000)},
+		},
+		"Under the limit": {
+			maxPayloadBytes: 2000,
+			wantDoc:         map[string]interface{}{"_id": "someid", "a": "foo", "big": strings.Repeat("x", 1000)},
+		},
+		"Over the limit": {
+			maxPayloadBytes: 500,
+			wantDoc:         map[string]interface{}{"_id": "someid"},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			pub, err := (&Tailer{MaxPayloadBytes: test.maxPayloadBytes}).processOplogEntry(entry())
+			require.NoError(t, err)
+
+			var msg message
+			require.NoError(t, json.Unmarshal(pub.Msg, &msg))
+
+			assert.Equal(t, "u", msg.Event)
+			assert.Equal(t, test.wantDoc, msg.Doc)
+			assert.Equal(t, []string{"a"}, msg.Fields)
+		})
+	}
+}
+
+func TestProcessOplogEntryFieldFilter(t *testing.T) {
+	update := func(set map[string]interface{}) *oplogEntry {
+		return &oplogEntry{
+			DocID:      "someid",
+			Operation:  "u",
+			Namespace:  "foo.users",
+			Database:   "foo",
+			Collection: "users",
+			Data:       bson.M{"$set": set},
+			Timestamp:  primitive.Timestamp{T: 1234},
+		}
+	}
+
+	tests := map[string]struct {
+		entry      *oplogEntry
+		wantFields []string
+	}{
+		"Interesting field changed": {
+			entry:      update(map[string]interface{}{"name": "x", "lastSeen": 1}),
+			wantFields: []string{"name"},
+		},
+		"Only other fields changed": {
+			entry:      update(map[string]interface{}{"lastSeen": 1, "visits": 2}),
+			wantFields: nil,
+		},
+		"Field within an interesting field changed": {
+			entry:      update(map[string]interface{}{"profile.email": "x"}),
+			wantFields: []string{"profile.email"},
+		},
+		"Document containing an interesting field changed": {
+			entry:      update(map[string]interface{}{"address": map[string]interface{}{"city": "x"}}),
+			wantFields: []string{"address"},
+		},
+		"Unfiltered namespace": {
+			entry: &oplogEntry{
+				DocID:      "someid",
+				Operation:  "u",
+				Namespace:  "foo.other",
+				Database:   "foo",
+				Collection: "other",
+				Data:       bson.M{"$set": map[string]interface{}{"lastSeen": 1}},
+			},
+			wantFields: []string{"lastSeen"},
+		},
+		"Insert": {
+			entry: &oplogEntry{
+				DocID:      "someid",
+				Operation:  "i",
+				Namespace:  "foo.users",
+				Database:   "foo",
+				Collection: "users",
+				Data:       bson.M{"_id": "someid", "lastSeen": 1},
+			},
+			wantFields: []string{"_id", "lastSeen"},
+		},
+	}
+
+	tailer := &Tailer{FieldFilter: map[string][]string{
+		"foo.users": {"name", "profile", "address.city"},
+	}}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			pub, err := tailer.processOplogEntry(test.entry)
+			require.NoError(t, err)
+
+			if test.wantFields == nil {
+				assert.Nil(t, pub)
+				return
+			}
+
+			require.NotNil(t, pub)
+			var msg struct {
+				Fields []string `json:"f"`
+			}
+			require.NoError(t, json.Unmarshal(pub.Msg, &msg))
+
+			sort.Strings(msg.Fields)
+			assert.Equal(t, test.wantFields, msg.Fields)
+		})
+	}
+}
+
+func TestProcessOplogEntryIncludeTimestamp(t *testing.T) {
+	entry := func() *oplogEntry {
+		return &oplogEntry{
+			DocID:      "someid",
+			Operation:  "i",
+			Namespace:  "foo.bar",
+			Database:   "foo",
+			Collection: "bar",
+			Data:       bson.M{"_id": "someid"},
+			Timestamp:  primitive.Timestamp{T: 1500000000, I: 7},
+		}
+	}
+
+	t.Run("Disabled", func(t *testing.T) {
+		pub, err := (&Tailer{}).processOplogEntry(entry())
+		require.NoError(t, err)
+
+		var msg map[string]interface{}
+		require.NoError(t, json.Unmarshal(pub.Msg, &msg))
+		assert.NotContains(t, msg, "ts")
+	})
+
+	t.Run("Enabled", func(t *testing.T) {
+		pub, err := (&Tailer{IncludeTimestamp: true}).processOplogEntry(entry())
+		require.NoError(t, err)
+
+		var msg struct {
+			Timestamp map[string]uint32 `json:"ts"`
+		}
+		require.NoError(t, json.Unmarshal(pub.Msg, &msg))
+		assert.Equal(t, map[string]uint32{"t": 1500000000, "i": 7}, msg.Timestamp)
+	})
+}
+
+func TestProcessOplogEntryIncludeOperation(t *testing.T) {
+	entry := func(operation string, data bson.M) *oplogEntry {
+		return &oplogEntry{
+			DocID:      "someid",
+			Operation:  operation,
+			Namespace:  "foo.bar",
+			Database:   "foo",
+			Collection: "bar",
+			Data:       data,
+			Timestamp:  primitive.Timestamp{T: 1234, I: 5},
+		}
+	}
+
+	tests := map[string]struct {
+		tailer  *Tailer
+		in      *oplogEntry
+		wantMsg string
+	}{
+		"Insert": {
+			tailer:  &Tailer{IncludeOperation: true},
+			in:      entry(operationInsert, bson.M{"a": 1}),
+			wantMsg: `{"e":"i","d":{"_id":"someid"},"f":["a"],"op":"i"}`,
+		},
+		"Update": {
+			tailer:  &Tailer{IncludeOperation: true},
+			in:      entry(operationUpdate, bson.M{"$set": map[string]interface{}{"a": 1}}),
+			wantMsg: `{"e":"u","d":{"_id":"someid"},"f":["a"],"op":"u"}`,
+		},
+		"Remove": {
+			tailer:  &Tailer{IncludeOperation: true},
+			in:      entry(operationRemove, nil),
+			wantMsg: `{"e":"r","d":{"_id":"someid"},"f":[],"op":"d"}`,
+		},
+		"Drop": {
+			tailer:  &Tailer{IncludeOperation: true},
+			in:      entry(operationDrop, bson.M{"ns": "foo.bar"}),
+			wantMsg: `{"e":"drop","d":{"ns":"foo.bar"}}`,
+		},
+		"Disabled": {
+			tailer:  &Tailer{},
+			in:      entry(operationInsert, bson.M{"a": 1}),
+			wantMsg: `{"e":"i","d":{"_id":"someid"},"f":["a"]}`,
+		},
+		"With timestamp and renamed key": {
+			tailer: &Tailer{
+				IncludeOperation: true,
+				IncludeTimestamp: true,
+				PayloadKeys:      map[string]string{"op": "operation"},
+			},
+			in:      entry(operationInsert, bson.M{"a": 1}),
+			wantMsg: `{"e":"i","d":{"_id":"someid"},"f":["a"],"operation":"i","ts":{"t":1234,"i":5}}`,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			pub, err := test.tailer.processOplogEntry(test.in)
+			require.NoError(t, err)
+			assert.Equal(t, test.wantMsg, string(pub.Msg))
+		})
+	}
+}
+
+func TestProcessOplogEntryMetricLabels(t *testing.T) {
+	entry := func(operation string, collection string) *oplogEntry {
+		return &oplogEntry{
+			DocID:      "someid",
+			Operation:  operation,
+			Namespace:  "foo." + collection,
+			Database:   "foo",
+			Collection: collection,
+			Data:       bson.M{"ns": "foo." + collection},
+			Timestamp:  primitive.Timestamp{T: 1234},
+		}
+	}
+
+	// Without collection labels, only the operation is set
+	pub, err := (&Tailer{}).processOplogEntry(entry(operationUpdate, "bar"))
+	require.NoError(t, err)
+	assert.Equal(t, "update", pub.Operation)
+	assert.Equal(t, "", pub.CollectionLabel)
+
+	// With them, collections past the limit share a label
+	tailer := &Tailer{CollectionLabels: NewCollectionLabels(1)}
+
+	pub, err = tailer.processOplogEntry(entry(operationInsert, "bar"))
+	require.NoError(t, err)
+	assert.Equal(t, "insert", pub.Operation)
+	assert.Equal(t, "bar", pub.CollectionLabel)
+
+	pub, err = tailer.processOplogEntry(entry(operationDrop, "baz"))
+	require.NoError(t, err)
+	assert.Equal(t, "drop", pub.Operation)
+	assert.Equal(t, otherCollectionsLabel, pub.CollectionLabel)
+}
+
+func TestFieldsOverlap(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"a", "a", true},
+		{"a.b", "a", true},
+		{"a", "a.b", true},
+		{"ab", "a", false},
+		{"a.b", "a.c", false},
+	}
+
+	for _, test := range tests {
+		if got := fieldsOverlap(test.a, test.b); got != test.want {
+			t.Errorf("fieldsOverlap(%s, %s) = %t; want %t", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+func TestProcessOplogEntryPayloadKeys(t *testing.T) {
+	update := &oplogEntry{
+		DocID:      "someid",
+		Timestamp:  primitive.Timestamp{T: 1234, I: 5},
+		Database:   "foo",
+		Collection: "bar",
+		Namespace:  "foo.bar",
+		Operation:  "u",
+		Data:       map[string]interface{}{"$set": map[string]interface{}{"a.b": 1}},
+	}
+	drop := &oplogEntry{
+		Timestamp:  primitive.Timestamp{T: 1234, I: 6},
+		Database:   "foo",
+		Collection: "bar",
+		Namespace:  "foo.bar",
+		Operation:  "drop",
+		Data:       map[string]interface{}{"ns": "foo.bar"},
+	}
+
+	tests := map[string]struct {
+		tailer     *Tailer
+		in         *oplogEntry
+		wantMsg    string
+		wantMsgHex string
+	}{
+		"Update, redis-oplog keys": {
+			tailer:  &Tailer{},
+			in:      update,
+			wantMsg: `{"e":"u","d":{"_id":"someid"},"f":["a.b"]}`,
+		},
+		"Update, redis-oplog keys with timestamp": {
+			tailer:  &Tailer{IncludeTimestamp: true},
+			in:      update,
+			wantMsg: `{"e":"u","d":{"_id":"someid"},"f":["a.b"],"ts":{"t":1234,"i":5}}`,
+		},
+		"Update, renamed keys": {
+			tailer: &Tailer{
+				IncludeTimestamp: true,
+				PayloadKeys:      map[string]string{"e": "event", "d": "doc", "f": "ef", "ts": "timestamp"},
+			},
+			in:      update,
+			wantMsg: `{"event":"u","doc":{"_id":"someid"},"ef":["a.b"],"timestamp":{"t":1234,"i":5}}`,
+		},
+		"Update, one renamed key": {
+			tailer:  &Tailer{PayloadKeys: map[string]string{"f": "fields"}},
+			in:      update,
+			wantMsg: `{"e":"u","d":{"_id":"someid"},"fields":["a.b"]}`,
+		},
+		"Update, renamed keys in msgpack": {
+			tailer: &Tailer{
+				PayloadSerializer: msgpackSerializer{},
+				PayloadKeys:       map[string]string{"f": "ef"},
+			},
+			in: update,
+			// {"d": {"_id": "someid"}, "e": "u", "ef": ["a.b"]}; msgpack
+			// maps have their keys sorted
+			wantMsgHex: "83a16481a35f6964a6736f6d656964a165a175a2656691a3612e62",
+		},
+		"Drop, renamed keys": {
+			tailer:  &Tailer{PayloadKeys: map[string]string{"e": "event", "d": "doc"}},
+			in:      drop,
+			wantMsg: `{"event":"drop","doc":{"ns":"foo.bar"}}`,
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			pub, err := test.tailer.processOplogEntry(test.in)
+			require.NoError(t, err)
+
+			if test.wantMsgHex != "" {
+				assert.Equal(t, test.wantMsgHex, hex.EncodeToString(pub.Msg))
+			} else {
+				assert.Equal(t, test.wantMsg, string(pub.Msg))
+			}
+		})
+	}
+}
+
+func TestProcessOplogEntryNamespaceEvent(t *testing.T) {
+	tests := map[string]struct {
+		in          *oplogEntry
+		wantChannel string
+		wantMsg     string
+	}{
+		"Rename": {
+			in: &oplogEntry{
+				Operation:  "rename",
+				Namespace:  "foo.Bar",
+				Database:   "foo",
+				Collection: "Bar",
+				Data:       map[string]interface{}{"from": "foo.Foo", "to": "foo.Bar"},
+			},
+			wantChannel: "foo.Bar",
+			wantMsg:     `{"e":"rename","d":{"from":"foo.Foo","to":"foo.Bar"}}`,
+		},
+		"Drop": {
+			in: &oplogEntry{
+				Operation:  "drop",
+				Namespace:  "foo.Bar",
+				Database:   "foo",
+				Collection: "Bar",
+				Data:       map[string]interface{}{"ns": "foo.Bar"},
+			},
+			wantChannel: "foo.Bar",
+			wantMsg:     `{"e":"drop","d":{"ns":"foo.Bar"}}`,
+		},
+		"Drop database": {
+			in: &oplogEntry{
+				Operation: "dropDatabase",
+				Namespace: "foo",
+				Database:  "foo",
+				Data:      map[string]interface{}{"db": "foo"},
+			},
+			wantChannel: "foo",
+			wantMsg:     `{"e":"dropDatabase","d":{"db":"foo"}}`,
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			test.in.Timestamp = primitive.Timestamp{T: 1234}
+			test.in.TxIdx = 1
+
+			pub, err := (&Tailer{}).processOplogEntry(test.in)
+			require.NoError(t, err)
+
+			assert.Equal(t, test.wantChannel, pub.CollectionChannel)
+			assert.Equal(t, "", pub.SpecificChannel)
+			assert.Equal(t, primitive.Timestamp{T: 1234}, pub.OplogTimestamp)
+			assert.Equal(t, uint(1), pub.TxIdx)
+			assert.JSONEq(t, test.wantMsg, string(pub.Msg))
+		})
+	}
+}
+
+func TestProcessOplogEntryChannelPrefixes(t *testing.T) {
+	namespaceMap, err := NewNamespaceMap([]string{"prod_*=*"})
+	require.NoError(t, err)
+
+	tailer := &Tailer{
+		NamespaceMap:    namespaceMap,
+		ChannelPrefixes: map[string]string{"app1": "app1:", "prod_app2": "app2:"},
+	}
+
+	tests := map[string]struct {
+		in                    *oplogEntry
+		wantCollectionChannel string
+		wantSpecificChannel   string
+	}{
+		"Prefixed database": {
+			in: &oplogEntry{
+				DocID:      "someid",
+				Operation:  "i",
+				Namespace:  "app1.users",
+				Database:   "app1",
+				Collection: "users",
+			},
+			wantCollectionChannel: "app1:app1.users",
+			wantSpecificChannel:   "app1:app1.users::someid",
+		},
+		"Prefix matches the database before the namespace map": {
+			in: &oplogEntry{
+				DocID:      "someid",
+				Operation:  "i",
+				Namespace:  "prod_app2.users",
+				Database:   "prod_app2",
+				Collection: "users",
+			},
+			wantCollectionChannel: "app2:app2.users",
+			wantSpecificChannel:   "app2:app2.users::someid",
+		},
+		"Database without a prefix": {
+			in: &oplogEntry{
+				DocID:      "someid",
+				Operation:  "i",
+				Namespace:  "other.users",
+				Database:   "other",
+				Collection: "users",
+			},
+			wantCollectionChannel: "other.users",
+			wantSpecificChannel:   "other.users::someid",
+		},
+		"Namespace event": {
+			in: &oplogEntry{
+				Operation:  "drop",
+				Namespace:  "app1.users",
+				Database:   "app1",
+				Collection: "users",
+				Data:       map[string]interface{}{"ns": "app1.users"},
+			},
+			wantCollectionChannel: "app1:app1.users",
+			wantSpecificChannel:   "",
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			pub, err := tailer.processOplogEntry(test.in)
+			require.NoError(t, err)
+
+			assert.Equal(t, test.wantCollectionChannel, pub.CollectionChannel)
+			assert.Equal(t, test.wantSpecificChannel, pub.SpecificChannel)
+		})
+	}
+}
+
+// Checks the redis-oplog envelope (the channels and message bytes) that
+// formatDocID, buildChannels, and buildPayload produce across operations and
+// _id types
+func TestBuildChannelsAndPayload(t *testing.T) {
+	objectID, err := primitive.ObjectIDFromHex("deadbeefdeadbeefdeadbeef")
+	require.NoError(t, err)
+
+	tests := map[string]struct {
+		docID     interface{}
+		operation string
+		data      map[string]interface{}
+
+		wantSpecificChannel string
+		wantPayload         string
+	}{
+		"Insert with a string _id": {
+			docID:               "someid",
+			operation:           "i",
+			data:                map[string]interface{}{"a": 1},
+			wantSpecificChannel: "foo.bar::someid",
+			wantPayload:         `{"e":"i","d":{"_id":"someid"},"f":["a"]}`,
+		},
+		"Modifier update with an ObjectID _id": {
+			docID:               objectID,
+			operation:           "u",
+			data:                map[string]interface{}{"$v": 1, "$set": map[string]interface{}{"a": 1}},
+			wantSpecificChannel: "foo.bar::deadbeefdeadbeefdeadbeef",
+			wantPayload:         `{"e":"u","d":{"_id":{"$type":"oid","$value":"deadbeefdeadbeefdeadbeef"}},"f":["a"]}`,
+		},
+		"Remove with an integer _id": {
+			docID:               int32(42),
+			operation:           "d",
+			wantSpecificChannel: "foo.bar::42",
+			wantPayload:         `{"e":"r","d":{"_id":42},"f":[]}`,
+		},
+		"Remove with a float _id": {
+			docID:               1.5,
+			operation:           "d",
+			wantSpecificChannel: "foo.bar::1.5",
+			wantPayload:         `{"e":"r","d":{"_id":1.5},"f":[]}`,
+		},
+		"Insert with a binary _id": {
+			docID:               primitive.Binary{Subtype: 4, Data: []byte{1, 2, 3}},
+			operation:           "i",
+			data:                map[string]interface{}{"a": 1},
+			wantSpecificChannel: `foo.bar::{"$binary":"AQID"}`,
+			wantPayload:         `{"e":"i","d":{"_id":{"$binary":"AQID"}},"f":["a"]}`,
+		},
+		"Remove with a document _id": {
+			docID:               map[string]interface{}{"b": "x", "a": 1},
+			operation:           "d",
+			wantSpecificChannel: `foo.bar::{"a":1,"b":"x"}`,
+			wantPayload:         `{"e":"r","d":{"_id":{"a":1,"b":"x"}},"f":[]}`,
+		},
+	}
+
+	tailer := &Tailer{}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			op := &oplogEntry{
+				DocID:      test.docID,
+				Operation:  test.operation,
+				Namespace:  "foo.bar",
+				Database:   "foo",
+				Collection: "bar",
+				Data:       test.data,
+			}
+
+			idForChannel, idForMessage, err := formatDocID(op.DocID)
+			require.NoError(t, err)
+
+			collectionChannel, specificChannel, err := tailer.buildChannels(op, op.Namespace, idForChannel)
+			require.NoError(t, err)
+			assert.Equal(t, "foo.bar", collectionChannel)
+			assert.Equal(t, test.wantSpecificChannel, specificChannel)
+
+			payload, err := tailer.buildPayload(op, idForMessage, op.ChangedFields())
+			require.NoError(t, err)
+			assert.Equal(t, test.wantPayload, string(payload))
+
+			// The output depends only on the entry
+			again, err := tailer.buildPayload(op, idForMessage, op.ChangedFields())
+			require.NoError(t, err)
+			assert.Equal(t, payload, again)
+		})
+	}
+}
+
+func TestFormatDocIDUnsupported(t *testing.T) {
+	_, _, err := formatDocID(make(chan int))
+	assert.True(t, errors.Is(err, ErrUnsupportedDocIDType))
+}
@@ -0,0 +1,76 @@
+package oplog
+
+import (
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Seeker makes the Tailer re-tail the oplog from a given timestamp, e.g. to
+// re-publish everything since a downstream bug. Each tailer (one per shard of
+// a sharded cluster) restarts its tail query from the timestamp once,
+// ignoring the last-processed timestamp stored in Redis, and then carries on
+// as usual.
+type Seeker struct {
+	lock sync.Mutex
+
+	// Incremented by each call to Seek, so tailers can tell whether they've
+	// seen the latest one
+	generation uint64
+	timestamp  primitive.Timestamp
+}
+
+// NewSeeker creates a Seeker
+func NewSeeker() *Seeker {
+	return &Seeker{}
+}
+
+// Seek makes the tailer re-tail the oplog from the entry with the given
+// timestamp (inclusive). A timestamp with an increment of 0 includes every
+// entry in that second.
+func (seeker *Seeker) Seek(ts primitive.Timestamp) {
+	seeker.lock.Lock()
+	defer seeker.lock.Unlock()
+
+	seeker.generation++
+	seeker.timestamp = ts
+}
+
+// Returns the timestamp of the latest seek, and its generation, if it's
+// newer than the given generation (the latest one a tailer has seen). It's
+// safe to call on a nil Seeker, which never has a seek pending.
+func (seeker *Seeker) pending(generation uint64) (primitive.Timestamp, uint64, bool) {
+	if seeker == nil {
+		return primitive.Timestamp{}, 0, false
+	}
+
+	seeker.lock.Lock()
+	defer seeker.lock.Unlock()
+
+	return seeker.timestamp, seeker.generation, seeker.generation > generation
+}
+
+// Returns whether there's a seek this tailer hasn't carried out yet
+func (tailer *Tailer) seekPending() bool {
+	_, _, ok := tailer.Seeker.pending(tailer.seekGeneration)
+	return ok
+}
+
+// If there's a seek this tailer hasn't carried out yet, marks it as done and
+// returns the position to start tailing from for it
+func (tailer *Tailer) takeSeek() (primitive.Timestamp, bool) {
+	ts, generation, ok := tailer.Seeker.pending(tailer.seekGeneration)
+	if !ok {
+		return primitive.Timestamp{}, false
+	}
+
+	tailer.seekGeneration = generation
+
+	// We tail the entries after the start position, so start just before
+	// the requested entry (entries' increments start at 1)
+	if ts.I > 0 {
+		ts.I--
+	}
+
+	return ts, true
+}
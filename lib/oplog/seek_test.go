@@ -0,0 +1,61 @@
+package oplog
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestSeek(t *testing.T) {
+	seeker := NewSeeker()
+	tailer := Tailer{Seeker: seeker}
+	shardTailer := Tailer{Seeker: seeker, shardName: "shard1"}
+
+	if tailer.seekPending() {
+		t.Fatal("Expected no seek to be pending before Seek")
+	}
+
+	seeker.Seek(primitive.Timestamp{T: 1500000000, I: 5})
+
+	for _, tl := range []*Tailer{&tailer, &shardTailer} {
+		if !tl.seekPending() {
+			t.Fatalf("Expected a seek to be pending for shard %q", tl.shardName)
+		}
+
+		start, ok := tl.takeSeek()
+		if !ok || start != (primitive.Timestamp{T: 1500000000, I: 4}) {
+			t.Errorf("takeSeek() = %v, %t; want the position just before the requested entry", start, ok)
+		}
+
+		if tl.seekPending() {
+			t.Errorf("Expected no seek to be pending for shard %q once taken", tl.shardName)
+		}
+	}
+
+	seeker.Seek(primitive.Timestamp{T: 1500000010})
+	start, ok := tailer.takeSeek()
+	if !ok || start != (primitive.Timestamp{T: 1500000010}) {
+		t.Errorf("takeSeek() = %v, %t; want the start of the second", start, ok)
+	}
+}
+
+func TestGetStartTimeSeek(t *testing.T) {
+	seeker := NewSeeker()
+	seeker.Seek(primitive.Timestamp{T: 1500000000, I: 1})
+	tailer := Tailer{Seeker: seeker}
+
+	// The seek takes precedence over Redis (which isn't even consulted) and
+	// the end of the oplog
+	start, source := tailer.getStartTime(func() (primitive.Timestamp, error) {
+		t.Error("Expected the end of the oplog not to be looked up")
+		return primitive.Timestamp{}, nil
+	})
+
+	if start != (primitive.Timestamp{T: 1500000000}) {
+		t.Errorf("getStartTime() = %v; want the seek position", start)
+	}
+
+	if source != startSourceSeek {
+		t.Errorf("getStartTime() source = %s; want %s", source, startSourceSeek)
+	}
+}
@@ -0,0 +1,212 @@
+package oplog
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/vlasky/oplogtoredis/lib/config"
+	"github.com/vlasky/oplogtoredis/lib/log"
+	"github.com/vlasky/oplogtoredis/lib/redispub"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// A shard of a sharded cluster, as stored in config.shards
+type shard struct {
+	Name string `bson:"_id"`
+	Host string `bson:"host"`
+}
+
+// Returns the shards of the cluster MongoClient is connected to, or nil if
+// it's not connected to a mongos (i.e. it's a replica set, and we can tail
+// its oplog directly).
+func (tailer *Tailer) discoverShards() ([]shard, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), config.MongoQueryTimeout())
+	defer cancel()
+
+	var isMaster struct {
+		Msg string `bson:"msg"`
+	}
+	err := tailer.MongoClient.Database("admin").RunCommand(ctx, bson.M{"isMaster": 1}).Decode(&isMaster)
+	if err != nil {
+		return nil, errors.Wrap(err, "running isMaster")
+	}
+
+	// mongos identifies itself with this message
+	if isMaster.Msg != "isdbgrid" {
+		return nil, nil
+	}
+
+	cursor, err := tailer.MongoClient.Database("config").Collection("shards").Find(ctx, bson.M{})
+	if err != nil {
+		return nil, errors.Wrap(err, "querying config.shards")
+	}
+
+	var shards []shard
+	err = cursor.All(ctx, &shards)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading config.shards")
+	}
+
+	if len(shards) == 0 {
+		return nil, errors.New("connected to mongos, but config.shards is empty")
+	}
+
+	return shards, nil
+}
+
+// Calls discoverShards until it succeeds. Returns false if we were stopped
+// before that happened.
+func (tailer *Tailer) discoverShardsWithRetries(stop <-chan bool) ([]shard, bool) {
+	retryBackoff := newBackoff(tailer.RetryInitialDelay, tailer.RetryMaxDelay)
+
+	for {
+		shards, err := tailer.discoverShards()
+		if err == nil {
+			return shards, true
+		}
+
+		delay := retryBackoff.next()
+		countMongoError(err)
+		log.Log.Errorw("Error discovering cluster topology. Waiting and then retrying.",
+			"error", err,
+			"delay", delay)
+
+		select {
+		case <-stop:
+			return nil, false
+		case <-time.After(delay):
+		}
+	}
+}
+
+// Tails each of the given shards in its own goroutine, all sending to out.
+// Returns once all of them have stopped.
+func (tailer *Tailer) tailShards(shards []shard, out chan *redispub.Publication, stop <-chan bool) {
+	waitGroup := sync.WaitGroup{}
+	var shardStops []chan bool
+
+	for _, s := range shards {
+		log.Log.Infow("Discovered shard", "shard", s.Name, "host", s.Host)
+
+		shardTailer := *tailer
+		shardTailer.shardName = s.Name
+
+		// Buffered, so that stopping doesn't block on a shard that has
+		// already finished (see Tailer.RunOnce)
+		shardStop := make(chan bool, 1)
+		shardStops = append(shardStops, shardStop)
+
+		waitGroup.Add(1)
+		go func(s shard) {
+			shardTailer.tailShard(s, out, shardStop)
+			waitGroup.Done()
+		}(s)
+	}
+
+	allDone := make(chan struct{})
+	go func() {
+		waitGroup.Wait()
+		close(allDone)
+	}()
+
+	select {
+	case <-stop:
+		for _, shardStop := range shardStops {
+			shardStop <- true
+		}
+		<-allDone
+	case <-allDone:
+		// Every shard has read up to where it was when we started
+	}
+}
+
+// Connects directly to the given shard's replica set and tails its oplog,
+// until stopped.
+func (tailer *Tailer) tailShard(s shard, out chan *redispub.Publication, stop <-chan bool) {
+	retryBackoff := newBackoff(tailer.RetryInitialDelay, tailer.RetryMaxDelay)
+
+	for {
+		client, err := connectToShard(s)
+		if err == nil {
+			tailer.oplogClient = client
+			break
+		}
+
+		delay := retryBackoff.next()
+		countMongoError(err)
+		log.Log.Errorw("Error connecting to shard. Waiting and then retrying.",
+			"error", err,
+			"shard", s.Name,
+			"delay", delay)
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(delay):
+		}
+	}
+
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), config.MongoConnectTimeout())
+		defer cancel()
+
+		err := tailer.oplogClient.Disconnect(ctx)
+		if err != nil {
+			log.Log.Errorw("Error closing shard client",
+				"error", err,
+				"shard", s.Name)
+		}
+	}()
+
+	tailer.checkOplogCollection(tailer.oplogClient)
+
+	windowDone := make(chan struct{})
+	defer close(windowDone)
+	go tailer.monitorOplogWindow(tailer.oplogClient, windowDone)
+
+	tailer.retryTailing(out, stop, tailer.tailOnce)
+}
+
+// Creates a client connected to the replica set of the given shard, using
+// the same credentials and other options (see MongoClientOptions) as the
+// mongos.
+func connectToShard(s shard) (*mongo.Client, error) {
+	replicaSet, hosts := parseShardHost(s.Host)
+
+	clientOptions, err := MongoClientOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	clientOptions.SetHosts(hosts)
+	if replicaSet != "" {
+		clientOptions.SetReplicaSet(replicaSet)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.MongoConnectTimeout())
+	defer cancel()
+
+	client, err := mongo.Connect(ctx, clientOptions)
+	if err != nil {
+		return nil, errors.Wrapf(err, "connecting to shard %s", s.Name)
+	}
+
+	return client, nil
+}
+
+// Parses the host field of a config.shards document, which looks like
+// `<replica-set>/<host1>,<host2>,...` (or just `<host>` for a shard that isn't
+// a replica set).
+func parseShardHost(host string) (string, []string) {
+	replicaSet := ""
+	if slash := strings.Index(host, "/"); slash >= 0 {
+		replicaSet = host[:slash]
+		host = host[slash+1:]
+	}
+
+	return replicaSet, strings.Split(host, ",")
+}
@@ -0,0 +1,40 @@
+package oplog
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseShardHost(t *testing.T) {
+	tests := map[string]struct {
+		in             string
+		wantReplicaSet string
+		wantHosts      []string
+	}{
+		"Replica set": {
+			in:             "shard01/mongo1:27018,mongo2:27018,mongo3:27018",
+			wantReplicaSet: "shard01",
+			wantHosts:      []string{"mongo1:27018", "mongo2:27018", "mongo3:27018"},
+		},
+		"Single member replica set": {
+			in:             "rs0/mongo1:27018",
+			wantReplicaSet: "rs0",
+			wantHosts:      []string{"mongo1:27018"},
+		},
+		"Standalone": {
+			in:             "mongo1:27018",
+			wantReplicaSet: "",
+			wantHosts:      []string{"mongo1:27018"},
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			replicaSet, hosts := parseShardHost(test.in)
+
+			assert.Equal(t, test.wantReplicaSet, replicaSet)
+			assert.Equal(t, test.wantHosts, hosts)
+		})
+	}
+}
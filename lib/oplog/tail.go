@@ -6,15 +6,21 @@ package oplog
 import (
 	"context"
 	"errors"
+	"math/rand"
+	"regexp"
 	"strings"
+	"sync"
+	"text/template"
 	"time"
 
 	"github.com/vlasky/oplogtoredis/lib/config"
 	"github.com/vlasky/oplogtoredis/lib/log"
 	"github.com/vlasky/oplogtoredis/lib/redispub"
+	"github.com/vlasky/oplogtoredis/lib/tracing"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
 
 	"github.com/go-redis/redis/v8"
 	"github.com/prometheus/client_golang/prometheus"
@@ -29,8 +35,209 @@ type Tailer struct {
 	RedisClient redis.UniversalClient
 	RedisPrefix string
 	MaxCatchUp  time.Duration
+
+	// MaxCatchUpOverrides overrides MaxCatchUp for individual databases
+	MaxCatchUpOverrides map[string]time.Duration
+
+	// Allowlist and Denylist are path.Match patterns for the namespaces
+	// (`<db-name>.<collection-name>`) that we publish. See config.Allowlist
+	// and config.Denylist.
+	Allowlist []string
+	Denylist  []string
+
+	// Databases, if non-empty, lists the only databases whose entries we
+	// publish. See config.Databases.
+	Databases []string
+
+	// OperationFilter maps namespace patterns to the operations (insert,
+	// update, remove, or command) to publish for them. See
+	// config.OperationFilter.
+	OperationFilter map[string][]string
+
+	// FieldFilter maps namespace patterns to the fields whose changes we
+	// publish updates for. See config.FieldFilter.
+	FieldFilter map[string][]string
+
+	// FullDocumentCollections lists the namespaces for which we look up and
+	// publish the full document on update. See config.FullDocumentCollections.
+	FullDocumentCollections []string
+
+	// NamespaceMap, if set, rewrites the namespaces of the entries we
+	// publish. See config.NamespaceMap.
+	NamespaceMap *NamespaceMap
+
+	// ChannelTemplate, if set, determines the names of the channels we
+	// publish to. Construct it with NewChannelTemplate. If nil, we use the
+	// redis-oplog channel names.
+	ChannelTemplate *template.Template
+
+	// Transformer, if set, can modify or drop each publication before it's
+	// sent. See PublicationTransformer.
+	Transformer PublicationTransformer
+
+	// ChannelPrefixes maps database names (before NamespaceMap) to prefixes
+	// for the channels we publish their changes to. See
+	// config.PrefixOverrides.
+	ChannelPrefixes map[string]string
+
+	// RetryInitialDelay and RetryMaxDelay bound the exponential backoff used
+	// when tailing fails. See config.RetryInitialDelay and
+	// config.RetryMaxDelay.
+	RetryInitialDelay time.Duration
+	RetryMaxDelay     time.Duration
+
+	// PositionLostWarnCount and PositionLostWarnWindow set when we warn that
+	// the oplog is rolling over past our position too often. See
+	// positionLossTracker.
+	PositionLostWarnCount  int
+	PositionLostWarnWindow time.Duration
+
+	// SourceMode is SourceModeOplog (the default) to tail the oplog, or
+	// SourceModeChangeStream to read from a change stream instead. See
+	// config.SourceMode.
+	SourceMode string
+
+	// ChangeStreamFullDocument is the fullDocument option for the change
+	// stream in SourceModeChangeStream. See config.ChangeStreamFullDocument.
+	ChangeStreamFullDocument options.FullDocument
+
+	// ProcessorConcurrency is the number of goroutines that unmarshal and
+	// process oplog entries. If it's greater than 1, entries are processed in
+	// parallel, but their publications are still sent in order. See
+	// config.ProcessorConcurrency.
+	ProcessorConcurrency int
+
+	// OplogDatabase and OplogCollection name the collection we tail. They
+	// default to "local" and "oplog.rs". See config.OplogDatabase and
+	// config.OplogCollection.
+	OplogDatabase   string
+	OplogCollection string
+
+	// OplogNamespaceFilter, if set, is matched against the namespaces of
+	// oplog entries by the oplog query itself, so Mongo only sends us the
+	// entries we're interested in. See oplogQueryFilter and
+	// config.OplogNsFilter.
+	OplogNamespaceFilter *regexp.Regexp
+
+	// PayloadSerializer builds the messages we publish. If it's nil, we use
+	// JSON (see NewPayloadSerializer).
+	PayloadSerializer PayloadSerializer
+
+	// MaxPayloadBytes, if positive, is the largest message we send with the
+	// full document. Larger messages are sent with only the document ID. See
+	// config.MaxPayloadBytes.
+	MaxPayloadBytes int
+
+	// PayloadKeys renames the top-level keys of the messages we publish
+	// ("e", "d", "f", "op", and "ts"). See config.PayloadKeys.
+	PayloadKeys map[string]string
+
+	// IncludeTimestamp adds the oplog timestamp of the entry to each message.
+	// See config.IncludeTimestamp.
+	IncludeTimestamp bool
+
+	// IncludeOperation adds the operation ("i", "u", or "d") of the entry to
+	// each message about a document. See config.IncludeOperation.
+	IncludeOperation bool
+
+	// IncludeSystemNamespaces publishes changes to system collections and
+	// to the config and admin databases, which are skipped by default. See
+	// isSystemNamespace and config.IncludeSystemNamespaces.
+	IncludeSystemNamespaces bool
+
+	// ReadPreference, if set, is the read preference used to query the
+	// oplog. Otherwise, we use the MongoClient's read preference.
+	ReadPreference *readpref.ReadPref
+
+	// Activity, if set, records when the tailer last made progress. See
+	// ActivityTracker.
+	Activity *ActivityTracker
+
+	// Backpressure is what we do when the output channel is full:
+	// BackpressureBlock (the default), BackpressureDropOldest, or
+	// BackpressureDrop. Dropped publications are recorded in DropBarrier,
+	// if it's set. See config.Backpressure.
+	Backpressure string
+	DropBarrier  *redispub.DropBarrier
+
+	// ResumeLogInterval is how often we log how far through the oplog we've
+	// read. Zero disables the log. See config.ResumeLogInterval.
+	ResumeLogInterval time.Duration
+
+	// TransactionAtomic marks the publications from each transaction (i.e.
+	// applyOps entry) so they're published in a single batch. See
+	// config.TransactionAtomic.
+	TransactionAtomic bool
+
+	// CollectionLabels, if set, adds a collection label to the oplog entry
+	// metrics. See config.MetricCollectionLabel.
+	CollectionLabels *CollectionLabels
+
+	// DeprecatedMetrics makes us update the deprecated oplog entry metrics
+	// as well as otr_oplog_entries_by_size. See RegisterDeprecatedMetrics.
+	DeprecatedMetrics bool
+
+	// Distribution, if set, keeps a rolling count of the oplog volume of
+	// each collection. See Distribution.
+	Distribution *Distribution
+
+	// Pauser, if set, can pause and resume the tailer. See Pauser.
+	Pauser *Pauser
+
+	// Seeker, if set, can make the tailer re-tail the oplog from an earlier
+	// timestamp. See Seeker. It isn't supported in SourceModeChangeStream.
+	Seeker *Seeker
+
+	// StartPosition is where we start tailing when we first start:
+	// StartPositionResume (the default), StartPositionEnd, or
+	// StartPositionBeginning. See config.StartPosition.
+	StartPosition string
+
+	// RunOnce makes Tail return once it has read up to the end of the oplog
+	// as it was when we started tailing, instead of tailing forever. It isn't
+	// supported in SourceModeChangeStream. See config.RunMode.
+	RunOnce bool
+
+	// StartupJitter, if positive, makes Tail wait a random duration of up to
+	// StartupJitter before it first queries Mongo. See config.StartupJitter.
+	StartupJitter time.Duration
+
+	// NowFunc, if set, is used instead of time.Now wherever the tailer reads
+	// the current time (e.g. to decide whether the last processed timestamp
+	// is within MaxCatchUp, and to measure the oplog lag), so tests can
+	// control it
+	NowFunc func() time.Time
+
+	// When tailing a sharded cluster, Tail runs a copy of the Tailer for each
+	// shard, with shardName set to the shard's name and oplogClient connected
+	// directly to the shard's replica set. MongoClient remains connected to
+	// the mongos, for queries that should see the whole cluster.
+	shardName   string
+	oplogClient *mongo.Client
+
+	// Set when we resume tailing; see startCatchUp
+	catchUp *catchUpLimit
+
+	// The generation of the last seek we carried out; see Seeker
+	seekGeneration uint64
+
+	// Set once we've started tailing, after which we always resume,
+	// regardless of StartPosition
+	started bool
+
+	// In RunOnce mode, the timestamp of the last oplog entry when we started
+	// tailing, and whether we've read up to it; see reachedStopPoint
+	stopAt   primitive.Timestamp
+	caughtUp bool
 }
 
+// Values for Tailer.StartPosition
+const (
+	StartPositionResume    = "resume"
+	StartPositionEnd       = "end"
+	StartPositionBeginning = "beginning"
+)
+
 // Raw oplog entry from Mongo
 type rawOplogEntry struct {
 	Timestamp    primitive.Timestamp `bson:"ts"`
@@ -40,6 +247,13 @@ type rawOplogEntry struct {
 	Namespace    string              `bson:"ns"`
 	Doc          bson.Raw            `bson:"o"`
 	Update       rawOplogEntryID     `bson:"o2"`
+	FromMigrate  bool                `bson:"fromMigrate"`
+
+	// Wall is the wall-clock time the entry was written, to the
+	// millisecond. Mongo 4.0+ records it; it's zero for older entries. The
+	// operations inside a transaction don't have their own, so
+	// parseTransactionOplogEntry gives them their transaction's.
+	Wall time.Time `bson:"wall"`
 }
 
 type rawOplogEntryID struct {
@@ -48,17 +262,37 @@ type rawOplogEntryID struct {
 
 const requeryDuration = time.Second
 
+// Where getStartTime found the timestamp to start tailing from, as reported in
+// otr_start_source
+const (
+	startSourceRedis     = "redis"
+	startSourceOplogEnd  = "oplog_end"
+	startSourceFallback  = "fallback"
+	startSourceBeginning = "beginning"
+	startSourceSeek      = "seek"
+)
+
+// RegisterDeprecatedMetrics registers the deprecated metrics
+// otr_oplog_entries_received and otr_oplog_entries_received_size with the
+// default Prometheus registry. Tailers only update them when
+// Tailer.DeprecatedMetrics is set. See config.DisableDeprecatedMetrics.
+func RegisterDeprecatedMetrics() {
+	prometheus.MustRegister(metricOplogEntriesReceived, metricOplogEntriesReceivedSize)
+}
+
 var (
-	// Deprecated: use metricOplogEntriesBySize instead
-	metricOplogEntriesReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+	// Deprecated: use metricOplogEntriesBySize instead. Only registered by
+	// RegisterDeprecatedMetrics.
+	metricOplogEntriesReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Namespace: "otr",
 		Subsystem: "oplog",
 		Name:      "entries_received",
 		Help:      "[Deprecated] Oplog entries received, partitioned by database and status",
 	}, []string{"database", "status"})
 
-	// Deprecated: use metricOplogEntriesBySize instead
-	metricOplogEntriesReceivedSize = promauto.NewCounterVec(prometheus.CounterOpts{
+	// Deprecated: use metricOplogEntriesBySize instead. Only registered by
+	// RegisterDeprecatedMetrics.
+	metricOplogEntriesReceivedSize = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Namespace: "otr",
 		Subsystem: "oplog",
 		Name:      "entries_received_size",
@@ -69,31 +303,214 @@ var (
 		Namespace: "otr",
 		Subsystem: "oplog",
 		Name:      "entries_by_size",
-		Help:      "Histogram of oplog entries received by size in bytes, partitioned by database and status.",
+		Help:      "Histogram of oplog entries received by size in bytes, partitioned by database, status (ignored, filtered, error, or processed), operation (insert, update, remove, command, or noop), and (if OTR_METRIC_COLLECTION_LABEL is set) collection.",
 		Buckets:   append([]float64{0}, prometheus.ExponentialBuckets(8, 2, 29)...),
-	}, []string{"database", "status"})
+	}, []string{"database", "status", "operation", "collection"})
+
+	metricOplogLag = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "otr",
+		Subsystem: "oplog",
+		Name:      "lag_seconds",
+		Help:      "Seconds between when the most recently received oplog entry was written to the oplog and when we received it, partitioned by database",
+	}, []string{"database"})
+
+	metricDecodeErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "otr",
+		Subsystem: "oplog",
+		Name:      "decode_errors_total",
+		Help:      "Oplog entries (or change events) that couldn't be decoded, and so were skipped",
+	})
+
+	metricNoopsReceived = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "otr",
+		Subsystem: "oplog",
+		Name:      "noops_received",
+		Help:      "Noop oplog entries received. Mongo writes these periodically, so they show that the oplog is being tailed even when nothing else is written.",
+	})
+
+	metricStartSource = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "otr",
+		Name:      "start_source",
+		Help:      "Times we chose where to start (or restart) tailing the oplog, partitioned by where the starting point came from: redis (the last processed timestamp), oplog_end, fallback (the current time, because we couldn't read the end of the oplog), beginning (OTR_START_POSITION=beginning), or seek (an admin seek). An unexpected oplog_end after a restart suggests the last processed timestamp was lost.",
+	}, []string{"source"})
+
+	metricMigrationEntries = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "otr",
+		Subsystem: "oplog",
+		Name:      "migration_entries_skipped",
+		Help:      "Oplog entries skipped because they were written by a chunk migration between shards (fromMigrate), and so don't represent changes to the data",
+	})
+
+	metricPrimaryChangeRequeries = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "otr",
+		Subsystem: "oplog",
+		Name:      "primary_change_requeries",
+		Help:      "Times the oplog tail query was re-issued because the replica set's primary changed (or the server we were reading from went away)",
+	})
+
+	// Not registered until we start tailing (see registerMaxSizeMetric), so
+	// that its interval can be configured first
+	metricMaxOplogEntrySize = newMaxOplogEntrySizeMetric(DefaultInterval)
+
+	registerMaxSizeMetric sync.Once
+)
+
+func newMaxOplogEntrySizeMetric(interval time.Duration) *IntervalMaxMetricVec {
+	period := interval.String()
+	if interval == time.Minute {
+		period = "minute"
+	}
 
-	metricMaxOplogEntryByMinute = NewIntervalMaxMetricVec(&IntervalMaxVecOpts{
+	return NewIntervalMaxMetricVec(&IntervalMaxVecOpts{
 		IntervalMaxOpts: IntervalMaxOpts{
 			Opts: prometheus.Opts{
 				Namespace: "otr",
 				Subsystem: "oplog",
 				Name:      "entries_max_size",
-				Help:      "Gauge recording maximum size recorded in the last minute, partitioned by database and status",
+				Help:      "Gauge recording maximum size recorded in the last " + period + ", partitioned by database and status",
 			},
 
-			ReportInterval: 1 * time.Minute,
+			ReportInterval: interval,
 		},
 	}, []string{"database", "status"})
-)
+}
 
-func init() {
-	prometheus.MustRegister(metricMaxOplogEntryByMinute)
+// SetMaxSizeReportInterval sets the interval over which the
+// otr_oplog_entries_max_size metric reports the largest oplog entry (see
+// config.MaxSizeReportInterval). It replaces the metric, so it must be called
+// before tailing starts.
+func SetMaxSizeReportInterval(interval time.Duration) {
+	metricMaxOplogEntrySize = newMaxOplogEntrySizeMetric(interval)
 }
 
 // Tail begins tailing the oplog. It doesn't return unless it receives a message
 // on the stop channel, in which case it wraps up its work and then returns.
-func (tailer *Tailer) Tail(out chan<- *redispub.Publication, stop <-chan bool) {
+//
+// If MongoClient is connected to a mongos, Tail discovers the shards of the
+// cluster and tails each shard's oplog in parallel, tracking the
+// last-processed timestamp of each separately. In SourceModeChangeStream,
+// Tail instead reads a single change stream for the whole cluster.
+func (tailer *Tailer) Tail(out chan *redispub.Publication, stop <-chan bool) {
+	registerMaxSizeMetric.Do(func() {
+		prometheus.MustRegister(metricMaxOplogEntrySize)
+	})
+	metricOutputChannelCapacity.Set(float64(cap(out)))
+
+	if !tailer.waitStartupJitter(stop) {
+		return
+	}
+
+	if tailer.SourceMode == SourceModeChangeStream {
+		tailer.retryTailing(out, stop, tailer.tailChangeStreamOnce)
+		return
+	}
+
+	shards, ok := tailer.discoverShardsWithRetries(stop)
+	if !ok {
+		return
+	}
+
+	if shards != nil {
+		tailer.tailShards(shards, out, stop)
+		return
+	}
+
+	tailer.checkOplogCollection(tailer.MongoClient)
+
+	windowDone := make(chan struct{})
+	defer close(windowDone)
+	go tailer.monitorOplogWindow(tailer.MongoClient, windowDone)
+
+	tailer.retryTailing(out, stop, tailer.tailOnce)
+}
+
+// Waits a random duration of up to StartupJitter, so that many instances
+// started at once don't all query Mongo at the same instant. Returns false if
+// it received a message on the stop channel while waiting.
+func (tailer *Tailer) waitStartupJitter(stop <-chan bool) bool {
+	if tailer.StartupJitter <= 0 {
+		return true
+	}
+
+	delay := time.Duration(rand.Int63n(int64(tailer.StartupJitter) + 1))
+	log.Log.Infow("Waiting before starting to tail", "delay", delay)
+
+	select {
+	case <-stop:
+		return false
+	case <-time.After(delay):
+		return true
+	}
+}
+
+// Returns the database and collection name of the oplog
+func (tailer *Tailer) oplogNamespace() (string, string) {
+	database := tailer.OplogDatabase
+	if database == "" {
+		database = "local"
+	}
+
+	collection := tailer.OplogCollection
+	if collection == "" {
+		collection = "oplog.rs"
+	}
+
+	return database, collection
+}
+
+// Logs an error if the oplog collection doesn't exist, since tailing it will
+// otherwise fail with a less helpful error. We keep trying regardless, in case
+// the collection is created later.
+func (tailer *Tailer) checkOplogCollection(client *mongo.Client) {
+	database, collection := tailer.oplogNamespace()
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.MongoQueryTimeout())
+	defer cancel()
+
+	names, err := client.Database(database).ListCollectionNames(ctx, bson.M{"name": collection})
+	if err != nil {
+		countMongoError(err)
+		log.Log.Errorw("Error checking that the oplog collection exists",
+			"error", err,
+			"shard", tailer.shardName,
+			"database", database,
+			"collection", collection)
+		return
+	}
+
+	if len(names) == 0 {
+		var isMaster struct {
+			SetName string `bson:"setName"`
+		}
+		err := client.Database("admin").RunCommand(ctx, bson.M{"isMaster": 1}).Decode(&isMaster)
+		standalone := err == nil && isMaster.SetName == ""
+
+		log.Log.Errorw(missingOplogMessage(standalone),
+			"shard", tailer.shardName,
+			"database", database,
+			"collection", collection)
+	}
+}
+
+// Returns the error we log when the oplog collection doesn't exist. Only
+// replica set members have an oplog, so if the server is standalone (which
+// is common in local development), we explain how to make it a single-node
+// replica set.
+func missingOplogMessage(standalone bool) string {
+	if standalone {
+		return "Oplog collection does not exist, because the Mongo server is standalone, and only replica set members have an oplog. " +
+			"To use oplogtoredis with it (e.g. for local development), make it a single-node replica set: " +
+			"restart mongod with --replSet rs0 (or replication.replSetName: rs0 in its config file), " +
+			"run rs.initiate() once in the mongo shell, " +
+			"and add replicaSet=rs0 to the options of OTR_MONGO_URL."
+	}
+
+	return "Oplog collection does not exist. Check OTR_OPLOG_DATABASE and OTR_OPLOG_COLLECTION, and that OTR_MONGO_URL points at a replica set."
+}
+
+// Calls tailOnce (which tails either the oplog of a single replica set or a
+// change stream) repeatedly, with backoff, until stopped
+func (tailer *Tailer) retryTailing(out chan *redispub.Publication, stop <-chan bool, tailOnce func(out chan *redispub.Publication, stop <-chan bool)) {
 	childStopC := make(chan bool)
 	wasStopped := false
 
@@ -103,37 +520,71 @@ func (tailer *Tailer) Tail(out chan<- *redispub.Publication, stop <-chan bool) {
 		childStopC <- true
 	}()
 
+	retryBackoff := newBackoff(tailer.RetryInitialDelay, tailer.RetryMaxDelay)
+
 	for {
-		log.Log.Info("Starting oplog tailing")
-		tailer.tailOnce(out, childStopC)
-		log.Log.Info("Oplog tailing ended")
+		log.Log.Infow("Starting oplog tailing", "shard", tailer.shardName)
+		startedAt := tailer.now()
+		tailOnce(out, childStopC)
+		log.Log.Infow("Oplog tailing ended", "shard", tailer.shardName)
 
 		if wasStopped {
 			return
 		}
 
-		log.Log.Errorw("Oplog tailing stopped prematurely. Waiting a second an then retrying.")
-		time.Sleep(requeryDuration)
+		if tailer.caughtUp {
+			log.Log.Infow("Read up to the end of the oplog as of when we started; stopping", "shard", tailer.shardName)
+			return
+		}
+
+		if tailer.seekPending() {
+			// We stopped to seek, so start again straight away
+			continue
+		}
+
+		// If we were tailing successfully for a while, this is a new problem
+		// rather than a continuation of a previous one, so start the backoff
+		// over
+		if tailer.now().Sub(startedAt) > retryBackoff.max {
+			retryBackoff.reset()
+		}
+
+		delay := retryBackoff.next()
+		log.Log.Errorw("Oplog tailing stopped prematurely. Waiting and then retrying.",
+			"shard", tailer.shardName,
+			"delay", delay)
+		time.Sleep(delay)
 	}
 }
 
-func (tailer *Tailer) tailOnce(out chan<- *redispub.Publication, stop <-chan bool) {
-	session, err := tailer.MongoClient.StartSession()
+func (tailer *Tailer) tailOnce(out chan *redispub.Publication, stop <-chan bool) {
+	oplogClient := tailer.MongoClient
+	if tailer.oplogClient != nil {
+		oplogClient = tailer.oplogClient
+	}
+
+	session, err := oplogClient.StartSession()
 	if err != nil {
+		countMongoError(err)
 		log.Log.Errorw("Failed to start Mongo session", "error", err)
 		return
 	}
 
-	oplogCollection := session.Client().Database("local").Collection("oplog.rs")
+	oplogDatabase, oplogCollectionName := tailer.oplogNamespace()
+	collectionOpts := options.Collection()
+	if tailer.ReadPreference != nil {
+		collectionOpts.SetReadPreference(tailer.ReadPreference)
+	}
+	oplogCollection := session.Client().Database(oplogDatabase).Collection(oplogCollectionName, collectionOpts)
 
-	startTime := tailer.getStartTime(func() (primitive.Timestamp, error) {
-		// Get the timestamp of the last entry in the oplog (as a position to
-		// start from if we don't have a last-written timestamp from Redis)
+	// Gets the timestamp of the last entry in the oplog
+	getTimestampOfLastOplogEntry := func() (primitive.Timestamp, error) {
 		var entry rawOplogEntry
 		findOneOpts := &options.FindOneOptions{}
 		findOneOpts.SetSort(bson.M{"$natural": -1})
+		findOneOpts.SetComment(oplogQueryComment())
 
-		queryContext, queryContextCancel := context.WithTimeout(context.Background(), config.MongoQueryTimeout())
+		queryContext, queryContextCancel := context.WithTimeout(context.Background(), config.MongoFindTimeout())
 		defer queryContextCancel()
 
 		result := oplogCollection.FindOne(queryContext, bson.M{}, findOneOpts)
@@ -152,16 +603,62 @@ func (tailer *Tailer) tailOnce(out chan<- *redispub.Publication, stop <-chan boo
 			"entry", entry)
 
 		return entry.Timestamp, nil
-	})
+	}
+
+	if tailer.RunOnce && tailer.stopAt.IsZero() {
+		stopAt, err := getTimestampOfLastOplogEntry()
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			log.Log.Infow("The oplog is empty, so there's nothing to read", "shard", tailer.shardName)
+			tailer.caughtUp = true
+			return
+		} else if err != nil {
+			countMongoError(err)
+			log.Log.Errorw("Error getting the end of the oplog to stop at", "error", err)
+			return
+		}
 
-	query, queryErr := issueOplogFindQuery(oplogCollection, startTime)
+		log.Log.Infow("Running once; will stop at the current end of the oplog",
+			"shard", tailer.shardName,
+			"timestamp", stopAt)
+		tailer.stopAt = stopAt
+	}
+
+	// The last entry in the oplog is where we start if we don't have a
+	// last-written timestamp from Redis
+	startTime, startSource := tailer.getStartTime(getTimestampOfLastOplogEntry)
+	metricStartSource.WithLabelValues(startSource).Inc()
+	log.Log.Infow("Starting to tail the oplog",
+		"shard", tailer.shardName,
+		"timestamp", startTime,
+		"source", startSource)
+
+	position := newOplogPosition(startTime)
+	reporter := tailer.newPositionReporter()
+	reporter.report(position, tailer.now())
+
+	if tailer.reachedStopPoint(position) {
+		tailer.caughtUp = true
+		return
+	}
+
+	query, queryErr := tailer.issueOplogFindQuery(oplogCollection, position)
 
 	if queryErr != nil {
+		countMongoError(queryErr)
 		log.Log.Errorw("Error issuing tail query", "error", queryErr)
 		return
 	}
 
-	lastTimestamp := startTime
+	transactions := newTransactionBuffer()
+	positionLosses := tailer.newPositionLossTracker()
+	primaryChanges := newBackoff(tailer.RetryInitialDelay, tailer.RetryMaxDelay)
+
+	var processor *orderedProcessor
+	if tailer.ProcessorConcurrency > 1 {
+		processor = tailer.newOrderedProcessor(tailer.ProcessorConcurrency, out)
+		defer processor.close()
+	}
+
 	for {
 		select {
 		case <-stop:
@@ -173,45 +670,139 @@ func (tailer *Tailer) tailOnce(out chan<- *redispub.Publication, stop <-chan boo
 		var rawData bson.Raw
 
 		for {
-			gotResult, didTimeout, didLosePosition, err := readNextFromCursor(query)
+			if tailer.seekPending() {
+				log.Log.Warnw("Restarting oplog tailing to seek", "shard", tailer.shardName)
+				closeCursor(query)
+				return
+			}
+
+			gotResult, didTimeout, didLosePosition, didChangePrimary, err := readNextFromCursor(query)
 
 			if gotResult {
+				tailer.Activity.record(tailer.shardName)
+				primaryChanges.reset()
+
 				decodeErr := query.Decode(&rawData)
 				if decodeErr != nil {
+					// rawData still holds the previous entry, so we mustn't
+					// go on to process it. We don't record the entry's
+					// position either; if we re-issue the query, we'll fail
+					// to decode it again rather than skipping it in its
+					// place.
+					metricDecodeErrors.Inc()
 					log.Log.Errorw("Error decoding oplog entry", "error", decodeErr)
+					continue
+				}
 
+				// Skip the entries we already read before re-issuing the
+				// query
+				entryIdx := uint(0)
+				if t, i, ok := rawData.Lookup("ts").TimestampOK(); ok {
+					if !position.observe(primitive.Timestamp{T: t, I: i}) {
+						continue
+					}
+					entryIdx = position.index()
+					reporter.report(position, tailer.now())
 				}
 
-				ts, pubs := tailer.unmarshalEntry(rawData)
+				// Hold back the entries of multi-entry transactions until
+				// they're committed
+				rawData = transactions.add(rawData)
+				if rawData == nil {
+					continue
+				}
 
-				if ts != nil {
-					lastTimestamp = *ts
+				if processor != nil {
+					// The cursor may reuse rawData's buffer, so the workers
+					// get their own copy
+					processor.submit(append(bson.Raw(nil), rawData...), entryIdx)
+				} else {
+					_, pubs := tailer.unmarshalEntry(rawData)
+					setEntryIdx(pubs, entryIdx)
+					tailer.sendPublications(out, pubs)
 				}
 
-				for _, pub := range pubs {
-					if pub != nil {
-						out <- pub
-					} else {
-						log.Log.Error("Nil Redis publication")
-					}
+				if tailer.reachedStopPoint(position) {
+					tailer.caughtUp = true
+					closeCursor(query)
+					return
 				}
 			} else if didTimeout {
+				if tailer.RunOnce {
+					// There are no more entries for now, so we've read all
+					// there were when we started (the entry we meant to
+					// stop at may have been left out by
+					// OplogNamespaceFilter)
+					tailer.caughtUp = true
+					closeCursor(query)
+					return
+				}
+
 				log.Log.Info("Oplog cursor timed out, will retry")
 
-				query, queryErr = issueOplogFindQuery(oplogCollection, lastTimestamp)
+				query, queryErr = tailer.issueOplogFindQuery(oplogCollection, position)
 
 				if queryErr != nil {
+					countMongoError(queryErr)
 					log.Log.Errorw("Error issuing tail query", "error", queryErr)
 					return
 				}
 
+				// There were no new entries, but Mongo is responding to
+				// our queries, so we're idle rather than stalled
+				tailer.Activity.record(tailer.shardName)
+				reporter.report(position, tailer.now())
+
 				break
 			} else if didLosePosition {
 				// Our cursor expired. Make a new cursor to pick up from where we
-				// left off.
-				query, queryErr = issueOplogFindQuery(oplogCollection, lastTimestamp)
+				// left off, backing off if this keeps happening.
+				delay := positionLosses.lost(tailer.now())
+				log.Log.Warnw("Lost our position in the oplog; re-issuing the tail query",
+					"shard", tailer.shardName,
+					"delay", delay)
+
+				select {
+				case <-stop:
+					log.Log.Infof("Received stop; aborting oplog tailing")
+					return
+				case <-time.After(delay):
+				}
+
+				query, queryErr = tailer.issueOplogFindQuery(oplogCollection, position)
 
 				if queryErr != nil {
+					countMongoError(queryErr)
+					log.Log.Errorw("Error issuing tail query", "error", queryErr)
+					return
+				}
+
+				break
+			} else if didChangePrimary {
+				// The primary stepped down, or the server we were reading
+				// from went away. Rather than starting tailing over, we
+				// re-issue the query from where we left off; server
+				// selection waits for the new primary.
+				closeCursor(query)
+
+				delay := primaryChanges.next()
+				log.Log.Warnw("Oplog cursor failed because the primary changed; re-issuing the tail query",
+					"shard", tailer.shardName,
+					"error", err,
+					"delay", delay)
+
+				select {
+				case <-stop:
+					log.Log.Infof("Received stop; aborting oplog tailing")
+					return
+				case <-time.After(delay):
+				}
+
+				metricPrimaryChangeRequeries.Inc()
+				query, queryErr = tailer.issueOplogFindQuery(oplogCollection, position)
+
+				if queryErr != nil {
+					countMongoError(queryErr)
 					log.Log.Errorw("Error issuing tail query", "error", queryErr)
 					return
 				}
@@ -235,8 +826,56 @@ func (tailer *Tailer) tailOnce(out chan<- *redispub.Publication, stop <-chan boo
 	}
 }
 
-func readNextFromCursor(cursor *mongo.Cursor) (gotResult bool, didTimeout bool, didLosePosition bool, err error) {
-	ctx, cancel := context.WithTimeout(context.Background(), config.MongoQueryTimeout())
+// Returns whether, in RunOnce mode, position has reached the end of the oplog
+// as it was when we started tailing
+func (tailer *Tailer) reachedStopPoint(position *oplogPosition) bool {
+	return tailer.RunOnce && primitive.CompareTimestamp(position.timestamp, tailer.stopAt) >= 0
+}
+
+// Sends the publications generated from a single oplog entry to out
+func (tailer *Tailer) sendPublications(out chan *redispub.Publication, pubs []*redispub.Publication) {
+	if tailer.TransactionAtomic {
+		markTransaction(pubs)
+	}
+
+	for _, pub := range pubs {
+		if pub != nil {
+			pub.ResumeKey = tailer.shardName
+			tailer.send(out, pub)
+		} else {
+			log.Log.Error("Nil Redis publication")
+		}
+	}
+}
+
+// Records the index of the oplog entry the publications came from among the
+// entries that share its timestamp (see oplogPosition.index)
+func setEntryIdx(pubs []*redispub.Publication, entryIdx uint) {
+	for _, pub := range pubs {
+		if pub != nil {
+			pub.EntryIdx = entryIdx
+		}
+	}
+}
+
+// Marks the publications from a single oplog entry so that they're
+// published together: every one but the last has TxContinues set.
+func markTransaction(pubs []*redispub.Publication) {
+	var last *redispub.Publication
+	for _, pub := range pubs {
+		if pub == nil {
+			continue
+		}
+
+		if last != nil {
+			last.TxContinues = true
+		}
+		last = pub
+	}
+}
+
+func readNextFromCursor(cursor *mongo.Cursor) (gotResult bool, didTimeout bool, didLosePosition bool, didChangePrimary bool, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), config.MongoNextTimeout())
 	defer cancel()
 
 	gotResult = cursor.Next(ctx)
@@ -250,42 +889,82 @@ func readNextFromCursor(cursor *mongo.Cursor) (gotResult bool, didTimeout bool,
 		time.Sleep(100 * time.Millisecond)
 		didTimeout = ctx.Err() != nil
 
-		// check if the error is a position-lost error. These errors are best handled
-		// by just re-issueing the query on the same connection; no need to surface
-		// a major error and re-connect to mongo
-		// From: https://github.com/rwynn/gtm/blob/e02a1f9c1b79eb5f14ed26c86a23b920589d84c9/gtm.go#L547
-		var serverErr mongo.ServerError
-		if errors.As(err, &serverErr) {
-			// 136  : cursor capped position lost
-			// 286  : change stream history lost
-			// 280  : change stream fatal error
-			for _, code := range []int{136, 286, 280} {
-				if serverErr.HasErrorCode(code) {
-					didLosePosition = true
-				}
-			}
+		kind := classifyMongoError(err)
+		if didTimeout {
+			// The driver may report our own deadline as some other error
+			kind = mongoErrorTimeout
 		}
+		metricMongoErrors.WithLabelValues(kind).Inc()
 
+		// Position-lost errors are best handled by just re-issuing the query
+		// on the same connection; no need to surface a major error and
+		// re-connect to mongo. The same goes for a change of primary: when we
+		// re-issue the query, the driver sends it to the new primary (or
+		// another server that matches our read preference).
+		// From: https://github.com/rwynn/gtm/blob/e02a1f9c1b79eb5f14ed26c86a23b920589d84c9/gtm.go#L547
+		didLosePosition = kind == mongoErrorPositionLost
+		didChangePrimary = kind == mongoErrorPrimaryChange || kind == mongoErrorNetwork
 	}
 
 	return
 }
 
-func issueOplogFindQuery(c *mongo.Collection, startTime primitive.Timestamp) (*mongo.Cursor, error) {
+func (tailer *Tailer) issueOplogFindQuery(c *mongo.Collection, position *oplogPosition) (*mongo.Cursor, error) {
 	queryOpts := &options.FindOptions{}
 	queryOpts.SetSort(bson.M{"$natural": 1})
 	queryOpts.SetCursorType(options.TailableAwait)
+	queryOpts.SetComment(oplogQueryComment())
+	if config.OplogBatchSize() > 0 {
+		queryOpts.SetBatchSize(config.OplogBatchSize())
+	}
+	if config.OplogMaxAwait() > 0 {
+		queryOpts.SetMaxAwaitTime(config.OplogMaxAwait())
+	}
 
-	queryContext, queryContextCancel := context.WithTimeout(context.Background(), config.MongoQueryTimeout())
+	queryContext, queryContextCancel := context.WithTimeout(context.Background(), config.MongoFindTimeout())
 	defer queryContextCancel()
 
-	return c.Find(queryContext, bson.M{
-		"ts": bson.M{"$gt": startTime},
-	}, queryOpts)
+	return c.Find(queryContext, oplogQueryFilter(position, tailer.OplogNamespaceFilter), queryOpts)
+}
+
+// Returns the filter for the oplog query that resumes from position. If
+// nsFilter is set, the query only returns entries whose namespaces match it,
+// along with every transaction and no-op:
+//
+//   - transactions are logged as commands in admin.$cmd whatever namespaces
+//     they change, so we filter their operations after we read them (see
+//     parseRawOplogEntry). The same goes for applyOps commands logged in
+//     other databases' command namespaces.
+//   - no-ops are written periodically even when nothing else is, so they
+//     keep our position (and the oplog lag we report) moving when none of
+//     the namespaces we're interested in change
+//
+// Whatever the filter, position counts the entries the query returns, so the
+// entries it skips when resuming are the same ones we read before.
+func oplogQueryFilter(position *oplogPosition, nsFilter *regexp.Regexp) bson.M {
+	filter := position.startQuery()
+	if nsFilter == nil {
+		return filter
+	}
+
+	filter["$or"] = bson.A{
+		bson.M{"ns": primitive.Regex{Pattern: nsFilter.String()}},
+		bson.M{"ns": "admin.$cmd"},
+		bson.M{"ns": primitive.Regex{Pattern: `\.\$cmd$`}, "o.applyOps": bson.M{"$exists": true}},
+		bson.M{"op": "n"},
+	}
+
+	return filter
+}
+
+// Returns the comment we attach to our oplog queries, so DBAs can identify
+// them in db.currentOp() and the profiler
+func oplogQueryComment() string {
+	return config.MongoAppName() + ": tailing the oplog"
 }
 
 func closeCursor(cursor *mongo.Cursor) {
-	queryContext, queryContextCancel := context.WithTimeout(context.Background(), config.MongoQueryTimeout())
+	queryContext, queryContextCancel := context.WithTimeout(context.Background(), config.MongoCloseTimeout())
 	defer queryContextCancel()
 
 	closeErr := cursor.Close(queryContext)
@@ -304,6 +983,7 @@ func (tailer *Tailer) unmarshalEntry(rawData bson.Raw) (timestamp *primitive.Tim
 
 	err := bson.Unmarshal(rawData, &result)
 	if err != nil {
+		metricDecodeErrors.Inc()
 		log.Log.Errorw("Error unmarshalling oplog entry", "error", err)
 		return
 	}
@@ -314,21 +994,78 @@ func (tailer *Tailer) unmarshalEntry(rawData bson.Raw) (timestamp *primitive.Tim
 	log.Log.Debugw("Received oplog entry",
 		"entry", result)
 
+	pubs = tailer.processEntries(entries, float64(len(rawData)), operationLabel(result.Operation))
+
+	if result.Operation == operationNoop {
+		// Mongo writes noops periodically even when nothing else is
+		// written, so they let us advance the last-processed timestamp on
+		// idle databases, and resume from closer to the end of the oplog
+		metricNoopsReceived.Inc()
+		pubs = append(pubs, &redispub.Publication{
+			OplogTimestamp: result.Timestamp,
+			TimestampOnly:  true,
+		})
+	}
+
+	return
+}
+
+// processEntries filters the entries parsed from a single oplog entry (or
+// change event) of the given size and operation (see operationLabel), and
+// converts them to publications. It records metrics for the entry as a whole.
+func (tailer *Tailer) processEntries(entries []oplogEntry, messageLen float64, operation string) (pubs []*redispub.Publication) {
+	receivedAt := tailer.now()
 	status := "ignored"
 	database := "(no database)"
-	messageLen := float64(len(rawData))
+	collection := ""
+
+	if len(entries) > 0 {
+		metricOplogLag.WithLabelValues(entries[0].Database).Set(entryLag(&entries[0], tailer.now()))
+	}
 
 	defer func() {
 		// TODO: remove these in a future version
-		metricOplogEntriesReceived.WithLabelValues(database, status).Inc()
-		metricOplogEntriesReceivedSize.WithLabelValues(database).Add(messageLen)
+		if tailer.DeprecatedMetrics {
+			metricOplogEntriesReceived.WithLabelValues(database, status).Inc()
+			metricOplogEntriesReceivedSize.WithLabelValues(database).Add(messageLen)
+		}
 
-		metricOplogEntriesBySize.WithLabelValues(database, status).Observe(messageLen)
-		metricMaxOplogEntryByMinute.Report(messageLen, database, status)
+		metricOplogEntriesBySize.WithLabelValues(database, status, operation, collection).Observe(messageLen)
+		metricMaxOplogEntrySize.Report(messageLen, database, status)
 	}()
 
 	if len(entries) > 0 {
 		database = entries[0].Database
+		collection = tailer.CollectionLabels.label(entries[0].Database, entries[0].Collection)
+		tailer.Distribution.record(entries[0].Database, entries[0].Collection, messageLen)
+	}
+
+	// Filter before processing, so we don't spend any time building
+	// publications we're just going to throw away
+	if len(entries) > 0 {
+		// If we filter out everything, there's nothing to publish, but the
+		// last-processed timestamp should still advance past the entry, so
+		// we don't read it again after restarting
+		timestampOnly := []*redispub.Publication{{
+			OplogTimestamp: entries[0].Timestamp,
+			TimestampOnly:  true,
+		}}
+
+		entries = tailer.dropBacklog(tailer.filterEntries(entries))
+
+		if len(entries) == 0 {
+			status = "filtered"
+			pubs = timestampOnly
+			return
+		}
+
+		entries = tailer.filterOperations(entries)
+
+		if len(entries) == 0 {
+			status = "filtered"
+			pubs = timestampOnly
+			return
+		}
 	}
 
 	type errEntry struct {
@@ -339,7 +1076,12 @@ func (tailer *Tailer) unmarshalEntry(rawData bson.Raw) (timestamp *primitive.Tim
 	var errs []errEntry
 	for i := range entries {
 		entry := &entries[i]
-		pub, err := processOplogEntry(entry)
+		tailer.lookupFullDocument(entry)
+
+		pub, err := tailer.processOplogEntry(entry)
+		if err == nil && pub != nil {
+			pub = tailer.transform(entry, pub)
+		}
 
 		if err != nil {
 			errs = append(errs, errEntry{
@@ -347,6 +1089,11 @@ func (tailer *Tailer) unmarshalEntry(rawData bson.Raw) (timestamp *primitive.Tim
 				op:  entry,
 			})
 		} else if pub != nil {
+			pub.Span = tracing.Start("oplogtoredis.publish", receivedAt)
+			pub.Span.SetAttribute("db.name", entry.Database)
+			pub.Span.SetAttribute("db.mongodb.collection", entry.Collection)
+			pub.Span.SetAttribute("db.operation", entry.Operation)
+			pub.Span.SetAttribute("messaging.message.payload_size_bytes", len(pub.Msg))
 			pubs = append(pubs, pub)
 		}
 	}
@@ -369,20 +1116,106 @@ func (tailer *Tailer) unmarshalEntry(rawData bson.Raw) (timestamp *primitive.Tim
 	return
 }
 
-// Gets the primitive.Timestamp from which we should start tailing
+// Returns the operation label for the metrics of an oplog entry with the
+// given op. Transactions (applyOps) are commands. Namespace events (which
+// we publish for some commands) are labeled with their own operation.
+func operationLabel(op string) string {
+	switch op {
+	case operationInsert:
+		return "insert"
+	case operationUpdate:
+		return "update"
+	case operationRemove:
+		return "remove"
+	case operationCommand:
+		return "command"
+	case operationNoop:
+		return "noop"
+	case operationRename, operationDrop, operationDropDatabase:
+		return op
+	default:
+		return "unknown"
+	}
+}
+
+// Returns the number of seconds between when the oplog entry with the given
+// timestamp was written, and now. Oplog timestamps only have second
+// resolution, and the clocks of the Mongo server and this machine may differ
+// slightly, so we never return a negative lag.
+func oplogLag(ts primitive.Timestamp, now time.Time) float64 {
+	lag := now.Sub(time.Unix(int64(ts.T), 0)).Seconds()
+	if lag < 0 {
+		return 0
+	}
+
+	return lag
+}
+
+// Returns the number of seconds between when the given entry was written, and
+// now. We use the entry's wall-clock time if the oplog recorded it, since it
+// has millisecond resolution, and its timestamp otherwise. Like oplogLag, we
+// never return a negative lag.
+func entryLag(op *oplogEntry, now time.Time) float64 {
+	if op.Wall.IsZero() {
+		return oplogLag(op.Timestamp, now)
+	}
+
+	lag := now.Sub(op.Wall).Seconds()
+	if lag < 0 {
+		return 0
+	}
+
+	return lag
+}
+
+// Gets the primitive.Timestamp from which we should start tailing, and where
+// we got it from (one of the startSource constants)
 //
 // We take the function to get the timestamp of the last oplog entry (as a
 // fallback if we don't have a latest timestamp from Redis) as an arg instead
 // of using tailer.mongoClient directly so we can unit test this function
-func (tailer *Tailer) getStartTime(getTimestampOfLastOplogEntry func() (primitive.Timestamp, error)) primitive.Timestamp {
-	ts, tsTime, redisErr := redispub.LastProcessedTimestamp(tailer.RedisClient, tailer.RedisPrefix)
+func (tailer *Tailer) getStartTime(getTimestampOfLastOplogEntry func() (primitive.Timestamp, error)) (primitive.Timestamp, string) {
+	tailer.catchUp = nil
+
+	if seekTo, ok := tailer.takeSeek(); ok {
+		log.Log.Warnw("Seeking: re-tailing the oplog from the requested timestamp, ignoring the last processed timestamp",
+			"shard", tailer.shardName,
+			"timestamp", seekTo)
+		return seekTo, startSourceSeek
+	}
+
+	startPosition := tailer.StartPosition
+	if tailer.started {
+		startPosition = StartPositionResume
+	}
+	tailer.started = true
+
+	switch startPosition {
+	case StartPositionBeginning:
+		log.Log.Warnw("Tailing the oplog from the beginning (OTR_START_POSITION=beginning). Everything it retains will be published, which may flood Redis and its subscribers.",
+			"shard", tailer.shardName)
+		return primitive.Timestamp{}, startSourceBeginning
+	case StartPositionEnd:
+		log.Log.Warnw("Ignoring the last processed timestamp (OTR_START_POSITION=end)",
+			"shard", tailer.shardName)
+		return tailer.startFromEndOfOplog(getTimestampOfLastOplogEntry)
+	}
+
+	ts, tsTime, redisErr := redispub.LastProcessedTimestamp(tailer.RedisClient, tailer.RedisPrefix, tailer.shardName)
 
 	if redisErr == nil {
 		// we have a last write time, check that it's not too far in the
 		// past
-		if tsTime.After(time.Now().Add(-1 * tailer.MaxCatchUp)) {
-			log.Log.Infof("Found last processed timestamp, resuming oplog tailing from %d", tsTime.Unix())
-			return ts
+		if tailer.startCatchUp(tsTime, tailer.now()) {
+			databaseTimestamps, dbErr := redispub.LastProcessedDatabaseTimestamps(tailer.RedisClient, tailer.RedisPrefix, tailer.shardName)
+			if dbErr != nil {
+				log.Log.Errorw("Error querying Redis for per-database last processed timestamps. Will resume every database from the global timestamp.",
+					"error", dbErr)
+			}
+
+			start := tailer.resumeFromDatabases(ts, databaseTimestamps)
+			log.Log.Infof("Found last processed timestamp, resuming oplog tailing from %d", start.T)
+			return start, startSourceRedis
 		}
 
 		log.Log.Warnf("Found last processed timestamp, but it was too far in the past (%d). Will start from end of oplog", tsTime.Unix())
@@ -393,15 +1226,31 @@ func (tailer *Tailer) getStartTime(getTimestampOfLastOplogEntry func() (primitiv
 			"error", redisErr)
 	}
 
+	return tailer.startFromEndOfOplog(getTimestampOfLastOplogEntry)
+}
+
+// Returns the timestamp of the last oplog entry, to start tailing from, or
+// the current time if we can't get it, along with which of the two it was
+func (tailer *Tailer) startFromEndOfOplog(getTimestampOfLastOplogEntry func() (primitive.Timestamp, error)) (primitive.Timestamp, string) {
 	mongoOplogEndTimestamp, mongoErr := getTimestampOfLastOplogEntry()
 	if mongoErr == nil {
 		log.Log.Infof("Starting tailing from end of oplog (timestamp %d)", mongoOplogEndTimestamp.T)
-		return mongoOplogEndTimestamp
+		return mongoOplogEndTimestamp, startSourceOplogEnd
 	}
 
+	countMongoError(mongoErr)
 	log.Log.Errorw("Got error when asking for last operation timestamp in the oplog. Returning current time.",
 		"error", mongoErr)
-	return primitive.Timestamp{T: uint32(time.Now().Unix() << 32)}
+	return primitive.Timestamp{T: uint32(tailer.now().Unix())}, startSourceFallback
+}
+
+// Returns the current time, from NowFunc if it's set
+func (tailer *Tailer) now() time.Time {
+	if tailer.NowFunc == nil {
+		return time.Now()
+	}
+
+	return tailer.NowFunc()
 }
 
 // converts a rawOplogEntry to an oplogEntry
@@ -411,61 +1260,113 @@ func (tailer *Tailer) parseRawOplogEntry(entry rawOplogEntry, txIdx *uint) []opl
 		txIdx = &idx
 	}
 
+	// Chunk migrations between shards show up as inserts and removes in the
+	// shards' oplogs, but don't represent changes to the data
+	if entry.FromMigrate {
+		metricMigrationEntries.Inc()
+		return nil
+	}
+
 	switch entry.Operation {
 	case operationInsert, operationUpdate, operationRemove:
-		var data map[string]interface{}
-		if err := bson.Unmarshal(entry.Doc, &data); err != nil {
-			log.Log.Errorf("unmarshalling oplog entry data: %v", err)
+		if (!tailer.IncludeSystemNamespaces && isSystemNamespace(entry.Namespace)) ||
+			(tailer.OplogNamespaceFilter != nil && !tailer.OplogNamespaceFilter.MatchString(entry.Namespace)) {
+			// Skip these before doing any work to decode them. The index
+			// still advances, so the indexes of the rest of a transaction
+			// don't depend on the config. (The oplog query already skips
+			// entries outside OplogNamespaceFilter, except for the
+			// operations in a transaction.)
+			*txIdx++
 			return nil
 		}
 
 		out := oplogEntry{
 			Operation: entry.Operation,
 			Timestamp: entry.Timestamp,
+			Wall:      entry.Wall,
 			Namespace: entry.Namespace,
-			Data:      data,
 
 			TxIdx: *txIdx,
 		}
 
-		*txIdx++
-
-		out.Database, out.Collection = parseNamespace(out.Namespace)
+		if out.Operation == operationUpdate && isModifierUpdate(entry.Doc) {
+			// We need the contents of a modifier update to work out which
+			// fields it changed
+			if err := bson.Unmarshal(entry.Doc, &out.Data); err != nil {
+				log.Log.Errorf("unmarshalling oplog entry data: %v", err)
+				return nil
+			}
+		} else {
+			// For inserts, removes, and replacements, we only need the
+			// document's _id and top-level field names, so we avoid
+			// decoding the (potentially large) document
+			out.RawData = entry.Doc
+		}
 
+		// An entry without an _id leaves DocID nil; processOplogEntry
+		// skips it
 		if out.Operation == operationUpdate {
 			out.DocID = entry.Update.ID
-		} else {
-			out.DocID = data["_id"]
+		} else if id, err := entry.Doc.LookupErr("_id"); err == nil {
+			if err := id.Unmarshal(&out.DocID); err != nil {
+				log.Log.Errorf("unmarshalling oplog entry _id: %v", err)
+				return nil
+			}
 		}
 
+		*txIdx++
+
+		out.Database, out.Collection = parseNamespace(out.Namespace)
+
 		return []oplogEntry{out}
 
 	case operationCommand:
-		if entry.Namespace != "admin.$cmd" {
-			return nil
-		}
-
-		var txData struct {
-			ApplyOps []rawOplogEntry `bson:"applyOps"`
-		}
+		return tailer.parseCommandOplogEntry(entry, txIdx)
 
-		if err := bson.Unmarshal(entry.Doc, &txData); err != nil {
-			log.Log.Errorf("unmarshaling transaction data: %v", err)
-			return nil
-		}
+	case operationNoop:
+		// Noops don't change any data; unmarshalEntry uses their timestamps
+		return nil
 
-		var ret []oplogEntry
+	default:
+		return nil
+	}
+}
 
-		for _, v := range txData.ApplyOps {
-			v.Timestamp = entry.Timestamp
-			ret = append(ret, tailer.parseRawOplogEntry(v, txIdx)...)
-		}
+// Returns whether the o field of an update oplog entry describes a
+// modification (with $set/$unset, or a v2 diff) rather than a replacement
+// document. This mirrors oplogEntry.UpdateIsReplace, without decoding the
+// document.
+func isModifierUpdate(doc bson.Raw) bool {
+	if _, err := doc.LookupErr("$set"); err == nil {
+		return true
+	}
 
-		return ret
+	if _, err := doc.LookupErr("$unset"); err == nil {
+		return true
+	}
 
-	default:
-		return nil
+	if version, ok := doc.Lookup("$v").AsInt64OK(); !ok || version != 2 {
+		return false
 	}
+
+	_, err := doc.LookupErr("diff")
+	return err == nil
+}
+
+// Returns whether the namespace is internal to Mongo, so that changes to
+// documents in it never need publishing: system collections (such as
+// mydb.system.views or mydb.system.indexes), and the config and admin
+// databases
+func isSystemNamespace(namespace string) bool {
+	database, collection := parseNamespace(namespace)
+	return database == "config" || database == "admin" || strings.HasPrefix(collection, "system.")
+}
+
+// Returns whether the namespace is a database's command namespace (such as
+// admin.$cmd), which is where commands are logged
+func isCommandNamespace(namespace string) bool {
+	_, collection := parseNamespace(namespace)
+	return collection == "$cmd"
 }
 
 // Parses op.Namespace into (database, collection)
@@ -0,0 +1,73 @@
+package oplog
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/vlasky/oplogtoredis/lib/config"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Builds a raw oplog entry for an insert of a document with the given number
+// of fields, each holding a small nested document
+func benchmarkInsertEntry(fieldCount int) bson.Raw {
+	doc := bson.D{{Key: "_id", Value: primitive.NewObjectID()}}
+	for i := 0; i < fieldCount; i++ {
+		doc = append(doc, bson.E{Key: fmt.Sprintf("field%d", i), Value: bson.M{
+			"name":  "some value",
+			"count": i,
+			"tags":  bson.A{"a", "b", "c"},
+		}})
+	}
+
+	raw, err := bson.Marshal(bson.M{
+		"ts": primitive.Timestamp{T: 1234, I: 1},
+		"op": "i",
+		"ns": "foo.bar",
+		"o":  doc,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	return raw
+}
+
+func BenchmarkUnmarshalEntry(b *testing.B) {
+	os.Setenv("OTR_REDIS_URL", "redis://yyy")
+	os.Setenv("OTR_MONGO_URL", "mongodb://xxx")
+	if err := config.ParseEnv(); err != nil {
+		panic(err)
+	}
+
+	update, err := bson.Marshal(bson.M{
+		"ts": primitive.Timestamp{T: 1234, I: 1},
+		"op": "u",
+		"ns": "foo.bar",
+		"o":  bson.M{"$v": 2, "diff": bson.M{"u": bson.M{"a": 1, "b": "two"}}},
+		"o2": bson.M{"_id": "someid"},
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	benchmarks := map[string]bson.Raw{
+		"Small insert": benchmarkInsertEntry(5),
+		"Large insert": benchmarkInsertEntry(500),
+		"Update":       update,
+	}
+
+	tailer := &Tailer{}
+
+	for name, rawData := range benchmarks {
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+
+			for i := 0; i < b.N; i++ {
+				tailer.unmarshalEntry(rawData)
+			}
+		})
+	}
+}
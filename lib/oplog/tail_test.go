@@ -2,6 +2,8 @@ package oplog
 
 import (
 	"errors"
+	"math"
+	"regexp"
 	"strconv"
 	"testing"
 	"time"
@@ -9,49 +11,56 @@ import (
 	"github.com/alicebob/miniredis"
 	"github.com/go-redis/redis/v8"
 	"github.com/kylelemons/godebug/pretty"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/require"
+	"github.com/vlasky/oplogtoredis/lib/redispub"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 // Converts a time to a mongo timestamp
 func mongoTS(d time.Time) primitive.Timestamp {
-	return primitive.Timestamp{T: uint32(d.Unix() << 32)}
-}
-
-// Determines if two dates are within a delta
-func timestampsWithinDelta(d1, d2 primitive.Timestamp, delta time.Duration) bool {
-	d1Seconds := int64(d1.T) >> 32
-	d2Seconds := int64(d2.T) >> 32
-
-	diff := d1Seconds - d2Seconds
-	if diff < 0 {
-		diff = -diff
-	}
-
-	return float64(diff) <= delta.Seconds()
+	return primitive.Timestamp{T: uint32(d.Unix())}
 }
 
 func TestGetStartTime(t *testing.T) {
-	now := time.Now()
+	now := time.Unix(1600000000, 0)
 	maxCatchUp := time.Minute
 	notTooOld := now.Add(-30 * time.Second)
 	tooOld := now.Add(-120 * time.Second)
+	justInside := now.Add(-maxCatchUp + time.Second)
+	atLimit := now.Add(-maxCatchUp)
 
 	tests := map[string]struct {
+		startPosition      string
 		redisTimestamp     primitive.Timestamp
 		mongoEndOfOplog    primitive.Timestamp
 		mongoEndOfOplogErr error
 		expectedResult     primitive.Timestamp
+		expectedSource     string
 	}{
 		"Start time is in Redis": {
 			redisTimestamp: mongoTS(notTooOld),
 			expectedResult: mongoTS(notTooOld),
+			expectedSource: startSourceRedis,
 		},
 		"Start time is in redis, but too old": {
 			redisTimestamp:  mongoTS(tooOld),
 			mongoEndOfOplog: mongoTS(notTooOld),
 			expectedResult:  mongoTS(notTooOld),
+			expectedSource:  startSourceOplogEnd,
+		},
+		"Start time is in Redis, just inside max catch-up": {
+			redisTimestamp:  mongoTS(justInside),
+			mongoEndOfOplog: mongoTS(notTooOld),
+			expectedResult:  mongoTS(justInside),
+			expectedSource:  startSourceRedis,
+		},
+		"Start time is in Redis, exactly max catch-up old": {
+			redisTimestamp:  mongoTS(atLimit),
+			mongoEndOfOplog: mongoTS(notTooOld),
+			expectedResult:  mongoTS(notTooOld),
+			expectedSource:  startSourceOplogEnd,
 		},
 		"Start time not in Redis": {
 			// We use tooOld here to make sure we're not applying any kind
@@ -59,10 +68,26 @@ func TestGetStartTime(t *testing.T) {
 			// that regardless of how old it is
 			mongoEndOfOplog: mongoTS(tooOld),
 			expectedResult:  mongoTS(tooOld),
+			expectedSource:  startSourceOplogEnd,
 		},
 		"Start time not in Redis, Mongo errors": {
 			mongoEndOfOplogErr: errors.New("Some mongo error"),
 			expectedResult:     mongoTS(now),
+			expectedSource:     startSourceFallback,
+		},
+		"Start from the end": {
+			startPosition:   StartPositionEnd,
+			redisTimestamp:  mongoTS(notTooOld),
+			mongoEndOfOplog: mongoTS(tooOld),
+			expectedResult:  mongoTS(tooOld),
+			expectedSource:  startSourceOplogEnd,
+		},
+		"Start from the beginning": {
+			startPosition:   StartPositionBeginning,
+			redisTimestamp:  mongoTS(notTooOld),
+			mongoEndOfOplog: mongoTS(notTooOld),
+			expectedResult:  primitive.Timestamp{},
+			expectedSource:  startSourceBeginning,
 		},
 	}
 
@@ -73,19 +98,21 @@ func TestGetStartTime(t *testing.T) {
 				panic(err)
 			}
 			defer redisServer.Close()
-			require.NoError(t, redisServer.Set("someprefix.lastProcessedEntry", strconv.FormatInt(int64(test.redisTimestamp.T), 10)))
+			require.NoError(t, redisServer.Set("someprefix.lastProcessedEntry", strconv.FormatUint(uint64(test.redisTimestamp.T)<<32, 10)))
 
 			redisClient := redis.NewUniversalClient(&redis.UniversalOptions{
 				Addrs: []string{redisServer.Addr()},
 			})
 
 			tailer := Tailer{
-				RedisClient: redisClient,
-				RedisPrefix: "someprefix.",
-				MaxCatchUp:  maxCatchUp,
+				RedisClient:   redisClient,
+				RedisPrefix:   "someprefix.",
+				MaxCatchUp:    maxCatchUp,
+				StartPosition: test.startPosition,
+				NowFunc:       func() time.Time { return now },
 			}
 
-			actualResult := tailer.getStartTime(func() (primitive.Timestamp, error) {
+			actualResult, actualSource := tailer.getStartTime(func() (primitive.Timestamp, error) {
 				if test.mongoEndOfOplogErr != nil {
 					return primitive.Timestamp{}, test.mongoEndOfOplogErr
 				}
@@ -93,15 +120,47 @@ func TestGetStartTime(t *testing.T) {
 				return test.mongoEndOfOplog, nil
 			})
 
-			// We need to do an approximate comparison; the function sometimes
-			// return time.Now
-			if !timestampsWithinDelta(actualResult, test.expectedResult, time.Second) {
+			if actualResult != test.expectedResult {
 				t.Errorf("Result was incorrect. Got %d, expected %d", actualResult, test.expectedResult)
 			}
+
+			if actualSource != test.expectedSource {
+				t.Errorf("Source was incorrect. Got %s, expected %s", actualSource, test.expectedSource)
+			}
 		})
 	}
 }
 
+func TestGetStartTimeOnlyAppliesStartPositionOnce(t *testing.T) {
+	redisServer, err := miniredis.Run()
+	require.NoError(t, err)
+	defer redisServer.Close()
+
+	resumeFrom := primitive.Timestamp{T: uint32(time.Now().Add(-30 * time.Second).Unix()), I: 1}
+	require.NoError(t, redisServer.Set("someprefix.lastProcessedEntry", strconv.FormatUint(uint64(resumeFrom.T)<<32|uint64(resumeFrom.I), 10)))
+
+	tailer := Tailer{
+		RedisClient: redis.NewUniversalClient(&redis.UniversalOptions{
+			Addrs: []string{redisServer.Addr()},
+		}),
+		RedisPrefix:   "someprefix.",
+		MaxCatchUp:    time.Minute,
+		StartPosition: StartPositionBeginning,
+	}
+	endOfOplog := func() (primitive.Timestamp, error) {
+		return primitive.Timestamp{}, errors.New("Unexpected query for the end of the oplog")
+	}
+
+	start, source := tailer.getStartTime(endOfOplog)
+	require.Equal(t, primitive.Timestamp{}, start)
+	require.Equal(t, startSourceBeginning, source)
+
+	// If tailing restarts, we resume from where we left off
+	start, source = tailer.getStartTime(endOfOplog)
+	require.Equal(t, resumeFrom, start)
+	require.Equal(t, startSourceRedis, source)
+}
+
 func mustRaw(t *testing.T, data interface{}) bson.Raw {
 	b, err := bson.Marshal(data)
 	require.NoError(t, err)
@@ -122,18 +181,63 @@ func TestParseRawOplogEntry(t *testing.T) {
 				Timestamp: primitive.Timestamp{T: 1234},
 				Operation: "i",
 				Namespace: "foo.Bar",
-				Doc:       mustRaw(t, map[string]interface{}{"_id": "someid", "foo": "bar"}),
+				Doc:       mustRaw(t, bson.D{{Key: "_id", Value: "someid"}, {Key: "foo", Value: "bar"}}),
 			},
 			want: []oplogEntry{{
 				Timestamp:  primitive.Timestamp{T: 1234},
 				Operation:  "i",
 				Namespace:  "foo.Bar",
-				Data:       map[string]interface{}{"_id": "someid", "foo": "bar"},
+				RawData:    mustRaw(t, bson.D{{Key: "_id", Value: "someid"}, {Key: "foo", Value: "bar"}}),
 				DocID:      interface{}("someid"),
 				Database:   "foo",
 				Collection: "Bar",
 			}},
 		},
+		"Insert without id": {
+			in: rawOplogEntry{
+				Timestamp: primitive.Timestamp{T: 1234},
+				Operation: "i",
+				Namespace: "foo.Bar",
+				Doc:       mustRaw(t, bson.D{{Key: "foo", Value: "bar"}}),
+			},
+			want: []oplogEntry{{
+				Timestamp:  primitive.Timestamp{T: 1234},
+				Operation:  "i",
+				Namespace:  "foo.Bar",
+				RawData:    mustRaw(t, bson.D{{Key: "foo", Value: "bar"}}),
+				Database:   "foo",
+				Collection: "Bar",
+			}},
+		},
+		"System collection": {
+			in: rawOplogEntry{
+				Timestamp: primitive.Timestamp{T: 1234},
+				Operation: "i",
+				Namespace: "mydb.system.views",
+				Doc:       mustRaw(t, bson.D{{Key: "_id", Value: "mydb.someview"}, {Key: "viewOn", Value: "foo"}}),
+			},
+			want: nil,
+		},
+		"Config database": {
+			in: rawOplogEntry{
+				Timestamp: primitive.Timestamp{T: 1234},
+				Operation: "u",
+				Namespace: "config.transactions",
+				Doc:       mustRaw(t, map[string]interface{}{"txnNum": 1}),
+				Update:    rawOplogEntryID{ID: "someid"},
+			},
+			want: nil,
+		},
+		"Chunk migration": {
+			in: rawOplogEntry{
+				Timestamp:   primitive.Timestamp{T: 1234},
+				Operation:   "i",
+				Namespace:   "foo.Bar",
+				Doc:         mustRaw(t, bson.D{{Key: "_id", Value: "someid"}, {Key: "foo", Value: "bar"}}),
+				FromMigrate: true,
+			},
+			want: nil,
+		},
 		"Update": {
 			in: rawOplogEntry{
 				Timestamp: primitive.Timestamp{T: 1234},
@@ -146,7 +250,25 @@ func TestParseRawOplogEntry(t *testing.T) {
 				Timestamp:  primitive.Timestamp{T: 1234},
 				Operation:  "u",
 				Namespace:  "foo.Bar",
-				Data:       map[string]interface{}{"new": "data"},
+				RawData:    mustRaw(t, map[string]interface{}{"new": "data"}),
+				DocID:      interface{}("updateid"),
+				Database:   "foo",
+				Collection: "Bar",
+			}},
+		},
+		"Modifier update": {
+			in: rawOplogEntry{
+				Timestamp: primitive.Timestamp{T: 1234},
+				Operation: "u",
+				Namespace: "foo.Bar",
+				Doc:       mustRaw(t, map[string]interface{}{"$set": map[string]interface{}{"new": "data"}}),
+				Update:    rawOplogEntryID{ID: "updateid"},
+			},
+			want: []oplogEntry{{
+				Timestamp:  primitive.Timestamp{T: 1234},
+				Operation:  "u",
+				Namespace:  "foo.Bar",
+				Data:       map[string]interface{}{"$set": map[string]interface{}{"new": "data"}},
 				DocID:      interface{}("updateid"),
 				Database:   "foo",
 				Collection: "Bar",
@@ -163,7 +285,7 @@ func TestParseRawOplogEntry(t *testing.T) {
 				Timestamp:  primitive.Timestamp{T: 1234},
 				Operation:  "d",
 				Namespace:  "foo.Bar",
-				Data:       map[string]interface{}{"_id": "someid"},
+				RawData:    mustRaw(t, map[string]interface{}{"_id": "someid"}),
 				DocID:      interface{}("someid"),
 				Database:   "foo",
 				Collection: "Bar",
@@ -174,10 +296,75 @@ func TestParseRawOplogEntry(t *testing.T) {
 				Timestamp: primitive.Timestamp{T: 1234},
 				Operation: "c",
 				Namespace: "foo.$cmd",
-				Doc:       mustRaw(t, map[string]interface{}{"drop": "Foo"}),
+				Doc:       mustRaw(t, map[string]interface{}{"create": "Foo"}),
 			},
 			want: nil,
 		},
+		"Drop collection": {
+			in: rawOplogEntry{
+				Timestamp: primitive.Timestamp{T: 1234},
+				Operation: "c",
+				Namespace: "foo.$cmd",
+				Doc:       mustRaw(t, map[string]interface{}{"drop": "Foo"}),
+			},
+			want: []oplogEntry{{
+				Timestamp:  primitive.Timestamp{T: 1234},
+				Operation:  "drop",
+				Namespace:  "foo.Foo",
+				Database:   "foo",
+				Collection: "Foo",
+				Data:       map[string]interface{}{"ns": "foo.Foo"},
+			}},
+		},
+		"Drop database": {
+			in: rawOplogEntry{
+				Timestamp: primitive.Timestamp{T: 1234},
+				Operation: "c",
+				Namespace: "foo.$cmd",
+				Doc:       mustRaw(t, map[string]interface{}{"dropDatabase": 1}),
+			},
+			want: []oplogEntry{{
+				Timestamp:  primitive.Timestamp{T: 1234},
+				Operation:  "dropDatabase",
+				Namespace:  "foo",
+				Database:   "foo",
+				Collection: "",
+				Data:       map[string]interface{}{"db": "foo"},
+			}},
+		},
+		"Rename collection": {
+			// Captured from MongoDB 4.4 after db.Foo.renameCollection("Bar")
+			in: rawOplogEntry{
+				Timestamp: primitive.Timestamp{T: 1234},
+				Operation: "c",
+				Namespace: "foo.$cmd",
+				Doc: mustRaw(t, bson.D{
+					{Key: "renameCollection", Value: "foo.Foo"},
+					{Key: "to", Value: "foo.Bar"},
+					{Key: "stayTemp", Value: false},
+				}),
+			},
+			want: []oplogEntry{
+				{
+					Timestamp:  primitive.Timestamp{T: 1234},
+					Operation:  "rename",
+					Namespace:  "foo.Foo",
+					Database:   "foo",
+					Collection: "Foo",
+					Data:       map[string]interface{}{"from": "foo.Foo", "to": "foo.Bar"},
+					TxIdx:      0,
+				},
+				{
+					Timestamp:  primitive.Timestamp{T: 1234},
+					Operation:  "rename",
+					Namespace:  "foo.Bar",
+					Database:   "foo",
+					Collection: "Bar",
+					Data:       map[string]interface{}{"from": "foo.Foo", "to": "foo.Bar"},
+					TxIdx:      1,
+				},
+			},
+		},
 		"Transaction": {
 			in: rawOplogEntry{
 				Timestamp: primitive.Timestamp{T: 1234},
@@ -194,9 +381,9 @@ func TestParseRawOplogEntry(t *testing.T) {
 									{
 										Operation: "i",
 										Namespace: "foo.Bar",
-										Doc: mustRaw(t, map[string]interface{}{
-											"_id": "id1",
-											"foo": "baz",
+										Doc: mustRaw(t, bson.D{
+											{Key: "_id", Value: "id1"},
+											{Key: "foo", Value: "baz"},
 										}),
 									},
 								},
@@ -205,9 +392,9 @@ func TestParseRawOplogEntry(t *testing.T) {
 						{
 							Operation: "i",
 							Namespace: "foo.Bar",
-							Doc: mustRaw(t, map[string]interface{}{
-								"_id": "id1",
-								"foo": "bar",
+							Doc: mustRaw(t, bson.D{
+								{Key: "_id", Value: "id1"},
+								{Key: "foo", Value: "bar"},
 							}),
 						},
 						{
@@ -236,10 +423,10 @@ func TestParseRawOplogEntry(t *testing.T) {
 					Namespace:  "foo.Bar",
 					Database:   "foo",
 					Collection: "Bar",
-					Data: map[string]interface{}{
-						"_id": "id1",
-						"foo": "baz",
-					},
+					RawData: mustRaw(t, bson.D{
+						{Key: "_id", Value: "id1"},
+						{Key: "foo", Value: "baz"},
+					}),
 					TxIdx: 0,
 				},
 				{
@@ -249,10 +436,10 @@ func TestParseRawOplogEntry(t *testing.T) {
 					Namespace:  "foo.Bar",
 					Database:   "foo",
 					Collection: "Bar",
-					Data: map[string]interface{}{
-						"_id": "id1",
-						"foo": "bar",
-					},
+					RawData: mustRaw(t, bson.D{
+						{Key: "_id", Value: "id1"},
+						{Key: "foo", Value: "bar"},
+					}),
 					TxIdx: 1,
 				},
 				{
@@ -262,9 +449,9 @@ func TestParseRawOplogEntry(t *testing.T) {
 					Namespace:  "foo.Bar",
 					Database:   "foo",
 					Collection: "Bar",
-					Data: map[string]interface{}{
+					RawData: mustRaw(t, map[string]interface{}{
 						"foo": "quux",
-					},
+					}),
 					TxIdx: 2,
 				},
 				{
@@ -274,9 +461,9 @@ func TestParseRawOplogEntry(t *testing.T) {
 					Namespace:  "foo.Bar",
 					Database:   "foo",
 					Collection: "Bar",
-					Data: map[string]interface{}{
+					RawData: mustRaw(t, map[string]interface{}{
 						"_id": "id3",
-					},
+					}),
 					TxIdx: 3,
 				},
 			},
@@ -294,6 +481,327 @@ func TestParseRawOplogEntry(t *testing.T) {
 	}
 }
 
+func TestParseRawOplogEntryChunkMigration(t *testing.T) {
+	tailer := Tailer{}
+	before := testutil.ToFloat64(metricMigrationEntries)
+
+	got := tailer.parseRawOplogEntry(rawOplogEntry{
+		Timestamp:   primitive.Timestamp{T: 1234},
+		Operation:   "i",
+		Namespace:   "foo.Bar",
+		Doc:         mustRaw(t, bson.D{{Key: "_id", Value: "someid"}, {Key: "foo", Value: "bar"}}),
+		FromMigrate: true,
+	}, nil)
+
+	require.Empty(t, got)
+	require.Equal(t, 1.0, testutil.ToFloat64(metricMigrationEntries)-before)
+}
+
+func TestProcessEntriesDeprecatedMetrics(t *testing.T) {
+	entries := []oplogEntry{{
+		DocID:      "id1",
+		Operation:  "i",
+		Namespace:  "deprecateddb.users",
+		Database:   "deprecateddb",
+		Collection: "users",
+	}}
+
+	received := metricOplogEntriesReceived.WithLabelValues("deprecateddb", "processed")
+	receivedSize := metricOplogEntriesReceivedSize.WithLabelValues("deprecateddb")
+
+	// They're only updated when enabled
+	(&Tailer{}).processEntries(entries, 100, "insert")
+	require.Equal(t, 0.0, testutil.ToFloat64(received))
+	require.Equal(t, 0.0, testutil.ToFloat64(receivedSize))
+
+	(&Tailer{DeprecatedMetrics: true}).processEntries(entries, 100, "insert")
+	require.Equal(t, 1.0, testutil.ToFloat64(received))
+	require.Equal(t, 100.0, testutil.ToFloat64(receivedSize))
+}
+
+func TestParseRawOplogEntryIncludeSystemNamespaces(t *testing.T) {
+	in := rawOplogEntry{
+		Timestamp: primitive.Timestamp{T: 1234},
+		Operation: "i",
+		Namespace: "mydb.system.views",
+		Doc:       mustRaw(t, bson.D{{Key: "_id", Value: "mydb.someview"}, {Key: "viewOn", Value: "foo"}}),
+	}
+
+	got := (&Tailer{IncludeSystemNamespaces: true}).parseRawOplogEntry(in, nil)
+	want := []oplogEntry{{
+		Timestamp:  primitive.Timestamp{T: 1234},
+		Operation:  "i",
+		Namespace:  "mydb.system.views",
+		RawData:    in.Doc,
+		DocID:      interface{}("mydb.someview"),
+		Database:   "mydb",
+		Collection: "system.views",
+	}}
+
+	if diff := pretty.Compare(got, want); diff != "" {
+		t.Errorf("Got incorrect result (-got +want)\n%s", diff)
+	}
+}
+
+func TestParseRawOplogEntrySystemNamespaceInTransaction(t *testing.T) {
+	// Skipping an operation on a system namespace doesn't change the
+	// indexes of the rest of the transaction
+	in := rawOplogEntry{
+		Timestamp: primitive.Timestamp{T: 1234},
+		Operation: "c",
+		Namespace: "admin.$cmd",
+		Doc: mustRaw(t, map[string]interface{}{
+			"applyOps": []rawOplogEntry{
+				{
+					Operation: "i",
+					Namespace: "config.transactions",
+					Doc:       mustRaw(t, map[string]interface{}{"_id": "txn"}),
+				},
+				{
+					Operation: "i",
+					Namespace: "foo.Bar",
+					Doc:       mustRaw(t, map[string]interface{}{"_id": "id1"}),
+				},
+			},
+		}),
+	}
+
+	got := (&Tailer{}).parseRawOplogEntry(in, nil)
+	if len(got) != 1 {
+		t.Fatalf("Expected 1 entry, got %d", len(got))
+	}
+	if got[0].Namespace != "foo.Bar" || got[0].TxIdx != 1 {
+		t.Errorf("Expected the foo.Bar insert with index 1, got %s with index %d", got[0].Namespace, got[0].TxIdx)
+	}
+}
+
+func TestParseRawOplogEntryNamespaceFilterInTransaction(t *testing.T) {
+	// The oplog query returns every transaction, so its operations outside
+	// OplogNamespaceFilter are skipped when we parse it, without changing
+	// the indexes of the rest
+	in := rawOplogEntry{
+		Timestamp: primitive.Timestamp{T: 1234},
+		Operation: "c",
+		Namespace: "admin.$cmd",
+		Doc: mustRaw(t, map[string]interface{}{
+			"applyOps": []rawOplogEntry{
+				{
+					Operation: "i",
+					Namespace: "other.Bar",
+					Doc:       mustRaw(t, map[string]interface{}{"_id": "id1"}),
+				},
+				{
+					Operation: "i",
+					Namespace: "foo.Bar",
+					Doc:       mustRaw(t, map[string]interface{}{"_id": "id2"}),
+				},
+			},
+		}),
+	}
+
+	tailer := &Tailer{OplogNamespaceFilter: regexp.MustCompile(`^foo\.`)}
+	got := tailer.parseRawOplogEntry(in, nil)
+	if len(got) != 1 {
+		t.Fatalf("Expected 1 entry, got %d", len(got))
+	}
+	if got[0].Namespace != "foo.Bar" || got[0].TxIdx != 1 {
+		t.Errorf("Expected the foo.Bar insert with index 1, got %s with index %d", got[0].Namespace, got[0].TxIdx)
+	}
+}
+
+func TestParseRawOplogEntryApplyOpsInOtherCommandNamespace(t *testing.T) {
+	// applyOps commands logged in a command namespace other than admin.$cmd
+	// are expanded like transactions; ones in other namespaces are ignored
+	applyOps := mustRaw(t, map[string]interface{}{
+		"applyOps": []rawOplogEntry{
+			{
+				Operation: "i",
+				Namespace: "foo.Bar",
+				Doc:       mustRaw(t, map[string]interface{}{"_id": "id1"}),
+			},
+		},
+	})
+
+	tests := map[string]struct {
+		namespace     string
+		expectedCount int
+	}{
+		"admin.$cmd":              {namespace: "admin.$cmd", expectedCount: 1},
+		"foo.$cmd":                {namespace: "foo.$cmd", expectedCount: 1},
+		"Not a command namespace": {namespace: "foo.cmd", expectedCount: 0},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			in := rawOplogEntry{
+				Timestamp: primitive.Timestamp{T: 1234},
+				Operation: "c",
+				Namespace: test.namespace,
+				Doc:       applyOps,
+			}
+
+			got := (&Tailer{}).parseRawOplogEntry(in, nil)
+			if len(got) != test.expectedCount {
+				t.Fatalf("Expected %d entries, got %d", test.expectedCount, len(got))
+			}
+			if len(got) > 0 && (got[0].Namespace != "foo.Bar" || got[0].Timestamp.T != 1234) {
+				t.Errorf("Expected the foo.Bar insert at T=1234, got %s at %v", got[0].Namespace, got[0].Timestamp)
+			}
+		})
+	}
+}
+
+func TestOplogQueryFilter(t *testing.T) {
+	ts := primitive.Timestamp{T: 1000, I: 1}
+
+	tests := map[string]struct {
+		nsFilter       *regexp.Regexp
+		expectedFilter bson.M
+	}{
+		"No namespace filter": {
+			expectedFilter: bson.M{"ts": bson.M{"$gt": ts}},
+		},
+		"Namespace filter": {
+			nsFilter: regexp.MustCompile(`^foo\.`),
+			expectedFilter: bson.M{
+				"ts": bson.M{"$gt": ts},
+				"$or": bson.A{
+					bson.M{"ns": primitive.Regex{Pattern: `^foo\.`}},
+					// Transactions and no-ops are always returned
+					bson.M{"ns": "admin.$cmd"},
+					bson.M{"ns": primitive.Regex{Pattern: `\.\$cmd$`}, "o.applyOps": bson.M{"$exists": true}},
+					bson.M{"op": "n"},
+				},
+			},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			filter := oplogQueryFilter(newOplogPosition(ts), test.nsFilter)
+
+			if diff := pretty.Compare(filter, test.expectedFilter); diff != "" {
+				t.Errorf("Got incorrect filter (-got +want)\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestMissingOplogMessage(t *testing.T) {
+	standalone := missingOplogMessage(true)
+	require.Contains(t, standalone, "--replSet rs0")
+	require.Contains(t, standalone, "rs.initiate()")
+	require.Contains(t, standalone, "replicaSet=rs0")
+
+	require.Contains(t, missingOplogMessage(false), "OTR_OPLOG_DATABASE and OTR_OPLOG_COLLECTION")
+}
+
+func TestIsSystemNamespace(t *testing.T) {
+	tests := map[string]bool{
+		"mydb.system.views":   true,
+		"mydb.system.indexes": true,
+		"config.transactions": true,
+		"admin.system.users":  true,
+		"admin.foo":           true,
+		"mydb.users":          false,
+		"mydb.systemic":       false,
+		"configuration.foo":   false,
+	}
+
+	for namespace, want := range tests {
+		if got := isSystemNamespace(namespace); got != want {
+			t.Errorf("isSystemNamespace(%q) = %t, expected %t", namespace, got, want)
+		}
+	}
+}
+
+func TestUnmarshalEntryNoop(t *testing.T) {
+	ts := primitive.Timestamp{T: 1234, I: 5}
+	rawData, err := bson.Marshal(bson.M{
+		"ts": ts,
+		"op": "n",
+		"ns": "",
+		"o":  bson.M{"msg": "periodic noop"},
+	})
+	require.NoError(t, err)
+
+	tailer := Tailer{}
+	timestamp, pubs := tailer.unmarshalEntry(rawData)
+
+	require.NotNil(t, timestamp)
+	require.Equal(t, ts, *timestamp)
+	require.Len(t, pubs, 1)
+	require.True(t, pubs[0].TimestampOnly)
+	require.Equal(t, ts, pubs[0].OplogTimestamp)
+	require.Empty(t, pubs[0].Msg)
+}
+
+func TestUnmarshalEntryDecodeError(t *testing.T) {
+	before := testutil.ToFloat64(metricDecodeErrors)
+
+	tailer := Tailer{}
+	timestamp, pubs := tailer.unmarshalEntry(bson.Raw{0x05, 0x00, 0x00})
+
+	require.Nil(t, timestamp)
+	require.Empty(t, pubs)
+	require.Equal(t, before+1, testutil.ToFloat64(metricDecodeErrors))
+}
+
+func TestSendPublicationsTransactionAtomic(t *testing.T) {
+	newPubs := func() []*redispub.Publication {
+		return []*redispub.Publication{{TxIdx: 0}, {TxIdx: 1}, nil, {TxIdx: 2}}
+	}
+
+	t.Run("Enabled", func(t *testing.T) {
+		out := make(chan *redispub.Publication, 10)
+		tailer := Tailer{TransactionAtomic: true}
+		tailer.sendPublications(out, newPubs())
+
+		require.Len(t, out, 3)
+		require.True(t, (<-out).TxContinues)
+		require.True(t, (<-out).TxContinues)
+		require.False(t, (<-out).TxContinues)
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		out := make(chan *redispub.Publication, 10)
+		tailer := Tailer{}
+		tailer.sendPublications(out, newPubs())
+
+		require.Len(t, out, 3)
+		for i := 0; i < 3; i++ {
+			require.False(t, (<-out).TxContinues)
+		}
+	})
+}
+
+func TestOperationLabel(t *testing.T) {
+	tests := map[string]string{
+		"i":     "insert",
+		"u":     "update",
+		"d":     "remove",
+		"c":     "command",
+		"n":     "noop",
+		"other": "unknown",
+	}
+
+	for op, want := range tests {
+		if got := operationLabel(op); got != want {
+			t.Errorf("operationLabel(%s) = %s; want %s", op, got, want)
+		}
+	}
+}
+
+func TestSetMaxSizeReportInterval(t *testing.T) {
+	defer SetMaxSizeReportInterval(DefaultInterval)
+
+	require.Contains(t, metricMaxOplogEntrySize.desc.String(), "in the last minute")
+
+	SetMaxSizeReportInterval(10 * time.Second)
+	require.Equal(t, 10*time.Second, metricMaxOplogEntrySize.opts.ReportInterval)
+	require.Contains(t, metricMaxOplogEntrySize.desc.String(), "in the last 10s")
+}
+
 func TestParseNamespace(t *testing.T) {
 	tests := map[string]struct {
 		in             string
@@ -333,3 +841,228 @@ func TestParseNamespace(t *testing.T) {
 		})
 	}
 }
+
+func TestOplogLag(t *testing.T) {
+	now := time.Unix(1600000000, 500000000)
+
+	tests := map[string]struct {
+		ts   primitive.Timestamp
+		want float64
+	}{
+		"Behind": {
+			ts:   primitive.Timestamp{T: 1599999990, I: 7},
+			want: 10.5,
+		},
+		"Caught up": {
+			ts:   primitive.Timestamp{T: 1600000000, I: 1},
+			want: 0.5,
+		},
+		"Clock skew": {
+			ts:   primitive.Timestamp{T: 1600000005},
+			want: 0,
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			got := oplogLag(test.ts, now)
+			if got != test.want {
+				t.Errorf("oplogLag() = %f; want %f", got, test.want)
+			}
+		})
+	}
+}
+
+func TestEntryLag(t *testing.T) {
+	now := time.Unix(1600000000, 500000000)
+
+	tests := map[string]struct {
+		op   oplogEntry
+		want float64
+	}{
+		"Wall time": {
+			op: oplogEntry{
+				Timestamp: primitive.Timestamp{T: 1599999990, I: 7},
+				Wall:      time.Unix(1599999990, 900000000),
+			},
+			want: 9.6,
+		},
+		"No wall time": {
+			op: oplogEntry{
+				Timestamp: primitive.Timestamp{T: 1599999990, I: 7},
+			},
+			want: 10.5,
+		},
+		"Clock skew": {
+			op: oplogEntry{
+				Timestamp: primitive.Timestamp{T: 1600000000, I: 1},
+				Wall:      time.Unix(1600000000, 700000000),
+			},
+			want: 0,
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			got := entryLag(&test.op, now)
+			if math.Abs(got-test.want) > 1e-9 {
+				t.Errorf("entryLag() = %f; want %f", got, test.want)
+			}
+		})
+	}
+}
+
+func TestUnmarshalEntryWall(t *testing.T) {
+	wall := time.Unix(1600000000, 123000000).UTC()
+	ts := primitive.Timestamp{T: 1600000000, I: 1}
+
+	tests := map[string]bson.M{
+		"Insert": {
+			"ts":   ts,
+			"op":   "i",
+			"ns":   "foo.bar",
+			"o":    bson.M{"_id": "id1"},
+			"wall": primitive.NewDateTimeFromTime(wall),
+		},
+		"Transaction": {
+			"ts": ts,
+			"op": "c",
+			"ns": "admin.$cmd",
+			"o": bson.M{"applyOps": bson.A{
+				bson.M{"op": "i", "ns": "foo.bar", "o": bson.M{"_id": "id1"}},
+			}},
+			"wall": primitive.NewDateTimeFromTime(wall),
+		},
+	}
+
+	for name, doc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var raw rawOplogEntry
+			require.NoError(t, bson.Unmarshal(mustRaw(t, doc), &raw))
+			require.True(t, wall.Equal(raw.Wall), "decoded wall %v, expected %v", raw.Wall, wall)
+
+			entries := (&Tailer{}).parseRawOplogEntry(raw, nil)
+			require.Len(t, entries, 1)
+			require.True(t, wall.Equal(entries[0].Wall), "parsed wall %v, expected %v", entries[0].Wall, wall)
+		})
+	}
+}
+
+func TestIsModifierUpdate(t *testing.T) {
+	tests := map[string]struct {
+		in   interface{}
+		want bool
+	}{
+		"$set": {
+			in:   map[string]interface{}{"$v": 1, "$set": map[string]interface{}{"a": 1}},
+			want: true,
+		},
+		"$unset": {
+			in:   map[string]interface{}{"$unset": map[string]interface{}{"a": true}},
+			want: true,
+		},
+		"v2 diff": {
+			in:   map[string]interface{}{"$v": int32(2), "diff": map[string]interface{}{"u": map[string]interface{}{"a": 1}}},
+			want: true,
+		},
+		"Replacement": {
+			in:   map[string]interface{}{"_id": "someid", "a": 1},
+			want: false,
+		},
+		"Replacement with a diff field": {
+			in:   map[string]interface{}{"_id": "someid", "diff": 1},
+			want: false,
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			got := isModifierUpdate(mustRaw(t, test.in))
+			if got != test.want {
+				t.Errorf("isModifierUpdate() = %t; want %t", got, test.want)
+			}
+		})
+	}
+}
+
+func TestReachedStopPoint(t *testing.T) {
+	stopAt := primitive.Timestamp{T: 1000, I: 2}
+
+	tests := map[string]struct {
+		runOnce  bool
+		position primitive.Timestamp
+		want     bool
+	}{
+		"Before the stop point": {
+			runOnce:  true,
+			position: primitive.Timestamp{T: 1000, I: 1},
+			want:     false,
+		},
+		"At the stop point": {
+			runOnce:  true,
+			position: stopAt,
+			want:     true,
+		},
+		"Past the stop point": {
+			runOnce:  true,
+			position: primitive.Timestamp{T: 1001},
+			want:     true,
+		},
+		"Running continuously": {
+			runOnce:  false,
+			position: primitive.Timestamp{T: 1001},
+			want:     false,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			tailer := &Tailer{RunOnce: test.runOnce, stopAt: stopAt}
+			require.Equal(t, test.want, tailer.reachedStopPoint(newOplogPosition(test.position)))
+		})
+	}
+}
+
+func TestRetryTailingStopsWhenCaughtUp(t *testing.T) {
+	tailer := &Tailer{
+		RunOnce:           true,
+		RetryInitialDelay: time.Millisecond,
+		RetryMaxDelay:     time.Millisecond,
+	}
+
+	// The first attempt fails, as if we lost our connection; the second
+	// reads up to the stop point
+	calls := 0
+	done := make(chan struct{})
+	go func() {
+		tailer.retryTailing(nil, make(chan bool), func(out chan *redispub.Publication, stop <-chan bool) {
+			calls++
+			if calls == 2 {
+				tailer.caughtUp = true
+			}
+		})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("retryTailing didn't return once the tailer caught up")
+	}
+	require.Equal(t, 2, calls)
+}
+
+func TestWaitStartupJitter(t *testing.T) {
+	tailer := &Tailer{StartupJitter: 10 * time.Millisecond}
+	require.True(t, tailer.waitStartupJitter(make(chan bool)))
+
+	// A stop request cuts the wait short
+	tailer.StartupJitter = time.Hour
+	stop := make(chan bool, 1)
+	stop <- true
+	require.False(t, tailer.waitStartupJitter(stop))
+
+	// No jitter means no waiting, even when stopping
+	tailer.StartupJitter = 0
+	require.True(t, tailer.waitStartupJitter(stop))
+}
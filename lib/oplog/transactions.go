@@ -0,0 +1,150 @@
+package oplog
+
+import (
+	"strconv"
+
+	"github.com/vlasky/oplogtoredis/lib/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// transactionBuffer stitches together transactions that Mongo (4.2+) writes
+// across several oplog entries, so that we publish their operations only
+// once they've been committed.
+//
+// A transaction that's too large for a single oplog entry is written as a
+// chain of applyOps entries with partialTxn set, linked by prevOpTime. For an
+// unprepared transaction, the last applyOps entry in the chain (without
+// partialTxn) commits it. A prepared transaction (one that spans shards) ends
+// with an applyOps entry with prepare set, and is committed by a later
+// commitTransaction entry, or discarded by an abortTransaction entry. All the
+// entries of a transaction have the same lsid and txnNumber.
+//
+// Entries must be added in oplog order, so the buffer is used before entries
+// are handed to the (possibly concurrent) processing.
+type transactionBuffer struct {
+	// The operations of each transaction we've seen some, but not all, of
+	// the entries of, by transactionKey
+	pending map[string][]bson.RawValue
+}
+
+func newTransactionBuffer() *transactionBuffer {
+	return &transactionBuffer{pending: map[string][]bson.RawValue{}}
+}
+
+// Adds a raw oplog entry to the buffer. Returns the entry that should be
+// processed in its place: the entry itself, if it's not part of a
+// multi-entry transaction; a single applyOps entry with all of a
+// transaction's operations (and the timestamp of the entry that committed
+// it), if it completes one; or nil, if it's part of a transaction that
+// hasn't been committed yet.
+func (buffer *transactionBuffer) add(rawData bson.Raw) bson.Raw {
+	if op, _ := rawData.Lookup("op").StringValueOK(); op != operationCommand {
+		return rawData
+	}
+
+	doc, ok := rawData.Lookup("o").DocumentOK()
+	if !ok {
+		return rawData
+	}
+
+	key, ok := transactionKey(rawData)
+	if !ok {
+		// Not part of a transaction (or a transaction from before Mongo
+		// 4.2, which is always a single entry)
+		return rawData
+	}
+
+	if _, err := doc.LookupErr("abortTransaction"); err == nil {
+		delete(buffer.pending, key)
+		return rawData
+	}
+
+	if _, err := doc.LookupErr("commitTransaction"); err == nil {
+		ops, ok := buffer.pending[key]
+		if !ok {
+			log.Log.Errorw("Saw the commit of a prepared transaction without its operations (probably because we resumed tailing partway through it). Its changes won't be published.",
+				"ts", rawData.Lookup("ts"))
+			return rawData
+		}
+
+		delete(buffer.pending, key)
+		return combineTransaction(rawData, ops)
+	}
+
+	opsArray, ok := doc.Lookup("applyOps").ArrayOK()
+	if !ok {
+		return rawData
+	}
+
+	// The entry may be backed by the cursor's buffer, which it reuses, so
+	// the operations we hold on to must be copied
+	ops, err := bson.Raw(append([]byte(nil), opsArray...)).Values()
+	if err != nil {
+		log.Log.Errorw("Error reading transaction operations", "error", err)
+		return rawData
+	}
+
+	partial, _ := doc.Lookup("partialTxn").BooleanOK()
+	prepare, _ := doc.Lookup("prepare").BooleanOK()
+	if partial || prepare {
+		buffer.pending[key] = append(buffer.pending[key], ops...)
+		return nil
+	}
+
+	earlierOps, ok := buffer.pending[key]
+	if !ok {
+		if hasPrevOpTime(rawData) {
+			log.Log.Errorw("Saw the last entry of a transaction without its earlier entries (probably because we resumed tailing partway through it). Only the operations in the last entry will be published.",
+				"ts", rawData.Lookup("ts"))
+		}
+
+		return rawData
+	}
+
+	delete(buffer.pending, key)
+	return combineTransaction(rawData, append(earlierOps, ops...))
+}
+
+// Returns a key identifying the transaction a raw oplog entry belongs to,
+// from its lsid (the session) and txnNumber. Returns false if the entry
+// isn't part of a transaction.
+func transactionKey(rawData bson.Raw) (string, bool) {
+	lsid, ok := rawData.Lookup("lsid").DocumentOK()
+	if !ok {
+		return "", false
+	}
+
+	txnNumber, ok := rawData.Lookup("txnNumber").AsInt64OK()
+	if !ok {
+		return "", false
+	}
+
+	return string(lsid) + ":" + strconv.FormatInt(txnNumber, 10), true
+}
+
+// Returns whether a raw oplog entry follows an earlier entry of the same
+// transaction. The first entry of a transaction has a zero prevOpTime.
+func hasPrevOpTime(rawData bson.Raw) bool {
+	t, i, ok := rawData.Lookup("prevOpTime", "ts").TimestampOK()
+	return ok && (t != 0 || i != 0)
+}
+
+// Builds a single applyOps entry with the given operations, and the
+// timestamp of the entry that committed them
+func combineTransaction(commit bson.Raw, ops []bson.RawValue) bson.Raw {
+	t, i, _ := commit.Lookup("ts").TimestampOK()
+
+	combined, err := bson.Marshal(bson.D{
+		{Key: "ts", Value: primitive.Timestamp{T: t, I: i}},
+		{Key: "op", Value: operationCommand},
+		{Key: "ns", Value: "admin.$cmd"},
+		{Key: "o", Value: bson.D{{Key: "applyOps", Value: ops}}},
+	})
+	if err != nil {
+		log.Log.Errorw("Error combining transaction operations", "error", err)
+		return nil
+	}
+
+	return combined
+}
@@ -0,0 +1,173 @@
+package oplog
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// The session ID of the transactions below, as Mongo writes it in the oplog
+var testLSID = bson.D{
+	{Key: "id", Value: primitive.Binary{Subtype: 4, Data: []byte("0123456789abcdef")}},
+	{Key: "uid", Value: primitive.Binary{Subtype: 0, Data: []byte("0123456789abcdef0123456789abcdef")}},
+}
+
+// Builds an oplog entry of a transaction with the given transaction number,
+// timestamp, previous entry timestamp, and o field
+func transactionEntry(t *testing.T, txnNumber int64, ts uint32, prevTS uint32, o bson.D) bson.Raw {
+	raw, err := bson.Marshal(bson.D{
+		{Key: "lsid", Value: testLSID},
+		{Key: "txnNumber", Value: txnNumber},
+		{Key: "op", Value: "c"},
+		{Key: "ns", Value: "admin.$cmd"},
+		{Key: "o", Value: o},
+		{Key: "ts", Value: primitive.Timestamp{T: ts, I: 1}},
+		{Key: "t", Value: int64(1)},
+		{Key: "v", Value: int64(2)},
+		{Key: "wall", Value: primitive.DateTime(int64(ts) * 1000)},
+		{Key: "prevOpTime", Value: bson.M{"ts": primitive.Timestamp{T: prevTS, I: prevTSIncrement(prevTS)}, "t": int64(1)}},
+	})
+	require.NoError(t, err)
+	return raw
+}
+
+func prevTSIncrement(prevTS uint32) uint32 {
+	if prevTS == 0 {
+		return 0
+	}
+	return 1
+}
+
+func insertOp(id string) bson.M {
+	return bson.M{
+		"op": "i",
+		"ns": "foo.bar",
+		"ui": primitive.Binary{Subtype: 4, Data: []byte("fedcba9876543210")},
+		"o":  bson.M{"_id": id, "value": "x"},
+	}
+}
+
+// Returns the document IDs and transaction indexes of the publications for an
+// entry, checking that they all have the commit timestamp
+func transactionPublications(t *testing.T, rawData bson.Raw) ([]string, []uint) {
+	tailer := Tailer{}
+	_, pubs := tailer.unmarshalEntry(rawData)
+
+	var ids []string
+	var txIdxs []uint
+	for _, pub := range pubs {
+		require.Equal(t, primitive.Timestamp{T: 1003, I: 1}, pub.OplogTimestamp)
+		ids = append(ids, pub.DocID)
+		txIdxs = append(txIdxs, pub.TxIdx)
+	}
+
+	return ids, txIdxs
+}
+
+func TestTransactionBuffer(t *testing.T) {
+	t.Run("Unprepared multi-entry transaction", func(t *testing.T) {
+		buffer := newTransactionBuffer()
+
+		require.Nil(t, buffer.add(transactionEntry(t, 5, 1001, 0, bson.D{
+			{Key: "applyOps", Value: bson.A{insertOp("a"), insertOp("b")}},
+			{Key: "partialTxn", Value: true},
+		})))
+		require.Nil(t, buffer.add(transactionEntry(t, 5, 1002, 1001, bson.D{
+			{Key: "applyOps", Value: bson.A{insertOp("c")}},
+			{Key: "partialTxn", Value: true},
+		})))
+		combined := buffer.add(transactionEntry(t, 5, 1003, 1002, bson.D{
+			{Key: "applyOps", Value: bson.A{insertOp("d")}},
+			{Key: "count", Value: int64(4)},
+		}))
+		require.NotNil(t, combined)
+		require.Empty(t, buffer.pending)
+
+		ids, txIdxs := transactionPublications(t, combined)
+		require.Equal(t, []string{"a", "b", "c", "d"}, ids)
+		require.Equal(t, []uint{0, 1, 2, 3}, txIdxs)
+	})
+
+	t.Run("Prepared transaction", func(t *testing.T) {
+		buffer := newTransactionBuffer()
+
+		require.Nil(t, buffer.add(transactionEntry(t, 6, 1001, 0, bson.D{
+			{Key: "applyOps", Value: bson.A{insertOp("a")}},
+			{Key: "partialTxn", Value: true},
+		})))
+		require.Nil(t, buffer.add(transactionEntry(t, 6, 1002, 1001, bson.D{
+			{Key: "applyOps", Value: bson.A{insertOp("b")}},
+			{Key: "prepare", Value: true},
+		})))
+		combined := buffer.add(transactionEntry(t, 6, 1003, 1002, bson.D{
+			{Key: "commitTransaction", Value: int32(1)},
+			{Key: "commitTimestamp", Value: primitive.Timestamp{T: 1002, I: 5}},
+		}))
+		require.NotNil(t, combined)
+		require.Empty(t, buffer.pending)
+
+		ids, _ := transactionPublications(t, combined)
+		require.Equal(t, []string{"a", "b"}, ids)
+	})
+
+	t.Run("Aborted prepared transaction", func(t *testing.T) {
+		buffer := newTransactionBuffer()
+
+		require.Nil(t, buffer.add(transactionEntry(t, 7, 1001, 0, bson.D{
+			{Key: "applyOps", Value: bson.A{insertOp("a")}},
+			{Key: "prepare", Value: true},
+		})))
+		abort := transactionEntry(t, 7, 1002, 1001, bson.D{{Key: "abortTransaction", Value: int32(1)}})
+		require.Equal(t, abort, buffer.add(abort))
+		require.Empty(t, buffer.pending)
+
+		tailer := Tailer{}
+		_, pubs := tailer.unmarshalEntry(abort)
+		require.Empty(t, pubs)
+	})
+
+	t.Run("Interleaved transactions", func(t *testing.T) {
+		buffer := newTransactionBuffer()
+
+		require.Nil(t, buffer.add(transactionEntry(t, 8, 1001, 0, bson.D{
+			{Key: "applyOps", Value: bson.A{insertOp("a")}},
+			{Key: "partialTxn", Value: true},
+		})))
+		require.Nil(t, buffer.add(transactionEntry(t, 9, 1001, 0, bson.D{
+			{Key: "applyOps", Value: bson.A{insertOp("x")}},
+			{Key: "partialTxn", Value: true},
+		})))
+		combined := buffer.add(transactionEntry(t, 8, 1003, 1001, bson.D{
+			{Key: "applyOps", Value: bson.A{insertOp("b")}},
+		}))
+
+		ids, _ := transactionPublications(t, combined)
+		require.Equal(t, []string{"a", "b"}, ids)
+		require.Len(t, buffer.pending, 1)
+	})
+
+	t.Run("Single-entry transaction", func(t *testing.T) {
+		buffer := newTransactionBuffer()
+
+		entry := transactionEntry(t, 10, 1003, 0, bson.D{
+			{Key: "applyOps", Value: bson.A{insertOp("a"), insertOp("b")}},
+		})
+		require.Equal(t, entry, buffer.add(entry))
+		require.Empty(t, buffer.pending)
+	})
+
+	t.Run("Not a transaction", func(t *testing.T) {
+		buffer := newTransactionBuffer()
+
+		entry, err := bson.Marshal(bson.M{
+			"ts": primitive.Timestamp{T: 1003, I: 1},
+			"op": "i",
+			"ns": "foo.bar",
+			"o":  bson.M{"_id": "a"},
+		})
+		require.NoError(t, err)
+		require.Equal(t, bson.Raw(entry), buffer.add(entry))
+	})
+}
@@ -0,0 +1,94 @@
+package oplog
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/vlasky/oplogtoredis/lib/redispub"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var metricTransformerDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "otr",
+	Subsystem: "oplog",
+	Name:      "transformer_dropped",
+	Help:      "Publications dropped by the Tailer's PublicationTransformer, partitioned by database",
+}, []string{"database"})
+
+// PublicationTransformer lets a program that uses oplogtoredis as a library
+// modify publications (for example, to enrich their messages or rename their
+// channels) or drop them, without changing oplogtoredis itself. Set it as
+// Tailer.Transformer.
+//
+// Transform is called with each publication once it's been built, along with
+// the entry it was built from. It returns the publication to send, which may
+// be pub itself after modifying it, or nil to drop it. With
+// Tailer.ProcessorConcurrency, it's called from several goroutines at once.
+type PublicationTransformer interface {
+	Transform(entry *Entry, pub *redispub.Publication) *redispub.Publication
+}
+
+// Entry is the oplog entry (or change event) that a publication was built
+// from, as passed to a PublicationTransformer. The entries of a transaction
+// are passed separately.
+type Entry struct {
+	// Operation is "i" (insert), "u" (update), or "d" (remove) for a change
+	// to a document, or "rename", "drop", or "dropDatabase" for an event
+	// that affects a whole collection or database
+	Operation string
+
+	// Namespace, Database, and Collection are as they are in Mongo, before
+	// Tailer.NamespaceMap is applied
+	Namespace  string
+	Database   string
+	Collection string
+
+	// DocID is the _id of the document that changed. It's nil for events
+	// that affect a whole collection or database.
+	DocID interface{}
+
+	Timestamp primitive.Timestamp
+
+	// TxIdx is the index of the entry within its transaction
+	TxIdx uint
+
+	// Data is the decoded o field of the entry, for modifier updates and
+	// for events that affect a whole collection or database. RawData is the
+	// undecoded document for inserts, removes, and replacement updates. Only
+	// one of them is set.
+	Data    map[string]interface{}
+	RawData bson.Raw
+
+	// FullDocument is the current version of the document, for updates to
+	// collections that we publish full documents for (see
+	// Tailer.FullDocumentCollections). It's nil otherwise.
+	FullDocument map[string]interface{}
+}
+
+// Returns the publication to send for pub, which was built from op, after
+// passing it to the Tailer's Transformer (if it has one), or nil if the
+// Transformer dropped it
+func (tailer *Tailer) transform(op *oplogEntry, pub *redispub.Publication) *redispub.Publication {
+	if tailer.Transformer == nil {
+		return pub
+	}
+
+	transformed := tailer.Transformer.Transform(&Entry{
+		Operation:    op.Operation,
+		Namespace:    op.Namespace,
+		Database:     op.Database,
+		Collection:   op.Collection,
+		DocID:        op.DocID,
+		Timestamp:    op.Timestamp,
+		TxIdx:        op.TxIdx,
+		Data:         op.Data,
+		RawData:      op.RawData,
+		FullDocument: op.FullDocument,
+	}, pub)
+
+	if transformed == nil {
+		metricTransformerDropped.WithLabelValues(op.Database).Inc()
+	}
+
+	return transformed
+}
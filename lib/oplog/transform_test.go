@@ -0,0 +1,87 @@
+package oplog
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vlasky/oplogtoredis/lib/redispub"
+)
+
+// A PublicationTransformer that drops publications for the "secrets"
+// collection, and prefixes the channels of the rest
+type testTransformer struct {
+	entries []Entry
+}
+
+func (transformer *testTransformer) Transform(entry *Entry, pub *redispub.Publication) *redispub.Publication {
+	transformer.entries = append(transformer.entries, *entry)
+
+	if entry.Collection == "secrets" {
+		return nil
+	}
+
+	pub.CollectionChannel = "transformed:" + pub.CollectionChannel
+	return pub
+}
+
+func TestProcessEntriesTransformer(t *testing.T) {
+	namespaceMap, err := NewNamespaceMap([]string{"prod_*=*"})
+	require.NoError(t, err)
+
+	transformer := &testTransformer{}
+	tailer := &Tailer{
+		NamespaceMap: namespaceMap,
+		Transformer:  transformer,
+	}
+
+	entries := []oplogEntry{
+		{
+			DocID:      "id1",
+			Operation:  "i",
+			Namespace:  "prod_app.users",
+			Database:   "prod_app",
+			Collection: "users",
+			TxIdx:      0,
+		},
+		{
+			DocID:      "id2",
+			Operation:  "i",
+			Namespace:  "prod_app.secrets",
+			Database:   "prod_app",
+			Collection: "secrets",
+			TxIdx:      1,
+		},
+	}
+
+	dropped := metricTransformerDropped.WithLabelValues("prod_app")
+	droppedBefore := testutil.ToFloat64(dropped)
+
+	pubs := tailer.processEntries(entries, 100, "command")
+
+	require.Len(t, pubs, 1)
+	assert.Equal(t, "transformed:app.users", pubs[0].CollectionChannel)
+	assert.Equal(t, "app.users::id1", pubs[0].SpecificChannel)
+	assert.Equal(t, 1.0, testutil.ToFloat64(dropped)-droppedBefore)
+
+	// The transformer sees each entry as it is in Mongo
+	require.Len(t, transformer.entries, 2)
+	assert.Equal(t, "prod_app.users", transformer.entries[0].Namespace)
+	assert.Equal(t, "users", transformer.entries[0].Collection)
+	assert.Equal(t, "id1", transformer.entries[0].DocID)
+	assert.Equal(t, uint(1), transformer.entries[1].TxIdx)
+}
+
+func TestProcessEntriesNoTransformer(t *testing.T) {
+	pubs := (&Tailer{}).processEntries([]oplogEntry{{
+		DocID:      "id1",
+		Operation:  "i",
+		Namespace:  "app.users",
+		Database:   "app",
+		Collection: "users",
+	}}, 100, "insert")
+
+	require.Len(t, pubs, 1)
+	assert.Equal(t, "app.users", pubs[0].CollectionChannel)
+}
@@ -0,0 +1,108 @@
+package redispub
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/vlasky/oplogtoredis/lib/log"
+)
+
+var metricCatchUpThrottling = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: "otr",
+	Subsystem: "redispub",
+	Name:      "catchup_throttling",
+	Help:      "1 while we're limiting the publish rate to OTR_CATCHUP_MAX_RATE because we're catching up on a backlog, 0 otherwise.",
+})
+
+var metricCatchUpDelay = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: "otr",
+	Subsystem: "redispub",
+	Name:      "catchup_delay_seconds",
+	Help:      "Total time we've waited before publishing to stay within OTR_CATCHUP_MAX_RATE.",
+})
+
+// catchUpLimiter limits the rate at which we publish messages while we're
+// catching up on a backlog (e.g. after an outage), so that replaying it
+// doesn't flood Redis and subscribers. We're catching up when the newest
+// message we're publishing is more than threshold behind the current time,
+// the same lag otr_oplog_lag_seconds reports (to the second, since that's
+// the resolution of the oplog timestamp).
+//
+// Unlike rateLimiter, it's a single token bucket for all messages, holding
+// up to a second's worth of them, and messages over the limit are delayed
+// rather than dropped. The delay holds up the publisher, so the buffer
+// between it and the tailer fills up and the tailer waits too. Like
+// rateLimiter, it's not threadsafe.
+type catchUpLimiter struct {
+	rate      float64
+	threshold time.Duration
+
+	active bool
+	tokens float64
+	filled time.Time
+
+	// Replaced by PublishStream, so that stopping cuts the wait short, and
+	// in tests
+	sleep func(time.Duration)
+}
+
+func newCatchUpLimiter(rate int, threshold time.Duration) *catchUpLimiter {
+	return &catchUpLimiter{
+		rate:      float64(rate),
+		threshold: threshold,
+		sleep:     time.Sleep,
+	}
+}
+
+// Waits until messages can be published without exceeding the rate, if
+// we're catching up. messages is in the order it'll be published.
+func (limiter *catchUpLimiter) wait(messages []*Publication, now time.Time) {
+	if len(messages) == 0 {
+		return
+	}
+
+	newest := messages[len(messages)-1].OplogTimestamp
+	lag := now.Sub(time.Unix(int64(newest.T), 0))
+
+	if lag <= limiter.threshold {
+		if limiter.active {
+			limiter.active = false
+			metricCatchUpThrottling.Set(0)
+			log.Log.Infow("Caught up; no longer limiting the publish rate to OTR_CATCHUP_MAX_RATE",
+				"lag", lag)
+		}
+		return
+	}
+
+	if !limiter.active {
+		limiter.active = true
+		limiter.tokens = limiter.rate
+		limiter.filled = now
+		metricCatchUpThrottling.Set(1)
+		log.Log.Warnw("Catching up on a backlog; limiting the publish rate to OTR_CATCHUP_MAX_RATE until the lag is within OTR_CATCHUP_LAG_THRESHOLD",
+			"lag", lag,
+			"rate", limiter.rate)
+	}
+
+	if elapsed := now.Sub(limiter.filled); elapsed > 0 {
+		limiter.tokens += elapsed.Seconds() * limiter.rate
+		if limiter.tokens > limiter.rate {
+			limiter.tokens = limiter.rate
+		}
+		limiter.filled = now
+	}
+
+	limiter.tokens -= float64(len(messages))
+	if limiter.tokens >= 0 {
+		return
+	}
+
+	// Wait until the bucket has refilled enough to cover the deficit
+	delay := time.Duration(-limiter.tokens / limiter.rate * float64(time.Second))
+	metricCatchUpDelay.Add(delay.Seconds())
+	limiter.sleep(delay)
+
+	limiter.tokens = 0
+	limiter.filled = now.Add(delay)
+}
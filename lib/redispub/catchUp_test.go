@@ -0,0 +1,150 @@
+package redispub
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func catchUpPubs(count int, ts uint32) []*Publication {
+	pubs := make([]*Publication, count)
+	for i := range pubs {
+		pubs[i] = &Publication{OplogTimestamp: primitive.Timestamp{T: ts}}
+	}
+	return pubs
+}
+
+func TestCatchUpLimiter(t *testing.T) {
+	start := time.Unix(1000, 0)
+	limiter := newCatchUpLimiter(10, time.Minute)
+
+	var delays []time.Duration
+	limiter.sleep = func(d time.Duration) {
+		delays = append(delays, d)
+	}
+
+	// Within the threshold, nothing is delayed
+	limiter.wait(catchUpPubs(100, 950), start)
+	if len(delays) != 0 || limiter.active {
+		t.Fatalf("Expected no delay within the lag threshold, got %v", delays)
+	}
+
+	// Behind, we can send a second's worth straight away...
+	limiter.wait(catchUpPubs(10, 800), start)
+	if len(delays) != 0 || !limiter.active {
+		t.Fatalf("Expected a full bucket when we start catching up, got delays %v", delays)
+	}
+	if testutil.ToFloat64(metricCatchUpThrottling) != 1 {
+		t.Error("Expected otr_redispub_catchup_throttling to be 1 while catching up")
+	}
+
+	// ...and then wait for the rest
+	limiter.wait(catchUpPubs(5, 800), start)
+	limiter.wait(catchUpPubs(5, 800), start.Add(500*time.Millisecond))
+	limiter.wait(catchUpPubs(20, 800), start.Add(1500*time.Millisecond))
+
+	expected := []time.Duration{500 * time.Millisecond, 500 * time.Millisecond, 1500 * time.Millisecond}
+	if !reflect.DeepEqual(delays, expected) {
+		t.Errorf("Incorrect delays. Got %v, expected %v", delays, expected)
+	}
+
+	// Once caught up, the limit is lifted
+	delays = nil
+	limiter.wait(catchUpPubs(100, 1000), start.Add(2*time.Second))
+	if len(delays) != 0 || limiter.active {
+		t.Errorf("Expected no delay once caught up, got %v", delays)
+	}
+	if testutil.ToFloat64(metricCatchUpThrottling) != 0 {
+		t.Error("Expected otr_redispub_catchup_throttling to be 0 once caught up")
+	}
+}
+
+func TestCatchUpLimiterUsesNewestMessage(t *testing.T) {
+	limiter := newCatchUpLimiter(1, time.Minute)
+	limiter.sleep = func(d time.Duration) {
+		t.Errorf("Expected no delay, got %s", d)
+	}
+
+	// The batch ends with a recent message, so we've caught up
+	pubs := append(catchUpPubs(5, 800), catchUpPubs(1, 990)...)
+	limiter.wait(pubs, time.Unix(1000, 0))
+
+	if limiter.active {
+		t.Error("Expected the limiter not to be active")
+	}
+}
+
+func TestPublishStreamStopsWhileThrottled(t *testing.T) {
+	redisServer, redisClient := startMiniredis()
+	defer redisServer.Close()
+
+	sink := &fakeSink{}
+	in := make(chan *Publication, 10)
+	stop := make(chan bool)
+	done := make(chan struct{})
+
+	// An hour-old backlog, in a batch that takes 9 seconds to be allowed
+	// out at 1 message per second
+	ts := uint32(time.Now().Add(-time.Hour).Unix())
+	for i := 1; i <= 10; i++ {
+		in <- &Publication{Msg: []byte(fmt.Sprint(i)), OplogTimestamp: primitive.Timestamp{T: ts, I: uint32(i)}}
+	}
+
+	metricCatchUpThrottling.Set(0)
+	heartbeats := metricHeartbeats.WithLabelValues("failed")
+	heartbeatsBefore := testutil.ToFloat64(heartbeats)
+
+	go func() {
+		PublishStream([]redis.UniversalClient{redisClient}, in, &PublishOpts{
+			MetadataPrefix:      "someprefix.",
+			FlushInterval:       time.Hour,
+			BatchSize:           10,
+			Sink:                sink,
+			CatchUpMaxRate:      1,
+			CatchUpLagThreshold: time.Minute,
+			HeartbeatInterval:   10 * time.Millisecond,
+			HeartbeatChannel:    "oplogtoredis.heartbeat",
+		}, stop)
+		close(done)
+	}()
+
+	// The throttling starts just before the wait
+	deadline := time.Now().Add(5 * time.Second)
+	for testutil.ToFloat64(metricCatchUpThrottling) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("PublishStream didn't start limiting the publish rate")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Heartbeats are still sent while we wait (miniredis doesn't support
+	// PUBLISH, so they fail)
+	time.Sleep(55 * time.Millisecond)
+	if sent := testutil.ToFloat64(heartbeats) - heartbeatsBefore; sent < 2 {
+		t.Errorf("Expected at least 2 heartbeats while throttled, got %v", sent)
+	}
+
+	stop <- true
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("PublishStream didn't stop while waiting to stay within the catch-up rate")
+	}
+
+	// The batch we were waiting on is still published, and covered by the
+	// final timestamp
+	var published int
+	for _, batch := range sink.batches {
+		published += len(batch)
+	}
+	if published != 10 {
+		t.Errorf("Expected 10 publications, got %d", published)
+	}
+
+	redisServer.CheckGet(t, "someprefix.lastProcessedEntry", encodeMongoTimestamp(primitive.Timestamp{T: ts, I: 10}))
+}
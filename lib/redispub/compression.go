@@ -0,0 +1,106 @@
+package redispub
+
+import (
+	"bytes"
+	"compress/gzip"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/vlasky/oplogtoredis/lib/log"
+)
+
+// Values for PublishOpts.Compression
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+// Prefixes that mark a compressed message, so the consumer knows to strip the
+// prefix and decompress the rest. An uncompressed message is always a JSON
+// object, so it can't start with either of them.
+const (
+	CompressedPrefixGzip = "gzip:"
+	CompressedPrefixZstd = "zstd:"
+)
+
+var metricCompressionRatio = promauto.NewHistogram(prometheus.HistogramOpts{
+	Namespace: "otr",
+	Subsystem: "redispub",
+	Name:      "compression_ratio",
+	Help:      "Size of each message compressed with OTR_PAYLOAD_COMPRESSION, as a fraction of its uncompressed size. Messages that don't shrink are sent uncompressed.",
+	Buckets:   prometheus.LinearBuckets(0.1, 0.1, 10),
+})
+
+// zstd encoders are expensive to create, but EncodeAll is safe to call
+// concurrently, so we share one
+var (
+	zstdEncoderOnce sync.Once
+	zstdEncoder     *zstd.Encoder
+	zstdEncoderErr  error
+)
+
+// Compresses the message of each publication in batch that's at least
+// opts.CompressionThreshold bytes, according to opts.Compression. A message
+// that doesn't get smaller is left as it is, and so is one that can't be
+// compressed (which shouldn't happen).
+func compressMessages(batch []*Publication, opts *PublishOpts) {
+	if opts.Compression == "" || opts.Compression == CompressionNone {
+		return
+	}
+
+	for _, p := range batch {
+		if len(p.Msg) < opts.CompressionThreshold {
+			continue
+		}
+
+		compressed, err := compressMessage(p.Msg, opts.Compression)
+		if err != nil {
+			log.Log.Errorw("Error compressing message; sending it uncompressed",
+				"error", err,
+				"compression", opts.Compression,
+				"channel", p.CollectionChannel)
+			continue
+		}
+
+		metricCompressionRatio.Observe(float64(len(compressed)) / float64(len(p.Msg)))
+		if len(compressed) < len(p.Msg) {
+			p.Msg = compressed
+		}
+	}
+}
+
+// Returns msg compressed with the given algorithm, including its prefix
+func compressMessage(msg []byte, compression string) ([]byte, error) {
+	switch compression {
+	case CompressionGzip:
+		var buf bytes.Buffer
+		buf.WriteString(CompressedPrefixGzip)
+
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(msg); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+
+		return buf.Bytes(), nil
+
+	case CompressionZstd:
+		zstdEncoderOnce.Do(func() {
+			zstdEncoder, zstdEncoderErr = zstd.NewWriter(nil)
+		})
+		if zstdEncoderErr != nil {
+			return nil, zstdEncoderErr
+		}
+
+		return zstdEncoder.EncodeAll(msg, []byte(CompressedPrefixZstd)), nil
+
+	default:
+		return nil, errors.Errorf("unknown compression %q", compression)
+	}
+}
@@ -0,0 +1,94 @@
+package redispub
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestCompressMessages(t *testing.T) {
+	large := []byte(`{"e":"u","d":{"_id":"abc"},"f":["` + strings.Repeat("field", 100) + `"]}`)
+	small := []byte(`{"e":"u","d":{"_id":"abc"},"f":["a"]}`)
+
+	decompress := map[string]func(t *testing.T, msg []byte) []byte{
+		CompressionGzip: func(t *testing.T, msg []byte) []byte {
+			r, err := gzip.NewReader(bytes.NewReader(msg))
+			if err != nil {
+				t.Fatalf("Error reading gzip message: %s", err)
+			}
+			decompressed, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatalf("Error decompressing gzip message: %s", err)
+			}
+			return decompressed
+		},
+		CompressionZstd: func(t *testing.T, msg []byte) []byte {
+			d, err := zstd.NewReader(nil)
+			if err != nil {
+				t.Fatalf("Error creating zstd decoder: %s", err)
+			}
+			defer d.Close()
+			decompressed, err := d.DecodeAll(msg, nil)
+			if err != nil {
+				t.Fatalf("Error decompressing zstd message: %s", err)
+			}
+			return decompressed
+		},
+	}
+	prefixes := map[string]string{
+		CompressionGzip: CompressedPrefixGzip,
+		CompressionZstd: CompressedPrefixZstd,
+	}
+
+	for compression, prefix := range prefixes {
+		t.Run(compression, func(t *testing.T) {
+			batch := []*Publication{
+				{Msg: append([]byte(nil), large...)},
+				{Msg: append([]byte(nil), small...)},
+			}
+			compressMessages(batch, &PublishOpts{
+				Compression:          compression,
+				CompressionThreshold: 100,
+			})
+
+			if !bytes.HasPrefix(batch[0].Msg, []byte(prefix)) {
+				t.Fatalf("Expected the large message to be compressed with prefix %q, got %q", prefix, batch[0].Msg)
+			}
+			if len(batch[0].Msg) >= len(large) {
+				t.Errorf("Expected the compressed message to be smaller: %d >= %d bytes", len(batch[0].Msg), len(large))
+			}
+			if got := decompress[compression](t, batch[0].Msg[len(prefix):]); !bytes.Equal(got, large) {
+				t.Errorf("Decompressed message didn't match. Got %s, expected %s", got, large)
+			}
+
+			if !bytes.Equal(batch[1].Msg, small) {
+				t.Errorf("Expected the message below the threshold to be left alone, got %q", batch[1].Msg)
+			}
+		})
+	}
+}
+
+func TestCompressMessagesNotSmaller(t *testing.T) {
+	// Too short and random to compress
+	msg := []byte(`{"e":"i","d":{"_id":"x7Qz"}}`)
+	batch := []*Publication{{Msg: append([]byte(nil), msg...)}}
+
+	compressMessages(batch, &PublishOpts{Compression: CompressionGzip})
+	if !bytes.Equal(batch[0].Msg, msg) {
+		t.Errorf("Expected a message that doesn't shrink to be sent uncompressed, got %q", batch[0].Msg)
+	}
+}
+
+func TestCompressMessagesNone(t *testing.T) {
+	msg := []byte(`{"e":"u","f":["` + strings.Repeat("field", 100) + `"]}`)
+	batch := []*Publication{{Msg: append([]byte(nil), msg...)}}
+
+	compressMessages(batch, &PublishOpts{Compression: CompressionNone})
+	if !bytes.Equal(batch[0].Msg, msg) {
+		t.Errorf("Expected no compression, got %q", batch[0].Msg)
+	}
+}
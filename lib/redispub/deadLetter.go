@@ -0,0 +1,87 @@
+package redispub
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/vlasky/oplogtoredis/lib/log"
+)
+
+var metricDeadLettered = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: "otr",
+	Subsystem: "redispub",
+	Name:      "dead_lettered",
+	Help:      "Number of publications that we gave up on publishing and appended to the dead-letter list (OTR_DEADLETTER_KEY).",
+})
+
+// deadLetter is the JSON record of a publication we gave up on, as stored
+// in the dead-letter list
+type deadLetter struct {
+	Namespace         string `json:"namespace"`
+	DocID             string `json:"id,omitempty"`
+	CollectionChannel string `json:"collectionChannel"`
+	SpecificChannel   string `json:"specificChannel,omitempty"`
+
+	// The message, base64-encoded, since it may not be JSON (see
+	// config.PayloadFormat)
+	Payload []byte `json:"payload"`
+
+	// The oplog timestamp, encoded as in the last-processed timestamp key
+	Timestamp string `json:"ts"`
+
+	Error    string    `json:"error"`
+	FailedAt time.Time `json:"failedAt"`
+}
+
+// Appends the publications in batch, which we failed to publish with the
+// given error, to the dead-letter list at key on each of the clients (or as
+// many of them as we can reach).
+func writeDeadLetters(clients []redis.UniversalClient, key string, batch []*Publication, publishErr error) {
+	now := time.Now().UTC()
+
+	records := make([]interface{}, 0, len(batch))
+	for _, p := range batch {
+		record, err := json.Marshal(deadLetter{
+			Namespace:         p.Namespace,
+			DocID:             p.DocID,
+			CollectionChannel: p.CollectionChannel,
+			SpecificChannel:   p.SpecificChannel,
+			Payload:           p.Msg,
+			Timestamp:         encodeMongoTimestamp(p.OplogTimestamp),
+			Error:             publishErr.Error(),
+			FailedAt:          now,
+		})
+		if err != nil {
+			log.Log.Errorw("Error encoding dead letter", "error", err)
+			continue
+		}
+
+		records = append(records, record)
+	}
+
+	if len(records) == 0 {
+		return
+	}
+
+	written := false
+	for i, client := range clients {
+		err := client.RPush(context.Background(), key, records...).Err()
+		if err != nil {
+			log.Log.Errorw("Error writing publications to the dead-letter list",
+				"error", err,
+				"key", key,
+				"redisServer", i,
+				"count", len(records))
+		} else {
+			written = true
+		}
+	}
+
+	if written {
+		metricDeadLettered.Add(float64(len(records)))
+	}
+}
@@ -0,0 +1,68 @@
+package redispub
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/go-redis/redis/v8"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestWriteDeadLetters(t *testing.T) {
+	redisServer, redisClient := startMiniredis()
+	defer redisServer.Close()
+
+	batch := []*Publication{
+		{
+			CollectionChannel: "foo.bar",
+			SpecificChannel:   "foo.bar::someid",
+			Msg:               []byte(`{"e":"u"}`),
+			OplogTimestamp:    primitive.Timestamp{T: 1, I: 2},
+			Namespace:         "foo.bar",
+			DocID:             "someid",
+		},
+		{
+			CollectionChannel: "foo.bar",
+			Msg:               []byte(`{"e":"drop"}`),
+			OplogTimestamp:    primitive.Timestamp{T: 1, I: 3},
+			Namespace:         "foo.bar",
+		},
+	}
+
+	writeDeadLetters([]redis.UniversalClient{redisClient}, "otr.deadletter", batch, errors.New("some error"))
+
+	records, err := redisServer.List("otr.deadletter")
+	if err != nil {
+		t.Fatalf("Error reading the dead-letter list: %s", err)
+	}
+
+	if len(records) != 2 {
+		t.Fatalf("Expected 2 dead letters, got %d", len(records))
+	}
+
+	var record deadLetter
+	if err := json.Unmarshal([]byte(records[0]), &record); err != nil {
+		t.Fatalf("Error decoding dead letter: %s", err)
+	}
+
+	if record.Namespace != "foo.bar" || record.DocID != "someid" || record.SpecificChannel != "foo.bar::someid" {
+		t.Errorf("Incorrect publication details in dead letter: %#v", record)
+	}
+
+	if string(record.Payload) != `{"e":"u"}` {
+		t.Errorf("Incorrect payload in dead letter: %s", record.Payload)
+	}
+
+	if record.Timestamp != encodeMongoTimestamp(primitive.Timestamp{T: 1, I: 2}) {
+		t.Errorf("Incorrect timestamp in dead letter: %s", record.Timestamp)
+	}
+
+	if record.Error != "some error" {
+		t.Errorf("Incorrect error in dead letter: %s", record.Error)
+	}
+
+	if record.FailedAt.IsZero() {
+		t.Error("Expected the dead letter to record when it failed")
+	}
+}
@@ -0,0 +1,117 @@
+package redispub
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/vlasky/oplogtoredis/lib/log"
+)
+
+// dedupKey identifies a single oplog entry (or change stream event)
+type dedupKey struct {
+	namespace string
+	docID     string
+	timestamp primitive.Timestamp
+	entryIdx  uint
+	txIdx     uint
+
+	// The resume token ID, for publications from a change stream. Events in
+	// the same transaction share a timestamp, so it disambiguates them.
+	resumeToken string
+
+	// The shard, on a sharded cluster; see formatKey
+	resumeKey string
+}
+
+type dedupCacheEntry struct {
+	key     dedupKey
+	expires time.Time
+}
+
+// dedupCache is an in-memory record of the publications we've recently
+// published, used to suppress duplicates without a round-trip to Redis. When
+// the tailer re-issues its query after a reconnect, it can re-read entries at
+// the timestamp it left off at; this catches those before they're sent.
+//
+// Every entry has the same TTL, so entries expire in the order they were
+// added, and we keep them in a queue to expire them cheaply. It's not
+// threadsafe.
+type dedupCache struct {
+	ttl     time.Duration
+	seen    map[dedupKey]time.Time
+	entries []dedupCacheEntry
+}
+
+func newDedupCache(ttl time.Duration) *dedupCache {
+	return &dedupCache{
+		ttl:  ttl,
+		seen: map[dedupKey]time.Time{},
+	}
+}
+
+func newDedupKey(p *Publication) dedupKey {
+	key := dedupKey{
+		namespace: p.Namespace,
+		docID:     p.DocID,
+		timestamp: p.OplogTimestamp,
+		entryIdx:  p.EntryIdx,
+		txIdx:     p.TxIdx,
+		resumeKey: p.ResumeKey,
+	}
+
+	if p.ResumeToken != nil {
+		key.resumeToken = resumeTokenID(p.ResumeToken)
+	}
+
+	return key
+}
+
+// checkAndAdd returns true if the publication was seen within the TTL.
+// Otherwise, it records the publication as seen and returns false.
+func (cache *dedupCache) checkAndAdd(p *Publication, now time.Time) bool {
+	cache.expire(now)
+
+	key := newDedupKey(p)
+	if _, ok := cache.seen[key]; ok {
+		return true
+	}
+
+	expires := now.Add(cache.ttl)
+	cache.seen[key] = expires
+	cache.entries = append(cache.entries, dedupCacheEntry{key: key, expires: expires})
+	return false
+}
+
+// Removes the entries that expired at or before now
+func (cache *dedupCache) expire(now time.Time) {
+	for len(cache.entries) > 0 && !cache.entries[0].expires.After(now) {
+		delete(cache.seen, cache.entries[0].key)
+
+		// Clear the entry so the backing array doesn't hold on to its
+		// strings; append reallocates it once it fills up
+		cache.entries[0] = dedupCacheEntry{}
+		cache.entries = cache.entries[1:]
+	}
+}
+
+// Removes duplicate publications from the batch, and returns the ones that
+// should be sent
+func (cache *dedupCache) filter(batch []*Publication, now time.Time) []*Publication {
+	filtered := batch[:0]
+	for _, p := range batch {
+		if cache.checkAndAdd(p, now) {
+			metricSuppressedDuplicates.Inc()
+			log.Log.Debugw("Suppressing duplicate publication",
+				"namespace", p.Namespace,
+				"docID", p.DocID,
+				"timestamp", p.OplogTimestamp,
+				"txIdx", p.TxIdx)
+			continue
+		}
+
+		filtered = append(filtered, p)
+	}
+
+	return filtered
+}
@@ -0,0 +1,116 @@
+package redispub
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestDedupCache(t *testing.T) {
+	start := time.Unix(1000, 0)
+	pub := func(docID string, ts uint32, txIdx uint) *Publication {
+		return &Publication{
+			Namespace:      "foo.bar",
+			DocID:          docID,
+			OplogTimestamp: primitive.Timestamp{T: ts},
+			TxIdx:          txIdx,
+		}
+	}
+
+	tests := map[string]struct {
+		first       *Publication
+		second      *Publication
+		elapsed     time.Duration
+		isDuplicate bool
+	}{
+		"Same entry within TTL": {
+			first:       pub("a", 1, 0),
+			second:      pub("a", 1, 0),
+			elapsed:     5 * time.Second,
+			isDuplicate: true,
+		},
+		"Same entry after TTL": {
+			first:       pub("a", 1, 0),
+			second:      pub("a", 1, 0),
+			elapsed:     10 * time.Second,
+			isDuplicate: false,
+		},
+		"Same timestamp on another shard": {
+			first:       pub("a", 1, 0),
+			second:      &Publication{Namespace: "foo.bar", DocID: "a", OplogTimestamp: primitive.Timestamp{T: 1}, ResumeKey: "shard2"},
+			elapsed:     5 * time.Second,
+			isDuplicate: false,
+		},
+		"Different document": {
+			first:       pub("a", 1, 0),
+			second:      pub("b", 1, 0),
+			isDuplicate: false,
+		},
+		"Different timestamp": {
+			first:       pub("a", 1, 0),
+			second:      pub("a", 2, 0),
+			isDuplicate: false,
+		},
+		"Different transaction index": {
+			first:       pub("a", 1, 0),
+			second:      pub("a", 1, 1),
+			isDuplicate: false,
+		},
+		"Different entry at the same timestamp": {
+			first: pub("a", 1, 0),
+			second: &Publication{
+				Namespace:      "foo.bar",
+				DocID:          "a",
+				OplogTimestamp: primitive.Timestamp{T: 1},
+				EntryIdx:       1,
+			},
+			isDuplicate: false,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			cache := newDedupCache(10 * time.Second)
+
+			if cache.checkAndAdd(test.first, start) {
+				t.Fatal("First publication was reported as a duplicate")
+			}
+
+			got := cache.checkAndAdd(test.second, start.Add(test.elapsed))
+			if got != test.isDuplicate {
+				t.Errorf("Got isDuplicate %v, expected %v", got, test.isDuplicate)
+			}
+		})
+	}
+}
+
+func TestDedupCacheExpiresEntries(t *testing.T) {
+	start := time.Unix(1000, 0)
+	cache := newDedupCache(time.Second)
+
+	for i := 0; i < 100; i++ {
+		cache.checkAndAdd(&Publication{OplogTimestamp: primitive.Timestamp{T: uint32(i)}}, start)
+	}
+
+	cache.expire(start.Add(time.Second))
+
+	if len(cache.seen) != 0 || len(cache.entries) != 0 {
+		t.Errorf("Expected all entries to expire, but %d remain in the map and %d in the queue",
+			len(cache.seen), len(cache.entries))
+	}
+}
+
+func TestDedupCacheFilter(t *testing.T) {
+	cache := newDedupCache(time.Minute)
+	now := time.Unix(1000, 0)
+
+	a := &Publication{DocID: "a", OplogTimestamp: primitive.Timestamp{T: 1}}
+	b := &Publication{DocID: "b", OplogTimestamp: primitive.Timestamp{T: 1}}
+	aAgain := &Publication{DocID: "a", OplogTimestamp: primitive.Timestamp{T: 1}}
+
+	got := cache.filter([]*Publication{a, b, aAgain}, now)
+	if len(got) != 2 || got[0] != a || got[1] != b {
+		t.Errorf("Expected the duplicate to be filtered out, got %v", got)
+	}
+}
@@ -0,0 +1,59 @@
+package redispub
+
+import (
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// DropBarrier records publications that were dropped before reaching the
+// publisher (see config.Backpressure), and stops the publisher from
+// recording a last-processed timestamp at or after the earliest dropped
+// one. That way, if oplogtoredis restarts, it resumes from before the
+// dropped publications (subject to the max catch-up), instead of skipping
+// them for good.
+//
+// A nil *DropBarrier never holds anything back.
+type DropBarrier struct {
+	lock sync.Mutex
+
+	// The earliest dropped timestamp for each Publication.ResumeKey
+	earliest map[string]primitive.Timestamp
+}
+
+// NewDropBarrier creates an empty DropBarrier
+func NewDropBarrier() *DropBarrier {
+	return &DropBarrier{
+		earliest: map[string]primitive.Timestamp{},
+	}
+}
+
+// Dropped records that a publication was dropped
+func (b *DropBarrier) Dropped(p *Publication) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	earliest, ok := b.earliest[p.ResumeKey]
+	if !ok || timestampBefore(p.OplogTimestamp, earliest) {
+		b.earliest[p.ResumeKey] = p.OplogTimestamp
+	}
+}
+
+// Holds returns whether the timestamp of the given publication must not be
+// recorded as the last-processed timestamp, because an earlier (or
+// simultaneous) publication from the same oplog was dropped
+func (b *DropBarrier) Holds(p *Publication) bool {
+	if b == nil {
+		return false
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	earliest, ok := b.earliest[p.ResumeKey]
+	return ok && !timestampBefore(p.OplogTimestamp, earliest)
+}
+
+func timestampBefore(a, b primitive.Timestamp) bool {
+	return a.T < b.T || (a.T == b.T && a.I < b.I)
+}
@@ -0,0 +1,44 @@
+package redispub
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestDropBarrier(t *testing.T) {
+	pub := func(key string, i uint32) *Publication {
+		return &Publication{ResumeKey: key, OplogTimestamp: primitive.Timestamp{T: 10, I: i}}
+	}
+
+	var nilBarrier *DropBarrier
+	if nilBarrier.Holds(pub("", 1)) {
+		t.Error("Expected a nil DropBarrier not to hold anything")
+	}
+
+	barrier := NewDropBarrier()
+	if barrier.Holds(pub("", 1)) {
+		t.Error("Expected an empty DropBarrier not to hold anything")
+	}
+
+	barrier.Dropped(pub("", 5))
+	barrier.Dropped(pub("", 7))
+
+	tests := map[string]struct {
+		pub      *Publication
+		expected bool
+	}{
+		"Before the earliest drop": {pub("", 4), false},
+		"At the earliest drop":     {pub("", 5), true},
+		"After the earliest drop":  {pub("", 6), true},
+		"Other resume key":         {pub("shard01", 6), false},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := barrier.Holds(test.pub); got != test.expected {
+				t.Errorf("Expected Holds to return %t, got %t", test.expected, got)
+			}
+		})
+	}
+}
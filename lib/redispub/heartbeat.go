@@ -0,0 +1,82 @@
+package redispub
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/vlasky/oplogtoredis/lib/log"
+)
+
+var metricHeartbeats = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "otr",
+	Subsystem: "redispub",
+	Name:      "heartbeats",
+	Help:      "Heartbeat messages published to OTR_HEARTBEAT_CHANNEL, partitioned by whether or not we successfully sent them. These aren't counted in otr_redispub_processed_messages.",
+}, []string{"status"})
+
+// How long we wait for each Redis server to accept a heartbeat. Heartbeats
+// are sent between batches, so this bounds how long a Redis server that's
+// down can hold up publishing.
+const heartbeatTimeout = 5 * time.Second
+
+// Returns the heartbeat message for the given time
+func heartbeatMessage(hostname string, now time.Time) ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"e":    "oplogtoredis-heartbeat",
+		"host": hostname,
+		"time": now.UTC().Format(time.RFC3339Nano),
+	})
+}
+
+// Publishes a heartbeat message to opts.HeartbeatChannel on each of the given
+// Redis clients (appending it to the stream of that name in
+// OutputModeStream). PublishStream calls this every opts.HeartbeatInterval,
+// so consumers can tell that the whole pipeline is alive even when nothing's
+// written to Mongo. Like PublishStartupPing, it bypasses deduplication and
+// doesn't affect the last-processed timestamp.
+//
+// Like regular publications, the heartbeat is sent to every client even if
+// some of them fail, and opts.WriteMode decides whether it has been sent (see
+// publishToDestinations).
+func publishHeartbeat(clients []redis.UniversalClient, opts *PublishOpts) error {
+	hostname, _ := os.Hostname()
+
+	msg, err := heartbeatMessage(hostname, time.Now())
+	if err != nil {
+		return err
+	}
+
+	return publishToDestinations(nil, clients, opts.WriteMode, func(_ []*Publication, client redis.UniversalClient) error {
+		ctx, cancel := context.WithTimeout(context.Background(), heartbeatTimeout)
+		defer cancel()
+
+		if opts.OutputMode == OutputModeStream {
+			return client.XAdd(ctx, &redis.XAddArgs{
+				Stream: opts.HeartbeatChannel,
+				MaxLen: opts.StreamMaxLen,
+				Approx: true,
+				Values: map[string]interface{}{"msg": msg},
+			}).Err()
+		}
+
+		return client.Publish(ctx, opts.HeartbeatChannel, msg).Err()
+	})
+}
+
+// Publishes a heartbeat, and records the outcome
+func sendHeartbeat(clients []redis.UniversalClient, opts *PublishOpts) {
+	if err := publishHeartbeat(clients, opts); err != nil {
+		metricHeartbeats.WithLabelValues("failed").Inc()
+		log.Log.Errorw("Error publishing heartbeat",
+			"error", err,
+			"channel", opts.HeartbeatChannel)
+		return
+	}
+
+	metricHeartbeats.WithLabelValues("sent").Inc()
+}
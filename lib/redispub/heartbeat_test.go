@@ -0,0 +1,94 @@
+package redispub
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestHeartbeatMessage(t *testing.T) {
+	msg, err := heartbeatMessage("somehost", time.Date(2021, 3, 4, 5, 6, 7, 8000000, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"e":"oplogtoredis-heartbeat","host":"somehost","time":"2021-03-04T05:06:07.008Z"}`
+	if string(msg) != expected {
+		t.Errorf("Incorrect heartbeat message. Got %s, expected %s", msg, expected)
+	}
+}
+
+func TestPublishStreamHeartbeat(t *testing.T) {
+	// miniredis doesn't support PUBLISH, so every heartbeat fails, but we
+	// can still see that they're sent on their own, and not through the sink
+	redisServer, redisClient := startMiniredis()
+	defer redisServer.Close()
+
+	sink := &fakeSink{}
+	in := make(chan *Publication)
+	stop := make(chan bool)
+	done := make(chan struct{})
+
+	failed := metricHeartbeats.WithLabelValues("failed")
+	before := testutil.ToFloat64(failed)
+
+	go func() {
+		PublishStream([]redis.UniversalClient{redisClient}, in, &PublishOpts{
+			MetadataPrefix:    "someprefix.",
+			FlushInterval:     time.Hour,
+			Sink:              sink,
+			HeartbeatInterval: 10 * time.Millisecond,
+			HeartbeatChannel:  "oplogtoredis.heartbeat",
+		}, stop)
+		close(done)
+	}()
+
+	time.Sleep(55 * time.Millisecond)
+	stop <- true
+	<-done
+
+	if sent := testutil.ToFloat64(failed) - before; sent < 2 {
+		t.Errorf("Expected at least 2 heartbeats, got %v", sent)
+	}
+
+	if len(sink.batches) != 0 {
+		t.Errorf("Expected heartbeats not to go through the sink, got %v", sink.batches)
+	}
+
+	if redisServer.Exists("someprefix.lastProcessedEntry") {
+		t.Error("Expected heartbeats not to write the last-processed timestamp")
+	}
+}
+
+func TestPublishHeartbeatTriesEveryClient(t *testing.T) {
+	// Nothing is listening for the first client, and miniredis doesn't
+	// support PUBLISH, so both fail; the second must still be tried
+	downServer, downClient := startMiniredis()
+	downServer.Close()
+
+	redisServer, redisClient := startMiniredis()
+	defer redisServer.Close()
+
+	failures0 := metricDestinationFailures.WithLabelValues("0")
+	failures1 := metricDestinationFailures.WithLabelValues("1")
+	before0 := testutil.ToFloat64(failures0)
+	before1 := testutil.ToFloat64(failures1)
+
+	err := publishHeartbeat([]redis.UniversalClient{downClient, redisClient}, &PublishOpts{
+		WriteMode:         WriteModeAny,
+		HeartbeatInterval: time.Nanosecond,
+		HeartbeatChannel:  "oplogtoredis.heartbeat",
+	})
+	if err == nil {
+		t.Error("Expected an error when every client fails")
+	}
+
+	if failures := testutil.ToFloat64(failures0) - before0; failures != 1 {
+		t.Errorf("Expected 1 failure on the first client, got %v", failures)
+	}
+	if failures := testutil.ToFloat64(failures1) - before1; failures != 1 {
+		t.Errorf("Expected 1 failure on the second client, got %v", failures)
+	}
+}
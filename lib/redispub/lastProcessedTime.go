@@ -5,6 +5,8 @@ import (
 	"time"
 
 	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
@@ -15,10 +17,14 @@ import (
 // timestamp represents (accurate to within 1 second; mongo timestamps only
 // store second resolution)
 //
+// resumeKey identifies which oplog the timestamp is for; it's empty for a
+// replica set, and the shard name when tailing a sharded cluster (see
+// Publication.ResumeKey).
+//
 // If oplogtoredis has not processed any messages, returns redis.Nil as an
 // error.
-func LastProcessedTimestamp(redisClient redis.UniversalClient, metadataPrefix string) (primitive.Timestamp, time.Time, error) {
-	str, err := redisClient.Get(context.Background(), metadataPrefix+"lastProcessedEntry").Result()
+func LastProcessedTimestamp(redisClient redis.UniversalClient, metadataPrefix string, resumeKey string) (primitive.Timestamp, time.Time, error) {
+	str, err := redisClient.Get(context.Background(), lastProcessedKey(metadataPrefix, resumeKey)).Result()
 	if err != nil {
 		return primitive.Timestamp{}, time.Unix(0, 0), err
 	}
@@ -31,3 +37,102 @@ func LastProcessedTimestamp(redisClient redis.UniversalClient, metadataPrefix st
 	time := mongoTimestampToTime(ts)
 	return ts, time, nil
 }
+
+// Returns the Redis key under which we store the last-processed timestamp
+// for the given resume key
+func lastProcessedKey(metadataPrefix string, resumeKey string) string {
+	if resumeKey == "" {
+		return metadataPrefix + "lastProcessedEntry"
+	}
+
+	return metadataPrefix + "lastProcessedEntry::" + resumeKey
+}
+
+// LastProcessedDatabaseTimestamps returns the timestamp of the last oplog
+// entry that oplogtoredis processed for each database it has published
+// changes for. These are tracked in addition to the timestamp returned by
+// LastProcessedTimestamp, so that a database that stopped being published
+// for a while (because it was removed from the allowlist, for example) can
+// resume from where it left off.
+//
+// Databases that we haven't published changes for since per-database
+// timestamps were introduced aren't included; callers should fall back to
+// LastProcessedTimestamp for those. If there are no per-database timestamps,
+// it returns an empty map.
+func LastProcessedDatabaseTimestamps(redisClient redis.UniversalClient, metadataPrefix string, resumeKey string) (map[string]primitive.Timestamp, error) {
+	databases, err := redisClient.SMembers(context.Background(), lastProcessedDatabasesKey(metadataPrefix, resumeKey)).Result()
+	if err != nil {
+		return nil, errors.Wrap(err, "listing databases with last-processed timestamps")
+	}
+
+	timestamps := make(map[string]primitive.Timestamp, len(databases))
+	for _, database := range databases {
+		str, err := redisClient.Get(context.Background(), lastProcessedDatabaseKey(metadataPrefix, resumeKey, database)).Result()
+		if err == redis.Nil {
+			continue
+		} else if err != nil {
+			return nil, errors.Wrapf(err, "getting last-processed timestamp for database %s", database)
+		}
+
+		ts, err := decodeMongoTimestamp(str)
+		if err != nil {
+			return nil, errors.Wrapf(err, "decoding last-processed timestamp for database %s", database)
+		}
+
+		timestamps[database] = ts
+	}
+
+	return timestamps, nil
+}
+
+// Returns the Redis key under which we store the last-processed timestamp for
+// the given database and resume key
+func lastProcessedDatabaseKey(metadataPrefix string, resumeKey string, database string) string {
+	if resumeKey == "" {
+		return metadataPrefix + "lastProcessedEntry::db::" + database
+	}
+
+	return metadataPrefix + "lastProcessedEntry::db::" + database + "::" + resumeKey
+}
+
+// Returns the Redis key of the set of databases that have a last-processed
+// timestamp for the given resume key
+func lastProcessedDatabasesKey(metadataPrefix string, resumeKey string) string {
+	if resumeKey == "" {
+		return metadataPrefix + "lastProcessedDatabases"
+	}
+
+	return metadataPrefix + "lastProcessedDatabases::" + resumeKey
+}
+
+// LastProcessedResumeToken returns the change stream resume token of the last
+// change event that oplogtoredis processed, when reading from a change stream
+// rather than the oplog (see Publication.ResumeToken). It's stored alongside
+// the timestamp returned by LastProcessedTimestamp, which is updated at the
+// same time.
+//
+// If oplogtoredis has not processed any change events, returns redis.Nil as
+// an error.
+func LastProcessedResumeToken(redisClient redis.UniversalClient, metadataPrefix string, resumeKey string) (bson.Raw, error) {
+	str, err := redisClient.Get(context.Background(), lastProcessedResumeTokenKey(metadataPrefix, resumeKey)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	token := bson.Raw(str)
+	if err := token.Validate(); err != nil {
+		return nil, errors.Wrap(err, "decoding resume token")
+	}
+
+	return token, nil
+}
+
+// Returns the Redis key under which we store the last-processed resume token
+// for the given resume key
+func lastProcessedResumeTokenKey(metadataPrefix string, resumeKey string) string {
+	if resumeKey == "" {
+		return metadataPrefix + "lastProcessedResumeToken"
+	}
+
+	return metadataPrefix + "lastProcessedResumeToken::" + resumeKey
+}
@@ -1,12 +1,15 @@
 package redispub
 
 import (
+	"bytes"
+	"reflect"
 	"testing"
 	"time"
 
 	"github.com/alicebob/miniredis"
 	"github.com/go-redis/redis/v8"
 	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
@@ -33,7 +36,7 @@ func TestLastProcessedTimestampSuccess(t *testing.T) {
 
 	require.NoError(t, redisServer.Set("someprefix.lastProcessedEntry", encodeMongoTimestamp(nowTS)))
 
-	gotTS, gotTime, err := LastProcessedTimestamp(redisClient, "someprefix.")
+	gotTS, gotTime, err := LastProcessedTimestamp(redisClient, "someprefix.", "")
 
 	if err != nil {
 		t.Errorf("Got unexpected error: %s", err)
@@ -52,7 +55,7 @@ func TestLastProcessedTimestampNoRecord(t *testing.T) {
 	redisServer, redisClient := startMiniredis()
 	defer redisServer.Close()
 
-	_, _, err := LastProcessedTimestamp(redisClient, "someprefix.")
+	_, _, err := LastProcessedTimestamp(redisClient, "someprefix.", "")
 
 	if err == nil {
 		t.Errorf("Expected redis.Nil error, got no error")
@@ -66,7 +69,7 @@ func TestLastProcessedTimestampInvalidRecord(t *testing.T) {
 	defer redisServer.Close()
 	require.NoError(t, redisServer.Set("someprefix.lastProcessedEntry", "not a number"))
 
-	_, _, err := LastProcessedTimestamp(redisClient, "someprefix.")
+	_, _, err := LastProcessedTimestamp(redisClient, "someprefix.", "")
 
 	if err == nil {
 		t.Errorf("Expected strconv error, got no error")
@@ -80,7 +83,7 @@ func TestLastProcessedTimestampRedisError(t *testing.T) {
 		Addrs: []string{"not a server"},
 	})
 
-	_, _, err := LastProcessedTimestamp(redisClient, "someprefix.")
+	_, _, err := LastProcessedTimestamp(redisClient, "someprefix.", "")
 
 	if err == nil {
 		t.Errorf("Expected TCP error, got no error")
@@ -88,3 +91,101 @@ func TestLastProcessedTimestampRedisError(t *testing.T) {
 		t.Errorf("Expected TCP error, got: %s", err)
 	}
 }
+
+func TestLastProcessedTimestampResumeKey(t *testing.T) {
+	shardTS := primitive.Timestamp{T: uint32(time.Now().Unix()), I: 1}
+
+	redisServer, redisClient := startMiniredis()
+	defer redisServer.Close()
+
+	require.NoError(t, redisServer.Set("someprefix.lastProcessedEntry", encodeMongoTimestamp(primitive.Timestamp{T: 1})))
+	require.NoError(t, redisServer.Set("someprefix.lastProcessedEntry::shard01", encodeMongoTimestamp(shardTS)))
+
+	gotTS, _, err := LastProcessedTimestamp(redisClient, "someprefix.", "shard01")
+	require.NoError(t, err)
+
+	if gotTS != shardTS {
+		t.Errorf("Incorrect mongo timestamp. Got %d, expected %d", gotTS, shardTS)
+	}
+
+	_, _, err = LastProcessedTimestamp(redisClient, "someprefix.", "shard02")
+	if err != redis.Nil {
+		t.Errorf("Expected redis.Nil for unknown resume key, got %s", err)
+	}
+}
+
+func TestLastProcessedResumeTokenSuccess(t *testing.T) {
+	token, err := bson.Marshal(bson.M{"_data": "8263A1B2C3000000012B022C0100296E5A1004"})
+	require.NoError(t, err)
+
+	redisServer, redisClient := startMiniredis()
+	defer redisServer.Close()
+
+	require.NoError(t, redisServer.Set("someprefix.lastProcessedResumeToken", string(token)))
+
+	gotToken, err := LastProcessedResumeToken(redisClient, "someprefix.", "")
+	require.NoError(t, err)
+
+	if !bytes.Equal(gotToken, token) {
+		t.Errorf("Incorrect resume token. Got %s, expected %s", gotToken, bson.Raw(token))
+	}
+}
+
+func TestLastProcessedResumeTokenNoRecord(t *testing.T) {
+	redisServer, redisClient := startMiniredis()
+	defer redisServer.Close()
+
+	_, err := LastProcessedResumeToken(redisClient, "someprefix.", "")
+
+	if err != redis.Nil {
+		t.Errorf("Expected redis.Nil, got %s", err)
+	}
+}
+
+func TestLastProcessedResumeTokenInvalidRecord(t *testing.T) {
+	redisServer, redisClient := startMiniredis()
+	defer redisServer.Close()
+	require.NoError(t, redisServer.Set("someprefix.lastProcessedResumeToken", "not bson"))
+
+	_, err := LastProcessedResumeToken(redisClient, "someprefix.", "")
+
+	if err == nil {
+		t.Errorf("Expected error, got nil")
+	}
+}
+
+func TestLastProcessedDatabaseTimestamps(t *testing.T) {
+	redisServer, redisClient := startMiniredis()
+	defer redisServer.Close()
+
+	fooTS := primitive.Timestamp{T: 1000, I: 1}
+	barTS := primitive.Timestamp{T: 1001, I: 2}
+
+	_, err := redisServer.SetAdd("someprefix.lastProcessedDatabases", "foo", "bar", "missing")
+	require.NoError(t, err)
+	require.NoError(t, redisServer.Set("someprefix.lastProcessedEntry::db::foo", encodeMongoTimestamp(fooTS)))
+	require.NoError(t, redisServer.Set("someprefix.lastProcessedEntry::db::bar", encodeMongoTimestamp(barTS)))
+
+	got, err := LastProcessedDatabaseTimestamps(redisClient, "someprefix.", "")
+	require.NoError(t, err)
+
+	expected := map[string]primitive.Timestamp{"foo": fooTS, "bar": barTS}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Incorrect timestamps. Got %v, expected %v", got, expected)
+	}
+}
+
+func TestLastProcessedDatabaseTimestampsNoRecord(t *testing.T) {
+	redisServer, redisClient := startMiniredis()
+	defer redisServer.Close()
+
+	// Before any per-database timestamps are written (such as just after
+	// upgrading), we get an empty map, and callers fall back to the global
+	// timestamp
+	got, err := LastProcessedDatabaseTimestamps(redisClient, "someprefix.", "")
+	require.NoError(t, err)
+
+	if len(got) != 0 {
+		t.Errorf("Expected no timestamps, got %v", got)
+	}
+}
@@ -0,0 +1,205 @@
+package redispub
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/vlasky/oplogtoredis/lib/log"
+)
+
+var metricLeader = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: "otr",
+	Subsystem: "redispub",
+	Name:      "leader",
+	Help:      "1 if this instance is the leader (see OTR_LEADER_KEY), and so is publishing, 0 if it's standing by.",
+})
+
+// This script acquires or renews the lease in KEYS[1] for the instance with
+// the ID ARGV[1], for ARGV[2] milliseconds. It returns 1 if the instance
+// holds the lease, and 0 if another instance does.
+var acquireLease = redis.NewScript(`
+	local holder = redis.call("GET", KEYS[1])
+	if holder == ARGV[1] then
+		redis.call("PEXPIRE", KEYS[1], ARGV[2])
+		return 1
+	end
+
+	if not holder then
+		redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+		return 1
+	end
+
+	return 0
+`)
+
+// This script releases the lease in KEYS[1], if it's held by the instance
+// with the ID ARGV[1]
+var releaseLease = redis.NewScript(`
+	if redis.call("GET", KEYS[1]) == ARGV[1] then
+		redis.call("DEL", KEYS[1])
+	end
+
+	return 0
+`)
+
+// Leader elects a single leader among several instances of oplogtoredis
+// sharing a Redis server, so that only one of them publishes at a time. The
+// leader holds a lease on a Redis key (set with NX and a TTL), which it
+// renews every third of the TTL; if it goes away, the lease expires and
+// another instance takes over.
+//
+// A nil *Leader is always the leader.
+type Leader struct {
+	client redis.UniversalClient
+	key    string
+	id     string
+	ttl    time.Duration
+	jitter time.Duration
+
+	lock      sync.Mutex
+	leading   bool
+	electedAt time.Time
+
+	// Closed (and replaced) whenever leading changes
+	changed chan struct{}
+}
+
+// NewLeader creates a Leader that campaigns for the lease on the given key,
+// with the given TTL. It doesn't campaign until Run is called, and then waits
+// a random duration of up to jitter before its first attempt, so that
+// instances started at the same time don't all race for the lease at once.
+func NewLeader(client redis.UniversalClient, key string, ttl time.Duration, jitter time.Duration) *Leader {
+	hostname, _ := os.Hostname()
+
+	return &Leader{
+		client:  client,
+		key:     key,
+		id:      fmt.Sprintf("%s:%d:%d", hostname, os.Getpid(), rand.Int63()),
+		ttl:     ttl,
+		jitter:  jitter,
+		changed: make(chan struct{}),
+	}
+}
+
+// Run campaigns for the lease, and renews it while we hold it, until it
+// receives a message on the stop channel. It then releases the lease, if we
+// hold it, so another instance can take over straight away.
+func (leader *Leader) Run(stop <-chan bool) {
+	if leader.jitter > 0 {
+		select {
+		case <-stop:
+			return
+		case <-time.After(time.Duration(rand.Int63n(int64(leader.jitter) + 1))):
+		}
+	}
+
+	for {
+		leader.campaign()
+
+		select {
+		case <-stop:
+			leader.resign()
+			return
+		case <-time.After(leader.ttl / 3):
+		}
+	}
+}
+
+// Leading returns whether we're the leader
+func (leader *Leader) Leading() bool {
+	if leader == nil {
+		return true
+	}
+
+	leader.lock.Lock()
+	defer leader.lock.Unlock()
+
+	return leader.leading
+}
+
+// ElectedAt returns when we last became the leader, or the zero time if we
+// never have
+func (leader *Leader) ElectedAt() time.Time {
+	if leader == nil {
+		return time.Time{}
+	}
+
+	leader.lock.Lock()
+	defer leader.lock.Unlock()
+
+	return leader.electedAt
+}
+
+// Changed returns a channel that's closed the next time we become, or stop
+// being, the leader
+func (leader *Leader) Changed() <-chan struct{} {
+	leader.lock.Lock()
+	defer leader.lock.Unlock()
+
+	return leader.changed
+}
+
+// Acquires or renews the lease. If we can't tell whether we hold it, because
+// Redis returned an error, we stand down: the lease may have expired, and we
+// mustn't publish alongside another leader.
+func (leader *Leader) campaign() {
+	ctx, cancel := context.WithTimeout(context.Background(), leader.ttl/3)
+	defer cancel()
+
+	held, err := acquireLease.Run(ctx, leader.client, []string{leader.key}, leader.id, leader.ttl.Milliseconds()).Int()
+	if err != nil {
+		log.Log.Errorw("Error acquiring or renewing the leader lease",
+			"error", err,
+			"key", leader.key)
+	}
+
+	leader.setLeading(err == nil && held == 1)
+}
+
+// Releases the lease, if we hold it
+func (leader *Leader) resign() {
+	if !leader.Leading() {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), leader.ttl/3)
+	defer cancel()
+
+	err := releaseLease.Run(ctx, leader.client, []string{leader.key}, leader.id).Err()
+	if err != nil {
+		log.Log.Errorw("Error releasing the leader lease. Another instance will take over when it expires.",
+			"error", err,
+			"key", leader.key)
+	}
+
+	leader.setLeading(false)
+}
+
+func (leader *Leader) setLeading(leading bool) {
+	leader.lock.Lock()
+	defer leader.lock.Unlock()
+
+	if leading == leader.leading {
+		return
+	}
+
+	leader.leading = leading
+	close(leader.changed)
+	leader.changed = make(chan struct{})
+
+	if leading {
+		leader.electedAt = time.Now()
+		metricLeader.Set(1)
+		log.Log.Warnw("Became the leader; starting to publish", "key", leader.key)
+	} else {
+		metricLeader.Set(0)
+		log.Log.Warnw("No longer the leader; standing by", "key", leader.key)
+	}
+}
@@ -0,0 +1,98 @@
+package redispub
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLeader(t *testing.T) {
+	redisServer, redisClient := startMiniredis()
+	defer redisServer.Close()
+
+	first := NewLeader(redisClient, "someprefix.leader", 30*time.Second, 0)
+	second := NewLeader(redisClient, "someprefix.leader", 30*time.Second, 0)
+
+	firstChanged := first.Changed()
+	first.campaign()
+	second.campaign()
+
+	if !first.Leading() || second.Leading() {
+		t.Fatalf("Expected only the first instance to lead, got %t and %t", first.Leading(), second.Leading())
+	}
+
+	select {
+	case <-firstChanged:
+	default:
+		t.Error("Expected the first instance's Changed channel to be closed when it became the leader")
+	}
+
+	// Renewing keeps the lease
+	redisServer.FastForward(20 * time.Second)
+	first.campaign()
+	redisServer.FastForward(20 * time.Second)
+	second.campaign()
+	if !first.Leading() || second.Leading() {
+		t.Fatalf("Expected the first instance to keep the lease, got %t and %t", first.Leading(), second.Leading())
+	}
+
+	// If the leader goes away, the lease expires and the other takes over
+	redisServer.FastForward(31 * time.Second)
+	second.campaign()
+	if !second.Leading() {
+		t.Fatal("Expected the second instance to take over once the lease expired")
+	}
+
+	first.campaign()
+	if first.Leading() {
+		t.Error("Expected the first instance to stand by once it lost the lease")
+	}
+
+	// Resigning hands over straight away
+	second.resign()
+	if second.Leading() {
+		t.Error("Expected the second instance to stand by after resigning")
+	}
+
+	first.campaign()
+	if !first.Leading() {
+		t.Error("Expected the first instance to take over after the second resigned")
+	}
+}
+
+func TestLeaderRedisError(t *testing.T) {
+	redisServer, redisClient := startMiniredis()
+
+	leader := NewLeader(redisClient, "someprefix.leader", 30*time.Second, 0)
+	leader.campaign()
+	if !leader.Leading() {
+		t.Fatal("Expected to become the leader")
+	}
+
+	redisServer.Close()
+	leader.campaign()
+	if leader.Leading() {
+		t.Error("Expected to stand down when the lease can't be renewed")
+	}
+}
+
+func TestLeaderStartupJitter(t *testing.T) {
+	redisServer, redisClient := startMiniredis()
+	defer redisServer.Close()
+
+	// Stopping while waiting to campaign returns without taking the lease
+	leader := NewLeader(redisClient, "someprefix.leader", 30*time.Second, time.Hour)
+	stop := make(chan bool, 1)
+	stop <- true
+	leader.Run(stop)
+
+	if leader.Leading() || redisServer.Exists("someprefix.leader") {
+		t.Error("Expected not to campaign while waiting for the startup jitter")
+	}
+}
+
+func TestNilLeader(t *testing.T) {
+	var leader *Leader
+	if !leader.Leading() {
+		t.Error("Expected a nil Leader to always lead")
+	}
+}
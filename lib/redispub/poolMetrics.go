@@ -0,0 +1,54 @@
+package redispub
+
+import (
+	"strconv"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	poolConnectionsDesc = prometheus.NewDesc(
+		"otr_redis_pool_connections",
+		"Connections in the connection pool for each Redis server, partitioned by the index of the server in OTR_REDIS_URL and by state (idle or in_use). If in_use stays at OTR_REDIS_POOL_SIZE, publishing is waiting for connections.",
+		[]string{"destination", "state"}, nil)
+
+	poolTimeoutsDesc = prometheus.NewDesc(
+		"otr_redis_pool_timeouts_total",
+		"Number of times we gave up waiting for a connection from the pool for a Redis server, partitioned by the index of the server in OTR_REDIS_URL.",
+		[]string{"destination"}, nil)
+)
+
+// PoolCollector is a prometheus.Collector that reports the connection pool
+// stats of the Redis clients we publish to. Register it with
+// prometheus.MustRegister.
+type PoolCollector struct {
+	clients []redis.UniversalClient
+}
+
+// NewPoolCollector returns a PoolCollector for the given clients, which
+// should be in the same order as OTR_REDIS_URL
+func NewPoolCollector(clients []redis.UniversalClient) *PoolCollector {
+	return &PoolCollector{clients: clients}
+}
+
+// Describe implements prometheus.Collector
+func (collector *PoolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- poolConnectionsDesc
+	ch <- poolTimeoutsDesc
+}
+
+// Collect implements prometheus.Collector
+func (collector *PoolCollector) Collect(ch chan<- prometheus.Metric) {
+	for i, client := range collector.clients {
+		destination := strconv.Itoa(i)
+		stats := client.PoolStats()
+
+		ch <- prometheus.MustNewConstMetric(poolConnectionsDesc, prometheus.GaugeValue,
+			float64(stats.IdleConns), destination, "idle")
+		ch <- prometheus.MustNewConstMetric(poolConnectionsDesc, prometheus.GaugeValue,
+			float64(stats.TotalConns-stats.IdleConns), destination, "in_use")
+		ch <- prometheus.MustNewConstMetric(poolTimeoutsDesc, prometheus.CounterValue,
+			float64(stats.Timeouts), destination)
+	}
+}
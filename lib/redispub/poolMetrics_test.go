@@ -0,0 +1,33 @@
+package redispub
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPoolCollector(t *testing.T) {
+	redisServer, redisClient := startMiniredis()
+	defer redisServer.Close()
+
+	// Open a connection and return it to the pool
+	require.NoError(t, redisClient.Ping(context.Background()).Err())
+
+	collector := NewPoolCollector([]redis.UniversalClient{redisClient})
+
+	expected := `
+# HELP otr_redis_pool_connections Connections in the connection pool for each Redis server, partitioned by the index of the server in OTR_REDIS_URL and by state (idle or in_use). If in_use stays at OTR_REDIS_POOL_SIZE, publishing is waiting for connections.
+# TYPE otr_redis_pool_connections gauge
+otr_redis_pool_connections{destination="0",state="idle"} 1
+otr_redis_pool_connections{destination="0",state="in_use"} 0
+# HELP otr_redis_pool_timeouts_total Number of times we gave up waiting for a connection from the pool for a Redis server, partitioned by the index of the server in OTR_REDIS_URL.
+# TYPE otr_redis_pool_timeouts_total counter
+otr_redis_pool_timeouts_total{destination="0"} 0
+`
+
+	require.NoError(t, testutil.CollectAndCompare(collector, strings.NewReader(expected)))
+}
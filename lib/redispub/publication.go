@@ -1,13 +1,19 @@
 package redispub
 
 import (
+	"strings"
+	"time"
+
+	"github.com/vlasky/oplogtoredis/lib/tracing"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 // Publication represents a message to be sent to Redis about an
 // oplog entry.
 type Publication struct {
-	// The two channels to send the message to
+	// The two channels to send the message to. SpecificChannel may be empty,
+	// in which case the message is only sent to CollectionChannel.
 	CollectionChannel string
 	SpecificChannel   string
 
@@ -19,6 +25,67 @@ type Publication struct {
 	// see https://docs.mongodb.com/manual/reference/bson-types/#timestamps
 	OplogTimestamp primitive.Timestamp
 
+	// Namespace and DocID identify the document the oplog entry is about
+	// (DocID is empty for events that aren't about a single document, such
+	// as a collection being dropped). They're used to deduplicate
+	// publications in memory; see PublishOpts.DedupTTL.
+	Namespace string
+	DocID     string
+
+	// Operation and CollectionLabel are the operation and collection labels
+	// of otr_publications_total. Operation is the kind of change (e.g.
+	// "insert" or "drop"), and CollectionLabel is the collection of
+	// Namespace, limited like the other per-collection metrics (see
+	// oplog.CollectionLabels), or empty if they aren't labeled by collection.
+	Operation       string
+	CollectionLabel string
+
 	// TxIdx is the index of the operation within a transaction. Used to supplement OplogTimestamp in a transaction.
 	TxIdx uint
+
+	// EntryIdx is the index of the oplog entry among the entries that share
+	// its OplogTimestamp. Timestamps are meant to be unique, so it's almost
+	// always 0; when they aren't, it keeps the deduplication keys of the
+	// entries apart, so that a later one isn't mistaken for a duplicate of
+	// an earlier one.
+	EntryIdx uint
+
+	// ResumeKey identifies the oplog this publication came from, so that we
+	// track the last-processed timestamp separately for each shard of a
+	// sharded cluster. It's empty when tailing a replica set.
+	ResumeKey string
+
+	// ResumeToken is the resume token of the change stream event this
+	// publication came from, when reading from a change stream rather than
+	// the oplog. It's persisted so we can resume the change stream, and
+	// it replaces OplogTimestamp in the deduplication key (timestamps aren't
+	// unique across the events of a transaction, and TxIdx can't be
+	// reconstructed when resuming in the middle of one).
+	ResumeToken bson.Raw
+
+	// TimestampOnly marks a publication that has no message to send, and only
+	// advances the last-processed timestamp (for example, for a noop oplog
+	// entry). Only OplogTimestamp and ResumeKey are set.
+	TimestampOnly bool
+
+	// TxContinues is set on each publication of a transaction, except the
+	// last, when the transaction's publications must be published together
+	// (see config.TransactionAtomic). PublishStream doesn't end a batch until
+	// it has the rest of the transaction.
+	TxContinues bool
+
+	// EnqueuedAt is when the tailer put the publication in the channel to
+	// PublishStream, so we can tell how long it waited there (see
+	// otr_publish_queue_wait_seconds). It's zero if the publication didn't
+	// come from the tailer.
+	EnqueuedAt time.Time
+
+	// Span traces the oplog entry from when it was read until it's been
+	// published (or we've given up on it). It's nil when tracing is disabled.
+	Span *tracing.Span
+}
+
+// Database returns the database part of the publication's Namespace
+func (p *Publication) Database() string {
+	return strings.SplitN(p.Namespace, ".", 2)[0]
 }
@@ -6,10 +6,14 @@ package redispub
 
 import (
 	"context"
+	"encoding/hex"
 	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/vlasky/oplogtoredis/lib/log"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 
 	"github.com/go-redis/redis/v8"
@@ -23,16 +27,161 @@ type PublishOpts struct {
 	FlushInterval    time.Duration
 	DedupeExpiration time.Duration
 	MetadataPrefix   string
+
+	// WriteMode controls whether a message must be published to all of the
+	// Redis clients (WriteModeAll) or just one of them (WriteModeAny) to be
+	// considered sent. Defaults to WriteModeAll.
+	WriteMode string
+
+	// OutputMode controls whether messages are sent with PUBLISH
+	// (OutputModePubSub) or appended to Redis Streams named after the
+	// channels with XADD (OutputModeStream). Defaults to OutputModePubSub.
+	// With OutputModeKafka, the Sink must be set to a Kafka sink (see
+	// NewKafkaSink).
+	OutputMode string
+
+	// StreamMaxLen caps the length of each stream in OutputModeStream, using
+	// approximate trimming. Zero means streams are not trimmed.
+	StreamMaxLen int64
+
+	// StreamDocumentStreams makes OutputModeStream also append each message
+	// to the stream of its SpecificChannel (one per document, unless
+	// SkipDocumentChannels is set). Those streams never expire, so there's
+	// one in Redis for every document that has ever changed; by default, we
+	// only append to the collection's stream.
+	StreamDocumentStreams bool
+
+	// SlowPublishThreshold is the duration after which we log a warning
+	// about a single publish. Zero disables the warning.
+	SlowPublishThreshold time.Duration
+
+	// BatchSize is the maximum number of messages to send to Redis in a
+	// single pipeline. Values less than 2 disable batching.
+	BatchSize int
+
+	// BatchWindow is how long to wait for more messages to fill a batch
+	// after receiving the first. If zero, we batch only the messages that
+	// are already waiting to be sent.
+	BatchWindow time.Duration
+
+	// DedupTTL is how long we remember each publication in memory, to
+	// suppress duplicates (such as entries re-read by the tailer after it
+	// reconnects) before they're sent to Redis. Zero disables the in-memory
+	// deduplication; the Redis-side deduplication controlled by
+	// DedupeExpiration always applies.
+	DedupTTL time.Duration
+
+	// SkipDocumentChannels disables publishing to each publication's
+	// SpecificChannel (the per-document channel), so messages are only sent
+	// to the CollectionChannel. This halves the number of messages, but
+	// redis-oplog subscriptions that target specific document IDs won't see
+	// any changes.
+	SkipDocumentChannels bool
+
+	// DropBarrier, if set, tracks publications that the tailer dropped
+	// because the publisher couldn't keep up. We don't advance the
+	// last-processed timestamp past any of them.
+	DropBarrier *DropBarrier
+
+	// DeadLetterKey, if set, is a Redis list to which we append the
+	// publications we give up on publishing, so they can be inspected and
+	// replayed. See writeDeadLetters.
+	DeadLetterKey string
+
+	// Sink, if set, replaces the Redis clients passed to PublishStream as
+	// the destination of publications. See Sink.
+	Sink Sink
+
+	// DryRun, if set, makes PublishStream log the publications instead of
+	// publishing them (overriding Sink), and not write the last-processed
+	// timestamp
+	DryRun bool
+
+	// SelfTest, if set, is told about every publication that's published.
+	// See SelfTest.
+	SelfTest *SelfTest
+
+	// Compression, if set to CompressionGzip or CompressionZstd, compresses
+	// the messages that are at least CompressionThreshold bytes. Compressed
+	// messages start with CompressedPrefixGzip or CompressedPrefixZstd, so
+	// this changes the wire format: every consumer must be able to
+	// decompress them. Defaults to CompressionNone.
+	Compression          string
+	CompressionThreshold int
+
+	// MaxPublishRate, if positive, is the most messages per second we send
+	// for any one collection. Beyond that, the collection's messages are
+	// replaced by refetch notifications; see rateLimiter.
+	MaxPublishRate int
+
+	// CatchUpMaxRate, if positive, is the most messages per second we send
+	// while the messages we're sending are more than CatchUpLagThreshold
+	// old, so that replaying a backlog doesn't flood Redis. Messages over
+	// the limit are delayed; see catchUpLimiter.
+	CatchUpMaxRate      int
+	CatchUpLagThreshold time.Duration
+
+	// ResumeKeyPersist makes us PERSIST the last-processed keys every time
+	// we write them, so that nothing else can leave an expiration on them
+	// (and make them candidates for eviction under a volatile-* maxmemory
+	// policy). SET clears a key's expiration, but SADD doesn't, so this
+	// matters most for the set of databases with per-database timestamps.
+	ResumeKeyPersist bool
+
+	// HeartbeatInterval, if positive, is how often we publish a heartbeat
+	// message to HeartbeatChannel, whether or not there's anything else to
+	// publish. See publishHeartbeat.
+	HeartbeatInterval time.Duration
+	HeartbeatChannel  string
 }
 
+// Values for PublishOpts.WriteMode
+const (
+	WriteModeAll = "all"
+	WriteModeAny = "any"
+)
+
+// Values for PublishOpts.OutputMode
+const (
+	OutputModePubSub = "pubsub"
+	OutputModeStream = "stream"
+	OutputModeKafka  = "kafka"
+)
+
 // This script checks whether KEYS[1] is set. If it is, it does nothing. It not,
 // it sets the key, using ARGV[1] as the expiration, and then publishes the
-// message ARGV[2] to channels ARGV[3] and ARGV[4].
+// message ARGV[2] to channels ARGV[3] and ARGV[4] (if ARGV[4] is non-empty).
 var publishDedupe = redis.NewScript(`
 	if redis.call("GET", KEYS[1]) == false then
 		redis.call("SETEX", KEYS[1], ARGV[1], 1)
 		redis.call("PUBLISH", ARGV[3], ARGV[2])
-		redis.call("PUBLISH", ARGV[4], ARGV[2])
+		if ARGV[4] ~= "" then
+			redis.call("PUBLISH", ARGV[4], ARGV[2])
+		end
+	end
+
+	return true
+`)
+
+// This script is the same as publishDedupe, but appends the message to the
+// streams ARGV[3] and ARGV[4] (if ARGV[4] is non-empty) as the field "msg",
+// instead of publishing it. If ARGV[5] is greater than 0, the streams are
+// trimmed to approximately that many entries.
+var streamDedupe = redis.NewScript(`
+	local function add(stream)
+		if tonumber(ARGV[5]) > 0 then
+			redis.call("XADD", stream, "MAXLEN", "~", ARGV[5], "*", "msg", ARGV[2])
+		else
+			redis.call("XADD", stream, "*", "msg", ARGV[2])
+		end
+	end
+
+	if redis.call("GET", KEYS[1]) == false then
+		redis.call("SETEX", KEYS[1], ARGV[1], 1)
+		add(ARGV[3])
+		if ARGV[4] ~= "" then
+			add(ARGV[4])
+		end
 	end
 
 	return true
@@ -45,6 +194,42 @@ var metricSentMessages = promauto.NewCounterVec(prometheus.CounterOpts{
 	Help:      "Messages processed by Redis publisher, partitioned by whether or not we successfully sent them",
 }, []string{"status"})
 
+var metricPublications = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "otr",
+	Name:      "publications_total",
+	Help:      "Messages successfully published, partitioned by database, collection (if OTR_METRIC_COLLECTION_LABEL is set), and operation. Unlike otr_oplog_entries_by_size, this doesn't include the oplog entries we filtered out or ignored.",
+}, []string{"database", "collection", "operation"})
+
+var metricDestinationFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "otr",
+	Subsystem: "redispub",
+	Name:      "destination_failures",
+	Help:      "Number of failures encountered when trying to send a message to a single Redis server, partitioned by the index of the server in OTR_REDIS_URL.",
+}, []string{"destination"})
+
+var metricPublishDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: "otr",
+	Subsystem: "redis",
+	Name:      "publish_duration_seconds",
+	Help:      "Time taken to publish a single message or batch of messages to Redis (to all destinations, not including retries), partitioned by outcome (success or error)",
+	Buckets:   prometheus.ExponentialBuckets(0.0001, 2, 18),
+}, []string{"outcome"})
+
+var metricQueueWait = promauto.NewHistogram(prometheus.HistogramOpts{
+	Namespace: "otr",
+	Name:      "publish_queue_wait_seconds",
+	Help:      "Time publications waited in the channel between the oplog tailer and the Redis publisher. If it's high, Redis is the bottleneck; if it's low while the oplog lag is high, reading from Mongo is.",
+	Buckets:   prometheus.ExponentialBuckets(0.0001, 2, 18),
+})
+
+var metricBatchSize = promauto.NewHistogram(prometheus.HistogramOpts{
+	Namespace: "otr",
+	Subsystem: "redispub",
+	Name:      "batch_size",
+	Help:      "Number of messages sent to Redis in each batch. Divide the sum by the count to get the average batch size.",
+	Buckets:   prometheus.ExponentialBuckets(1, 2, 12),
+})
+
 var metricTemporaryFailures = promauto.NewCounter(prometheus.CounterOpts{
 	Namespace: "otr",
 	Subsystem: "redispub",
@@ -52,58 +237,438 @@ var metricTemporaryFailures = promauto.NewCounter(prometheus.CounterOpts{
 	Help:      "Number of failures encountered when trying to send a message. We automatically retry, and only register a permanent failure (in otr_redispub_processed_messages) after 30 failures.",
 })
 
+var metricSuppressedDuplicates = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: "otr",
+	Subsystem: "redispub",
+	Name:      "suppressed_duplicates",
+	Help:      "Number of publications that were not sent because the in-memory deduplication cache (OTR_DEDUP_TTL) had already seen them.",
+})
+
+var metricResumeKeyVanished = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "otr",
+	Subsystem: "redispub",
+	Name:      "resume_key_vanished",
+	Help:      "Number of times a last-processed timestamp key that we had written was missing from Redis the next time we wrote it, partitioned by the index of the server in OTR_REDIS_URL. This usually means Redis evicted it; if oplogtoredis restarted while it was missing, it would start from the end of the oplog.",
+}, []string{"destination"})
+
+// How many times we try to publish a batch before giving up on it, and how
+// long we wait between attempts (doubling each time, up to the max)
+const (
+	publishMaxRetries        = 10
+	publishRetryInitialDelay = 100 * time.Millisecond
+	publishRetryMaxDelay     = 5 * time.Second
+)
+
 // PublishStream reads Publications from the given channel and publishes them
-// to Redis.
-func PublishStream(client redis.UniversalClient, in <-chan *Publication, opts *PublishOpts, stop <-chan bool) {
+// to each of the given Redis clients (or to opts.Sink, if it's set; the
+// last-processed timestamp is still written to the Redis clients). With
+// opts.DryRun, nothing is written to Redis at all.
+//
+// Publications that arrive together are sent in batches of up to
+// opts.BatchSize, using a single Redis pipeline per batch.
+//
+// When it receives a message on the stop channel, PublishStream publishes the
+// publications already waiting on the input channel, writes the final
+// last-processed timestamp, and then returns. To avoid dropping
+// publications, the producer should be stopped first. A second message on
+// the stop channel cuts the draining short, so the final timestamp can
+// still be written when shutdown is taking too long.
+func PublishStream(clients []redis.UniversalClient, in <-chan *Publication, opts *PublishOpts, stop <-chan bool) {
 	// Start up a background goroutine for periodically updating the last-processed
 	// timestamp
-	timestampC := make(chan primitive.Timestamp)
-	go periodicallyUpdateTimestamp(client, timestampC, opts)
+	timestampC := make(chan resumePoint)
+	timestampDone := make(chan struct{})
+	go func() {
+		periodicallyUpdateTimestamp(clients, timestampC, opts)
+		close(timestampDone)
+	}()
 
-	// Redis expiration is in integer seconds, so we have to convert the
-	// time.Duration
-	dedupeExpirationSeconds := int(opts.DedupeExpiration.Seconds())
+	sink := opts.Sink
+	if opts.DryRun {
+		sink = dryRunSink{}
+	} else if sink == nil {
+		sink = NewRedisSink(clients, opts)
+	}
 
-	publishFn := func(p *Publication) error {
-		return publishSingleMessage(p, client, opts.MetadataPrefix, dedupeExpirationSeconds)
+	publishFn := func(batch []*Publication) error {
+		start := time.Now()
+
+		err := sink.Publish(batch)
+
+		recordPublishDuration(batch, time.Since(start), err, opts.SlowPublishThreshold)
+		return err
 	}
 
 	metricSendFailed := metricSentMessages.WithLabelValues("failed")
 	metricSendSuccess := metricSentMessages.WithLabelValues("sent")
 
+	var dedup *dedupCache
+	if opts.DedupTTL > 0 {
+		dedup = newDedupCache(opts.DedupTTL)
+	}
+
+	var limiter *rateLimiter
+	var noticeTick <-chan time.Time
+	if opts.MaxPublishRate > 0 {
+		limiter = newRateLimiter(opts.MaxPublishRate)
+
+		ticker := time.NewTicker(rateLimitNoticeInterval)
+		defer ticker.Stop()
+		noticeTick = ticker.C
+	}
+
+	// Heartbeats go straight to Redis, so there are none in dry runs
+	var heartbeatTick <-chan time.Time
+	if opts.HeartbeatInterval > 0 && !opts.DryRun {
+		ticker := time.NewTicker(opts.HeartbeatInterval)
+		defer ticker.Stop()
+		heartbeatTick = ticker.C
+	}
+
+	// Set when we get a message on stop while we're waiting to stay within
+	// the catch-up rate. We stop waiting and publish the batch, and then act
+	// on the stop as if we'd got it between batches.
+	stopRequested := false
+
+	var catchUp *catchUpLimiter
+	if opts.CatchUpMaxRate > 0 {
+		catchUp = newCatchUpLimiter(opts.CatchUpMaxRate, opts.CatchUpLagThreshold)
+
+		// A full batch can take many seconds to be allowed out, so we keep
+		// sending heartbeats, and don't hold up stopping
+		catchUp.sleep = func(d time.Duration) {
+			timer := time.NewTimer(d)
+			defer timer.Stop()
+
+			for {
+				select {
+				case <-timer.C:
+					return
+				case <-stop:
+					stopRequested = true
+					return
+				case <-heartbeatTick:
+					sendHeartbeat(clients, opts)
+				}
+			}
+		}
+	}
+
+	// Publishes a batch of publications, along with any refetch
+	// notifications that are due. The batch may be empty, to send just the
+	// notifications; if stopping is set, every pending notification is sent.
+	publishBatch := func(batch []*Publication, stopping bool) {
+		now := time.Now()
+		recordQueueWait(batch, now)
+		if dedup != nil {
+			batch = dedup.filter(batch, now)
+		}
+
+		messages := withoutTimestampOnly(batch)
+		if limiter != nil {
+			// The throttled publications stay in the batch, so that they
+			// still advance the last-processed timestamp
+			messages = append(limiter.filter(messages, now), limiter.notices(now, stopping)...)
+		}
+
+		if len(batch) == 0 && len(messages) == 0 {
+			return
+		}
+
+		if catchUp != nil {
+			catchUp.wait(messages, now)
+		}
+
+		var err error
+		if len(messages) > 0 {
+			metricBatchSize.Observe(float64(len(messages)))
+			compressMessages(messages, opts)
+
+			err = publishWithRetries(messages, publishMaxRetries, publishRetryInitialDelay, publishRetryMaxDelay, publishFn)
+			endSpans(messages, err)
+		}
+
+		if err != nil {
+			metricSendFailed.Add(float64(len(messages)))
+			log.Log.Errorw("Permanent error while trying to publish messages; giving up",
+				"error", err,
+				"messages", messages)
+
+			if opts.DeadLetterKey != "" {
+				writeDeadLetters(clients, opts.DeadLetterKey, messages, err)
+			}
+
+			return
+		}
+
+		opts.SelfTest.observe(messages)
+
+		if opts.DryRun {
+			// Nothing was sent, and the last-processed timestamp must stay
+			// where it is, so that a real run resumes from the right place
+			return
+		}
+
+		metricSendSuccess.Add(float64(len(messages)))
+		for _, p := range messages {
+			metricPublications.WithLabelValues(p.Database(), p.CollectionLabel, p.Operation).Inc()
+		}
+
+		// We want to make sure we do this *after* we've successfully published
+		// the messages
+		for _, p := range batch {
+			if opts.DropBarrier.Holds(p) {
+				continue
+			}
+			timestampC <- resumePoint{key: p.ResumeKey, database: p.Database(), timestamp: p.OplogTimestamp, token: p.ResumeToken}
+		}
+	}
+
+	// Publishes the batch starting with p, and returns whether we got a
+	// message on stop while collecting it
+	publishFrom := func(p *Publication) bool {
+		batch, stopped := collectBatch(p, in, opts.BatchSize, opts.BatchWindow, stop)
+		publishBatch(batch, false)
+		return stopped
+	}
+
+	// Drains the buffered publications (unless draining is already cut
+	// short) and writes the final last-processed timestamp
+	finish := func(drain bool) {
+		if drain {
+			log.Log.Infow("Draining buffered publications before stopping",
+				"count", len(in))
+
+			drainPublications(in, stop, func(p *Publication) bool {
+				return publishFrom(p) || stopRequested
+			})
+		}
+
+		if limiter != nil {
+			publishBatch(nil, true)
+		}
+
+		// Closing the channel makes the timestamp updater write out the
+		// final timestamp
+		close(timestampC)
+		<-timestampDone
+	}
+
+	for {
+		select {
+		case <-stop:
+			finish(true)
+			return
+
+		case p := <-in:
+			if publishFrom(p) {
+				// A transaction was cut short, so the rest of the buffer
+				// can't be published in order
+				finish(false)
+				return
+			}
+
+		case <-noticeTick:
+			publishBatch(nil, false)
+
+		case <-heartbeatTick:
+			sendHeartbeat(clients, opts)
+		}
+
+		if stopRequested {
+			// Like the first message on stop above, this one means we
+			// should drain the buffer, which the next one cuts short
+			stopRequested = false
+			finish(true)
+			return
+		}
+	}
+}
+
+// Calls publish with each publication left in the channel, until it's empty
+// or we get another message on stop (because shutdown is taking too long),
+// either here or while publish waits for one (in which case it returns
+// true). Then the rest aren't published, and the last-processed timestamp
+// only covers the ones that were, so they're published after restarting.
+func drainPublications(in <-chan *Publication, stop <-chan bool, publish func(*Publication) bool) {
 	for {
+		// Check for a stop first, so a full channel can't keep us draining
 		select {
 		case <-stop:
-			close(timestampC)
+			log.Log.Warnw("Stopped draining buffered publications before the buffer was empty; they'll be published after restarting",
+				"remaining", len(in))
 			return
+		default:
+		}
 
+		select {
 		case p := <-in:
-			err := publishSingleMessageWithRetries(p, 30, time.Second, publishFn)
-
-			if err != nil {
-				metricSendFailed.Inc()
-				log.Log.Errorw("Permanent error while trying to publish message; giving up",
-					"error", err,
-					"message", p)
-			} else {
-				metricSendSuccess.Inc()
-
-				// We want to make sure we do this *after* we've successfully published
-				// the messages
-				timestampC <- p.OplogTimestamp
+			if publish(p) {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+// Records how long each publication in the batch waited to be read from the
+// channel
+func recordQueueWait(batch []*Publication, now time.Time) {
+	for _, p := range batch {
+		if !p.EnqueuedAt.IsZero() {
+			metricQueueWait.Observe(now.Sub(p.EnqueuedAt).Seconds())
+		}
+	}
+}
+
+// Returns the publications in batch that have messages to send, leaving out
+// the ones that only advance the last-processed timestamp
+func withoutTimestampOnly(batch []*Publication) []*Publication {
+	messages := batch[:0:0]
+	for _, p := range batch {
+		if !p.TimestampOnly {
+			messages = append(messages, p)
+		}
+	}
+
+	return messages
+}
+
+// Finishes the trace spans of a batch of publications, recording the
+// outcome of publishing it
+func endSpans(batch []*Publication, err error) {
+	for _, p := range batch {
+		if p.Span == nil {
+			continue
+		}
+
+		p.Span.SetAttribute("oplogtoredis.batch_size", len(batch))
+		if err != nil {
+			p.Span.SetAttribute("error", true)
+			p.Span.SetAttribute("error.message", err.Error())
+		}
+		p.Span.End()
+	}
+}
+
+// Collects a batch of publications, starting with first. We add any
+// publications that arrive on in within window of the first one, up to a
+// total of maxSize. If window is zero, we only add publications that are
+// already waiting on in.
+//
+// A batch never ends partway through a transaction (see
+// Publication.TxContinues): once we've reached maxSize or window, we keep
+// waiting for publications until every transaction in the batch is complete,
+// so the batch may be larger than maxSize. If we get a message on stop while
+// we wait, we leave the incomplete transactions out of the batch, so the
+// last-processed timestamp stays before them and they're published in full
+// after restarting, and return true.
+func collectBatch(first *Publication, in <-chan *Publication, maxSize int, window time.Duration, stop <-chan bool) ([]*Publication, bool) {
+	batch := []*Publication{}
+
+	// The resume keys (i.e. shards) that have a transaction in the batch we
+	// don't have all the publications for yet, and the index in the batch
+	// of the transaction's first publication. Different shards'
+	// publications may be interleaved, but each shard's are in order.
+	openTransactions := map[string]int{}
+	add := func(p *Publication) {
+		if _, open := openTransactions[p.ResumeKey]; !open && p.TxContinues {
+			openTransactions[p.ResumeKey] = len(batch)
+		} else if !p.TxContinues {
+			delete(openTransactions, p.ResumeKey)
+		}
+		batch = append(batch, p)
+	}
+	add(first)
+
+	var deadline <-chan time.Time
+	if window > 0 {
+		timer := time.NewTimer(window)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+collect:
+	for len(batch) < maxSize {
+		if deadline == nil {
+			select {
+			case p := <-in:
+				add(p)
+			default:
+				break collect
+			}
+		} else {
+			select {
+			case p := <-in:
+				add(p)
+			case <-deadline:
+				break collect
 			}
 		}
 	}
+
+	for len(openTransactions) > 0 {
+		select {
+		case p := <-in:
+			add(p)
+		case <-stop:
+			log.Log.Warnw("Stopping while waiting for the rest of a transaction; it will be published after restarting",
+				"shards", len(openTransactions))
+			return withoutOpenTransactions(batch, openTransactions), true
+		}
+	}
+
+	return batch, false
+}
+
+// Returns the publications in batch that aren't part of the open
+// transactions (see collectBatch)
+func withoutOpenTransactions(batch []*Publication, openTransactions map[string]int) []*Publication {
+	complete := batch[:0:0]
+	for i, p := range batch {
+		if start, open := openTransactions[p.ResumeKey]; open && i >= start {
+			continue
+		}
+		complete = append(complete, p)
+	}
+
+	return complete
 }
 
-func publishSingleMessageWithRetries(p *Publication, maxRetries int, sleepTime time.Duration, publishFn func(p *Publication) error) error {
-	if p == nil {
-		return errors.New("Nil Redis publication")
+// Records how long an attempt to publish a batch took, and warns if it was
+// slow
+func recordPublishDuration(batch []*Publication, duration time.Duration, err error, slowThreshold time.Duration) {
+	outcome := "success"
+	if err != nil {
+		outcome = "error"
+	}
+
+	metricPublishDuration.WithLabelValues(outcome).Observe(duration.Seconds())
+
+	if slowThreshold > 0 && duration > slowThreshold {
+		log.Log.Warnw("Slow Redis publish",
+			"duration", duration,
+			"outcome", outcome,
+			"messages", len(batch),
+			"channel", batch[0].CollectionChannel)
+	}
+}
+
+// Calls publishFn until it succeeds, up to maxRetries times, waiting
+// initialDelay after the first failure and twice as long after each
+// subsequent one, up to maxDelay
+func publishWithRetries(batch []*Publication, maxRetries int, initialDelay time.Duration, maxDelay time.Duration, publishFn func(batch []*Publication) error) error {
+	for _, p := range batch {
+		if p == nil {
+			return errors.New("Nil Redis publication")
+		}
 	}
 
 	retries := 0
+	delay := initialDelay
 	for retries < maxRetries {
-		err := publishFn(p)
+		err := publishFn(batch)
 
 		if err != nil {
 			log.Log.Errorw("Error publishing message, will retry",
@@ -113,7 +678,12 @@ func publishSingleMessageWithRetries(p *Publication, maxRetries int, sleepTime t
 			// failure, retry
 			metricTemporaryFailures.Inc()
 			retries++
-			time.Sleep(sleepTime)
+			time.Sleep(delay)
+
+			delay *= 2
+			if delay > maxDelay {
+				delay = maxDelay
+			}
 		} else {
 			// success, return
 			return nil
@@ -123,68 +693,268 @@ func publishSingleMessageWithRetries(p *Publication, maxRetries int, sleepTime t
 	return errors.Errorf("sending message (retried %v times)", maxRetries)
 }
 
-func publishSingleMessage(p *Publication, client redis.UniversalClient, prefix string, dedupeExpirationSeconds int) error {
-	_, err := publishDedupe.Run(
-		context.Background(),
-		client,
-		[]string{
-			// The key used for deduplication
-			// The oplog timestamp isn't really a timestamp -- it's a 64-bit int
-			// where the first 32 bits are a unix timestamp (seconds since
-			// the epoch), and the next 32 bits are a monotonically-increasing
-			// sequence number for operations within that second. It's
-			// guaranteed-unique, so we can use it for deduplication.
-			// However, timestamps are shared within transactions, so we need more information to ensure uniqueness.
-			// The TxIdx field is used to ensure that each entry in a transaction has its own unique key.
-			formatKey(p, prefix),
-		},
+// Publishes the batch to each of the clients, returning an error if it
+// could not be published to all of them (or, in WriteModeAny, to any of them).
+//
+// When one client fails in WriteModeAll, the whole batch is retried; the
+// dedupe keys written by the publish scripts ensure the clients that
+// already succeeded don't send it twice.
+func publishToDestinations(batch []*Publication, clients []redis.UniversalClient, writeMode string, publishOne func(batch []*Publication, client redis.UniversalClient) error) error {
+	var lastErr error
+	successes := 0
+
+	for i, client := range clients {
+		err := publishOne(batch, client)
+		if err != nil {
+			metricDestinationFailures.WithLabelValues(strconv.Itoa(i)).Inc()
+			lastErr = errors.Wrapf(err, "publishing to Redis server %d", i)
+		} else {
+			successes++
+		}
+	}
+
+	if successes == len(clients) || (writeMode == WriteModeAny && successes > 0) {
+		return nil
+	}
+
+	return lastErr
+}
+
+// Sends a batch of messages to a single client. A batch of more than one
+// message is sent as a single pipeline, which preserves the order of the
+// messages. If any message in the pipeline fails, we return an error and the
+// whole batch is retried.
+func publishMessages(batch []*Publication, client redis.UniversalClient, opts *PublishOpts) error {
+	ctx := context.Background()
+
+	if len(batch) == 1 {
+		script, keys, args := publishCommand(batch[0], opts)
+		return script.Run(ctx, client, keys, args...).Err()
+	}
+
+	runPipeline := func(useSha bool) error {
+		_, err := client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, p := range batch {
+				script, keys, args := publishCommand(p, opts)
+				if useSha {
+					script.EvalSha(ctx, pipe, keys, args...)
+				} else {
+					script.Eval(ctx, pipe, keys, args...)
+				}
+			}
+
+			return nil
+		})
+
+		return err
+	}
+
+	// As in redis.Script.Run, we optimistically assume the script is already
+	// loaded, and fall back to sending it in full if it isn't
+	err := runPipeline(true)
+	if err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT ") {
+		err = runPipeline(false)
+	}
+
+	return err
+}
+
+// Returns the script, keys, and arguments to run to send p, according to
+// opts.OutputMode
+func publishCommand(p *Publication, opts *PublishOpts) (*redis.Script, []string, []interface{}) {
+	// Redis expiration is in integer seconds, so we have to convert the
+	// time.Duration
+	dedupeExpirationSeconds := int(opts.DedupeExpiration.Seconds())
+
+	keys := []string{
+		// The key used for deduplication
+		// The oplog timestamp isn't really a timestamp -- it's a 64-bit int
+		// where the first 32 bits are a unix timestamp (seconds since
+		// the epoch), and the next 32 bits are a monotonically-increasing
+		// sequence number for operations within that second. It's
+		// guaranteed-unique, so we can use it for deduplication.
+		// However, timestamps are shared within transactions, so we need more information to ensure uniqueness.
+		// The TxIdx field is used to ensure that each entry in a transaction has its own unique key.
+		formatKey(p, opts.MetadataPrefix),
+	}
+
+	specificChannel := p.SpecificChannel
+	if opts.SkipDocumentChannels {
+		specificChannel = ""
+	}
+
+	if opts.OutputMode == OutputModeStream {
+		if !opts.StreamDocumentStreams {
+			specificChannel = ""
+		}
+
+		return streamDedupe, keys, []interface{}{
+			dedupeExpirationSeconds, // ARGV[1], expiration time
+			p.Msg,                   // ARGV[2], message
+			p.CollectionChannel,     // ARGV[3], stream #1
+			specificChannel,         // ARGV[4], stream #2
+			opts.StreamMaxLen,       // ARGV[5], max stream length
+		}
+	}
+
+	return publishDedupe, keys, []interface{}{
 		dedupeExpirationSeconds, // ARGV[1], expiration time
 		p.Msg,                   // ARGV[2], message
 		p.CollectionChannel,     // ARGV[3], channel #1
-		p.SpecificChannel,       // ARGV[4], channel #2
-	).Result()
-
-	return err
+		specificChannel,         // ARGV[4], channel #2
+	}
 }
 
 func formatKey(p *Publication, prefix string) string {
-	return fmt.Sprintf("%vprocessed::%v::%v", prefix, encodeMongoTimestamp(p.OplogTimestamp), p.TxIdx)
+	// A transaction across shards commits with the same timestamp on each of
+	// them, and TxIdx starts at 0 on each, so their publications are only
+	// told apart by the shard. Replica sets keep the same keys as older
+	// versions.
+	prefix += "processed::"
+	if p.ResumeKey != "" {
+		prefix += p.ResumeKey + "::"
+	}
+
+	if p.ResumeToken != nil {
+		return fmt.Sprintf("%v%v::%v", prefix, resumeTokenID(p.ResumeToken), p.TxIdx)
+	}
+
+	// Entries almost never share a timestamp, so we only add EntryIdx when
+	// they do, to keep the keys the same as older versions'
+	if p.EntryIdx > 0 {
+		return fmt.Sprintf("%v%v.%v::%v", prefix, encodeMongoTimestamp(p.OplogTimestamp), p.EntryIdx, p.TxIdx)
+	}
+
+	return fmt.Sprintf("%v%v::%v", prefix, encodeMongoTimestamp(p.OplogTimestamp), p.TxIdx)
+}
+
+// Returns a string that uniquely identifies the change event with the given
+// resume token. Since Mongo 4.2, resume tokens are documents of the form
+// { _data: "<hex string>" }; for anything else we just hex-encode the token.
+func resumeTokenID(token bson.Raw) string {
+	if data, ok := token.Lookup("_data").StringValueOK(); ok {
+		return data
+	}
+
+	return hex.EncodeToString(token)
 }
 
-// Periodically updates the last-processed-entry timestamp in Redis.
+// resumePoint is the timestamp (and, for change streams, the resume token) of
+// a published oplog entry, along with the Publication.ResumeKey of the oplog
+// it came from
+type resumePoint struct {
+	key       string
+	database  string
+	timestamp primitive.Timestamp
+	token     bson.Raw
+}
+
+// Identifies a per-database last-processed timestamp
+type databaseResumeKey struct {
+	key      string
+	database string
+}
+
+// Identifies a last-processed timestamp key on one of the Redis clients
+type clientResumeKey struct {
+	client int
+	key    string
+}
+
+// Writes the last-processed timestamp (and resume token, if any) for the
+// given resume key to a single Redis client. If written says we've already
+// written the timestamp to this client, but it's no longer there, we warn
+// about it: something (most likely eviction) removed it, and we'd have
+// started from the end of the oplog if we'd restarted in the meantime.
+func writeResumePoint(client redis.UniversalClient, clientIdx int, key string, point resumePoint, opts *PublishOpts, written map[clientResumeKey]bool) {
+	ctx := context.Background()
+	redisKey := lastProcessedKey(opts.MetadataPrefix, key)
+
+	pipe := client.Pipeline()
+	exists := pipe.Exists(ctx, redisKey)
+	pipe.Set(ctx, redisKey, encodeMongoTimestamp(point.timestamp), 0)
+
+	if point.token != nil {
+		pipe.Set(ctx, lastProcessedResumeTokenKey(opts.MetadataPrefix, key), []byte(point.token), 0)
+	}
+
+	if opts.ResumeKeyPersist {
+		pipe.Persist(ctx, redisKey)
+	}
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return
+	}
+
+	writtenKey := clientResumeKey{client: clientIdx, key: redisKey}
+	if written[writtenKey] && exists.Val() == 0 {
+		log.Log.Warnw("Last-processed timestamp key vanished from Redis since we last wrote it; check the Redis eviction policy",
+			"key", redisKey,
+			"destination", clientIdx)
+		metricResumeKeyVanished.WithLabelValues(strconv.Itoa(clientIdx)).Inc()
+	}
+	written[writtenKey] = true
+}
+
+// Periodically updates the last-processed-entry timestamps in Redis.
 // PublishStream sends the timestamp for *every* entry it processes to the
 // channel, and this function throttles that to only update occasionally.
+// We keep a separate timestamp for each resume key.
 //
-// This blocks forever; it should be run in a goroutine
-func periodicallyUpdateTimestamp(client redis.UniversalClient, timestamps <-chan primitive.Timestamp, opts *PublishOpts) {
+// This blocks until the channel is closed, at which point it writes any
+// timestamps it hasn't yet written and returns. It should be run in a
+// goroutine.
+func periodicallyUpdateTimestamp(clients []redis.UniversalClient, timestamps <-chan resumePoint, opts *PublishOpts) {
 	var lastFlush time.Time
-	var mostRecentTimestamp primitive.Timestamp
-	var needFlush bool
+	pending := map[string]resumePoint{}
+	pendingDatabases := map[databaseResumeKey]primitive.Timestamp{}
+	written := map[clientResumeKey]bool{}
 
 	flush := func() {
-		if needFlush {
-			client.Set(context.Background(), opts.MetadataPrefix+"lastProcessedEntry", encodeMongoTimestamp(mostRecentTimestamp), 0)
-			lastFlush = time.Now()
-			needFlush = false
+		for key, point := range pending {
+			// Write to every client, so any of them can be used to resume
+			for i, client := range clients {
+				writeResumePoint(client, i, key, point, opts, written)
+			}
+		}
+
+		for dbKey, ts := range pendingDatabases {
+			for _, client := range clients {
+				client.Set(context.Background(), lastProcessedDatabaseKey(opts.MetadataPrefix, dbKey.key, dbKey.database), encodeMongoTimestamp(ts), 0)
+				client.SAdd(context.Background(), lastProcessedDatabasesKey(opts.MetadataPrefix, dbKey.key), dbKey.database)
+
+				if opts.ResumeKeyPersist {
+					client.Persist(context.Background(), lastProcessedDatabasesKey(opts.MetadataPrefix, dbKey.key))
+				}
+			}
 		}
+
+		lastFlush = time.Now()
+		pending = map[string]resumePoint{}
+		pendingDatabases = map[databaseResumeKey]primitive.Timestamp{}
 	}
 
 	for {
 		select {
-		case timestamp, ok := <-timestamps:
+		case point, ok := <-timestamps:
 			if !ok {
-				// channel got closed
+				// channel got closed; write out whatever we haven't yet
+				if len(pending) > 0 {
+					flush()
+				}
 				return
 			}
 
-			mostRecentTimestamp = timestamp
-			needFlush = true
+			pending[point.key] = point
+			if point.database != "" {
+				pendingDatabases[databaseResumeKey{key: point.key, database: point.database}] = point.timestamp
+			}
 
 			if time.Since(lastFlush) > opts.FlushInterval {
 				flush()
 			}
 		case <-time.After(opts.FlushInterval):
-			if needFlush {
+			if len(pending) > 0 {
 				flush()
 			}
 		}
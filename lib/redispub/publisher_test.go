@@ -2,20 +2,313 @@ package redispub
 
 import (
 	"errors"
+	"reflect"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/alicebob/miniredis"
 	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
-// We don't test PublishStream here -- it requires a real Redis server because
-// miniredis doesn't support PUBLISH and its lua support is spotty. It gets
-// tested in integration tests.
+// We only test PublishStream here with a fake Sink -- publishing to Redis
+// requires a real Redis server because miniredis doesn't support PUBLISH and
+// its lua support is spotty. It gets tested in integration tests.
 
-func TestPublishSingleMessageWithRetriesImmediateSuccess(t *testing.T) {
+type fakeSink struct {
+	lock    sync.Mutex
+	batches [][]*Publication
+}
+
+func (sink *fakeSink) Publish(batch []*Publication) error {
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+
+	sink.batches = append(sink.batches, batch)
+	return nil
+}
+
+func TestPublishStreamWithSink(t *testing.T) {
+	redisServer, redisClient := startMiniredis()
+	defer redisServer.Close()
+
+	sink := &fakeSink{}
+	in := make(chan *Publication, 10)
+	stop := make(chan bool)
+	done := make(chan struct{})
+
+	in <- &Publication{Msg: []byte("1"), OplogTimestamp: primitive.Timestamp{I: 1}}
+	in <- &Publication{Msg: []byte("2"), OplogTimestamp: primitive.Timestamp{I: 2}}
+
+	go func() {
+		PublishStream([]redis.UniversalClient{redisClient}, in, &PublishOpts{
+			MetadataPrefix: "someprefix.",
+			FlushInterval:  time.Hour,
+			BatchSize:      10,
+			Sink:           sink,
+		}, stop)
+		close(done)
+	}()
+
+	stop <- true
+	<-done
+
+	var published []string
+	for _, batch := range sink.batches {
+		for _, p := range batch {
+			published = append(published, string(p.Msg))
+		}
+	}
+
+	if !reflect.DeepEqual(published, []string{"1", "2"}) {
+		t.Errorf("Expected the sink to receive both publications, got %v", published)
+	}
+
+	// The last-processed timestamp is still stored in Redis
+	redisServer.CheckGet(t, "someprefix.lastProcessedEntry", "2")
+}
+
+func TestPublishStreamDryRun(t *testing.T) {
+	redisServer, redisClient := startMiniredis()
+	defer redisServer.Close()
+
+	sink := &fakeSink{}
+	in := make(chan *Publication, 10)
+	stop := make(chan bool)
+	done := make(chan struct{})
+
+	in <- &Publication{Msg: []byte("1"), OplogTimestamp: primitive.Timestamp{I: 1}}
+	in <- &Publication{Msg: []byte("2"), OplogTimestamp: primitive.Timestamp{I: 2}}
+
+	go func() {
+		PublishStream([]redis.UniversalClient{redisClient}, in, &PublishOpts{
+			MetadataPrefix: "someprefix.",
+			FlushInterval:  time.Hour,
+			BatchSize:      10,
+			Sink:           sink,
+			DryRun:         true,
+		}, stop)
+		close(done)
+	}()
+
+	stop <- true
+	<-done
+
+	if len(sink.batches) != 0 {
+		t.Errorf("Expected nothing to be published in a dry run, got %v", sink.batches)
+	}
+
+	if keys := redisServer.Keys(); len(keys) != 0 {
+		t.Errorf("Expected nothing to be written to Redis in a dry run, got keys %v", keys)
+	}
+}
+
+func TestPublishStreamCountsPublications(t *testing.T) {
+	redisServer, redisClient := startMiniredis()
+	defer redisServer.Close()
+
+	in := make(chan *Publication, 10)
+	stop := make(chan bool)
+	done := make(chan struct{})
+
+	inserts := metricPublications.WithLabelValues("countdb", "coll", "insert")
+	drops := metricPublications.WithLabelValues("countdb", "", "drop")
+	insertsBefore := testutil.ToFloat64(inserts)
+	dropsBefore := testutil.ToFloat64(drops)
+
+	in <- &Publication{Msg: []byte("1"), Namespace: "countdb.coll", CollectionLabel: "coll", Operation: "insert", OplogTimestamp: primitive.Timestamp{I: 1}}
+	in <- &Publication{Msg: []byte("2"), Namespace: "countdb.coll", CollectionLabel: "coll", Operation: "insert", OplogTimestamp: primitive.Timestamp{I: 2}}
+	in <- &Publication{Msg: []byte("3"), Namespace: "countdb.coll", Operation: "drop", OplogTimestamp: primitive.Timestamp{I: 3}}
+
+	// Publications that only advance the timestamp aren't counted
+	in <- &Publication{TimestampOnly: true, Namespace: "countdb.coll", Operation: "insert", CollectionLabel: "coll", OplogTimestamp: primitive.Timestamp{I: 4}}
+
+	go func() {
+		PublishStream([]redis.UniversalClient{redisClient}, in, &PublishOpts{
+			MetadataPrefix: "someprefix.",
+			FlushInterval:  time.Hour,
+			BatchSize:      10,
+			Sink:           &fakeSink{},
+		}, stop)
+		close(done)
+	}()
+
+	stop <- true
+	<-done
+
+	if got := testutil.ToFloat64(inserts) - insertsBefore; got != 2 {
+		t.Errorf("Expected 2 inserts to be counted, got %v", got)
+	}
+	if got := testutil.ToFloat64(drops) - dropsBefore; got != 1 {
+		t.Errorf("Expected 1 drop to be counted, got %v", got)
+	}
+}
+
+func TestDrainPublications(t *testing.T) {
+	in := make(chan *Publication, 5)
+	for i := 1; i <= 5; i++ {
+		in <- &Publication{OplogTimestamp: primitive.Timestamp{I: uint32(i)}}
+	}
+
+	stop := make(chan bool, 1)
+
+	var published []uint32
+	drainPublications(in, stop, func(p *Publication) bool {
+		published = append(published, p.OplogTimestamp.I)
+		if len(published) == 2 {
+			// Shutdown is taking too long
+			stop <- true
+		}
+		return false
+	})
+
+	if !reflect.DeepEqual(published, []uint32{1, 2}) {
+		t.Errorf("Expected draining to stop after the second publication, got %v", published)
+	}
+
+	if len(in) != 3 {
+		t.Errorf("Expected 3 publications to be left in the channel, got %d", len(in))
+	}
+
+	// Without a stop, everything is drained
+	published = nil
+	drainPublications(in, stop, func(p *Publication) bool {
+		published = append(published, p.OplogTimestamp.I)
+		return false
+	})
+
+	if !reflect.DeepEqual(published, []uint32{3, 4, 5}) {
+		t.Errorf("Expected the rest of the publications to be drained, got %v", published)
+	}
+}
+
+// A sink that asks PublishStream to stop once it has published stopAfter
+// publications
+type stoppingSink struct {
+	fakeSink
+	stop      chan bool
+	stopAfter int
+}
+
+func (sink *stoppingSink) Publish(batch []*Publication) error {
+	_ = sink.fakeSink.Publish(batch)
+
+	if len(sink.batches) == sink.stopAfter {
+		sink.stop <- true
+	}
+	return nil
+}
+
+func TestPublishStreamStopMidDrain(t *testing.T) {
+	redisServer, redisClient := startMiniredis()
+	defer redisServer.Close()
+
+	in := make(chan *Publication, 10)
+	for i := 1; i <= 10; i++ {
+		in <- &Publication{Msg: []byte("msg"), OplogTimestamp: primitive.Timestamp{I: uint32(i)}}
+	}
+
+	// The first stop may be picked up before or after some publications;
+	// the second stops draining
+	stop := make(chan bool, 2)
+	stop <- true
+	sink := &stoppingSink{stop: stop, stopAfter: 3}
+	done := make(chan struct{})
+
+	go func() {
+		PublishStream([]redis.UniversalClient{redisClient}, in, &PublishOpts{
+			MetadataPrefix: "someprefix.",
+			FlushInterval:  time.Hour,
+			BatchSize:      1,
+			Sink:           sink,
+		}, stop)
+		close(done)
+	}()
+
+	<-done
+
+	var published []uint32
+	for _, batch := range sink.batches {
+		for _, p := range batch {
+			published = append(published, p.OplogTimestamp.I)
+		}
+	}
+
+	if len(published) < 3 || len(published) == 10 {
+		t.Fatalf("Expected draining to stop partway through, got %v", published)
+	}
+
+	// Every publication up to the final timestamp was published, in order,
+	// and none after it, so a restart neither skips nor repeats any
+	for i, ts := range published {
+		if ts != uint32(i+1) {
+			t.Fatalf("Expected the publications to be published in order, got %v", published)
+		}
+	}
+
+	redisServer.CheckGet(t, "someprefix.lastProcessedEntry", encodeMongoTimestamp(primitive.Timestamp{I: published[len(published)-1]}))
+
+	if len(in) != 10-len(published) {
+		t.Errorf("Expected the unpublished publications to be left in the channel, got %d left", len(in))
+	}
+}
+
+func TestPublishStreamStopsDuringTransaction(t *testing.T) {
+	redisServer, redisClient := startMiniredis()
+	defer redisServer.Close()
+
+	sink := &fakeSink{}
+	in := make(chan *Publication, 10)
+	stop := make(chan bool)
+	done := make(chan struct{})
+
+	// The end of the transaction never comes
+	in <- &Publication{Msg: []byte("1"), OplogTimestamp: primitive.Timestamp{I: 1}}
+	in <- &Publication{Msg: []byte("2"), OplogTimestamp: primitive.Timestamp{I: 2}, TxContinues: true}
+
+	go func() {
+		PublishStream([]redis.UniversalClient{redisClient}, in, &PublishOpts{
+			MetadataPrefix: "someprefix.",
+			FlushInterval:  time.Hour,
+			BatchSize:      10,
+			Sink:           sink,
+		}, stop)
+		close(done)
+	}()
+
+	// Keep asking it to stop, as main does when shutdown takes too long
+	timeout := time.After(5 * time.Second)
+stopping:
+	for {
+		select {
+		case stop <- true:
+		case <-done:
+			break stopping
+		case <-timeout:
+			t.Fatal("PublishStream didn't stop while waiting for the end of a transaction")
+		}
+	}
+
+	for _, batch := range sink.batches {
+		for _, p := range batch {
+			if p.TxContinues {
+				t.Errorf("Expected the incomplete transaction not to be published, got %s", p.Msg)
+			}
+		}
+	}
+
+	// If anything was published, it's only the publication before the
+	// transaction
+	if redisServer.Exists("someprefix.lastProcessedEntry") {
+		redisServer.CheckGet(t, "someprefix.lastProcessedEntry", "1")
+	}
+}
+
+func TestPublishWithRetriesImmediateSuccess(t *testing.T) {
 	publication := &Publication{
 		CollectionChannel: "a",
 		SpecificChannel:   "b",
@@ -24,9 +317,9 @@ func TestPublishSingleMessageWithRetriesImmediateSuccess(t *testing.T) {
 	}
 
 	callCount := 0
-	publishFn := func(p *Publication) error {
-		if p != publication {
-			t.Errorf("Got incorrect argument to the publish function: %#v", p)
+	publishFn := func(batch []*Publication) error {
+		if len(batch) != 1 || batch[0] != publication {
+			t.Errorf("Got incorrect argument to the publish function: %#v", batch)
 		}
 
 		callCount++
@@ -34,7 +327,7 @@ func TestPublishSingleMessageWithRetriesImmediateSuccess(t *testing.T) {
 		return nil
 	}
 
-	err := publishSingleMessageWithRetries(publication, 30, time.Second, publishFn)
+	err := publishWithRetries([]*Publication{publication}, 30, time.Second, time.Second, publishFn)
 
 	if err != nil {
 		t.Errorf("Got unexpected error: %s", err)
@@ -45,7 +338,7 @@ func TestPublishSingleMessageWithRetriesImmediateSuccess(t *testing.T) {
 	}
 }
 
-func TestPublishSingleMessageWithRetriesTransientFailure(t *testing.T) {
+func TestPublishWithRetriesTransientFailure(t *testing.T) {
 	publication := &Publication{
 		CollectionChannel: "a",
 		SpecificChannel:   "b",
@@ -54,9 +347,9 @@ func TestPublishSingleMessageWithRetriesTransientFailure(t *testing.T) {
 	}
 
 	callCount := 0
-	publishFn := func(p *Publication) error {
-		if p != publication {
-			t.Errorf("Got incorrect argument to the publish function: %#v", p)
+	publishFn := func(batch []*Publication) error {
+		if len(batch) != 1 || batch[0] != publication {
+			t.Errorf("Got incorrect argument to the publish function: %#v", batch)
 		}
 
 		callCount++
@@ -69,14 +362,14 @@ func TestPublishSingleMessageWithRetriesTransientFailure(t *testing.T) {
 		return nil
 	}
 
-	err := publishSingleMessageWithRetries(publication, 30, 0, publishFn)
+	err := publishWithRetries([]*Publication{publication}, 30, 0, 0, publishFn)
 
 	if err != nil {
 		t.Errorf("Got unexpected error: %s", err)
 	}
 }
 
-func TestPublishSingleMessageWithRetriesPermanentFailure(t *testing.T) {
+func TestPublishWithRetriesPermanentFailure(t *testing.T) {
 	publication := &Publication{
 		CollectionChannel: "a",
 		SpecificChannel:   "b",
@@ -84,11 +377,11 @@ func TestPublishSingleMessageWithRetriesPermanentFailure(t *testing.T) {
 		OplogTimestamp:    primitive.Timestamp{},
 	}
 
-	publishFn := func(p *Publication) error {
+	publishFn := func(batch []*Publication) error {
 		return errors.New("Some error")
 	}
 
-	err := publishSingleMessageWithRetries(publication, 30, 0, publishFn)
+	err := publishWithRetries([]*Publication{publication}, 30, 0, 0, publishFn)
 
 	if err == nil {
 		t.Errorf("Expected an error, but didn't get one")
@@ -116,12 +409,12 @@ func TestPeriodicallyUpdateTimestamp(t *testing.T) {
 	})
 
 	// Start up the periodic updater
-	timestampC := make(chan primitive.Timestamp)
+	timestampC := make(chan resumePoint)
 	waitGroup := sync.WaitGroup{}
 	waitGroup.Add(1)
 
 	go func() {
-		periodicallyUpdateTimestamp(redisClient, timestampC, &PublishOpts{
+		periodicallyUpdateTimestamp([]redis.UniversalClient{redisClient}, timestampC, &PublishOpts{
 			MetadataPrefix: "someprefix.",
 			FlushInterval:  testSpeed,
 		})
@@ -136,7 +429,7 @@ func TestPeriodicallyUpdateTimestamp(t *testing.T) {
 	}
 
 	// Write something
-	timestampC <- primitive.Timestamp{I: 1}
+	timestampC <- resumePoint{timestamp: primitive.Timestamp{I: 1}}
 	time.Sleep(testSpeed / 4) // t = 0.25
 
 	// Key should be set
@@ -144,14 +437,14 @@ func TestPeriodicallyUpdateTimestamp(t *testing.T) {
 
 	// Wait less FlushInterval and write something
 	time.Sleep(testSpeed / 2) // t = 0.75
-	timestampC <- primitive.Timestamp{I: 2}
+	timestampC <- resumePoint{timestamp: primitive.Timestamp{I: 2}}
 
 	// Key should not have updated
 	redisServer.CheckGet(t, key, "1")
 
 	// Wait FlushInterval and write something
 	time.Sleep(testSpeed / 2) // t = 1.25
-	timestampC <- primitive.Timestamp{I: 3}
+	timestampC <- resumePoint{timestamp: primitive.Timestamp{I: 3}}
 	time.Sleep(testSpeed / 4) // t = 1.5
 
 	// Key should have been updated
@@ -159,7 +452,7 @@ func TestPeriodicallyUpdateTimestamp(t *testing.T) {
 
 	// Wait less than FlushInterval and write something
 	time.Sleep(testSpeed / 4) // t = 1.75
-	timestampC <- primitive.Timestamp{I: 4}
+	timestampC <- resumePoint{timestamp: primitive.Timestamp{I: 4}}
 
 	// Key should not have been updated (making sure that when it *was* updated, we reset the timer)
 	redisServer.CheckGet(t, key, "3")
@@ -169,14 +462,154 @@ func TestPeriodicallyUpdateTimestamp(t *testing.T) {
 	time.Sleep(testSpeed * 2) // t = 3.75
 	redisServer.CheckGet(t, key, "4")
 
+	// Timestamps with a resume key are tracked separately
+	timestampC <- resumePoint{key: "shard01", timestamp: primitive.Timestamp{I: 5}}
+	time.Sleep(testSpeed * 2) // t = 5.75
+	redisServer.CheckGet(t, "someprefix.lastProcessedEntry::shard01", "5")
+	redisServer.CheckGet(t, key, "4")
+
+	// Resume tokens are written alongside the timestamp
+	token, err := bson.Marshal(bson.M{"_data": "8263A1B2C3"})
+	if err != nil {
+		panic(err)
+	}
+	timestampC <- resumePoint{timestamp: primitive.Timestamp{I: 6}, token: token}
+	time.Sleep(testSpeed * 2) // t = 7.75
+	redisServer.CheckGet(t, key, "6")
+	redisServer.CheckGet(t, "someprefix.lastProcessedResumeToken", string(token))
+
 	// Close the channel, make sure the flusher exists (we wait here so the test
 	// will time out if it does not)
 	close(timestampC)
 	waitGroup.Wait()
 }
 
+func TestPeriodicallyUpdateTimestampFlushesOnClose(t *testing.T) {
+	redisServer, redisClient := startMiniredis()
+	defer redisServer.Close()
+
+	timestampC := make(chan resumePoint)
+	done := make(chan struct{})
+
+	go func() {
+		periodicallyUpdateTimestamp([]redis.UniversalClient{redisClient}, timestampC, &PublishOpts{
+			MetadataPrefix: "someprefix.",
+			FlushInterval:  time.Hour,
+		})
+		close(done)
+	}()
+
+	// The first timestamp is written immediately, and the second is held
+	// back until the next flush
+	timestampC <- resumePoint{timestamp: primitive.Timestamp{I: 1}}
+	timestampC <- resumePoint{timestamp: primitive.Timestamp{I: 2}}
+
+	close(timestampC)
+	<-done
+
+	redisServer.CheckGet(t, "someprefix.lastProcessedEntry", "2")
+}
+
+func TestPeriodicallyUpdateTimestampByDatabase(t *testing.T) {
+	redisServer, redisClient := startMiniredis()
+	defer redisServer.Close()
+
+	timestampC := make(chan resumePoint)
+	done := make(chan struct{})
+
+	go func() {
+		periodicallyUpdateTimestamp([]redis.UniversalClient{redisClient}, timestampC, &PublishOpts{
+			MetadataPrefix: "someprefix.",
+			FlushInterval:  time.Hour,
+		})
+		close(done)
+	}()
+
+	timestampC <- resumePoint{database: "foo", timestamp: primitive.Timestamp{I: 1}}
+	timestampC <- resumePoint{database: "bar", timestamp: primitive.Timestamp{I: 2}}
+	timestampC <- resumePoint{database: "foo", timestamp: primitive.Timestamp{I: 3}}
+
+	close(timestampC)
+	<-done
+
+	redisServer.CheckGet(t, "someprefix.lastProcessedEntry", "3")
+	redisServer.CheckGet(t, "someprefix.lastProcessedEntry::db::foo", "3")
+	redisServer.CheckGet(t, "someprefix.lastProcessedEntry::db::bar", "2")
+
+	databases, err := redisServer.Members("someprefix.lastProcessedDatabases")
+	if err != nil {
+		t.Fatalf("Error reading the set of databases: %s", err)
+	}
+
+	// Members returns a sorted list
+	if !reflect.DeepEqual(databases, []string{"bar", "foo"}) {
+		t.Errorf("Incorrect set of databases. Got %v, expected [bar foo]", databases)
+	}
+}
+
+func TestPeriodicallyUpdateTimestampPersist(t *testing.T) {
+	redisServer, redisClient := startMiniredis()
+	defer redisServer.Close()
+
+	// Something else put an expiration on the set of databases, which SADD
+	// doesn't clear
+	if _, err := redisServer.SetAdd("someprefix.lastProcessedDatabases", "bar"); err != nil {
+		panic(err)
+	}
+	redisServer.SetTTL("someprefix.lastProcessedDatabases", time.Hour)
+
+	timestampC := make(chan resumePoint)
+	done := make(chan struct{})
+
+	go func() {
+		periodicallyUpdateTimestamp([]redis.UniversalClient{redisClient}, timestampC, &PublishOpts{
+			MetadataPrefix:   "someprefix.",
+			FlushInterval:    time.Hour,
+			ResumeKeyPersist: true,
+		})
+		close(done)
+	}()
+
+	timestampC <- resumePoint{database: "foo", timestamp: primitive.Timestamp{I: 1}}
+
+	close(timestampC)
+	<-done
+
+	redisServer.CheckGet(t, "someprefix.lastProcessedEntry", "1")
+	for _, key := range []string{"someprefix.lastProcessedEntry", "someprefix.lastProcessedDatabases"} {
+		if ttl := redisServer.TTL(key); ttl != 0 {
+			t.Errorf("Expected %s to have no expiration, got %s", key, ttl)
+		}
+	}
+}
+
+func TestWriteResumePointVanished(t *testing.T) {
+	redisServer, redisClient := startMiniredis()
+	defer redisServer.Close()
+
+	opts := &PublishOpts{MetadataPrefix: "someprefix."}
+	written := map[clientResumeKey]bool{}
+	vanished := metricResumeKeyVanished.WithLabelValues("0")
+	before := testutil.ToFloat64(vanished)
+
+	// The key not existing the first time we write it is expected
+	writeResumePoint(redisClient, 0, "", resumePoint{timestamp: primitive.Timestamp{I: 1}}, opts, written)
+	writeResumePoint(redisClient, 0, "", resumePoint{timestamp: primitive.Timestamp{I: 2}}, opts, written)
+	if got := testutil.ToFloat64(vanished) - before; got != 0 {
+		t.Errorf("Expected no vanished keys, got %v", got)
+	}
+
+	redisServer.Del("someprefix.lastProcessedEntry")
+
+	writeResumePoint(redisClient, 0, "", resumePoint{timestamp: primitive.Timestamp{I: 3}}, opts, written)
+	if got := testutil.ToFloat64(vanished) - before; got != 1 {
+		t.Errorf("Expected 1 vanished key, got %v", got)
+	}
+	redisServer.CheckGet(t, "someprefix.lastProcessedEntry", "3")
+}
+
 func TestNilPublicationMessage(t *testing.T) {
-	err := publishSingleMessageWithRetries(nil, 5, 1*time.Second, func(p *Publication) error {
+	err := publishWithRetries([]*Publication{nil}, 5, 1*time.Second, 1*time.Second, func(batch []*Publication) error {
 		t.Error("Should not have been called")
 		return nil
 	})
@@ -185,3 +618,369 @@ func TestNilPublicationMessage(t *testing.T) {
 		t.Error("Exepcted error")
 	}
 }
+
+func TestPublishToDestinations(t *testing.T) {
+	publication := &Publication{
+		CollectionChannel: "a",
+		SpecificChannel:   "b",
+		Msg:               []byte("asdf"),
+	}
+
+	// We don't use these clients; they just identify the destinations
+	clients := []redis.UniversalClient{
+		redis.NewUniversalClient(&redis.UniversalOptions{Addrs: []string{"one:6379"}}),
+		redis.NewUniversalClient(&redis.UniversalOptions{Addrs: []string{"two:6379"}}),
+	}
+
+	tests := map[string]struct {
+		writeMode   string
+		failing     map[int]bool
+		expectError bool
+	}{
+		"All succeed, all mode": {
+			writeMode: WriteModeAll,
+		},
+		"One fails, all mode": {
+			writeMode:   WriteModeAll,
+			failing:     map[int]bool{1: true},
+			expectError: true,
+		},
+		"One fails, any mode": {
+			writeMode: WriteModeAny,
+			failing:   map[int]bool{0: true},
+		},
+		"All fail, any mode": {
+			writeMode:   WriteModeAny,
+			failing:     map[int]bool{0: true, 1: true},
+			expectError: true,
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			calledWith := map[redis.UniversalClient]bool{}
+
+			err := publishToDestinations([]*Publication{publication}, clients, test.writeMode, func(batch []*Publication, client redis.UniversalClient) error {
+				calledWith[client] = true
+
+				for i, c := range clients {
+					if c == client && test.failing[i] {
+						return errors.New("Some error")
+					}
+				}
+
+				return nil
+			})
+
+			if len(calledWith) != len(clients) {
+				t.Errorf("Expected publish to be attempted on all %d clients, got %d", len(clients), len(calledWith))
+			}
+
+			if test.expectError && err == nil {
+				t.Errorf("Expected an error, but didn't get one")
+			} else if !test.expectError && err != nil {
+				t.Errorf("Got unexpected error: %s", err)
+			}
+		})
+	}
+}
+
+func TestFormatKey(t *testing.T) {
+	tokenWithData, err := bson.Marshal(bson.M{"_data": "8263A1B2C3"})
+	if err != nil {
+		panic(err)
+	}
+
+	tokenWithoutData, err := bson.Marshal(bson.M{"x": int32(1)})
+	if err != nil {
+		panic(err)
+	}
+
+	tests := map[string]struct {
+		in   *Publication
+		want string
+	}{
+		"Oplog timestamp": {
+			in:   &Publication{OplogTimestamp: primitive.Timestamp{T: 1, I: 2}, TxIdx: 3},
+			want: "someprefix.processed::4294967298::3",
+		},
+		"Oplog timestamp shared with an earlier entry": {
+			in:   &Publication{OplogTimestamp: primitive.Timestamp{T: 1, I: 2}, EntryIdx: 1, TxIdx: 3},
+			want: "someprefix.processed::4294967298.1::3",
+		},
+		"Resume token": {
+			in:   &Publication{OplogTimestamp: primitive.Timestamp{T: 1, I: 2}, ResumeToken: tokenWithData, TxIdx: 1},
+			want: "someprefix.processed::8263A1B2C3::1",
+		},
+		"Shard": {
+			in:   &Publication{OplogTimestamp: primitive.Timestamp{T: 1, I: 2}, ResumeKey: "shard1", TxIdx: 3},
+			want: "someprefix.processed::shard1::4294967298::3",
+		},
+		"Resume token without _data": {
+			in:   &Publication{ResumeToken: tokenWithoutData},
+			want: "someprefix.processed::0c0000001078000100000000::0",
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			got := formatKey(test.in, "someprefix.")
+			if got != test.want {
+				t.Errorf("formatKey() = %s; want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCrossShardTransactionNotDeduplicated(t *testing.T) {
+	// A transaction across two shards commits with the same timestamp on
+	// both, and the TxIdx of each shard's operations starts at 0
+	shard1 := &Publication{Namespace: "foo.bar", DocID: "a", OplogTimestamp: primitive.Timestamp{T: 1, I: 2}, ResumeKey: "shard1"}
+	shard2 := &Publication{Namespace: "foo.bar", DocID: "a", OplogTimestamp: primitive.Timestamp{T: 1, I: 2}, ResumeKey: "shard2"}
+
+	if formatKey(shard1, "someprefix.") == formatKey(shard2, "someprefix.") {
+		t.Errorf("Expected the publications of each shard to have their own deduplication key, got %s for both", formatKey(shard1, "someprefix."))
+	}
+
+	kept := newDedupCache(time.Minute).filter([]*Publication{shard1, shard2}, time.Unix(1000, 0))
+	if len(kept) != 2 {
+		t.Errorf("Expected both shards' publications to be kept, got %d", len(kept))
+	}
+}
+
+func TestCollectBatch(t *testing.T) {
+	pubs := make([]*Publication, 5)
+	for i := range pubs {
+		pubs[i] = &Publication{TxIdx: uint(i)}
+	}
+
+	t.Run("No window takes waiting publications", func(t *testing.T) {
+		in := make(chan *Publication, 10)
+		in <- pubs[1]
+		in <- pubs[2]
+
+		batch, _ := collectBatch(pubs[0], in, 10, 0, nil)
+
+		if len(batch) != 3 || batch[0] != pubs[0] || batch[1] != pubs[1] || batch[2] != pubs[2] {
+			t.Errorf("Got incorrect batch: %#v", batch)
+		}
+	})
+
+	t.Run("Stops at max size", func(t *testing.T) {
+		in := make(chan *Publication, 10)
+		for _, p := range pubs[1:] {
+			in <- p
+		}
+
+		batch, _ := collectBatch(pubs[0], in, 3, time.Second, nil)
+
+		if len(batch) != 3 {
+			t.Errorf("Expected batch of 3, got %d", len(batch))
+		}
+
+		if len(in) != 2 {
+			t.Errorf("Expected 2 publications left in the channel, got %d", len(in))
+		}
+	})
+
+	t.Run("Waits for window", func(t *testing.T) {
+		in := make(chan *Publication)
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			in <- pubs[1]
+		}()
+
+		batch, _ := collectBatch(pubs[0], in, 10, 200*time.Millisecond, nil)
+
+		if len(batch) != 2 || batch[1] != pubs[1] {
+			t.Errorf("Got incorrect batch: %#v", batch)
+		}
+	})
+
+	t.Run("Batching disabled", func(t *testing.T) {
+		in := make(chan *Publication, 10)
+		in <- pubs[1]
+
+		batch, _ := collectBatch(pubs[0], in, 1, time.Second, nil)
+
+		if len(batch) != 1 {
+			t.Errorf("Expected batch of 1, got %d", len(batch))
+		}
+	})
+
+	t.Run("Waits for the rest of a transaction", func(t *testing.T) {
+		txFirst := &Publication{TxContinues: true}
+		otherShard := &Publication{ResumeKey: "shard2"}
+		txLast := &Publication{}
+		after := &Publication{}
+
+		in := make(chan *Publication, 10)
+		in <- otherShard
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			in <- txLast
+			in <- after
+		}()
+
+		batch, _ := collectBatch(txFirst, in, 1, 0, nil)
+
+		if len(batch) != 3 || batch[0] != txFirst || batch[1] != otherShard || batch[2] != txLast {
+			t.Errorf("Got incorrect batch: %#v", batch)
+		}
+	})
+
+	t.Run("Gives up on a transaction when stopping", func(t *testing.T) {
+		before := &Publication{}
+		txFirst := &Publication{TxContinues: true}
+		otherShard := &Publication{ResumeKey: "shard2"}
+		txSecond := &Publication{TxContinues: true}
+
+		in := make(chan *Publication, 10)
+		in <- txFirst
+		in <- otherShard
+		in <- txSecond
+
+		// The end of the transaction never comes (e.g. the tailer stopped
+		// partway through sending it)
+		stop := make(chan bool, 1)
+		stop <- true
+
+		batch, stopped := collectBatch(before, in, 10, 0, stop)
+
+		if !stopped {
+			t.Error("Expected collectBatch to report that it stopped")
+		}
+
+		// Only the incomplete transaction is left out
+		if len(batch) != 2 || batch[0] != before || batch[1] != otherShard {
+			t.Errorf("Got incorrect batch: %#v", batch)
+		}
+	})
+}
+
+func TestWithoutTimestampOnly(t *testing.T) {
+	message1 := &Publication{Msg: []byte("1")}
+	heartbeat := &Publication{TimestampOnly: true}
+	message2 := &Publication{Msg: []byte("2")}
+
+	batch := []*Publication{message1, heartbeat, message2}
+	messages := withoutTimestampOnly(batch)
+
+	if len(messages) != 2 || messages[0] != message1 || messages[1] != message2 {
+		t.Errorf("Got incorrect messages: %#v", messages)
+	}
+
+	if batch[1] != heartbeat {
+		t.Errorf("Expected the original batch to be unmodified, got %#v", batch)
+	}
+
+	if messages := withoutTimestampOnly([]*Publication{heartbeat}); len(messages) != 0 {
+		t.Errorf("Expected no messages, got %#v", messages)
+	}
+}
+
+func TestPublishCommandDocumentChannels(t *testing.T) {
+	pub := &Publication{
+		CollectionChannel: "foo.bar",
+		SpecificChannel:   "foo.bar::someid",
+		Msg:               []byte("{}"),
+	}
+
+	tests := map[string]struct {
+		opts            PublishOpts
+		expectedChannel string
+	}{
+		"Pub/sub": {
+			opts:            PublishOpts{},
+			expectedChannel: "foo.bar::someid",
+		},
+		"Pub/sub without document channels": {
+			opts:            PublishOpts{SkipDocumentChannels: true},
+			expectedChannel: "",
+		},
+		"Streams": {
+			opts:            PublishOpts{OutputMode: OutputModeStream},
+			expectedChannel: "",
+		},
+		"Streams with document streams": {
+			opts:            PublishOpts{OutputMode: OutputModeStream, StreamDocumentStreams: true},
+			expectedChannel: "foo.bar::someid",
+		},
+		"Streams without document channels": {
+			opts:            PublishOpts{OutputMode: OutputModeStream, SkipDocumentChannels: true},
+			expectedChannel: "",
+		},
+		"Document streams without document channels": {
+			opts:            PublishOpts{OutputMode: OutputModeStream, StreamDocumentStreams: true, SkipDocumentChannels: true},
+			expectedChannel: "",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, _, args := publishCommand(pub, &test.opts)
+
+			if args[2] != "foo.bar" {
+				t.Errorf("Expected the collection channel to be foo.bar, got %v", args[2])
+			}
+			if args[3] != test.expectedChannel {
+				t.Errorf("Expected the document channel to be %q, got %q", test.expectedChannel, args[3])
+			}
+		})
+	}
+}
+
+// miniredis doesn't support XADD, so we check what we'd run instead
+func TestPublishCommandStream(t *testing.T) {
+	pub := &Publication{
+		CollectionChannel: "foo.bar",
+		SpecificChannel:   "foo.bar::someid",
+		Msg:               []byte("{}"),
+		OplogTimestamp:    primitive.Timestamp{T: 1, I: 2},
+	}
+
+	script, keys, args := publishCommand(pub, &PublishOpts{
+		OutputMode:       OutputModeStream,
+		StreamMaxLen:     1000,
+		DedupeExpiration: 2 * time.Minute,
+		MetadataPrefix:   "someprefix.",
+	})
+
+	if script != streamDedupe {
+		t.Error("Expected the stream script")
+	}
+
+	expectedKeys := []string{"someprefix.processed::4294967298::0"}
+	if !reflect.DeepEqual(keys, expectedKeys) {
+		t.Errorf("Incorrect keys. Got %v, expected %v", keys, expectedKeys)
+	}
+
+	expectedArgs := []interface{}{120, []byte("{}"), "foo.bar", "", int64(1000)}
+	if !reflect.DeepEqual(args, expectedArgs) {
+		t.Errorf("Incorrect args. Got %#v, expected %#v", args, expectedArgs)
+	}
+}
+
+func TestRecordQueueWait(t *testing.T) {
+	sampleCount := func() uint64 {
+		var metric dto.Metric
+		if err := metricQueueWait.Write(&metric); err != nil {
+			t.Fatalf("Error reading metric: %s", err)
+		}
+		return metric.GetHistogram().GetSampleCount()
+	}
+
+	before := sampleCount()
+
+	now := time.Unix(1000, 0)
+	recordQueueWait([]*Publication{
+		{EnqueuedAt: now.Add(-time.Second)},
+		{},
+		{EnqueuedAt: now.Add(-2 * time.Second)},
+	}, now)
+
+	// Publications without an enqueue time aren't recorded
+	if count := sampleCount() - before; count != 2 {
+		t.Errorf("Expected 2 samples, got %d", count)
+	}
+}
@@ -0,0 +1,217 @@
+package redispub
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/vlasky/oplogtoredis/lib/log"
+)
+
+// RefetchEvent is the event ("e") of the notification we send in place of
+// the messages for a collection that exceeds PublishOpts.MaxPublishRate
+const RefetchEvent = "refetch"
+
+// How often we send a refetch notification for a collection while it's
+// being throttled. We also send one this long after the last message we
+// throttled, so subscribers refetch once the burst is over.
+const rateLimitNoticeInterval = time.Second
+
+var metricThrottled = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "otr",
+	Subsystem: "redispub",
+	Name:      "throttled",
+	Help:      "Number of publications that weren't sent because their collection exceeded OTR_MAX_PUBLISH_RATE, partitioned by database.",
+}, []string{"database"})
+
+var metricRefetchNotices = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "otr",
+	Subsystem: "redispub",
+	Name:      "refetch_notices",
+	Help:      "Number of refetch notifications sent in place of the publications for collections that exceeded OTR_MAX_PUBLISH_RATE, partitioned by database.",
+}, []string{"database"})
+
+var metricThrottledCollections = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: "otr",
+	Subsystem: "redispub",
+	Name:      "throttled_collections",
+	Help:      "Number of collections currently exceeding OTR_MAX_PUBLISH_RATE.",
+})
+
+// The message of a refetch notification
+type refetchMessage struct {
+	Event string      `json:"e"`
+	Data  refetchData `json:"d"`
+}
+
+type refetchData struct {
+	Namespace string `json:"ns"`
+	Throttled int    `json:"throttled"`
+}
+
+// A token bucket for a single collection
+type rateBucket struct {
+	tokens float64
+	filled time.Time
+
+	// Set while the collection is being throttled, from the first message
+	// we throttle until a notice interval passes without any
+	throttling     bool
+	lastThrottled  time.Time
+	lastNotice     time.Time
+	pendingCount   int
+	pendingChannel string
+	pendingLast    *Publication
+}
+
+// rateLimiter limits the rate at which we publish messages for each
+// collection (by source namespace), using a token bucket that holds up to a
+// second's worth of messages. The messages over the limit aren't sent;
+// instead, subscribers are sent a notification (see RefetchEvent) at most
+// once per rateLimitNoticeInterval, and once more after the last message we
+// throttled, telling them to refetch the collection.
+//
+// Messages that aren't about a single document (such as a collection being
+// dropped) are never throttled. Like dedupCache, it's not threadsafe.
+type rateLimiter struct {
+	rate    float64
+	buckets map[string]*rateBucket
+}
+
+func newRateLimiter(rate int) *rateLimiter {
+	return &rateLimiter{
+		rate:    float64(rate),
+		buckets: map[string]*rateBucket{},
+	}
+}
+
+// Returns the bucket for a namespace, refilled as of now
+func (limiter *rateLimiter) bucket(namespace string, now time.Time) *rateBucket {
+	bucket, ok := limiter.buckets[namespace]
+	if !ok {
+		bucket = &rateBucket{tokens: limiter.rate, filled: now}
+		limiter.buckets[namespace] = bucket
+		return bucket
+	}
+
+	if elapsed := now.Sub(bucket.filled); elapsed > 0 {
+		bucket.tokens += elapsed.Seconds() * limiter.rate
+		if bucket.tokens > limiter.rate {
+			bucket.tokens = limiter.rate
+		}
+		bucket.filled = now
+	}
+
+	return bucket
+}
+
+// Returns the messages that are within their collection's rate, and records
+// the rest so that notices can send a refetch notification for them
+func (limiter *rateLimiter) filter(messages []*Publication, now time.Time) []*Publication {
+	allowed := messages[:0:0]
+	for _, p := range messages {
+		if p.DocID == "" {
+			allowed = append(allowed, p)
+			continue
+		}
+
+		bucket := limiter.bucket(p.Namespace, now)
+		if bucket.tokens >= 1 {
+			bucket.tokens--
+			allowed = append(allowed, p)
+			continue
+		}
+
+		if !bucket.throttling {
+			bucket.throttling = true
+			metricThrottledCollections.Inc()
+			log.Log.Warnw("Collection exceeded OTR_MAX_PUBLISH_RATE; sending refetch notifications instead of its messages",
+				"namespace", p.Namespace)
+		}
+
+		metricThrottled.WithLabelValues(p.Database()).Inc()
+		bucket.lastThrottled = now
+		bucket.pendingCount++
+		bucket.pendingChannel = p.CollectionChannel
+		bucket.pendingLast = p
+	}
+
+	return allowed
+}
+
+// Returns the refetch notifications that are due, for the collections we've
+// throttled messages for since their last notification. If all is set,
+// every pending notification is due (for when we're stopping).
+func (limiter *rateLimiter) notices(now time.Time, all bool) []*Publication {
+	namespaces := make([]string, 0, len(limiter.buckets))
+	for namespace := range limiter.buckets {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+
+	var notices []*Publication
+	for _, namespace := range namespaces {
+		bucket := limiter.bucket(namespace, now)
+
+		if bucket.pendingCount > 0 && (all || now.Sub(bucket.lastNotice) >= rateLimitNoticeInterval) {
+			notice, err := newRefetchNotice(namespace, bucket)
+			if err != nil {
+				log.Log.Errorw("Error building refetch notification",
+					"error", err,
+					"namespace", namespace)
+			} else {
+				metricRefetchNotices.WithLabelValues(notice.Database()).Inc()
+				notices = append(notices, notice)
+			}
+
+			bucket.lastNotice = now
+			bucket.pendingCount = 0
+			bucket.pendingLast = nil
+		}
+
+		if bucket.throttling && bucket.pendingCount == 0 && now.Sub(bucket.lastThrottled) >= rateLimitNoticeInterval {
+			bucket.throttling = false
+			metricThrottledCollections.Dec()
+			log.Log.Infow("Collection is back within OTR_MAX_PUBLISH_RATE",
+				"namespace", namespace)
+		}
+
+		// A full bucket is the same as no bucket, so forget collections
+		// that have gone quiet
+		if !bucket.throttling && bucket.tokens >= limiter.rate {
+			delete(limiter.buckets, namespace)
+		}
+	}
+
+	return notices
+}
+
+// Builds the refetch notification for the messages throttled in a bucket.
+// It has the timestamp of the last of them, so that copies of oplogtoredis
+// publishing the same oplog deduplicate it.
+func newRefetchNotice(namespace string, bucket *rateBucket) (*Publication, error) {
+	msg, err := json.Marshal(refetchMessage{
+		Event: RefetchEvent,
+		Data: refetchData{
+			Namespace: namespace,
+			Throttled: bucket.pendingCount,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Publication{
+		CollectionChannel: bucket.pendingChannel,
+		Msg:               msg,
+		OplogTimestamp:    bucket.pendingLast.OplogTimestamp,
+		Namespace:         namespace,
+		Operation:         RefetchEvent,
+		CollectionLabel:   bucket.pendingLast.CollectionLabel,
+		TxIdx:             bucket.pendingLast.TxIdx,
+		ResumeKey:         bucket.pendingLast.ResumeKey,
+		ResumeToken:       bucket.pendingLast.ResumeToken,
+	}, nil
+}
@@ -0,0 +1,160 @@
+package redispub
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func rateLimitedPub(namespace string, docID string, ts uint32) *Publication {
+	return &Publication{
+		CollectionChannel: namespace,
+		SpecificChannel:   namespace + "::" + docID,
+		Msg:               []byte(docID),
+		Namespace:         namespace,
+		DocID:             docID,
+		OplogTimestamp:    primitive.Timestamp{T: ts},
+	}
+}
+
+func docIDs(pubs []*Publication) []string {
+	ids := []string{}
+	for _, p := range pubs {
+		ids = append(ids, p.DocID)
+	}
+	return ids
+}
+
+func TestRateLimiter(t *testing.T) {
+	start := time.Unix(1000, 0)
+	limiter := newRateLimiter(2)
+
+	allowed := limiter.filter([]*Publication{
+		rateLimitedPub("app.users", "a", 1),
+		rateLimitedPub("app.users", "b", 2),
+		rateLimitedPub("app.users", "c", 3),
+		rateLimitedPub("app.posts", "d", 4),
+		{CollectionChannel: "app.users", Namespace: "app.users", Msg: []byte("drop")},
+		rateLimitedPub("app.users", "e", 5),
+	}, start)
+
+	// Each collection has its own limit, and messages that aren't about a
+	// single document aren't limited
+	if ids := docIDs(allowed); !reflect.DeepEqual(ids, []string{"a", "b", "d", ""}) {
+		t.Errorf("Expected a, b, d, and the drop to be allowed, got %v", ids)
+	}
+
+	notices := limiter.notices(start, false)
+	if len(notices) != 1 {
+		t.Fatalf("Expected one refetch notification, got %d", len(notices))
+	}
+	if notices[0].CollectionChannel != "app.users" || notices[0].SpecificChannel != "" {
+		t.Errorf("Notification sent to the wrong channels: %q, %q", notices[0].CollectionChannel, notices[0].SpecificChannel)
+	}
+	if notices[0].OplogTimestamp.T != 5 {
+		t.Errorf("Expected the notification to have the last throttled timestamp, got %v", notices[0].OplogTimestamp)
+	}
+
+	var msg refetchMessage
+	if err := json.Unmarshal(notices[0].Msg, &msg); err != nil {
+		t.Fatalf("Error decoding notification: %s", err)
+	}
+	if want := (refetchMessage{Event: RefetchEvent, Data: refetchData{Namespace: "app.users", Throttled: 2}}); msg != want {
+		t.Errorf("Incorrect notification. Got %#v, expected %#v", msg, want)
+	}
+
+	// Still throttled half a second later; the next notification isn't due
+	// yet
+	allowed = limiter.filter([]*Publication{
+		rateLimitedPub("app.users", "f", 6),
+		rateLimitedPub("app.users", "g", 7),
+	}, start.Add(500*time.Millisecond))
+	if ids := docIDs(allowed); !reflect.DeepEqual(ids, []string{"f"}) {
+		t.Errorf("Expected only f to be allowed after refilling, got %v", ids)
+	}
+	if notices := limiter.notices(start.Add(500*time.Millisecond), false); len(notices) != 0 {
+		t.Errorf("Expected no notifications within the interval, got %d", len(notices))
+	}
+
+	// After the interval, there's a notification for g
+	notices = limiter.notices(start.Add(time.Second), false)
+	if len(notices) != 1 || notices[0].OplogTimestamp.T != 7 {
+		t.Errorf("Expected a notification for g, got %v", notices)
+	}
+
+	// Once it's quiet, we forget about the collection
+	if notices := limiter.notices(start.Add(3*time.Second), false); len(notices) != 0 {
+		t.Errorf("Expected no more notifications, got %d", len(notices))
+	}
+	if _, ok := limiter.buckets["app.users"]; ok {
+		t.Errorf("Expected the quiet collection to be forgotten")
+	}
+}
+
+func TestRateLimiterNoticesWhenStopping(t *testing.T) {
+	start := time.Unix(1000, 0)
+	limiter := newRateLimiter(1)
+
+	limiter.filter([]*Publication{rateLimitedPub("app.users", "a", 1), rateLimitedPub("app.users", "b", 2)}, start)
+	if notices := limiter.notices(start, false); len(notices) != 1 {
+		t.Fatalf("Expected one refetch notification, got %d", len(notices))
+	}
+
+	limiter.filter([]*Publication{rateLimitedPub("app.users", "c", 3)}, start)
+	if notices := limiter.notices(start, false); len(notices) != 0 {
+		t.Errorf("Expected no notifications within the interval, got %d", len(notices))
+	}
+	if notices := limiter.notices(start, true); len(notices) != 1 {
+		t.Errorf("Expected the pending notification when stopping, got %d", len(notices))
+	}
+}
+
+func TestPublishStreamMaxPublishRate(t *testing.T) {
+	redisServer, redisClient := startMiniredis()
+	defer redisServer.Close()
+
+	sink := &fakeSink{}
+	in := make(chan *Publication, 10)
+	stop := make(chan bool)
+	done := make(chan struct{})
+
+	for i := 1; i <= 5; i++ {
+		p := rateLimitedPub("app.users", fmt.Sprint(i), 0)
+		p.OplogTimestamp = primitive.Timestamp{I: uint32(i)}
+		in <- p
+	}
+
+	go func() {
+		PublishStream([]redis.UniversalClient{redisClient}, in, &PublishOpts{
+			MetadataPrefix: "someprefix.",
+			FlushInterval:  time.Hour,
+			BatchSize:      10,
+			Sink:           sink,
+			MaxPublishRate: 2,
+		}, stop)
+		close(done)
+	}()
+
+	stop <- true
+	<-done
+
+	var published []string
+	for _, batch := range sink.batches {
+		for _, p := range batch {
+			published = append(published, string(p.Msg))
+		}
+	}
+
+	want := []string{"1", "2", `{"e":"refetch","d":{"ns":"app.users","throttled":3}}`}
+	if !reflect.DeepEqual(published, want) {
+		t.Errorf("Incorrect publications. Got %v, expected %v", published, want)
+	}
+
+	// The throttled publications still advance the last-processed timestamp
+	redisServer.CheckGet(t, "someprefix.lastProcessedEntry", "5")
+}
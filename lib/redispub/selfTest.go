@@ -0,0 +1,100 @@
+package redispub
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var metricSelfTest = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: "otr",
+	Subsystem: "redispub",
+	Name:      "self_test_ok",
+	Help:      "1 if the startup self-test (see OTR_SELF_TEST_COLLECTION) saw its write published, 0 if it hasn't (yet).",
+})
+
+// SelfTest watches for the publication of a single document, written by the
+// startup self-test, to confirm that a write to Mongo makes it all the way
+// through to Redis. Pass it to PublishStream in PublishOpts.SelfTest.
+//
+// A nil *SelfTest watches for nothing.
+type SelfTest struct {
+	namespace string
+	docID     string
+
+	once      sync.Once
+	published chan struct{}
+}
+
+// NewSelfTest creates a SelfTest that watches for the publication of the
+// document with the given ID, in the given namespace (before any renaming by
+// OTR_NAMESPACE_MAP)
+func NewSelfTest(namespace, docID string) *SelfTest {
+	return &SelfTest{
+		namespace: namespace,
+		docID:     docID,
+		published: make(chan struct{}),
+	}
+}
+
+// Wait waits up to timeout for the document to be published, and returns
+// whether it was
+func (selfTest *SelfTest) Wait(timeout time.Duration) bool {
+	select {
+	case <-selfTest.published:
+		metricSelfTest.Set(1)
+		return true
+	case <-time.After(timeout):
+		metricSelfTest.Set(0)
+		return false
+	}
+}
+
+// Checks a batch of publications that was just published for the document
+func (selfTest *SelfTest) observe(batch []*Publication) {
+	if selfTest == nil {
+		return
+	}
+
+	for _, p := range batch {
+		if p.Namespace == selfTest.namespace && p.DocID == selfTest.docID {
+			selfTest.once.Do(func() { close(selfTest.published) })
+			return
+		}
+	}
+}
+
+// PublishStartupPing publishes a message announcing that oplogtoredis has
+// started to the given channel on each of the given Redis clients, so that a
+// health dashboard can see that the instance is up and can reach Redis. It
+// bypasses PublishStream, so it doesn't affect the last-processed timestamp.
+func PublishStartupPing(clients []redis.UniversalClient, channel string, timeout time.Duration) error {
+	hostname, _ := os.Hostname()
+
+	msg, err := json.Marshal(map[string]interface{}{
+		"e":        "oplogtoredis-startup",
+		"selfTest": true,
+		"host":     hostname,
+		"time":     time.Now().UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	for _, client := range clients {
+		if err := client.Publish(ctx, channel, msg).Err(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
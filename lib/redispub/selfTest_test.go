@@ -0,0 +1,31 @@
+package redispub
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSelfTest(t *testing.T) {
+	selfTest := NewSelfTest("test.selfTest", "abc")
+
+	selfTest.observe([]*Publication{
+		{Namespace: "test.other", DocID: "abc"},
+		{Namespace: "test.selfTest", DocID: "def"},
+	})
+	if selfTest.Wait(10 * time.Millisecond) {
+		t.Error("Expected the self-test not to pass before its document was published")
+	}
+
+	selfTest.observe([]*Publication{{Namespace: "test.selfTest", DocID: "abc"}})
+	selfTest.observe([]*Publication{{Namespace: "test.selfTest", DocID: "abc"}})
+	if !selfTest.Wait(10 * time.Millisecond) {
+		t.Error("Expected the self-test to pass once its document was published")
+	}
+}
+
+func TestSelfTestNil(t *testing.T) {
+	var selfTest *SelfTest
+
+	// Doesn't panic
+	selfTest.observe([]*Publication{{Namespace: "test.selfTest", DocID: "abc"}})
+}
@@ -0,0 +1,159 @@
+package redispub
+
+import (
+	"io/ioutil"
+	"strings"
+	"text/template"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/vlasky/oplogtoredis/lib/kafka"
+	"github.com/vlasky/oplogtoredis/lib/log"
+)
+
+var metricDryRunMessages = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: "otr",
+	Subsystem: "redispub",
+	Name:      "dry_run_messages",
+	Help:      "Messages that would have been published, if we weren't doing a dry run (OTR_DRY_RUN).",
+})
+
+// Sink delivers batches of publications to wherever they're being published.
+// PublishStream takes care of batching, deduplication, retries, and recording
+// the last-processed timestamp (which is always stored in Redis); the Sink
+// only has to send each batch, and return an error if it couldn't be sent.
+//
+// A Sink is only used from a single goroutine.
+type Sink interface {
+	Publish(batch []*Publication) error
+}
+
+// redisSink publishes to one or more Redis servers, either with PUBLISH or
+// to streams, depending on PublishOpts.OutputMode
+type redisSink struct {
+	clients []redis.UniversalClient
+	opts    *PublishOpts
+}
+
+// NewRedisSink returns a Sink that publishes to the given Redis clients,
+// following opts.WriteMode and opts.OutputMode. This is the Sink that
+// PublishStream uses if PublishOpts.Sink isn't set.
+func NewRedisSink(clients []redis.UniversalClient, opts *PublishOpts) Sink {
+	return &redisSink{clients: clients, opts: opts}
+}
+
+func (sink *redisSink) Publish(batch []*Publication) error {
+	return publishToDestinations(batch, sink.clients, sink.opts.WriteMode, func(batch []*Publication, client redis.UniversalClient) error {
+		return publishMessages(batch, client, sink.opts)
+	})
+}
+
+// dryRunSink publishes nothing: it logs each publication it's given, and
+// counts it in metricDryRunMessages. See PublishOpts.DryRun.
+type dryRunSink struct{}
+
+func (dryRunSink) Publish(batch []*Publication) error {
+	for _, p := range batch {
+		log.Log.Debugw("Dry run: not publishing message",
+			"channel", p.CollectionChannel,
+			"specificChannel", p.SpecificChannel,
+			"message", string(p.Msg))
+	}
+
+	metricDryRunMessages.Add(float64(len(batch)))
+	return nil
+}
+
+// kafkaProducer is the part of *kafka.Producer that kafkaSink uses, so it can
+// be replaced in tests
+type kafkaProducer interface {
+	Produce(messages []kafka.Message) error
+}
+
+// kafkaSink produces each publication as a Kafka message, instead of
+// publishing it to Redis. See NewKafkaSink.
+type kafkaSink struct {
+	producer kafkaProducer
+	topics   *template.Template
+}
+
+// NewKafkaSink returns a Sink that produces one Kafka message per
+// publication (only to the collection, not to each document as well), to
+// the topic given by topicTemplate (see NewKafkaTopicTemplate). Messages are
+// keyed by the ID of the document they're about, so each document's
+// changes go to the same partition, in order. Messages that aren't about a
+// single document, such as refetch notifications, have no key.
+func NewKafkaSink(producer *kafka.Producer, topicTemplate *template.Template) Sink {
+	return &kafkaSink{producer: producer, topics: topicTemplate}
+}
+
+func (sink *kafkaSink) Publish(batch []*Publication) error {
+	messages := make([]kafka.Message, len(batch))
+	for i, p := range batch {
+		topic, err := renderKafkaTopic(sink.topics, p)
+		if err != nil {
+			return err
+		}
+
+		messages[i] = kafka.Message{Topic: topic, Value: p.Msg}
+		if p.DocID != "" {
+			messages[i].Key = []byte(p.DocID)
+		}
+	}
+
+	return sink.producer.Produce(messages)
+}
+
+// kafkaTopicData is the data available to a Kafka topic template
+type kafkaTopicData struct {
+	Database   string
+	Collection string
+	Operation  string
+}
+
+// NewKafkaTopicTemplate parses a text/template used to name the Kafka topics
+// we produce to (see config.KafkaTopicTemplate). The template may reference
+// {{.Database}}, {{.Collection}}, and {{.Operation}}. Like
+// oplog.NewChannelTemplate, it's validated by rendering it against sample
+// data.
+func NewKafkaTopicTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("topic").Parse(text)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing Kafka topic template")
+	}
+
+	err = tmpl.Execute(ioutil.Discard, kafkaTopicData{
+		Database:   "db",
+		Collection: "collection",
+		Operation:  "update",
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "validating Kafka topic template")
+	}
+
+	return tmpl, nil
+}
+
+// Renders the Kafka topic for a publication
+func renderKafkaTopic(tmpl *template.Template, p *Publication) (string, error) {
+	data := kafkaTopicData{Operation: p.Operation}
+	if parts := strings.SplitN(p.Namespace, ".", 2); len(parts) == 2 {
+		data.Database = parts[0]
+		data.Collection = parts[1]
+	} else {
+		data.Database = p.Namespace
+	}
+
+	var topic strings.Builder
+	if err := tmpl.Execute(&topic, data); err != nil {
+		return "", errors.Wrap(err, "rendering Kafka topic")
+	}
+
+	if topic.Len() == 0 {
+		return "", errors.Errorf("Kafka topic for namespace %q is empty", p.Namespace)
+	}
+
+	return topic.String(), nil
+}
@@ -0,0 +1,159 @@
+package redispub
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/vlasky/oplogtoredis/lib/kafka"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type fakeKafkaProducer struct {
+	messages []kafka.Message
+	err      error
+}
+
+func (producer *fakeKafkaProducer) Produce(messages []kafka.Message) error {
+	if producer.err != nil {
+		return producer.err
+	}
+
+	producer.messages = append(producer.messages, messages...)
+	return nil
+}
+
+func TestKafkaSink(t *testing.T) {
+	topics, err := NewKafkaTopicTemplate("changes.{{.Database}}.{{.Collection}}")
+	if err != nil {
+		t.Fatalf("Error parsing template: %s", err)
+	}
+
+	producer := &fakeKafkaProducer{}
+	sink := &kafkaSink{producer: producer, topics: topics}
+
+	err = sink.Publish([]*Publication{
+		{Namespace: "db.coll", DocID: "id1", Msg: []byte("1"), CollectionChannel: "db.coll", SpecificChannel: "db.coll::id1"},
+		{Namespace: "db.other.coll", DocID: "id2", Msg: []byte("2")},
+		{Namespace: "db.coll", Operation: RefetchEvent, Msg: []byte("3")},
+	})
+	if err != nil {
+		t.Fatalf("Error publishing: %s", err)
+	}
+
+	// One message per publication, whether or not it has a document channel
+	expected := []kafka.Message{
+		{Topic: "changes.db.coll", Key: []byte("id1"), Value: []byte("1")},
+		{Topic: "changes.db.other.coll", Key: []byte("id2"), Value: []byte("2")},
+		{Topic: "changes.db.coll", Value: []byte("3")},
+	}
+	if !reflect.DeepEqual(producer.messages, expected) {
+		t.Errorf("Incorrect messages. Got %q, expected %q", producer.messages, expected)
+	}
+}
+
+func TestKafkaSinkError(t *testing.T) {
+	topics, err := NewKafkaTopicTemplate("{{.Database}}.{{.Collection}}")
+	if err != nil {
+		t.Fatalf("Error parsing template: %s", err)
+	}
+
+	producerErr := errors.New("broker down")
+	sink := &kafkaSink{producer: &fakeKafkaProducer{err: producerErr}, topics: topics}
+
+	if err := sink.Publish([]*Publication{{Namespace: "db.coll", Msg: []byte("1")}}); err != producerErr {
+		t.Errorf("Expected the producer's error, got %v", err)
+	}
+}
+
+func TestKafkaTopicTemplate(t *testing.T) {
+	tests := map[string]struct {
+		template    string
+		expected    string
+		expectError bool
+	}{
+		"Default": {
+			template: "{{.Database}}.{{.Collection}}",
+			expected: "db.coll",
+		},
+		"Operation": {
+			template: "{{.Database}}-{{.Operation}}",
+			expected: "db-update",
+		},
+		"Empty": {
+			template:    "{{if false}}topic{{end}}",
+			expectError: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			tmpl, err := NewKafkaTopicTemplate(test.template)
+			if err != nil {
+				t.Fatalf("Error parsing template: %s", err)
+			}
+
+			topic, err := renderKafkaTopic(tmpl, &Publication{Namespace: "db.coll", Operation: "update"})
+			if test.expectError {
+				if err == nil {
+					t.Errorf("Expected an error, got topic %q", topic)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Errorf("Error rendering topic: %s", err)
+			} else if topic != test.expected {
+				t.Errorf("Incorrect topic. Got %q, expected %q", topic, test.expected)
+			}
+		})
+	}
+
+	if _, err := NewKafkaTopicTemplate("{{.DocID}}"); err == nil {
+		t.Error("Expected an error for a template referencing an unknown field")
+	}
+}
+
+func TestPublishStreamToKafka(t *testing.T) {
+	redisServer, redisClient := startMiniredis()
+	defer redisServer.Close()
+
+	topics, err := NewKafkaTopicTemplate("{{.Database}}.{{.Collection}}")
+	if err != nil {
+		t.Fatalf("Error parsing template: %s", err)
+	}
+
+	producer := &fakeKafkaProducer{}
+	in := make(chan *Publication, 10)
+	stop := make(chan bool)
+	done := make(chan struct{})
+
+	in <- &Publication{Namespace: "db.coll", DocID: "id1", Msg: []byte("1"), OplogTimestamp: primitive.Timestamp{I: 1}}
+	in <- &Publication{Namespace: "db.coll", DocID: "id2", Msg: []byte("2"), OplogTimestamp: primitive.Timestamp{I: 2}}
+
+	go func() {
+		PublishStream([]redis.UniversalClient{redisClient}, in, &PublishOpts{
+			MetadataPrefix: "someprefix.",
+			FlushInterval:  time.Hour,
+			BatchSize:      10,
+			Sink:           &kafkaSink{producer: producer, topics: topics},
+		}, stop)
+		close(done)
+	}()
+
+	stop <- true
+	<-done
+
+	expected := []kafka.Message{
+		{Topic: "db.coll", Key: []byte("id1"), Value: []byte("1")},
+		{Topic: "db.coll", Key: []byte("id2"), Value: []byte("2")},
+	}
+	if !reflect.DeepEqual(producer.messages, expected) {
+		t.Errorf("Incorrect messages. Got %q, expected %q", producer.messages, expected)
+	}
+
+	// The last-processed timestamp is still stored in Redis
+	redisServer.CheckGet(t, "someprefix.lastProcessedEntry", "2")
+}
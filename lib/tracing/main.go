@@ -0,0 +1,344 @@
+// Package tracing records spans covering the path of each change through
+// oplogtoredis, from reading it from Mongo to publishing it to Redis, and
+// exports them to an OpenTelemetry collector using OTLP over HTTP (with the
+// JSON encoding, so we don't need the OpenTelemetry SDK).
+//
+// Tracing is disabled until Enable is called. While it's disabled, Start
+// returns a nil *Span, and all of the methods on a nil *Span do nothing, so
+// instrumented code doesn't need to check whether tracing is enabled.
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/vlasky/oplogtoredis/lib/log"
+)
+
+// How many finished spans we buffer for export; if the collector can't keep
+// up, we drop spans rather than slowing down publishing
+const queueSize = 10000
+
+// The maximum number of spans we send in a single request
+const maxBatchSize = 512
+
+// How long we wait for more spans before sending a partial batch
+const batchTimeout = 5 * time.Second
+
+var exporterInstance *exporter
+
+var metricDroppedSpans = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: "otr",
+	Subsystem: "tracing",
+	Name:      "dropped_spans",
+	Help:      "Number of trace spans that were not exported, because the export queue was full or the collector returned an error.",
+})
+
+// Span is a single timed operation, such as the processing of one oplog entry
+type Span struct {
+	traceID    [16]byte
+	spanID     [8]byte
+	name       string
+	start      time.Time
+	end        time.Time
+	attributes map[string]interface{}
+	lock       sync.Mutex
+}
+
+// Enable starts exporting spans to the OpenTelemetry collector at endpoint
+// (e.g. "http://otel-collector:4318"), under the given service name. It
+// should be called once, before any spans are started.
+func Enable(endpoint string, serviceName string) {
+	exporterInstance = newExporter(strings.TrimSuffix(endpoint, "/")+"/v1/traces", serviceName, http.DefaultClient)
+	go exporterInstance.run()
+}
+
+// Shutdown exports any spans that are waiting to be exported, and stops the
+// exporter. It returns early if ctx is done first. Spans that end after
+// this (e.g. in goroutines still running when shutdown times out) are
+// dropped.
+func Shutdown(ctx context.Context) {
+	if exporterInstance == nil {
+		return
+	}
+
+	exporterInstance.close()
+
+	select {
+	case <-exporterInstance.done:
+	case <-ctx.Done():
+		log.Log.Warn("Timed out exporting the remaining trace spans")
+	}
+}
+
+// Start starts a new span, in a new trace, that started at the given time.
+// It returns nil if tracing isn't enabled.
+func Start(name string, start time.Time) *Span {
+	if exporterInstance == nil {
+		return nil
+	}
+
+	span := &Span{
+		name:       name,
+		start:      start,
+		attributes: map[string]interface{}{},
+	}
+
+	// crypto/rand.Read doesn't fail on any platform we run on
+	_, _ = rand.Read(span.traceID[:])
+	_, _ = rand.Read(span.spanID[:])
+
+	return span
+}
+
+// SetAttribute records an attribute of the span. The value should be a
+// string, bool, int, or float64.
+func (span *Span) SetAttribute(key string, value interface{}) {
+	if span == nil {
+		return
+	}
+
+	span.lock.Lock()
+	defer span.lock.Unlock()
+
+	span.attributes[key] = value
+}
+
+// End finishes the span and queues it for export
+func (span *Span) End() {
+	if span == nil {
+		return
+	}
+
+	span.lock.Lock()
+	span.end = time.Now()
+	span.lock.Unlock()
+
+	exporterInstance.export(span)
+}
+
+// exporter batches up finished spans and sends them to the collector
+type exporter struct {
+	url         string
+	serviceName string
+	client      *http.Client
+	spans       chan *Span
+	done        chan struct{}
+
+	// Guards against sending on spans once close has closed it
+	lock   sync.RWMutex
+	closed bool
+}
+
+func newExporter(url string, serviceName string, client *http.Client) *exporter {
+	return &exporter{
+		url:         url,
+		serviceName: serviceName,
+		client:      client,
+		spans:       make(chan *Span, queueSize),
+		done:        make(chan struct{}),
+	}
+}
+
+func (e *exporter) export(span *Span) {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+
+	if e.closed {
+		metricDroppedSpans.Inc()
+		return
+	}
+
+	select {
+	case e.spans <- span:
+	default:
+		metricDroppedSpans.Inc()
+	}
+}
+
+// Stops accepting spans, which makes run send the ones it has and return
+func (e *exporter) close() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if !e.closed {
+		e.closed = true
+		close(e.spans)
+	}
+}
+
+// Sends batches of spans until the spans channel is closed
+func (e *exporter) run() {
+	defer close(e.done)
+
+	var batch []*Span
+	timer := time.NewTimer(batchTimeout)
+	defer timer.Stop()
+
+	send := func() {
+		if len(batch) == 0 {
+			return
+		}
+
+		if err := e.send(batch); err != nil {
+			metricDroppedSpans.Add(float64(len(batch)))
+			log.Log.Errorw("Error exporting trace spans",
+				"error", err,
+				"count", len(batch))
+		}
+		batch = nil
+	}
+
+	for {
+		select {
+		case span, ok := <-e.spans:
+			if !ok {
+				send()
+				return
+			}
+
+			batch = append(batch, span)
+			if len(batch) >= maxBatchSize {
+				send()
+			}
+		case <-timer.C:
+			send()
+			timer.Reset(batchTimeout)
+		}
+	}
+}
+
+func (e *exporter) send(batch []*Span) error {
+	body, err := json.Marshal(e.encode(batch))
+	if err != nil {
+		return errors.Wrap(err, "encoding spans")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "creating request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "sending spans")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return errors.Errorf("collector returned status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// The OTLP/JSON request body. See
+// https://github.com/open-telemetry/opentelemetry-proto/blob/main/opentelemetry/proto/trace/v1/trace.proto
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes"`
+}
+
+type otlpAttribute struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+// The OTLP span kind for internal operations
+const spanKindInternal = 1
+
+func (e *exporter) encode(batch []*Span) otlpRequest {
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, span := range batch {
+		span.lock.Lock()
+		spans = append(spans, otlpSpan{
+			TraceID:           hex.EncodeToString(span.traceID[:]),
+			SpanID:            hex.EncodeToString(span.spanID[:]),
+			Name:              span.name,
+			Kind:              spanKindInternal,
+			StartTimeUnixNano: strconv.FormatInt(span.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.end.UnixNano(), 10),
+			Attributes:        encodeAttributes(span.attributes),
+		})
+		span.lock.Unlock()
+	}
+
+	return otlpRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{
+				Attributes: encodeAttributes(map[string]interface{}{"service.name": e.serviceName}),
+			},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: "github.com/vlasky/oplogtoredis"},
+				Spans: spans,
+			}},
+		}},
+	}
+}
+
+func encodeAttributes(attributes map[string]interface{}) []otlpAttribute {
+	encoded := make([]otlpAttribute, 0, len(attributes))
+	for key, value := range attributes {
+		var otlpValue map[string]interface{}
+		switch v := value.(type) {
+		case bool:
+			otlpValue = map[string]interface{}{"boolValue": v}
+		case int:
+			// OTLP/JSON encodes 64-bit integers as strings
+			otlpValue = map[string]interface{}{"intValue": strconv.Itoa(v)}
+		case float64:
+			otlpValue = map[string]interface{}{"doubleValue": v}
+		case string:
+			otlpValue = map[string]interface{}{"stringValue": v}
+		default:
+			otlpValue = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+		}
+
+		encoded = append(encoded, otlpAttribute{Key: key, Value: otlpValue})
+	}
+
+	return encoded
+}
@@ -0,0 +1,123 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestDisabled(t *testing.T) {
+	exporterInstance = nil
+
+	span := Start("test", time.Now())
+	if span != nil {
+		t.Fatalf("Expected a nil span when tracing is disabled, got %#v", span)
+	}
+
+	// These must not panic
+	span.SetAttribute("key", "value")
+	span.End()
+	Shutdown(context.Background())
+}
+
+func TestExport(t *testing.T) {
+	requests := make(chan otlpRequest, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" {
+			t.Errorf("Expected a request to /v1/traces, got %s", r.URL.Path)
+		}
+		if r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("Expected Content-Type application/json, got %s", r.Header.Get("Content-Type"))
+		}
+
+		var req otlpRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("Error decoding request: %s", err)
+		}
+		requests <- req
+	}))
+	defer server.Close()
+
+	Enable(server.URL+"/", "test-service")
+	defer func() { exporterInstance = nil }()
+
+	start := time.Unix(1500000000, 0)
+	span := Start("oplogtoredis.publish", start)
+	span.SetAttribute("db.name", "testdb")
+	span.SetAttribute("messaging.message.payload_size_bytes", 123)
+	span.End()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	Shutdown(ctx)
+
+	var req otlpRequest
+	select {
+	case req = <-requests:
+	default:
+		t.Fatal("Expected spans to be exported on shutdown")
+	}
+
+	if len(req.ResourceSpans) != 1 || len(req.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("Unexpected request structure: %#v", req)
+	}
+
+	resource := req.ResourceSpans[0].Resource.Attributes
+	if len(resource) != 1 || resource[0].Key != "service.name" || resource[0].Value["stringValue"] != "test-service" {
+		t.Errorf("Unexpected resource attributes: %#v", resource)
+	}
+
+	spans := req.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 1 {
+		t.Fatalf("Expected 1 span, got %d", len(spans))
+	}
+
+	got := spans[0]
+	if got.Name != "oplogtoredis.publish" {
+		t.Errorf("Incorrect name: %s", got.Name)
+	}
+	if len(got.TraceID) != 32 || len(got.SpanID) != 16 {
+		t.Errorf("Expected hex trace and span IDs, got %s and %s", got.TraceID, got.SpanID)
+	}
+	if got.StartTimeUnixNano != "1500000000000000000" {
+		t.Errorf("Incorrect start time: %s", got.StartTimeUnixNano)
+	}
+
+	attributes := map[string]map[string]interface{}{}
+	for _, attr := range got.Attributes {
+		attributes[attr.Key] = attr.Value
+	}
+	if attributes["db.name"]["stringValue"] != "testdb" {
+		t.Errorf("Incorrect db.name attribute: %#v", attributes["db.name"])
+	}
+	if attributes["messaging.message.payload_size_bytes"]["intValue"] != "123" {
+		t.Errorf("Incorrect payload size attribute: %#v", attributes["messaging.message.payload_size_bytes"])
+	}
+}
+
+func TestEndAfterShutdown(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	Enable(server.URL, "test-service")
+	defer func() { exporterInstance = nil }()
+
+	span := Start("oplogtoredis.publish", time.Now())
+	Shutdown(context.Background())
+
+	// A goroutine that's still running after shutdown can still end its
+	// spans; they're dropped rather than panicking
+	before := testutil.ToFloat64(metricDroppedSpans)
+	span.End()
+	if dropped := testutil.ToFloat64(metricDroppedSpans) - before; dropped != 1 {
+		t.Errorf("Expected the span to be dropped, got %v dropped", dropped)
+	}
+
+	// Shutting down again is harmless
+	Shutdown(context.Background())
+}
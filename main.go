@@ -3,29 +3,64 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
 	stdlog "log"
+	"math/rand"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
+	"text/template"
+	"time"
 
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.mongodb.org/mongo-driver/mongo/readpref"
 
 	"github.com/vlasky/oplogtoredis/lib/config"
+	"github.com/vlasky/oplogtoredis/lib/kafka"
 	"github.com/vlasky/oplogtoredis/lib/log"
 	"github.com/vlasky/oplogtoredis/lib/oplog"
 	"github.com/vlasky/oplogtoredis/lib/redispub"
+	"github.com/vlasky/oplogtoredis/lib/tracing"
 
 	"github.com/go-redis/redis/v8"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.uber.org/zap"
 )
 
+// The version of oplogtoredis, reported by /debug/info. It's set at build
+// time with -ldflags "-X main.version=<version>".
+var version = "dev"
+
 func main() {
+	// Before Go 1.20, math/rand isn't seeded, so without this every copy of
+	// oplogtoredis would pick the same "random" startup jitter and retry
+	// backoffs
+	rand.Seed(time.Now().UnixNano())
+
+	validateConfig := flag.Bool("validate-config", false, "Check the configuration and the connections to Mongo and Redis, print a report, and exit (with status 1 if there's a problem)")
+	flag.Parse()
+
+	if *validateConfig || validateOnlyFromEnv() {
+		os.Exit(runValidation(os.Stdout, validateTimeout))
+	}
+
+	startedAt := time.Now()
 	defer log.Sync()
 
 	err := config.ParseEnv()
@@ -33,7 +68,29 @@ func main() {
 		panic("Error parsing environment variables: " + err.Error())
 	}
 
-	mongoSession, err := createMongoClient()
+	parsed, err := parseSettings()
+	if err != nil {
+		panic("Error " + err.Error())
+	}
+
+	if config.OtelEndpoint() != "" {
+		tracing.Enable(config.OtelEndpoint(), "oplogtoredis")
+		defer func() {
+			tracingShutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			tracing.Shutdown(tracingShutdownCtx)
+		}()
+	}
+
+	// If we're going to wait for Mongo or Redis, serve the health checks
+	// while we do, so it's clear what we're waiting for
+	wait := &startupWait{}
+	var startupServer *http.Server
+	if config.MongoStartupRetry() != 0 || config.RedisStartupRetry() != 0 {
+		startupServer = serveWhileStarting(wait)
+	}
+
+	mongoSession, err := createMongoClient(wait)
 	if err != nil {
 		panic("Error initializing oplog tailer: " + err.Error())
 	}
@@ -48,19 +105,32 @@ func main() {
 	}()
 	log.Log.Info("Initialized connection to Mongo")
 
-	redisClient, err := createRedisClient()
+	redisClients, err := createRedisClients(wait)
 	if err != nil {
 		panic("Error initializing Redis client: " + err.Error())
 	}
 	defer func() {
-		redisCloseErr := redisClient.Close()
-		if redisCloseErr != nil {
-			log.Log.Errorw("Error closing Redis client",
-				"error", redisCloseErr)
+		for _, redisClient := range redisClients {
+			redisCloseErr := redisClient.Close()
+			if redisCloseErr != nil {
+				log.Log.Errorw("Error closing Redis client",
+					"error", redisCloseErr)
+			}
 		}
 	}()
 	log.Log.Info("Initialized connection to Redis")
 
+	if startupServer != nil {
+		// Free up the address for the real HTTP server
+		if err := startupServer.Shutdown(context.Background()); err != nil {
+			log.Log.Errorw("Error stopping the startup HTTP server", "error", err)
+		}
+	}
+	prometheus.MustRegister(redispub.NewPoolCollector(redisClients))
+	if !config.DisableDeprecatedMetrics() {
+		oplog.RegisterDeprecatedMetrics()
+	}
+
 	// We crate two goroutines:
 	//
 	// The oplog.Tail goroutine reads messages from the oplog, and generates the
@@ -70,41 +140,186 @@ func main() {
 	// The redispub.PublishStream goroutine reads messages from the buffered channel
 	// and sends them to Redis.
 	//
-	// TODO PERF: Use a leaky buffer (https://github.com/vlasky/oplogtoredis/issues/2)
-	redisPubs := make(chan *redispub.Publication, 10000)
-	waitGroup := sync.WaitGroup{}
+	// The channel's size is config.OutputBufferSize, and config.Backpressure
+	// decides what happens when it's full.
+	redisPubs := make(chan *redispub.Publication, config.OutputBufferSize())
+
+	tailerActivity := oplog.NewActivityTracker()
+	tailerPauser := oplog.NewPauser()
+	dropBarrier := redispub.NewDropBarrier()
+
+	var tailerSeeker *oplog.Seeker
+	if config.AdminSeekEnabled() {
+		tailerSeeker = oplog.NewSeeker()
+	}
+
+	oplog.SetMaxSizeReportInterval(config.MaxSizeReportInterval())
+
+	var distribution *oplog.Distribution
+	if config.DistributionWindow() > 0 {
+		distribution = oplog.NewDistribution(&oplog.DistributionOpts{Window: config.DistributionWindow()})
+	}
+
+	var collectionLabels *oplog.CollectionLabels
+	if config.MetricCollectionLabel() {
+		collectionLabels = oplog.NewCollectionLabels(config.MetricMaxCollections())
+	}
+
+	var leader *redispub.Leader
+	stopLeader := make(chan bool)
+	leaderDone := make(chan struct{})
+	if config.LeaderKey() != "" {
+		leader = redispub.NewLeader(redisClients[0], config.LeaderKey(), config.LeaderTTL(), config.StartupJitter())
+		go func() {
+			leader.Run(stopLeader)
+			close(leaderDone)
+		}()
+	}
+
+	// With leader election, only the leader tails, and its first attempt to
+	// become the leader is already delayed by the jitter
+	tailerStartupJitter := config.StartupJitter()
+	if leader != nil {
+		tailerStartupJitter = 0
+	}
 
 	stopOplogTail := make(chan bool)
-	waitGroup.Add(1)
-	go func() {
+	oplogTailDone := make(chan struct{})
+	tail := func(stop <-chan bool) {
 		tailer := oplog.Tailer{
 			MongoClient: mongoSession,
-			RedisClient: redisClient,
+			RedisClient: redisClients[0],
 			RedisPrefix: config.RedisMetadataPrefix(),
 			MaxCatchUp:  config.MaxCatchUp(),
+			Allowlist:   config.Allowlist(),
+			Denylist:    config.Denylist(),
+			Databases:   config.Databases(),
+
+			OperationFilter:         config.OperationFilter(),
+			FieldFilter:             config.FieldFilter(),
+			MaxCatchUpOverrides:     config.MaxCatchUpOverrides(),
+			FullDocumentCollections: config.FullDocumentCollections(),
+			ChannelTemplate:         parsed.channelTemplate,
+			ChannelPrefixes:         config.PrefixOverrides(),
+			NamespaceMap:            parsed.namespaceMap,
+			RetryInitialDelay:       config.RetryInitialDelay(),
+			RetryMaxDelay:           config.RetryMaxDelay(),
+			PositionLostWarnCount:   config.PositionLostWarnCount(),
+			PositionLostWarnWindow:  config.PositionLostWarnWindow(),
+
+			SourceMode:               config.SourceMode(),
+			ChangeStreamFullDocument: options.FullDocument(config.ChangeStreamFullDocument()),
+			ProcessorConcurrency:     config.ProcessorConcurrency(),
+			OplogDatabase:            config.OplogDatabase(),
+			OplogCollection:          config.OplogCollection(),
+			OplogNamespaceFilter:     parsed.oplogNamespaceFilter,
+			PayloadSerializer:        parsed.payloadSerializer,
+			MaxPayloadBytes:          config.MaxPayloadBytes(),
+			IncludeTimestamp:         config.IncludeTimestamp(),
+			IncludeOperation:         config.IncludeOperation(),
+			PayloadKeys:              config.PayloadKeys(),
+			IncludeSystemNamespaces:  config.IncludeSystemNamespaces(),
+			ReadPreference:           parsed.readPreference,
+			Activity:                 tailerActivity,
+			Backpressure:             config.Backpressure(),
+			DropBarrier:              dropBarrier,
+			ResumeLogInterval:        config.ResumeLogInterval(),
+			TransactionAtomic:        config.TransactionAtomic(),
+			CollectionLabels:         collectionLabels,
+			DeprecatedMetrics:        !config.DisableDeprecatedMetrics(),
+			Distribution:             distribution,
+			Pauser:                   tailerPauser,
+			Seeker:                   tailerSeeker,
+			StartPosition:            config.StartPosition(),
+			RunOnce:                  config.RunMode() == "once",
+			StartupJitter:            tailerStartupJitter,
+		}
+		tailer.Tail(redisPubs, stop)
+	}
+	go func() {
+		if leader != nil {
+			runWhileLeader(leader, stopOplogTail, tail)
+		} else {
+			tail(stopOplogTail)
 		}
-		tailer.Tail(redisPubs, stopOplogTail)
 
 		log.Log.Info("Oplog tailer completed")
-		waitGroup.Done()
+		close(oplogTailDone)
 	}()
 
+	var selfTest *redispub.SelfTest
+	selfTestID := "oplogtoredis-self-test-" + primitive.NewObjectID().Hex()
+	if config.SelfTestCollection() != "" {
+		selfTest = redispub.NewSelfTest(config.SelfTestCollection(), selfTestID)
+	}
+
+	// With OTR_OUTPUT_MODE=kafka, messages go to Kafka, and Redis is only
+	// used for the last-processed timestamp and our other metadata
+	var sink redispub.Sink
+	if config.OutputMode() == redispub.OutputModeKafka {
+		producer := kafka.NewProducer(config.KafkaBrokers(), config.KafkaTimeout())
+		defer producer.Close()
+
+		sink = redispub.NewKafkaSink(producer, parsed.kafkaTopicTemplate)
+	}
+
 	stopRedisPub := make(chan bool)
-	waitGroup.Add(1)
+	redisPubDone := make(chan struct{})
 	go func() {
-		redispub.PublishStream(redisClient, redisPubs, &redispub.PublishOpts{
+		redispub.PublishStream(redisClients, redisPubs, &redispub.PublishOpts{
 			FlushInterval:    config.TimestampFlushInterval(),
 			DedupeExpiration: config.RedisDedupeExpiration(),
 			MetadataPrefix:   config.RedisMetadataPrefix(),
+			WriteMode:        config.RedisWriteMode(),
+			OutputMode:       config.OutputMode(),
+			StreamMaxLen:     config.StreamMaxLen(),
+
+			StreamDocumentStreams: config.StreamDocumentStreams(),
+
+			SlowPublishThreshold: config.SlowPublishThreshold(),
+			BatchSize:            config.PublishBatchSize(),
+			BatchWindow:          config.PublishBatchWindow(),
+			DedupTTL:             config.DedupTTL(),
+
+			SkipDocumentChannels: !config.PublishDocumentChannels(),
+			DropBarrier:          dropBarrier,
+			DeadLetterKey:        config.DeadLetterKey(),
+			Sink:                 sink,
+			DryRun:               config.DryRun(),
+			SelfTest:             selfTest,
+
+			Compression:          config.PayloadCompression(),
+			CompressionThreshold: config.PayloadCompressionThreshold(),
+
+			MaxPublishRate:   config.MaxPublishRate(),
+			ResumeKeyPersist: config.ResumeKeyPersist(),
+
+			HeartbeatInterval: config.HeartbeatInterval(),
+			HeartbeatChannel:  config.HeartbeatChannel(),
+
+			CatchUpMaxRate:      config.CatchUpMaxRate(),
+			CatchUpLagThreshold: config.CatchUpLagThreshold(),
 		}, stopRedisPub)
 
 		log.Log.Info("Redis publisher completed")
-		waitGroup.Done()
+		close(redisPubDone)
 	}()
 	log.Log.Info("Started up processing goroutines")
 
+	if channel := config.StartupPingChannel(); channel != "" {
+		if err := redispub.PublishStartupPing(redisClients, channel, config.SelfTestTimeout()); err != nil {
+			log.Log.Errorw("Error publishing the startup ping",
+				"error", err,
+				"channel", channel)
+		}
+	}
+
+	if selfTest != nil {
+		go runSelfTest(mongoSession, leader, selfTest, config.SelfTestCollection(), selfTestID, config.SelfTestTimeout())
+	}
+
 	// Start one more goroutine for the HTTP server
-	httpServer := makeHTTPServer(redisClient, mongoSession)
+	httpServer := makeHTTPServer(redisClients, mongoSession, tailerActivity, tailerPauser, tailerSeeker, distribution, leader, startedAt)
 	go func() {
 		httpErr := httpServer.ListenAndServe()
 		if httpErr != nil {
@@ -118,38 +333,486 @@ func main() {
 	// if we're not ready to receive when the signal is sent.
 	// See examples from https://golang.org/pkg/os/signal/#Notify
 	signalChan := make(chan os.Signal, 1)
-	signal.Notify(signalChan, os.Interrupt)
+	signal.Notify(signalChan, os.Interrupt, syscall.SIGTERM)
 
-	sig := <-signalChan
+	// With OTR_RUN_MODE=once, the tailer also stops by itself, once it has
+	// read up to the end of the oplog as of startup
+	var tailerFinished <-chan struct{}
+	if config.RunMode() == "once" {
+		tailerFinished = oplogTailDone
+	}
 
-	// We got a SIGINT, cleanly stop background goroutines and then return so
-	// that the `defer`s above can close the Mongo and Redis connection.
-	//
-	// We also call signal.Reset() to clear our signal handler so if we get
-	// another SIGINT we immediately exit without cleaning up.
-	log.Log.Warnf("Exiting cleanly due to signal %s. Interrupt again to force unclean shutdown.", sig)
-	signal.Reset()
+	var shutdownDeadline <-chan struct{}
+
+	select {
+	case sig := <-signalChan:
+		// We got a SIGINT or SIGTERM, cleanly stop background goroutines
+		// and then return so that the `defer`s above can close the Mongo and
+		// Redis connection.
+		//
+		// We also call signal.Reset() to clear our signal handler so if we
+		// get another signal we immediately exit without cleaning up.
+		log.Log.Warnf("Exiting cleanly due to signal %s. Interrupt again to force unclean shutdown.", sig)
+		signal.Reset()
+
+		// Unlike time.After, the deadline stays passed once it has, for
+		// each of the waits below
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout())
+		defer cancel()
+		shutdownDeadline = shutdownCtx.Done()
 
-	stopOplogTail <- true
-	stopRedisPub <- true
+		// Stop the tailer first, so nothing more is added to the buffered
+		// channel, and then let the publisher drain the channel and write
+		// the final last-processed timestamp. A paused tailer can't stop
+		// until it's resumed.
+		tailerPauser.Resume()
+		stopOplogTail <- true
+
+	case <-tailerFinished:
+		// Everything we read is in the buffered channel. The publisher may
+		// have a lot of it left to send, so we wait for it however long it
+		// takes, rather than for OTR_SHUTDOWN_TIMEOUT.
+		log.Log.Info("Finished reading the oplog (OTR_RUN_MODE=once); exiting once everything has been published. Interrupt to force unclean shutdown.")
+		signal.Reset()
+	}
+
+	published := stopPublisher(oplogTailDone, stopRedisPub, redisPubDone, shutdownDeadline, config.ShutdownFlushTimeout())
+
+	// Only hand over to another instance once we've written the final
+	// last-processed timestamp, so it resumes from the right place
+	if published && leader != nil {
+		stopLeader <- true
+		waitForShutdown(leaderDone, shutdownDeadline, "leader election")
+	}
 
 	err = httpServer.Shutdown(context.Background())
 	if err != nil {
 		log.Log.Errorw("Error shutting down HTTP server",
 			"error", err)
 	}
+}
+
+// Calls run whenever we're the leader, and stops it when we stop being the
+// leader, until stopped. run must return once it receives a message on its
+// stop channel.
+func runWhileLeader(leader *redispub.Leader, stop <-chan bool, run func(stop <-chan bool)) {
+	for {
+		changed := leader.Changed()
+		if !leader.Leading() {
+			select {
+			case <-stop:
+				return
+			case <-changed:
+				continue
+			}
+		}
+
+		runStop := make(chan bool)
+		runDone := make(chan struct{})
+		go func() {
+			run(runStop)
+			close(runDone)
+		}()
+
+		select {
+		case <-stop:
+			runStop <- true
+			<-runDone
+			return
+		case <-changed:
+			log.Log.Warn("Lost leadership; stopping oplog tailing")
+			runStop <- true
+			<-runDone
+		}
+	}
+}
+
+// Writes a document with the given ID to the given collection
+// ("database.collection"), and waits for selfTest to see it published, to
+// check the whole path from Mongo to Redis. The document is removed
+// afterwards.
+func runSelfTest(client *mongo.Client, leader *redispub.Leader, selfTest *redispub.SelfTest, namespace string, docID string, timeout time.Duration) {
+	// Only the leader publishes, so there's nothing to test until we are it
+	if leader != nil {
+		for {
+			changed := leader.Changed()
+			if leader.Leading() {
+				break
+			}
+			<-changed
+		}
+	}
+
+	parts := strings.SplitN(namespace, ".", 2)
+	collection := client.Database(parts[0]).Collection(parts[1])
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	_, err := collection.InsertOne(ctx, bson.M{"_id": docID, "selfTest": true, "at": time.Now()})
+	if err != nil {
+		log.Log.Errorw("Self-test failed: error writing the test document",
+			"error", err,
+			"collection", namespace)
+		return
+	}
+
+	if selfTest.Wait(timeout) {
+		log.Log.Infow("Self-test passed: the test document was published",
+			"collection", namespace)
+	} else {
+		log.Log.Errorw("Self-test failed: the test document wasn't published in time. Check that the collection is published (OTR_ALLOWLIST and OTR_DENYLIST) and the logs for errors.",
+			"collection", namespace,
+			"timeout", timeout.String())
+	}
+
+	deleteCtx, deleteCancel := context.WithTimeout(context.Background(), timeout)
+	defer deleteCancel()
+
+	_, err = collection.DeleteOne(deleteCtx, bson.M{"_id": docID})
+	if err != nil {
+		log.Log.Errorw("Error removing the self-test document",
+			"error", err,
+			"collection", namespace,
+			"id", docID)
+	}
+}
+
+// Waits for done to be closed, or for the deadline to pass (a nil deadline
+// never passes). Returns whether done was closed in time.
+func waitForShutdown(done <-chan struct{}, deadline <-chan struct{}, name string) bool {
+	select {
+	case <-done:
+		return true
+	case <-deadline:
+		log.Log.Errorw("Timed out waiting for shutdown; buffered publications may be lost. Consider increasing OTR_SHUTDOWN_TIMEOUT.",
+			"waitingFor", name)
+		return false
+	}
+}
+
+// Stops the Redis publisher after the tailer, so the final last-processed
+// timestamp covers everything that was published: once the tailer has
+// stopped adding to the buffer, the publisher drains it until the deadline.
+// Whether or not the tailer and the draining finish by the deadline, the
+// publisher is then stopped, and gets up to flushTimeout to write the final
+// timestamp for what it did publish. Returns whether it did so and returned.
+func stopPublisher(tailerDone <-chan struct{}, stop chan<- bool, done <-chan struct{}, deadline <-chan struct{}, flushTimeout time.Duration) bool {
+	if waitForShutdown(tailerDone, deadline, "oplog tailer") {
+		// The publisher only reads stop between batches, so sending can block
+		select {
+		case stop <- true:
+			if waitForShutdown(done, deadline, "Redis publisher") {
+				return true
+			}
+		case <-done:
+			return true
+		case <-deadline:
+		}
+	}
+
+	return stopDraining(stop, done, flushTimeout)
+}
+
+// Tells the Redis publisher to stop without draining the rest of its
+// buffer, and waits up to timeout for it to write the final last-processed
+// timestamp and return. Returns whether it returned in time.
+func stopDraining(stop chan<- bool, done <-chan struct{}, timeout time.Duration) bool {
+	deadline := time.After(timeout)
+
+	// The publisher starts draining at the first message on stop, and stops
+	// draining at the next, and only reads stop between batches, so we keep
+	// sending until it returns
+	for {
+		select {
+		case stop <- true:
+		case <-done:
+			return true
+		case <-deadline:
+			log.Log.Error("Timed out waiting for the Redis publisher to write the final last-processed timestamp. Consider increasing OTR_SHUTDOWN_FLUSH_TIMEOUT.")
+			return false
+		}
+	}
+}
+
+// settings are the parts of the config that need parsing beyond what the
+// config package does
+type settings struct {
+	channelTemplate      *template.Template
+	kafkaTopicTemplate   *template.Template
+	namespaceMap         *oplog.NamespaceMap
+	oplogNamespaceFilter *regexp.Regexp
+	payloadSerializer    oplog.PayloadSerializer
+	readPreference       *readpref.ReadPref
+}
+
+// Parses the settings from the (already parsed) config
+func parseSettings() (*settings, error) {
+	var parsed settings
+	var err error
+
+	if config.ChannelTemplate() != "" {
+		parsed.channelTemplate, err = oplog.NewChannelTemplate(config.ChannelTemplate())
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing OTR_CHANNEL_TEMPLATE")
+		}
+	}
+
+	if config.OutputMode() == redispub.OutputModeKafka {
+		parsed.kafkaTopicTemplate, err = redispub.NewKafkaTopicTemplate(config.KafkaTopicTemplate())
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing OTR_KAFKA_TOPIC_TEMPLATE")
+		}
+	}
+
+	parsed.namespaceMap, err = oplog.NewNamespaceMap(config.NamespaceMap())
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing OTR_NAMESPACE_MAP")
+	}
+
+	if config.OplogNsFilter() != "" {
+		parsed.oplogNamespaceFilter, err = regexp.Compile(config.OplogNsFilter())
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing OTR_OPLOG_NS_FILTER")
+		}
+	}
+
+	parsed.payloadSerializer, err = oplog.NewPayloadSerializer(config.PayloadFormat())
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing OTR_PAYLOAD_FORMAT")
+	}
+
+	if config.MongoReadPreference() != "" {
+		readPreferenceMode, err := readpref.ModeFromString(config.MongoReadPreference())
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing OTR_MONGO_READ_PREFERENCE")
+		}
+
+		parsed.readPreference, err = readpref.New(readPreferenceMode)
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing OTR_MONGO_READ_PREFERENCE")
+		}
+	}
+
+	return &parsed, nil
+}
+
+// How long --validate-config waits for each of Mongo and Redis to respond
+const validateTimeout = 5 * time.Second
+
+// Returns whether OTR_VALIDATE_ONLY is set, which has the same effect as
+// --validate-config. We read it directly, rather than through the config
+// package, so that it works even if the rest of the config doesn't parse.
+func validateOnlyFromEnv() bool {
+	validateOnly, _ := strconv.ParseBool(os.Getenv("OTR_VALIDATE_ONLY"))
+	return validateOnly
+}
+
+// validationCheck is the result of one of the checks run by
+// --validate-config
+type validationCheck struct {
+	Name string `json:"name"`
+	dependencyStatus
+}
+
+// Checks the config, and that we can connect to Mongo and Redis (giving each
+// at most timeout to respond), and writes a JSON report of the results to
+// out. Returns the exit status: 0 if every check passed, and 1 otherwise.
+func runValidation(out io.Writer, timeout time.Duration) int {
+	checks := validateSettings(context.Background(), timeout)
+
+	ok := true
+	for _, check := range checks {
+		ok = ok && check.OK
+	}
+
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(map[string]interface{}{
+		"ok":     ok,
+		"checks": checks,
+	}); err != nil {
+		return 1
+	}
+
+	if !ok {
+		return 1
+	}
+	return 0
+}
+
+// Runs the checks for runValidation. If the config doesn't parse, that's the
+// only check; otherwise, we go on to check the settings derived from it and
+// the connections to Mongo and to each Redis URL.
+func validateSettings(ctx context.Context, timeout time.Duration) []validationCheck {
+	var checks []validationCheck
+	check := func(name string, err error) {
+		checks = append(checks, validationCheck{Name: name, dependencyStatus: newDependencyStatus(err)})
+	}
+
+	if err := config.ParseEnv(); err != nil {
+		check("config", err)
+		return checks
+	}
+	check("config", nil)
+
+	_, err := parseSettings()
+	check("settings", err)
+
+	check("mongo", validateMongo(ctx, timeout))
+
+	for i, redisURL := range config.RedisURL() {
+		check(fmt.Sprintf("redis[%d]", i), validateRedis(ctx, redisURL, timeout))
+	}
+
+	return checks
+}
+
+// Connects to Mongo and pings it
+func validateMongo(ctx context.Context, timeout time.Duration) error {
+	clientOptions, err := oplog.MongoClientOptions()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	client, err := mongo.Connect(ctx, clientOptions)
+	if err != nil {
+		return errors.Wrap(err, "connecting to Mongo")
+	}
+	defer client.Disconnect(ctx)
+
+	return errors.Wrap(client.Ping(ctx, nil), "pinging Mongo")
+}
+
+// Connects to the Redis server at the given URL and pings it
+func validateRedis(ctx context.Context, redisURL string, timeout time.Duration) error {
+	clientOptions, err := redisClientOptions(redisURL)
+	if err != nil {
+		return err
+	}
+
+	client := redis.NewUniversalClient(clientOptions)
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	return errors.Wrap(client.Ping(ctx).Err(), "pinging Redis")
+}
+
+// startupWait tracks which dependency, if any, we're waiting to connect to
+// while we start up (see config.RedisStartupRetry)
+type startupWait struct {
+	lock       sync.Mutex
+	waitingFor string
+}
+
+func (wait *startupWait) set(dependency string) {
+	wait.lock.Lock()
+	defer wait.lock.Unlock()
+
+	wait.waitingFor = dependency
+}
+
+func (wait *startupWait) get() string {
+	wait.lock.Lock()
+	defer wait.lock.Unlock()
+
+	return wait.waitingFor
+}
+
+// Calls connect until it succeeds, retrying with exponential backoff (from
+// config.RetryInitialDelay up to config.RetryMaxDelay) for up to retryFor, or
+// forever if retryFor is negative. While we retry, wait reports that we're
+// waiting for the named dependency. Returns the last error if we give up.
+func retryUntilConnected(name string, retryFor time.Duration, wait *startupWait, connect func() error) error {
+	deadline := time.Now().Add(retryFor)
+	delay := config.RetryInitialDelay()
+	defer wait.set("")
+
+	for attempt := 1; ; attempt++ {
+		err := connect()
+		if err == nil {
+			return nil
+		}
+
+		if retryFor == 0 || (retryFor > 0 && time.Now().Add(delay).After(deadline)) {
+			return err
+		}
+
+		wait.set(name)
+		log.Log.Warnw("Couldn't connect to "+name+" at startup; retrying",
+			"error", err,
+			"attempt", attempt,
+			"delay", delay)
+
+		time.Sleep(delay)
+		delay *= 2
+		if delay > config.RetryMaxDelay() {
+			delay = config.RetryMaxDelay()
+		}
+	}
+}
+
+// Serves the health checks while we wait for Mongo or Redis at startup,
+// until we're ready to start the real HTTP server (see makeHTTPServer)
+func serveWhileStarting(wait *startupWait) *http.Server {
+	server := &http.Server{Addr: config.HTTPServerAddr(), Handler: startupHandler(wait)}
+
+	// We listen before returning, so that once Shutdown returns, the address
+	// is free for the real HTTP server
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		log.Log.Errorw("Error starting the startup HTTP server", "error", err)
+		return nil
+	}
 
-	waitGroup.Wait()
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Log.Errorw("Error from the startup HTTP server", "error", err)
+		}
+	}()
+
+	return server
 }
 
-// Connects to mongo
-func createMongoClient() (*mongo.Client, error) {
-	clientOptions := options.Client()
-	clientOptions.ApplyURI(config.MongoURL())
+// startupHandler serves /healthz and /healthz/ready with a 503, reporting
+// which dependency we're waiting for, while we start up. /healthz/live
+// reports that we're live, since waiting isn't a reason to restart us.
+func startupHandler(wait *startupWait) http.Handler {
+	respond := func(status int) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+
+			jsonErr := json.NewEncoder(w).Encode(map[string]interface{}{
+				"starting":   true,
+				"waitingFor": wait.get(),
+			})
+			if jsonErr != nil {
+				log.Log.Errorw("Error writing startup health response",
+					"error", jsonErr)
+			}
+		}
+	}
 
-	err := clientOptions.Validate()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", respond(http.StatusServiceUnavailable))
+	mux.HandleFunc("/healthz/ready", respond(http.StatusServiceUnavailable))
+	mux.HandleFunc("/healthz/live", respond(http.StatusOK))
+	mux.Handle("/metrics", promhttp.Handler())
+
+	return mux
+}
+
+// Connects to mongo. If config.MongoStartupRetry is set, we also wait until
+// Mongo responds to a ping.
+func createMongoClient(wait *startupWait) (*mongo.Client, error) {
+	clientOptions, err := oplog.MongoClientOptions()
 	if err != nil {
-		return nil, errors.Wrap(err, "parsing Mongo URL")
+		return nil, err
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), config.MongoConnectTimeout())
@@ -160,6 +823,18 @@ func createMongoClient() (*mongo.Client, error) {
 		return nil, errors.Wrap(err, "connecting to Mongo")
 	}
 
+	if config.MongoStartupRetry() != 0 {
+		err = retryUntilConnected("Mongo", config.MongoStartupRetry(), wait, func() error {
+			pingCtx, pingCancel := context.WithTimeout(context.Background(), config.MongoConnectTimeout())
+			defer pingCancel()
+
+			return client.Ping(pingCtx, nil)
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "pinging Mongo")
+		}
+	}
+
 	return client, nil
 }
 
@@ -171,10 +846,10 @@ func (l redisLogger) Printf(ctx context.Context, format string, v ...interface{}
 	l.log.Printf(format, v...)
 }
 
-// Goroutine that just reads messages and sends them to Redis. We don't do this
-// inline above so that messages can queue up in the channel if we lose our
-// redis connection
-func createRedisClient() (redis.UniversalClient, error) {
+// Creates a client for each of the configured Redis URLs. We publish to
+// every one of these clients. If we can't connect to one of them, we retry
+// for up to config.RedisStartupRetry.
+func createRedisClients(wait *startupWait) ([]redis.UniversalClient, error) {
 	// Configure go-redis to use our logger
 	stdLog, err := zap.NewStdLogAt(log.RawLog, zap.InfoLevel)
 	if err != nil {
@@ -183,8 +858,37 @@ func createRedisClient() (redis.UniversalClient, error) {
 
 	redis.SetLogger(redisLogger{log: stdLog})
 
+	var clients []redis.UniversalClient
+	for _, redisURL := range config.RedisURL() {
+		clientOptions, err := redisClientOptions(redisURL)
+		if err != nil {
+			return nil, err
+		}
+
+		// Create a Redis client
+		client := redis.NewUniversalClient(clientOptions)
+
+		// Check that we have a connection
+		err = retryUntilConnected("Redis", config.RedisStartupRetry(), wait, func() error {
+			return client.Ping(context.Background()).Err()
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "pinging redis")
+		}
+
+		clients = append(clients, client)
+	}
+
+	return clients, nil
+}
+
+// Builds the options for the Redis client for the given URL, with the
+// credentials from OTR_REDIS_USERNAME and OTR_REDIS_PASSWORD if they're set.
+// If Sentinel is configured, the returned options produce a failover client
+// that tracks the current master.
+func redisClientOptions(redisURL string) (*redis.UniversalOptions, error) {
 	// Parse the Redis URL
-	parsedRedisURL, err := redis.ParseURL(config.RedisURL())
+	parsedRedisURL, err := redis.ParseURL(redisURL)
 	if err != nil {
 		return nil, errors.Wrap(err, "parsing redis url")
 	}
@@ -192,50 +896,88 @@ func createRedisClient() (redis.UniversalClient, error) {
 	clientOptions := redis.UniversalOptions{
 		Addrs:     []string{parsedRedisURL.Addr},
 		DB:        parsedRedisURL.DB,
+		Username:  parsedRedisURL.Username,
 		Password:  parsedRedisURL.Password,
 		TLSConfig: parsedRedisURL.TLSConfig,
 	}
 
-	if clientOptions.TLSConfig != nil {
-		clientOptions.TLSConfig = &tls.Config{
-			InsecureSkipVerify: false,
-			MinVersion:         tls.VersionTLS12,
-		}
+	// Credentials from the config take precedence over the ones in the URL
+	if username := config.RedisUsername(); username != "" {
+		clientOptions.Username = username
+	}
+	if password := config.RedisPassword(); password != "" {
+		clientOptions.Password = password
 	}
 
-	// Create a Redis client
-	client := redis.NewUniversalClient(&clientOptions)
+	if clientOptions.TLSConfig != nil || config.RedisTLS() {
+		clientOptions.TLSConfig, err = redisTLSConfig()
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	// Check that we have a connection
-	_, err = client.Ping(context.Background()).Result()
-	if err != nil {
-		return nil, errors.Wrap(err, "pinging redis")
+	if len(config.RedisSentinelAddrs()) > 0 {
+		clientOptions.Addrs = config.RedisSentinelAddrs()
+		clientOptions.MasterName = config.RedisSentinelMaster()
 	}
 
-	return client, nil
+	// 0 leaves it to the driver's default
+	clientOptions.PoolSize = config.RedisPoolSize()
+
+	return &clientOptions, nil
 }
 
-func makeHTTPServer(redis redis.UniversalClient, mongo *mongo.Client) *http.Server {
-	mux := http.NewServeMux()
+// Builds the TLS configuration for connecting to Redis, loading the CA and
+// client certificates named in the config
+func redisTLSConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: config.RedisTLSInsecureSkipVerify(), // #nosec
+		MinVersion:         tls.VersionTLS12,
+	}
 
-	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
-		redisErr := redis.Ping(r.Context()).Err()
-		redisOK := redisErr == nil
-		if !redisOK {
-			log.Log.Errorw("Error connecting to Redis during healthz check",
-				"error", redisErr)
+	if caFile := config.RedisTLSCAFile(); caFile != "" {
+		caPEM, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "reading OTR_REDIS_TLS_CA_FILE")
 		}
 
-		ctx, cancel := context.WithTimeout(context.Background(), config.MongoConnectTimeout())
-		defer cancel()
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caPEM) {
+			return nil, errors.Errorf("no certificates found in OTR_REDIS_TLS_CA_FILE (%s)", caFile)
+		}
+	}
 
-		mongoErr := mongo.Ping(ctx, readpref.Primary())
-		mongoOK := mongoErr == nil
+	if config.RedisTLSCertFile() != "" {
+		cert, err := tls.LoadX509KeyPair(config.RedisTLSCertFile(), config.RedisTLSKeyFile())
+		if err != nil {
+			return nil, errors.Wrap(err, "loading OTR_REDIS_TLS_CERT_FILE and OTR_REDIS_TLS_KEY_FILE")
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
 
-		if !mongoOK {
-			log.Log.Errorw("Error connecting to Mongo during healthz check",
-				"error", mongoErr)
+	return tlsConfig, nil
+}
+
+func makeHTTPServer(redisClients []redis.UniversalClient, mongo *mongo.Client, tailerActivity *oplog.ActivityTracker, tailerPauser *oplog.Pauser, tailerSeeker *oplog.Seeker, distribution *oplog.Distribution, leader *redispub.Leader, startedAt time.Time) *http.Server {
+	mux := http.NewServeMux()
+
+	pingRedis := func(ctx context.Context) error {
+		for _, redisClient := range redisClients {
+			if err := redisClient.Ping(ctx).Err(); err != nil {
+				return err
+			}
 		}
+		return nil
+	}
+	pingMongo := func(ctx context.Context) error {
+		return mongo.Ping(ctx, readpref.Primary())
+	}
+
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		mongoErr, redisErr := pingDependencies(r.Context(), pingMongo, pingRedis, config.MongoQueryTimeout())
+		mongoOK := mongoErr == nil
+		redisOK := redisErr == nil
 
 		if mongoOK && redisOK {
 			w.WriteHeader(http.StatusOK)
@@ -254,7 +996,301 @@ func makeHTTPServer(redis redis.UniversalClient, mongo *mongo.Client) *http.Serv
 		}
 	})
 
+	mux.HandleFunc("/healthz/ready", readinessHandler(pingMongo, pingRedis, config.MongoQueryTimeout()))
+	mux.HandleFunc("/healthz/live", livenessHandler(tailerActivity, tailerPauser, leader, config.MaxIdle()))
+
+	// POST to pause or resume publishing
+	mux.HandleFunc("/admin/pause", pauseHandler(tailerPauser, true))
+	mux.HandleFunc("/admin/resume", pauseHandler(tailerPauser, false))
+
+	// POST {"timestamp": ...} to re-tail the oplog from that timestamp
+	if tailerSeeker != nil {
+		mux.HandleFunc("/admin/seek", seekHandler(tailerSeeker))
+	}
+
 	mux.Handle("/metrics", promhttp.Handler())
 
+	// GET (optionally with ?top=N) for the collections with the most recent
+	// oplog volume
+	if distribution != nil {
+		mux.HandleFunc("/metrics/oplog-distribution", distributionHandler(distribution))
+	}
+
+	// GET to see the log level, or PUT {"level": "debug"} to change it
+	mux.Handle("/log/level", log.Level)
+
+	// GET for the version, effective config, and oplog position
+	mux.HandleFunc("/debug/info", debugInfoHandler(tailerActivity, startedAt))
+
 	return &http.Server{Addr: config.HTTPServerAddr(), Handler: mux}
 }
+
+// livenessHandler reports whether the oplog tailer has made progress within
+// maxIdle. Unlike /healthz, it doesn't check connectivity to Mongo or Redis;
+// it's meant to catch a tailer that's stuck even though everything it talks
+// to is reachable. A paused tailer (see pauseHandler), or one that's
+// standing by because another instance is the leader, is always live.
+func livenessHandler(tailerActivity *oplog.ActivityTracker, tailerPauser *oplog.Pauser, leader *redispub.Leader, maxIdle time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// The tailer only started when we became the leader
+		lastActivity := tailerActivity.LastActivity()
+		if electedAt := leader.ElectedAt(); electedAt.After(lastActivity) {
+			lastActivity = electedAt
+		}
+
+		idle := time.Since(lastActivity)
+		paused := tailerPauser.Paused()
+		leading := leader.Leading()
+		live := paused || !leading || idle <= maxIdle
+
+		if live {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			log.Log.Errorw("Oplog tailer has not made progress, reporting unhealthy",
+				"idleSeconds", idle.Seconds(),
+				"maxIdleSeconds", maxIdle.Seconds())
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+
+		jsonErr := json.NewEncoder(w).Encode(map[string]interface{}{
+			"live":        live,
+			"idleSeconds": idle.Seconds(),
+			"paused":      paused,
+			"leader":      leading,
+		})
+		if jsonErr != nil {
+			log.Log.Errorw("Error writing liveness response",
+				"error", jsonErr)
+			http.Error(w, jsonErr.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// debugInfoHandler reports the version of oplogtoredis, how long it's been
+// running, its effective configuration (with secrets redacted; see
+// config.Redacted), and how far it's read through the oplog of each shard
+// (see oplog.ActivityTracker.Positions)
+func debugInfoHandler(tailerActivity *oplog.ActivityTracker, startedAt time.Time) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		now := time.Now()
+		positions := []map[string]interface{}{}
+		for _, position := range tailerActivity.Positions(now) {
+			positions = append(positions, map[string]interface{}{
+				"shard":      position.Shard,
+				"timestamp":  map[string]uint32{"t": position.Timestamp.T, "i": position.Timestamp.I},
+				"time":       time.Unix(int64(position.Timestamp.T), 0).UTC().Format(time.RFC3339),
+				"lagSeconds": position.LagSeconds,
+			})
+		}
+
+		jsonErr := json.NewEncoder(w).Encode(map[string]interface{}{
+			"version":       version,
+			"goVersion":     runtime.Version(),
+			"startedAt":     startedAt.UTC().Format(time.RFC3339),
+			"uptimeSeconds": now.Sub(startedAt).Seconds(),
+			"config":        config.Redacted(),
+			"positions":     positions,
+		})
+		if jsonErr != nil {
+			log.Log.Errorw("Error writing debug info response",
+				"error", jsonErr)
+			http.Error(w, jsonErr.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// pauseHandler pauses (if pause is true) or resumes the oplog tailer on
+// POST, and reports whether it's paused
+func pauseHandler(tailerPauser *oplog.Pauser, pause bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if pause {
+			log.Log.Warn("Pausing publishing due to a request to /admin/pause")
+			tailerPauser.Pause()
+		} else {
+			log.Log.Warn("Resuming publishing due to a request to /admin/resume")
+			tailerPauser.Resume()
+		}
+
+		jsonErr := json.NewEncoder(w).Encode(map[string]interface{}{
+			"paused": tailerPauser.Paused(),
+		})
+		if jsonErr != nil {
+			log.Log.Errorw("Error writing pause response",
+				"error", jsonErr)
+			http.Error(w, jsonErr.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// seekHandler makes the oplog tailer re-tail the oplog from a timestamp on
+// POST. The body is a JSON object whose timestamp is either a Unix timestamp
+// in seconds, or a BSON timestamp in the form {"t": <seconds>, "i": <increment>}.
+func seekHandler(tailerSeeker *oplog.Seeker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		ts, err := parseSeekRequest(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		log.Log.Warnw("Re-tailing the oplog due to a request to /admin/seek. Everything since the timestamp will be re-published.",
+			"timestamp", ts,
+			"time", time.Unix(int64(ts.T), 0).UTC().Format(time.RFC3339),
+			"remoteAddr", r.RemoteAddr)
+		tailerSeeker.Seek(ts)
+
+		jsonErr := json.NewEncoder(w).Encode(map[string]interface{}{
+			"t": ts.T,
+			"i": ts.I,
+		})
+		if jsonErr != nil {
+			log.Log.Errorw("Error writing seek response",
+				"error", jsonErr)
+			http.Error(w, jsonErr.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// Parses the body of a request to /admin/seek (see seekHandler)
+func parseSeekRequest(body io.Reader) (primitive.Timestamp, error) {
+	var request struct {
+		Timestamp json.RawMessage `json:"timestamp"`
+	}
+	if err := json.NewDecoder(body).Decode(&request); err != nil {
+		return primitive.Timestamp{}, errors.Wrap(err, "parsing request")
+	}
+
+	var seconds uint32
+	if err := json.Unmarshal(request.Timestamp, &seconds); err == nil {
+		return primitive.Timestamp{T: seconds}, nil
+	}
+
+	var bsonTimestamp struct {
+		T *uint32 `json:"t"`
+		I uint32  `json:"i"`
+	}
+	if err := json.Unmarshal(request.Timestamp, &bsonTimestamp); err != nil || bsonTimestamp.T == nil {
+		return primitive.Timestamp{}, errors.New(`timestamp must be a Unix timestamp or {"t": <seconds>, "i": <increment>}`)
+	}
+
+	return primitive.Timestamp{T: *bsonTimestamp.T, I: bsonTimestamp.I}, nil
+}
+
+// distributionHandler reports the collections with the most oplog entries,
+// and with the largest total size of oplog entries, over the distribution's
+// window. The top query parameter sets how many collections are listed in
+// each (default 10).
+func distributionHandler(distribution *oplog.Distribution) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		top := 10
+		if param := r.URL.Query().Get("top"); param != "" {
+			var err error
+			top, err = strconv.Atoi(param)
+			if err != nil || top <= 0 {
+				http.Error(w, "top must be a positive integer", http.StatusBadRequest)
+				return
+			}
+		}
+
+		byEntries, byBytes := distribution.Top(top)
+
+		jsonErr := json.NewEncoder(w).Encode(map[string]interface{}{
+			"windowSeconds": distribution.Window().Seconds(),
+			"byEntries":     byEntries,
+			"byBytes":       byBytes,
+		})
+		if jsonErr != nil {
+			log.Log.Errorw("Error writing oplog distribution response",
+				"error", jsonErr)
+			http.Error(w, jsonErr.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// pingDependencies pings Mongo and Redis concurrently, giving each at most
+// timeout to respond, so a hung dependency can't hang a health check.
+func pingDependencies(ctx context.Context, pingMongo, pingRedis func(context.Context) error, timeout time.Duration) (mongoErr error, redisErr error) {
+	ping := func(name string, pingFn func(context.Context) error) <-chan error {
+		result := make(chan error, 1)
+		go func() {
+			pingCtx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+
+			err := pingFn(pingCtx)
+			if err != nil {
+				log.Log.Errorw("Error connecting to "+name+" during health check",
+					"error", err)
+			}
+			result <- err
+		}()
+		return result
+	}
+
+	mongoResult := ping("Mongo", pingMongo)
+	redisResult := ping("Redis", pingRedis)
+
+	return <-mongoResult, <-redisResult
+}
+
+// dependencyStatus is the readiness of a single dependency, as reported by
+// /healthz/ready
+type dependencyStatus struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+func newDependencyStatus(err error) dependencyStatus {
+	if err != nil {
+		return dependencyStatus{OK: false, Error: err.Error()}
+	}
+	return dependencyStatus{OK: true}
+}
+
+// readinessHandler reports the status of Mongo and Redis independently, so
+// when the check fails it's clear which dependency is at fault. It returns
+// 200 only if both are reachable.
+func readinessHandler(pingMongo, pingRedis func(context.Context) error, timeout time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		mongoErr, redisErr := pingDependencies(r.Context(), pingMongo, pingRedis, timeout)
+
+		if mongoErr == nil && redisErr == nil {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+
+		jsonErr := json.NewEncoder(w).Encode(map[string]dependencyStatus{
+			"mongo": newDependencyStatus(mongoErr),
+			"redis": newDependencyStatus(redisErr),
+		})
+		if jsonErr != nil {
+			log.Log.Errorw("Error writing readiness response",
+				"error", jsonErr)
+			http.Error(w, jsonErr.Error(), http.StatusInternalServerError)
+		}
+	}
+}